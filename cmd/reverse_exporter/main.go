@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
 	"syscall"
 
 	"github.com/samber/lo"
@@ -14,6 +16,7 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/moby/moby/pkg/reexec"
 	"github.com/wrouesnel/multihttp"
 
 	"github.com/alecthomas/kong"
@@ -23,6 +26,12 @@ import (
 	"go.uber.org/zap"
 )
 
+// debugPathSuffix is appended to reverse exporter paths to serve their debug status.
+const debugPathSuffix = "-/debug"
+
+// pushPathSuffix is appended to push exporter paths to match the Pushgateway API.
+const pushPathSuffix = "/metrics/*grouping"
+
 //nolint:gochecknoglobals
 var CLI struct {
 	Version   kong.VersionFlag `help:"Show version number"`
@@ -33,6 +42,10 @@ var CLI struct {
 }
 
 func main() {
+	// Exec sandbox helpers re-execute this binary, and never return from here.
+	if reexec.Init() {
+		return
+	}
 	os.Exit(cmdMain(os.Args[1:]))
 }
 
@@ -98,8 +111,15 @@ func realMain(ctx context.Context, l *zap.Logger, cfg *config.Config) int {
 	router = api.NewAPIv1(apiConfig, router)
 
 	l.Debug("Begin initializing reverse proxy backends")
-	initializedPaths := make(map[string]http.Handler)
-	for _, reverseExporterConfig := range cfg.ReverseExporters {
+	// Paths are initialized after the paths they include, so their backends can be shared.
+	reverseExporterConfigs, err := config.IncludeOrder(cfg.ReverseExporters)
+	if err != nil {
+		l.Error("Invalid include exporters", zap.Error(err))
+		return 1
+	}
+	initializedPaths := make(map[string]*metricproxy.ReverseProxyEndpoint)
+	initializedPushPaths := make(map[string]struct{})
+	for _, reverseExporterConfig := range reverseExporterConfigs {
 		reLog := l.With(zap.String("path", reverseExporterConfig.Path))
 		if reverseExporterConfig.Path == "" {
 			reLog.Error("Blank exporter paths are not allowed.")
@@ -111,7 +131,7 @@ func realMain(ctx context.Context, l *zap.Logger, cfg *config.Config) int {
 			return 1
 		}
 
-		proxyHandler, perr := metricproxy.NewMetricReverseProxy(reverseExporterConfig)
+		proxyHandler, perr := metricproxy.NewMetricReverseProxy(reverseExporterConfig, initializedPaths)
 		if perr != nil {
 			reLog.Error("Error initializing reverse proxy for path")
 			return 1
@@ -119,9 +139,34 @@ func realMain(ctx context.Context, l *zap.Logger, cfg *config.Config) int {
 
 		router.Handler("GET", apiConfig.WrapPath(reverseExporterConfig.Path), proxyHandler)
 
+		if cfg.Web.DebugEndpoints {
+			debugPath := apiConfig.WrapPath(path.Join(reverseExporterConfig.Path, debugPathSuffix))
+			reLog.Info("Enabling debug endpoint", zap.String("debug_path", debugPath))
+			router.Handler("GET", debugPath, proxyHandler.DebugHandler())
+		}
+
+		for pushPath, pushHandler := range proxyHandler.PushHandlers() {
+			if _, found := initializedPushPaths[pushPath]; found {
+				reLog.Error("Push exporter paths must be unique.", zap.String("push_path", pushPath))
+				return 1
+			}
+			initializedPushPaths[pushPath] = struct{}{}
+
+			// A push path of / must not leave a double slash in the route.
+			wrappedPushPath := strings.TrimSuffix(apiConfig.WrapPath(pushPath), "/")
+			reLog.Info("Accepting pushed metrics", zap.String("push_path", wrappedPushPath))
+			for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+				router.Handler(method, wrappedPushPath+pushPathSuffix, http.StripPrefix(wrappedPushPath, pushHandler))
+			}
+		}
+
 		initializedPaths[reverseExporterConfig.Path] = proxyHandler
 	}
 	l.Debug("Finished initializing reverse proxy backends")
+	// Backends run in the background, such as scheduled scripts, only once every path is valid.
+	for _, endpoint := range initializedPaths {
+		endpoint.Start()
+	}
 	l.Info("Initializsed backends")
 
 	l.Info("Starting HTTP server")
@@ -154,6 +199,12 @@ func realMain(ctx context.Context, l *zap.Logger, cfg *config.Config) int {
 		}
 	}
 
+	// Backends are stopped, and save their state such as pushed metrics, once the listeners
+	// are closed.
+	for _, endpoint := range initializedPaths {
+		endpoint.Stop()
+	}
+
 	l.Info("Exiting")
 	return 0
 }
@@ -4,17 +4,23 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"github.com/samber/lo"
+	"go.uber.org/zap/zapcore"
 )
 
 var (
 	ErrInvalidExportersConfig = errors.New("exporters key is not in the known format")
 	ErrUnknownExporterType    = errors.New("unknown exporter type specified")
+	ErrIncludedPathUnknown    = errors.New("included path is not a configured reverse exporter path")
+	ErrIncludeCycle           = errors.New("reverse exporter paths include each other")
 )
 
 // Config is the main application configuration structure.
 type Config struct {
-	Web              *WebConfig               `mapstructure:"web,omitempty"`
-	ExporterDefaults *ExporterDefaults        `mapstructure:"exporter_defaults,omitempty"`
+	Web              *WebConfig        `mapstructure:"web,omitempty"`
+	ExporterDefaults *ExporterDefaults `mapstructure:"exporter_defaults,omitempty"`
+	// ExporterLabel is the name of the label metrics are given the name of their exporter in,
+	// unless a path sets its own. Defaults to exporter_name.
+	ExporterLabel    string                   `mapstructure:"exporter_label,omitempty"`
 	ReverseExporters []*ReverseExporterConfig `mapstructure:"reverse_exporters,omitempty"`
 }
 
@@ -42,6 +48,8 @@ type WebConfig struct {
 	ContextPath       string         `mapstructure:"context_path,omitempty"`
 	ReadHeaderTimeout model.Duration `mapstructure:"read_header_timeout,omitempty"`
 	Listen            []URL          `mapstructure:"listen,omitempty"`
+	// DebugEndpoints enables a JSON debug status endpoint under each reverse exporter path.
+	DebugEndpoints bool `mapstructure:"debug_endpoints,omitempty"`
 }
 
 // ReverseExporterConfig is a configuration struct describing a logically-decoded proxied exporter.
@@ -53,6 +61,72 @@ type ReverseExporterConfig struct {
 	// Exporters is a list of URLs defining exporter endpoints to be aggregated
 	// and the unique name to be given to differentiate their metrics.
 	Exporters *ExportersConfig `mapstructure:"exporters"`
+	// Routing optionally selects the exporters scraped by the value of a url param.
+	Routing *RoutingConfig `mapstructure:"routing,omitempty"`
+	// MatchFilter filters the metrics served by the Prometheus series selectors of the
+	// match[] url params, as the Prometheus /federate endpoint does.
+	MatchFilter bool `mapstructure:"match_filter,omitempty"`
+	// OpenMetrics serves the OpenMetrics format to scrapers which accept it. Unlike the text
+	// format it carries exemplars, but counters without a _total suffix are typed unknown.
+	OpenMetrics bool `mapstructure:"open_metrics,omitempty"`
+	// Aggregations compute new metrics from the merged metrics of the exporters.
+	Aggregations []*AggregationConfig `mapstructure:"aggregations,omitempty"`
+	// Labels are static labels added to the metrics of every exporter of the path. Labels
+	// of an exporter take precedence over them.
+	Labels map[string]string `mapstructure:"labels,omitempty"`
+	// ExporterLabel overrides the global exporter label for this path.
+	ExporterLabel string `mapstructure:"exporter_label,omitempty"`
+}
+
+// AggregationConfig computes a new metric from the series of another metric, like a
+// PromQL aggregation operator.
+type AggregationConfig struct {
+	// Name is the name of the new metric.
+	Name string `mapstructure:"name"`
+	Help string `mapstructure:"help,omitempty"`
+	// Op is one of sum, min, max, count or avg.
+	Op AggregationOp `mapstructure:"op"`
+	// Metric is the name of the metric whose series are aggregated.
+	Metric string `mapstructure:"metric"`
+	// By are the labels series are grouped by. All labels are aggregated away if neither
+	// By nor Without is set.
+	By []string `mapstructure:"by,omitempty"`
+	// Without are the labels aggregated away. Series are grouped by their other labels.
+	Without []string `mapstructure:"without,omitempty"`
+	// DropSource drops the series of Metric from the output.
+	DropSource bool `mapstructure:"drop_source,omitempty"`
+}
+
+// RoutingConfig selects the backends a path scrapes by the value of a url param, like the
+// target param of a blackbox_exporter /probe endpoint. Values no route allows are rejected.
+type RoutingConfig struct {
+	// Param is the url param whose value selects the route.
+	Param string `mapstructure:"param"`
+	// Label is the label the selected value is added to the metrics as. It defaults to Param.
+	Label string `mapstructure:"label,omitempty"`
+	// Routes are checked in order, and the first which allows the value is scraped.
+	Routes []*RouteConfig `mapstructure:"routes"`
+}
+
+// RouteConfig is a set of values of the routing param, and the backend scraped for them.
+type RouteConfig struct {
+	// Values are the values this route allows.
+	Values []string `mapstructure:"values,omitempty"`
+	// Regex allows the values it fully matches.
+	Regex Regexp `mapstructure:"regex,omitempty"`
+	// Exporters are the names of the exporters of the path scraped for this route.
+	Exporters []string `mapstructure:"exporters,omitempty"`
+	// Name is the exporter name of the AddressTemplate backend.
+	Name string `mapstructure:"name,omitempty"`
+	// AddressTemplate is a text/template of the address scraped for this route. It is
+	// executed with the selected .Value, which should be escaped with urlquery or
+	// pathEscape. Values which change the scheme or host of the address are not scraped.
+	AddressTemplate string `mapstructure:"address_template,omitempty"`
+	// Timeout is the maximum length of time scraping the AddressTemplate backend can take.
+	Timeout model.Duration `mapstructure:"timeout,omitempty"`
+	// MaxBytes is the maximum size of the response read from the AddressTemplate backend,
+	// before and after decompression. 0 is unlimited.
+	MaxBytes uint64 `mapstructure:"max_bytes,omitempty"`
 }
 
 type ExporterDefaults struct {
@@ -60,6 +134,15 @@ type ExporterDefaults struct {
 	FileDefaults       *FileExporterConfig        `mapstructure:"file"`
 	ExecDefaults       *ExecExporterConfig        `mapstructure:"exec"`
 	ExecCachedDefaults *ExecCachingExporterConfig `mapstructure:"exec_cached"`
+	ExecDaemonDefaults *ExecDaemonExporterConfig  `mapstructure:"exec_daemon"`
+	StaticDefaults     *StaticExporterConfig      `mapstructure:"static"`
+	PushDefaults       *PushExporterConfig        `mapstructure:"push"`
+	JSONDefaults       *JSONExporterConfig        `mapstructure:"json"`
+	ProbeDefaults      *ProbeExporterConfig       `mapstructure:"probe"`
+	ProcessDefaults    *ProcessExporterConfig     `mapstructure:"process"`
+	LogtailDefaults    *LogtailExporterConfig     `mapstructure:"logtail"`
+	IncludeDefaults    *IncludeExporterConfig     `mapstructure:"include"`
+	HTTPSDDefaults     *HTTPSDExporterConfig      `mapstructure:"http_sd"`
 }
 
 // ExportersConfig is the internal mapping the exporter config representation.
@@ -68,6 +151,15 @@ type ExportersConfig struct {
 	FileExporters       []*FileExporterConfig        `mapstructure:"file"`
 	ExecExporters       []*ExecExporterConfig        `mapstructure:"exec"`
 	ExecCachedExporters []*ExecCachingExporterConfig `mapstructure:"exec_cached"`
+	ExecDaemonExporters []*ExecDaemonExporterConfig  `mapstructure:"exec_daemon"`
+	StaticExporters     []*StaticExporterConfig      `mapstructure:"static"`
+	PushExporters       []*PushExporterConfig        `mapstructure:"push"`
+	JSONExporters       []*JSONExporterConfig        `mapstructure:"json"`
+	ProbeExporters      []*ProbeExporterConfig       `mapstructure:"probe"`
+	ProcessExporters    []*ProcessExporterConfig     `mapstructure:"process"`
+	LogtailExporters    []*LogtailExporterConfig     `mapstructure:"logtail"`
+	IncludeExporters    []*IncludeExporterConfig     `mapstructure:"include"`
+	HTTPSDExporters     []*HTTPSDExporterConfig      `mapstructure:"http_sd"`
 }
 
 func (ex *ExportersConfig) All() []BaseExporter {
@@ -76,6 +168,15 @@ func (ex *ExportersConfig) All() []BaseExporter {
 	exporters = append(exporters, lo.Map(ex.FileExporters, func(v *FileExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
 	exporters = append(exporters, lo.Map(ex.ExecExporters, func(v *ExecExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
 	exporters = append(exporters, lo.Map(ex.ExecCachedExporters, func(v *ExecCachingExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.ExecDaemonExporters, func(v *ExecDaemonExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.StaticExporters, func(v *StaticExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.PushExporters, func(v *PushExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.JSONExporters, func(v *JSONExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.ProbeExporters, func(v *ProbeExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.ProcessExporters, func(v *ProcessExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.LogtailExporters, func(v *LogtailExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.IncludeExporters, func(v *IncludeExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
+	exporters = append(exporters, lo.Map(ex.HTTPSDExporters, func(v *HTTPSDExporterConfig, _ int) BaseExporter { return BaseExporter(v) })...)
 	return exporters
 }
 
@@ -92,6 +193,20 @@ type Exporter struct {
 	NoRewrite bool `mapstructure:"no_rewrite"`
 	// Labels are additional key-value labels which should be statically added to all metrics
 	Labels map[string]string `mapstructure:"labels"`
+	// SampleLimit fails the scrape of the exporter if it returns more samples. 0 is unlimited.
+	SampleLimit uint64 `mapstructure:"sample_limit,omitempty"`
+	// LabelLimit fails the scrape of the exporter if a series has more labels. 0 is unlimited.
+	LabelLimit uint64 `mapstructure:"label_limit,omitempty"`
+	// LabelNameLengthLimit fails the scrape of the exporter if a label name is longer. 0 is unlimited.
+	LabelNameLengthLimit uint64 `mapstructure:"label_name_length_limit,omitempty"`
+	// LabelValueLengthLimit fails the scrape of the exporter if a label value is longer. 0 is unlimited.
+	LabelValueLengthLimit uint64 `mapstructure:"label_value_length_limit,omitempty"`
+	// ConvertHistograms converts the classic histograms of the exporter to series or summaries.
+	ConvertHistograms HistogramConversion `mapstructure:"convert_histograms,omitempty"`
+	// HistogramQuantiles are the quantiles of histograms converted to summaries.
+	HistogramQuantiles []float64 `mapstructure:"histogram_quantiles,omitempty"`
+	// Timestamps is how the sample timestamps of the exporter are handled (default keep).
+	Timestamps TimestampMode `mapstructure:"timestamps,omitempty"`
 }
 
 // GetBaseExporter returns the common exporter parameters of an exporter.
@@ -102,7 +217,19 @@ func (e Exporter) GetBaseExporter() Exporter {
 // FileExporterConfig contains configuration specific to reverse proxying files.
 type FileExporterConfig struct {
 	Exporter `mapstructure:",squash"`
-	Path     string `mapstructure:"path"`
+	// Path is a single file, a directory of *.prom files or a glob of files. Metrics from
+	// a directory or glob are merged.
+	Path string `mapstructure:"path"`
+	// FileLabel adds a "file" label with the path of the source file, relative to the directory
+	// or glob, to each metric.
+	FileLabel bool `mapstructure:"file_label,omitempty"`
+	// MaxAge is the maximum age of the mtime of a file before it is stale.
+	MaxAge model.Duration `mapstructure:"max_age,omitempty"`
+	// StaleAction is the action taken when a file is older than MaxAge.
+	StaleAction StaleAction `mapstructure:"stale_action,omitempty"`
+	// MaxBytes is the maximum size of the output read from the file, before and after
+	// decompression. 0 is unlimited.
+	MaxBytes uint64 `mapstructure:"max_bytes,omitempty"`
 }
 
 // ExecExporterConfig contains configuration specific to reverse proxying executable scripts.
@@ -110,6 +237,42 @@ type ExecExporterConfig struct {
 	Exporter `mapstructure:",squash"`
 	Command  string   `mapstructure:"command"`
 	Args     []string `mapstructure:"args"`
+	// ForwardURLParams determines whether the whitelisted url params of the parent
+	// request are passed to the script. They are set as prefixed environment variables,
+	// and Args are treated as text/template's which can reference them. Only the first
+	// value of a repeated param is forwarded. Values are passed as they are, so a value
+	// which looks like a flag reaches the script as one, and must be validated by it.
+	ForwardURLParams bool `mapstructure:"forward_url_params"`
+	// AllowedURLParams is the whitelist of url param names which will be forwarded. No two
+	// names may map to the same environment variable.
+	AllowedURLParams []string `mapstructure:"allowed_url_params"`
+	// URLParamsEnvPrefix is the prefix given to the environment variables of forwarded
+	// url params.
+	URLParamsEnvPrefix string `mapstructure:"url_params_env_prefix,omitempty"`
+	// StderrLogLevel is the level the stderr output of the script is logged at.
+	StderrLogLevel zapcore.Level `mapstructure:"stderr_log_level,omitempty"`
+	// MaxBytes is the maximum size of the output read from the script. 0 is unlimited.
+	MaxBytes uint64 `mapstructure:"max_bytes,omitempty"`
+
+	ExecSandboxConfig `mapstructure:",squash"`
+}
+
+// ExecSandboxConfig configures the privileges and resource limits a script is executed
+// with. Limits are applied before the script is executed.
+type ExecSandboxConfig struct {
+	// User is the user name or uid to execute the script as.
+	User string `mapstructure:"user,omitempty"`
+	// Group is the group name or gid to execute the script as. It defaults to the primary
+	// group of User.
+	Group string `mapstructure:"group,omitempty"`
+	// CPUTimeLimit is the maximum CPU time the script may use (RLIMIT_CPU).
+	CPUTimeLimit model.Duration `mapstructure:"cpu_time_limit,omitempty"`
+	// AddressSpaceLimit is the maximum size in bytes of the script's address space (RLIMIT_AS).
+	AddressSpaceLimit uint64 `mapstructure:"address_space_limit,omitempty"`
+	// OpenFilesLimit is the maximum number of files the script may open (RLIMIT_NOFILE).
+	OpenFilesLimit uint64 `mapstructure:"open_files_limit,omitempty"`
+	// Nice is the nice level of the script. Negative levels require privileges.
+	Nice *int `mapstructure:"nice,omitempty"`
 }
 
 // ExecCachingExporterConfig contains configuration specific to reverse proxying cached executable scripts.
@@ -118,10 +281,101 @@ type ExecCachingExporterConfig struct {
 	Command      string         `mapstructure:"command"`
 	Args         []string       `mapstructure:"args"`
 	ExecInterval model.Duration `mapstructure:"exec_interval"`
+	// ExecSchedule is a cron expression to execute the script on. It is an alternative
+	// to ExecInterval.
+	ExecSchedule CronSchedule `mapstructure:"exec_schedule,omitempty"`
+	// ExecJitter is the maximum random delay added to each scheduled execution.
+	ExecJitter model.Duration `mapstructure:"exec_jitter,omitempty"`
+	// RunOnStart executes the script immediately on startup rather than waiting for
+	// the first scheduled execution. Defaults to true.
+	RunOnStart *bool `mapstructure:"run_on_start,omitempty"`
+	// ExecTimeout is the maximum time an execution may take before it is killed. It
+	// defaults to the period of the schedule.
+	ExecTimeout model.Duration `mapstructure:"exec_timeout,omitempty"`
+	// MaxAge is the maximum age of the last successful result before it is stale.
+	MaxAge model.Duration `mapstructure:"max_age,omitempty"`
+	// StaleAction is the action taken when the result is older than MaxAge.
+	StaleAction StaleAction `mapstructure:"stale_action,omitempty"`
+	// CacheAge optionally exposes the age of the result as a gauge or a label.
+	CacheAge CacheAgeMode `mapstructure:"cache_age,omitempty"`
+	// StderrLogLevel is the level the stderr output of the script is logged at.
+	StderrLogLevel zapcore.Level `mapstructure:"stderr_log_level,omitempty"`
+	// MaxBytes is the maximum size of the output read from the script. 0 is unlimited.
+	MaxBytes uint64 `mapstructure:"max_bytes,omitempty"`
+
+	ExecSandboxConfig `mapstructure:",squash"`
 
 	//ExecExporterConfig `mapstructure:",inline"`
 }
 
+// ExecDaemonExporterConfig contains configuration specific to reverse proxying a long-running
+// script which periodically writes complete blocks of metrics to stdout.
+type ExecDaemonExporterConfig struct {
+	Exporter `mapstructure:",squash"`
+	Command  string   `mapstructure:"command"`
+	Args     []string `mapstructure:"args"`
+	// RestartBackoff is the initial delay before the script is restarted after it exits.
+	// It doubles with each consecutive restart which produced no metrics.
+	RestartBackoff model.Duration `mapstructure:"restart_backoff,omitempty"`
+	// MaxRestartBackoff is the maximum delay before the script is restarted.
+	MaxRestartBackoff model.Duration `mapstructure:"max_restart_backoff,omitempty"`
+	// MaxAge is the maximum age of the last complete block of metrics before it is stale.
+	MaxAge model.Duration `mapstructure:"max_age,omitempty"`
+	// StaleAction is the action taken when the last block is older than MaxAge.
+	StaleAction StaleAction `mapstructure:"stale_action,omitempty"`
+	// StderrLogLevel is the level the stderr output of the script is logged at.
+	StderrLogLevel zapcore.Level `mapstructure:"stderr_log_level,omitempty"`
+	// MaxBytes is the maximum size of a block of metrics written by the script. It defaults
+	// to 16MiB.
+	MaxBytes uint64 `mapstructure:"max_bytes,omitempty"`
+
+	ExecSandboxConfig `mapstructure:",squash"`
+}
+
+// StaticExporterConfig contains configuration for metrics which are declared directly in
+// the configuration file.
+type StaticExporterConfig struct {
+	Exporter `mapstructure:",squash"`
+	Metrics  []*StaticMetricConfig `mapstructure:"metrics"`
+}
+
+// StaticMetricConfig declares a single static metric. Exactly one of Value, ValueFromEnv or
+// ValueFromFile must be set. Values from the environment or files are read on every scrape.
+type StaticMetricConfig struct {
+	Name string     `mapstructure:"name"`
+	Type MetricType `mapstructure:"type,omitempty"`
+	Help string     `mapstructure:"help,omitempty"`
+	// Labels are the static labels of the metric.
+	Labels map[string]string `mapstructure:"labels,omitempty"`
+	// LabelsFromEnv maps label names to the environment variable holding their value.
+	LabelsFromEnv map[string]string `mapstructure:"labels_from_env,omitempty"`
+	// LabelsFromFile maps label names to the file holding their value.
+	LabelsFromFile map[string]string `mapstructure:"labels_from_file,omitempty"`
+	// Value is the constant value of the metric.
+	Value *float64 `mapstructure:"value,omitempty"`
+	// ValueFromEnv is the environment variable holding the value of the metric.
+	ValueFromEnv string `mapstructure:"value_from_env,omitempty"`
+	// ValueFromFile is the file holding the value of the metric.
+	ValueFromFile string `mapstructure:"value_from_file,omitempty"`
+}
+
+// PushExporterConfig contains configuration specific to accepting metrics pushed by
+// short-lived jobs with the Pushgateway API.
+type PushExporterConfig struct {
+	Exporter `mapstructure:",squash"`
+	// Path is the URL path pushes are accepted under. Metrics are pushed to
+	// <path>/metrics/job/<job>{/<label>/<value>} like with the Pushgateway.
+	Path string `mapstructure:"path"`
+	// PersistenceFile is the file pushed metrics are saved to and restored from on startup.
+	// Pushed metrics are only held in memory if it is not set.
+	PersistenceFile string `mapstructure:"persistence_file,omitempty"`
+	// PersistenceInterval is the interval changes are saved to the persistence file at.
+	// It defaults to 5m. Changes are also saved on shutdown.
+	PersistenceInterval model.Duration `mapstructure:"persistence_interval,omitempty"`
+	// MaxBytes is the maximum size of a push request body. It defaults to 16MiB.
+	MaxBytes uint64 `mapstructure:"max_bytes,omitempty"`
+}
+
 // HTTPExporterConfig contains configuration specific to reverse proxying normal http-based Prometheus exporters.
 type HTTPExporterConfig struct {
 	Exporter `mapstructure:",squash"`
@@ -135,4 +389,173 @@ type HTTPExporterConfig struct {
 	// ForwardURLParams determines whether the exporter will have ALL url params
 	// of the parent request added to it.
 	ForwardURLParams bool `mapstructure:"forward_url_params"`
+	// MaxBytes is the maximum size of the response body read from the exporter, before and
+	// after decompression. 0 is unlimited.
+	MaxBytes uint64 `mapstructure:"max_bytes,omitempty"`
+}
+
+// JSONExporterConfig contains configuration specific to converting the JSON returned by an
+// HTTP endpoint to metrics. The endpoint is retrieved like a normal http exporter.
+type JSONExporterConfig struct {
+	HTTPExporterConfig `mapstructure:",squash"`
+	// Metrics are the rules mapping values of the JSON document to metrics.
+	Metrics []*JSONMetricConfig `mapstructure:"metrics"`
+}
+
+// JSONMetricConfig maps values selected from a JSON document by JSONPath expressions to metrics.
+type JSONMetricConfig struct {
+	Name string     `mapstructure:"name"`
+	Type MetricType `mapstructure:"type,omitempty"`
+	Help string     `mapstructure:"help,omitempty"`
+	// Path selects the values of the metric. If it selects an array (or several values),
+	// each element is a separate metric.
+	Path string `mapstructure:"path"`
+	// ValuePath selects the value from each element selected by Path. Elements are used as
+	// the value directly if it is not set.
+	ValuePath string `mapstructure:"value_path,omitempty"`
+	// KeyLabel turns each entry of an object selected by Path into a metric, with the key of
+	// the entry as the value of this label.
+	KeyLabel string `mapstructure:"key_label,omitempty"`
+	// Labels are the static labels of the metric.
+	Labels map[string]string `mapstructure:"labels,omitempty"`
+	// LabelPaths maps label names to JSONPath expressions selecting their value from each
+	// element selected by Path.
+	LabelPaths map[string]string `mapstructure:"label_paths,omitempty"`
+}
+
+// ProbeExporterConfig contains configuration specific to probing the health of services.
+type ProbeExporterConfig struct {
+	Exporter `mapstructure:",squash"`
+	// Timeout is the maximum time a probe may take. Probes are also bounded by the scrape.
+	Timeout model.Duration `mapstructure:"timeout,omitempty"`
+	// Targets are probed concurrently on each scrape.
+	Targets []*ProbeTargetConfig `mapstructure:"targets"`
+}
+
+// ProbeTargetConfig configures a single probe.
+type ProbeTargetConfig struct {
+	// Name is the value of the target label of the probe metrics. It defaults to Address.
+	Name string    `mapstructure:"name,omitempty"`
+	Type ProbeType `mapstructure:"type"`
+	// Address is host:port for tcp probes, and the URL for http probes.
+	Address string `mapstructure:"address"`
+	// TLS makes tcp probes perform a TLS handshake after connecting. http probes use TLS
+	// for https URLs.
+	TLS bool `mapstructure:"tls,omitempty"`
+	// InsecureSkipVerify disables verification of the certificate of the target.
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify,omitempty"`
+	// ValidStatusCodes are the HTTP status codes of a successful http probe. It defaults
+	// to 200-299.
+	ValidStatusCodes HTTPStatusRange `mapstructure:"valid_status_codes,omitempty"`
+	// BodyRegex must match the body of the response for an http probe to succeed.
+	BodyRegex Regexp `mapstructure:"body_regex,omitempty"`
+}
+
+// ProcessExporterConfig contains configuration specific to reporting the resource usage of
+// groups of processes read from procfs.
+type ProcessExporterConfig struct {
+	Exporter `mapstructure:",squash"`
+	// ProcPath is the mount point of procfs. It defaults to /proc.
+	ProcPath string `mapstructure:"proc_path,omitempty"`
+	// Groups are the named groups processes are reported in. A process is reported in the
+	// first group which matches it.
+	Groups []*ProcessGroupConfig `mapstructure:"groups"`
+}
+
+// ProcessGroupConfig matches the processes of a group. A process matches if any of the
+// matchers match it.
+type ProcessGroupConfig struct {
+	// Name is the value of the groupname label of the group's metrics.
+	Name string `mapstructure:"name"`
+	// Comm matches processes by their name, as in /proc/<pid>/comm.
+	Comm []string `mapstructure:"comm,omitempty"`
+	// Cmdline matches processes whose command line, with arguments joined by spaces, matches.
+	Cmdline Regexp `mapstructure:"cmdline,omitempty"`
+	// Pidfile matches the process whose pid is in the file.
+	Pidfile string `mapstructure:"pidfile,omitempty"`
+}
+
+// LogtailExporterConfig contains configuration specific to deriving metrics from the lines
+// appended to log files.
+type LogtailExporterConfig struct {
+	Exporter `mapstructure:",squash"`
+	// Paths are the files which are followed. They may be glob patterns. Files are followed
+	// across rotation by rename or truncation.
+	Paths []string `mapstructure:"paths"`
+	// PollInterval is the interval files are checked for new lines at. It defaults to 1s.
+	PollInterval model.Duration `mapstructure:"poll_interval,omitempty"`
+	// FromBeginning makes files which exist on startup be read from the beginning rather
+	// than the end, if no offset was persisted for them.
+	FromBeginning bool `mapstructure:"from_beginning,omitempty"`
+	// PersistenceFile is the file the offsets of followed files are saved to and restored
+	// from on startup. Offsets are only held in memory if it is not set.
+	PersistenceFile string `mapstructure:"persistence_file,omitempty"`
+	// PersistenceInterval is the interval changed offsets are saved at. It defaults to 10s.
+	// Offsets are also saved on shutdown.
+	PersistenceInterval model.Duration `mapstructure:"persistence_interval,omitempty"`
+	// Rules are applied to every line. A line may match several rules.
+	Rules []*LogtailRuleConfig `mapstructure:"rules"`
+}
+
+// LogtailRuleConfig derives a metric from the log lines which match a regex.
+type LogtailRuleConfig struct {
+	Name string `mapstructure:"name"`
+	// Type is counter or gauge. It defaults to counter.
+	Type MetricType `mapstructure:"type,omitempty"`
+	Help string     `mapstructure:"help,omitempty"`
+	// Regex is matched against each line. Its named capture groups, other than the value
+	// group, are added as labels.
+	Regex Regexp `mapstructure:"regex"`
+	// ValueGroup is the named capture group holding the value of the match. Counters are
+	// incremented by it, or by 1 if it is not set. Gauges are set to it, so require it.
+	ValueGroup string `mapstructure:"value_group,omitempty"`
+	// Labels are added to the metric.
+	Labels map[string]string `mapstructure:"labels,omitempty"`
+}
+
+// IncludeExporterConfig contains configuration specific to including the backends of another
+// reverse exporter path. The backends are shared with the other path rather than duplicated,
+// so concurrent scrapes of both paths are coalesced into one scrape of the backends.
+type IncludeExporterConfig struct {
+	Exporter `mapstructure:",squash"`
+	// Path is the reverse exporter path whose backends are included.
+	Path string `mapstructure:"path"`
+	// KeepMetrics keeps only the metric families whose name matches one of the regexes, if set.
+	KeepMetrics []Regexp `mapstructure:"keep_metrics,omitempty"`
+	// DropMetrics drops the metric families whose name matches one of the regexes.
+	DropMetrics []Regexp `mapstructure:"drop_metrics,omitempty"`
+}
+
+// HTTPSDExporterConfig contains configuration specific to reverse proxying http-based
+// exporters discovered from file_sd files or DNS SRV records. Each discovered target is
+// proxied like an http exporter, and targets are added and removed as they are discovered.
+type HTTPSDExporterConfig struct {
+	Exporter `mapstructure:",squash"`
+	// Files are Prometheus file_sd files in JSON or YAML. They may be glob patterns. Files
+	// are re-read when they change.
+	Files []string `mapstructure:"files,omitempty"`
+	// DNSSRVNames are DNS SRV names whose records are targets.
+	DNSSRVNames []string `mapstructure:"dns_srv_names,omitempty"`
+	// DNSServer is the host:port of the DNS server SRV records are looked up with. It
+	// defaults to the system resolver.
+	DNSServer string `mapstructure:"dns_server,omitempty"`
+	// RefreshInterval is the interval targets are re-discovered at. It defaults to 30s.
+	RefreshInterval model.Duration `mapstructure:"refresh_interval,omitempty"`
+	// Scheme is the scheme targets are scraped with. It defaults to http, and can be
+	// overridden per file_sd target by the __scheme__ label.
+	Scheme string `mapstructure:"scheme,omitempty"`
+	// MetricsPath is the path targets are scraped at. It defaults to /metrics, and can be
+	// overridden per file_sd target by the __metrics_path__ label.
+	MetricsPath string `mapstructure:"metrics_path,omitempty"`
+	// NameTemplate is a text/template of the exporter name of each target. It is executed
+	// with .Name, .Address and .Labels, and defaults to "{{ .Name }}-{{ .Address }}".
+	NameTemplate string `mapstructure:"name_template,omitempty"`
+	// Timeout is the maximum length of time scraping a target can take.
+	Timeout model.Duration `mapstructure:"timeout,omitempty"`
+	// ForwardURLParams determines whether the exporter will have ALL url params
+	// of the parent request added to it.
+	ForwardURLParams bool `mapstructure:"forward_url_params,omitempty"`
+	// MaxBytes is the maximum size of the response read from a target, before and after
+	// decompression. 0 is unlimited.
+	MaxBytes uint64 `mapstructure:"max_bytes,omitempty"`
 }
@@ -1,8 +1,11 @@
 package config_test
 
 import (
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/wrouesnel/reverse_exporter/pkg/config"
 
 	. "gopkg.in/check.v1"
@@ -39,3 +42,295 @@ func (s *ConfigSuite) TestConfigParsing(c *C) {
 
 	c.Assert(cfg.ReverseExporters, Not(IsNil))
 }
+
+func (s *ConfigSuite) TestStaticExporterParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var staticExporters []*config.StaticExporterConfig
+	for _, reverseExporter := range cfg.ReverseExporters {
+		staticExporters = append(staticExporters, reverseExporter.Exporters.StaticExporters...)
+	}
+	c.Assert(staticExporters, HasLen, 1)
+
+	metrics := staticExporters[0].Metrics
+	c.Assert(metrics, HasLen, 2)
+	c.Assert(metrics[0].Value, Not(IsNil))
+	c.Check(*metrics[0].Value, Equals, 1.0)
+	c.Check(metrics[0].Labels["version"], Equals, "1.2.3")
+	c.Check(metrics[0].LabelsFromFile["serial"], Equals, "/sys/class/dmi/id/product_serial")
+	c.Check(metrics[1].Type, Equals, config.MetricTypeCounter)
+	c.Check(metrics[1].ValueFromEnv, Equals, "APPLIANCE_SLOTS")
+}
+
+func (s *ConfigSuite) TestProbeExporterParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var probeExporters []*config.ProbeExporterConfig
+	for _, reverseExporter := range cfg.ReverseExporters {
+		probeExporters = append(probeExporters, reverseExporter.Exporters.ProbeExporters...)
+	}
+	c.Assert(probeExporters, HasLen, 1)
+
+	targets := probeExporters[0].Targets
+	c.Assert(targets, HasLen, 2)
+	c.Check(targets[0].Type, Equals, config.ProbeTCP)
+	c.Check(targets[1].Type, Equals, config.ProbeHTTP)
+	c.Check(targets[1].ValidStatusCodes, HasLen, 5)
+	c.Check(targets[1].ValidStatusCodes[204], Equals, true)
+	c.Assert(targets[1].BodyRegex.Regexp, Not(IsNil))
+	c.Check(targets[1].BodyRegex.MatchString("ok"), Equals, true)
+}
+
+func (s *ConfigSuite) TestProcessExporterParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var processExporters []*config.ProcessExporterConfig
+	for _, reverseExporter := range cfg.ReverseExporters {
+		processExporters = append(processExporters, reverseExporter.Exporters.ProcessExporters...)
+	}
+	c.Assert(processExporters, HasLen, 1)
+	c.Check(processExporters[0].ProcPath, Equals, "/host/proc")
+
+	groups := processExporters[0].Groups
+	c.Assert(groups, HasLen, 3)
+	c.Check(groups[0].Comm, DeepEquals, []string{"nginx"})
+	c.Assert(groups[1].Cmdline.Regexp, Not(IsNil))
+	c.Check(groups[1].Cmdline.MatchString("python3 /srv/app.py"), Equals, true)
+	c.Check(groups[2].Pidfile, Equals, "/run/daemon.pid")
+}
+
+func (s *ConfigSuite) TestLogtailExporterParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var logtailExporters []*config.LogtailExporterConfig
+	for _, reverseExporter := range cfg.ReverseExporters {
+		logtailExporters = append(logtailExporters, reverseExporter.Exporters.LogtailExporters...)
+	}
+	c.Assert(logtailExporters, HasLen, 1)
+	c.Check(logtailExporters[0].Paths, DeepEquals, []string{"/var/log/daemon/*.log"})
+	c.Check(logtailExporters[0].PollInterval, Equals, model.Duration(5*time.Second))
+
+	rules := logtailExporters[0].Rules
+	c.Assert(rules, HasLen, 2)
+	c.Assert(rules[0].Regex.Regexp, Not(IsNil))
+	c.Check(rules[0].Regex.FindStringSubmatch("ERROR [db] failed"), DeepEquals, []string{"ERROR [db]", "db"})
+	c.Check(rules[1].Type, Equals, config.MetricTypeGauge)
+	c.Check(rules[1].ValueGroup, Equals, "depth")
+}
+
+func (s *ConfigSuite) TestIncludeExporterParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var includeExporters []*config.IncludeExporterConfig
+	for _, reverseExporter := range cfg.ReverseExporters {
+		includeExporters = append(includeExporters, reverseExporter.Exporters.IncludeExporters...)
+	}
+	c.Assert(includeExporters, HasLen, 1)
+	c.Check(includeExporters[0].Path, Equals, "/static")
+	c.Assert(includeExporters[0].KeepMetrics, HasLen, 1)
+	c.Check(includeExporters[0].KeepMetrics[0].MatchString("appliance_slots"), Equals, true)
+	c.Assert(includeExporters[0].DropMetrics, HasLen, 1)
+	c.Check(includeExporters[0].DropMetrics[0].MatchString("appliance_info"), Equals, true)
+}
+
+func (s *ConfigSuite) TestHTTPSDExporterParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var httpSDExporters []*config.HTTPSDExporterConfig
+	for _, reverseExporter := range cfg.ReverseExporters {
+		httpSDExporters = append(httpSDExporters, reverseExporter.Exporters.HTTPSDExporters...)
+	}
+	c.Assert(httpSDExporters, HasLen, 1)
+	c.Check(httpSDExporters[0].Files, DeepEquals, []string{"/etc/reverse_exporter/targets/*.json"})
+	c.Check(httpSDExporters[0].DNSSRVNames, DeepEquals, []string{"_metrics._tcp.example.com"})
+	c.Check(time.Duration(httpSDExporters[0].RefreshInterval), Equals, time.Minute)
+	c.Check(httpSDExporters[0].MetricsPath, Equals, "/internal/metrics")
+	c.Check(httpSDExporters[0].NameTemplate, Equals, "{{ .Labels.service }}")
+}
+
+func (s *ConfigSuite) TestRoutingParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var routings []*config.RoutingConfig
+	for _, reverseExporter := range cfg.ReverseExporters {
+		if reverseExporter.Routing != nil {
+			routings = append(routings, reverseExporter.Routing)
+		}
+	}
+	c.Assert(routings, HasLen, 1)
+	c.Check(routings[0].Param, Equals, "target")
+	c.Assert(routings[0].Routes, HasLen, 2)
+	c.Check(routings[0].Routes[0].Values, DeepEquals, []string{"www.example.com"})
+	c.Check(routings[0].Routes[0].Exporters, DeepEquals, []string{"blackbox_http"})
+	c.Check(routings[0].Routes[1].Regex.MatchString("db1"), Equals, true)
+	c.Check(routings[0].Routes[1].Name, Equals, "snmp")
+	c.Check(routings[0].Routes[1].AddressTemplate, Equals, "http://127.0.0.1:9116/snmp?target={{ .Value | urlquery }}")
+}
+
+func (s *ConfigSuite) TestMatchFilterParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	matchFilterPaths := []string{}
+	for _, reverseExporter := range cfg.ReverseExporters {
+		if reverseExporter.MatchFilter {
+			matchFilterPaths = append(matchFilterPaths, reverseExporter.Path)
+		}
+	}
+	c.Check(matchFilterPaths, DeepEquals, []string{"/federate"})
+}
+
+func (s *ConfigSuite) TestAggregationParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var aggregations []*config.AggregationConfig
+	for _, reverseExporter := range cfg.ReverseExporters {
+		aggregations = append(aggregations, reverseExporter.Aggregations...)
+	}
+	c.Assert(aggregations, HasLen, 1)
+	c.Check(aggregations[0].Name, Equals, "worker_requests_total")
+	c.Check(aggregations[0].Op, Equals, config.AggregationSum)
+	c.Check(aggregations[0].Metric, Equals, "http_requests_total")
+	c.Check(aggregations[0].By, DeepEquals, []string{"code"})
+	c.Check(aggregations[0].DropSource, Equals, true)
+
+	var op config.AggregationOp
+	c.Check(errors.Is(op.UnmarshalText([]byte("median")), config.ErrInvalidAggregation), Equals, true)
+}
+
+func (s *ConfigSuite) TestHistogramConversionParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	var exporters []config.Exporter
+	for _, reverseExporter := range cfg.ReverseExporters {
+		for _, exporter := range reverseExporter.Exporters.All() {
+			if baseExporter := exporter.GetBaseExporter(); baseExporter.ConvertHistograms != config.HistogramConversionNone {
+				exporters = append(exporters, baseExporter)
+			}
+		}
+	}
+	c.Assert(exporters, HasLen, 1)
+	c.Check(exporters[0].Name, Equals, "worker1")
+	c.Check(exporters[0].ConvertHistograms, Equals, config.HistogramConversionSummary)
+	c.Check(exporters[0].HistogramQuantiles, DeepEquals, []float64{0.5, 0.99})
+
+	var conversion config.HistogramConversion
+	c.Check(errors.Is(conversion.UnmarshalText([]byte("native")), config.ErrInvalidConversion), Equals, true)
+}
+
+func (s *ConfigSuite) TestOpenMetricsParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	openMetricsPaths := []string{}
+	for _, reverseExporter := range cfg.ReverseExporters {
+		if reverseExporter.OpenMetrics {
+			openMetricsPaths = append(openMetricsPaths, reverseExporter.Path)
+		}
+	}
+	c.Check(openMetricsPaths, DeepEquals, []string{"/workers"})
+}
+
+func (s *ConfigSuite) TestTimestampsParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+
+	timestamps := make(map[string]config.TimestampMode)
+	for _, reverseExporter := range cfg.ReverseExporters {
+		for _, exporter := range reverseExporter.Exporters.All() {
+			if baseExporter := exporter.GetBaseExporter(); baseExporter.Timestamps != "" {
+				timestamps[baseExporter.Name] = baseExporter.Timestamps
+			}
+		}
+	}
+	c.Check(timestamps, DeepEquals, map[string]config.TimestampMode{
+		"periodic_dynamic_metrics": config.TimestampsProductionTime,
+	})
+
+	var mode config.TimestampMode
+	c.Check(errors.Is(mode.UnmarshalText([]byte("now")), config.ErrInvalidTimestamps), Equals, true)
+}
+
+func (s *ConfigSuite) TestExporterLabelParsing(c *C) {
+	cfg, err := config.LoadFromFile("test_data/test_config.yml")
+	c.Assert(err, IsNil)
+	c.Check(cfg.ExporterLabel, Equals, "job_component")
+
+	for _, reverseExporter := range cfg.ReverseExporters {
+		// Paths inherit the global exporter label unless they set their own.
+		if reverseExporter.Path != "/probes" {
+			c.Check(reverseExporter.ExporterLabel, Equals, "job_component", Commentf("path: %s", reverseExporter.Path))
+			c.Check(reverseExporter.Labels, IsNil, Commentf("path: %s", reverseExporter.Path))
+			continue
+		}
+		c.Check(reverseExporter.ExporterLabel, Equals, "exporter_name")
+		c.Check(reverseExporter.Labels, DeepEquals, map[string]string{"appliance_id": "appliance-01"})
+	}
+}
+
+func (s *ConfigSuite) TestIncludeOrder(c *C) {
+	newReverseExporter := func(path string, includes ...string) *config.ReverseExporterConfig {
+		reverseExporter := &config.ReverseExporterConfig{Path: path, Exporters: &config.ExportersConfig{}}
+		for _, include := range includes {
+			reverseExporter.Exporters.IncludeExporters = append(reverseExporter.Exporters.IncludeExporters,
+				&config.IncludeExporterConfig{Path: include})
+		}
+		return reverseExporter
+	}
+	paths := func(reverseExporters []*config.ReverseExporterConfig) []string {
+		result := make([]string, 0, len(reverseExporters))
+		for _, reverseExporter := range reverseExporters {
+			result = append(result, reverseExporter.Path)
+		}
+		return result
+	}
+
+	ordered, err := config.IncludeOrder([]*config.ReverseExporterConfig{
+		newReverseExporter("/all", "/core", "/extra"),
+		newReverseExporter("/core", "/base"),
+		newReverseExporter("/extra"),
+		newReverseExporter("/base"),
+	})
+	c.Assert(err, IsNil)
+	c.Check(paths(ordered), DeepEquals, []string{"/base", "/core", "/extra", "/all"})
+
+	_, err = config.IncludeOrder([]*config.ReverseExporterConfig{newReverseExporter("/all", "/missing")})
+	c.Check(errors.Is(err, config.ErrIncludedPathUnknown), Equals, true, Commentf("got error: %v", err))
+
+	_, err = config.IncludeOrder([]*config.ReverseExporterConfig{
+		newReverseExporter("/a", "/b"),
+		newReverseExporter("/b", "/c"),
+		newReverseExporter("/c", "/a"),
+	})
+	c.Check(errors.Is(err, config.ErrIncludeCycle), Equals, true, Commentf("got error: %v", err))
+	c.Check(err, ErrorMatches, ".*/a -> /b -> /c -> /a.*")
+
+	_, err = config.IncludeOrder([]*config.ReverseExporterConfig{newReverseExporter("/self", "/self")})
+	c.Check(errors.Is(err, config.ErrIncludeCycle), Equals, true, Commentf("got error: %v", err))
+}
+
+func (s *ConfigSuite) TestLoadRejectsIncludeCycle(c *C) {
+	_, err := config.Load([]byte(`
+reverse_exporters:
+- path: /a
+  exporters:
+    include:
+    - name: b
+      path: /b
+- path: /b
+  exporters:
+    include:
+    - name: a
+      path: /a
+`))
+	c.Check(errors.Is(err, config.ErrIncludeCycle), Equals, true, Commentf("got error: %v", err))
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"io/ioutil"
 	"reflect"
+	"strings"
 
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
@@ -161,6 +162,69 @@ func Load(configData []byte) (*Config, error) {
 				configMapMerge(exporterDefaults["exec_cached"].(map[string]interface{}), service)
 			}
 		}
+
+		if _, ok := reverseExporter["exec_daemon"]; ok {
+			for _, serviceIntf := range reverseExporter["exec_daemon"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["exec_daemon"].(map[string]interface{}), service)
+			}
+		}
+
+		if _, ok := reverseExporter["static"]; ok {
+			for _, serviceIntf := range reverseExporter["static"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["static"].(map[string]interface{}), service)
+			}
+		}
+
+		if _, ok := reverseExporter["push"]; ok {
+			for _, serviceIntf := range reverseExporter["push"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["push"].(map[string]interface{}), service)
+			}
+		}
+
+		if _, ok := reverseExporter["json"]; ok {
+			for _, serviceIntf := range reverseExporter["json"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["json"].(map[string]interface{}), service)
+			}
+		}
+
+		if _, ok := reverseExporter["probe"]; ok {
+			for _, serviceIntf := range reverseExporter["probe"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["probe"].(map[string]interface{}), service)
+			}
+		}
+
+		if _, ok := reverseExporter["process"]; ok {
+			for _, serviceIntf := range reverseExporter["process"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["process"].(map[string]interface{}), service)
+			}
+		}
+
+		if _, ok := reverseExporter["logtail"]; ok {
+			for _, serviceIntf := range reverseExporter["logtail"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["logtail"].(map[string]interface{}), service)
+			}
+		}
+
+		if _, ok := reverseExporter["include"]; ok {
+			for _, serviceIntf := range reverseExporter["include"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["include"].(map[string]interface{}), service)
+			}
+		}
+
+		if _, ok := reverseExporter["http_sd"]; ok {
+			for _, serviceIntf := range reverseExporter["http_sd"].([]interface{}) {
+				service := serviceIntf.(map[string]interface{})
+				configMapMerge(exporterDefaults["http_sd"].(map[string]interface{}), service)
+			}
+		}
 	}
 
 	// Do the decode after inheritance and allow unused key errors.
@@ -173,9 +237,76 @@ func Load(configData []byte) (*Config, error) {
 	if err := decoder.Decode(configMap); err != nil {
 		return nil, errors.Wrap(err, "Load: second-pass config map decoding failed")
 	}
+
+	// Paths inherit the global exporter label unless they set their own.
+	for _, reverseExporter := range cfg.ReverseExporters {
+		if reverseExporter.ExporterLabel == "" {
+			reverseExporter.ExporterLabel = cfg.ExporterLabel
+		}
+	}
+
+	if _, err := IncludeOrder(cfg.ReverseExporters); err != nil {
+		return nil, errors.Wrap(err, "Load: invalid include exporters")
+	}
 	return cfg, nil
 }
 
+// IncludeOrder returns the reverse exporters ordered so every path comes after the paths it
+// includes. ErrIncludedPathUnknown is returned if an included path is not configured, and
+// ErrIncludeCycle if paths include each other.
+func IncludeOrder(reverseExporters []*ReverseExporterConfig) ([]*ReverseExporterConfig, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	byPath := make(map[string]*ReverseExporterConfig, len(reverseExporters))
+	for _, reverseExporter := range reverseExporters {
+		if _, found := byPath[reverseExporter.Path]; !found {
+			byPath[reverseExporter.Path] = reverseExporter
+		}
+	}
+
+	state := make(map[*ReverseExporterConfig]int, len(reverseExporters))
+	ordered := make([]*ReverseExporterConfig, 0, len(reverseExporters))
+
+	var visit func(reverseExporter *ReverseExporterConfig, chain []string) error
+	visit = func(reverseExporter *ReverseExporterConfig, chain []string) error {
+		chain = append(chain, reverseExporter.Path)
+		switch state[reverseExporter] {
+		case visited:
+			return nil
+		case visiting:
+			return errors.Wrap(ErrIncludeCycle, strings.Join(chain, " -> "))
+		}
+
+		state[reverseExporter] = visiting
+		if reverseExporter.Exporters != nil {
+			for _, include := range reverseExporter.Exporters.IncludeExporters {
+				included, found := byPath[include.Path]
+				if !found {
+					return errors.Wrapf(ErrIncludedPathUnknown, "%s includes %q", reverseExporter.Path, include.Path)
+				}
+				if err := visit(included, chain); err != nil {
+					return err
+				}
+			}
+		}
+		state[reverseExporter] = visited
+
+		ordered = append(ordered, reverseExporter)
+		return nil
+	}
+
+	for _, reverseExporter := range reverseExporters {
+		if err := visit(reverseExporter, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
 func LoadFromFile(filename string) (*Config, error) {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
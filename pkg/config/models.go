@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/robfig/cron/v3"
 	"github.com/samber/lo"
 
 	"github.com/pkg/errors"
@@ -30,15 +31,92 @@ const (
 	ProxyDirect      string = "direct"
 )
 
+const (
+	// StaleActionError fails the scrape of stale results.
+	StaleActionError StaleAction = "error"
+	// StaleActionDrop returns no metrics for stale results.
+	StaleActionDrop StaleAction = "drop"
+	// StaleActionLabel returns stale results with a stale="true" label.
+	StaleActionLabel StaleAction = "label"
+)
+
+const (
+	// CacheAgeNone does not expose the age of cached results.
+	CacheAgeNone CacheAgeMode = ""
+	// CacheAgeGauge exposes the age of cached results as a separate gauge.
+	CacheAgeGauge CacheAgeMode = "gauge"
+	// CacheAgeLabel adds the age of cached results in whole seconds as a label of each
+	// series. The label changes as the result ages, so each scrape starts new series.
+	CacheAgeLabel CacheAgeMode = "label"
+)
+
+const (
+	// MetricTypeGauge declares a gauge. It is the default type.
+	MetricTypeGauge MetricType = "gauge"
+	// MetricTypeCounter declares a counter.
+	MetricTypeCounter MetricType = "counter"
+	// MetricTypeUntyped declares an untyped metric.
+	MetricTypeUntyped MetricType = "untyped"
+)
+
+const (
+	// ProbeTCP probes by connecting to a TCP port.
+	ProbeTCP ProbeType = "tcp"
+	// ProbeHTTP probes with an HTTP GET request.
+	ProbeHTTP ProbeType = "http"
+)
+
+const (
+	// AggregationSum sums the values of each group.
+	AggregationSum AggregationOp = "sum"
+	// AggregationMin is the smallest value of each group.
+	AggregationMin AggregationOp = "min"
+	// AggregationMax is the largest value of each group.
+	AggregationMax AggregationOp = "max"
+	// AggregationCount counts the series of each group.
+	AggregationCount AggregationOp = "count"
+	// AggregationAvg averages the values of each group.
+	AggregationAvg AggregationOp = "avg"
+)
+
+const (
+	// HistogramConversionNone passes classic histograms through unchanged.
+	HistogramConversionNone HistogramConversion = ""
+	// HistogramConversionSeries converts classic histograms to untyped _bucket, _sum and _count series.
+	HistogramConversionSeries HistogramConversion = "series"
+	// HistogramConversionSummary converts classic histograms to summaries with estimated quantiles.
+	HistogramConversionSummary HistogramConversion = "summary"
+)
+
+const (
+	// TimestampsKeep passes sample timestamps through unchanged.
+	TimestampsKeep TimestampMode = "keep"
+	// TimestampsStrip removes sample timestamps, so the scraper uses its own scrape time.
+	TimestampsStrip TimestampMode = "strip"
+	// TimestampsScrapeTime sets sample timestamps to the time the exporter was scraped.
+	TimestampsScrapeTime TimestampMode = "set_to_scrape_time"
+	// TimestampsProductionTime sets sample timestamps to the time an exec or file exporter
+	// produced its metrics.
+	TimestampsProductionTime TimestampMode = "set_to_production_time"
+)
+
 var (
-	ErrInvalidInputType = errors.New("invalid input type for decoder")
-	ErrInvalidPEMFile   = errors.New("PEM file could not be added to certificate pool")
+	ErrInvalidInputType   = errors.New("invalid input type for decoder")
+	ErrInvalidPEMFile     = errors.New("PEM file could not be added to certificate pool")
+	ErrInvalidStaleAction = errors.New("invalid stale action")
+	ErrInvalidCacheAge    = errors.New("invalid cache age mode")
+	ErrInvalidMetricType  = errors.New("invalid metric type")
+	ErrInvalidProbeType   = errors.New("invalid probe type")
+	ErrInvalidAggregation = errors.New("invalid aggregation op")
+	ErrInvalidConversion  = errors.New("invalid histogram conversion")
+	ErrInvalidTimestamps  = errors.New("invalid timestamps mode")
 )
 
 // HTTPStatusRange is a range of HTTP status codes which can be specifid in YAML using human-friendly ranging notation.
 type HTTPStatusRange map[int]bool
 
 // FromString initializes a new HTTPStatusRange from the given string specifier
+//
 //nolint:cyclop
 func (hsr *HTTPStatusRange) FromString(ranges string) error {
 	const HTTPStatusRangeBase int = 10
@@ -199,6 +277,167 @@ func (r *Regexp) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// CronSchedule encapsulates a cron.Schedule parsed from a standard cron expression
+// and makes it YAML marshallable.
+type CronSchedule struct {
+	cron.Schedule
+	original string
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (cs *CronSchedule) MarshalText() ([]byte, error) {
+	return []byte(cs.original), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (cs *CronSchedule) UnmarshalText(text []byte) error {
+	schedule, err := cron.ParseStandard(string(text))
+	if err != nil {
+		return errors.Wrapf(err, "CronSchedule.UnmarshalText failed: %v", string(text))
+	}
+	cs.Schedule = schedule
+	cs.original = string(text)
+	return nil
+}
+
+// String returns the original cron expression.
+func (cs CronSchedule) String() string {
+	return cs.original
+}
+
+// StaleAction is the action taken when an exporter's data is older than its max age.
+type StaleAction string
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (sa *StaleAction) UnmarshalText(text []byte) error {
+	switch StaleAction(text) {
+	case StaleActionError, StaleActionDrop, StaleActionLabel:
+		*sa = StaleAction(text)
+		return nil
+	default:
+		return errors.Wrapf(ErrInvalidStaleAction, "StaleAction.UnmarshalText: %s", string(text))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (sa *StaleAction) MarshalText() ([]byte, error) {
+	return []byte(*sa), nil
+}
+
+// CacheAgeMode is how the age of cached results is exposed.
+type CacheAgeMode string
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (cam *CacheAgeMode) UnmarshalText(text []byte) error {
+	switch CacheAgeMode(text) {
+	case CacheAgeNone, CacheAgeGauge, CacheAgeLabel:
+		*cam = CacheAgeMode(text)
+		return nil
+	default:
+		return errors.Wrapf(ErrInvalidCacheAge, "CacheAgeMode.UnmarshalText: %s", string(text))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (cam *CacheAgeMode) MarshalText() ([]byte, error) {
+	return []byte(*cam), nil
+}
+
+// MetricType is the type of a metric declared in the configuration.
+type MetricType string
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (mt *MetricType) UnmarshalText(text []byte) error {
+	switch MetricType(text) {
+	case MetricTypeGauge, MetricTypeCounter, MetricTypeUntyped:
+		*mt = MetricType(text)
+		return nil
+	default:
+		return errors.Wrapf(ErrInvalidMetricType, "MetricType.UnmarshalText: %s", string(text))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (mt *MetricType) MarshalText() ([]byte, error) {
+	return []byte(*mt), nil
+}
+
+// ProbeType is the protocol a probe checks a target with.
+type ProbeType string
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (pt *ProbeType) UnmarshalText(text []byte) error {
+	switch ProbeType(text) {
+	case ProbeTCP, ProbeHTTP:
+		*pt = ProbeType(text)
+		return nil
+	default:
+		return errors.Wrapf(ErrInvalidProbeType, "ProbeType.UnmarshalText: %s", string(text))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (pt *ProbeType) MarshalText() ([]byte, error) {
+	return []byte(*pt), nil
+}
+
+// AggregationOp is the operator of an aggregation.
+type AggregationOp string
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (ao *AggregationOp) UnmarshalText(text []byte) error {
+	switch AggregationOp(text) {
+	case AggregationSum, AggregationMin, AggregationMax, AggregationCount, AggregationAvg:
+		*ao = AggregationOp(text)
+		return nil
+	default:
+		return errors.Wrapf(ErrInvalidAggregation, "AggregationOp.UnmarshalText: %s", string(text))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (ao *AggregationOp) MarshalText() ([]byte, error) {
+	return []byte(*ao), nil
+}
+
+// HistogramConversion is how the classic histograms of an exporter are converted.
+type HistogramConversion string
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (hc *HistogramConversion) UnmarshalText(text []byte) error {
+	switch HistogramConversion(text) {
+	case HistogramConversionNone, HistogramConversionSeries, HistogramConversionSummary:
+		*hc = HistogramConversion(text)
+		return nil
+	default:
+		return errors.Wrapf(ErrInvalidConversion, "HistogramConversion.UnmarshalText: %s", string(text))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (hc *HistogramConversion) MarshalText() ([]byte, error) {
+	return []byte(*hc), nil
+}
+
+// TimestampMode is how the sample timestamps of an exporter are handled. Empty is keep.
+type TimestampMode string
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (tm *TimestampMode) UnmarshalText(text []byte) error {
+	switch TimestampMode(text) {
+	case "", TimestampsKeep, TimestampsStrip, TimestampsScrapeTime, TimestampsProductionTime:
+		*tm = TimestampMode(text)
+		return nil
+	default:
+		return errors.Wrapf(ErrInvalidTimestamps, "TimestampMode.UnmarshalText: %s", string(text))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (tm *TimestampMode) MarshalText() ([]byte, error) {
+	return []byte(*tm), nil
+}
+
 // URL is a custom URL type that allows validation at configuration load time.
 type URL struct {
 	*url.URL
@@ -237,6 +476,7 @@ type TLSCertificatePool struct {
 }
 
 // MapStructureDecode implements the yaml.Unmarshaler interface for tls_cacerts.
+//
 //nolint:cyclop
 func (t *TLSCertificatePool) MapStructureDecode(input interface{}) error {
 	// Get the slice
@@ -2,6 +2,7 @@ package config_test
 
 import (
 	"encoding/base64"
+	"errors"
 
 	"github.com/wrouesnel/reverse_exporter/pkg/config"
 	. "gopkg.in/check.v1"
@@ -34,3 +35,27 @@ func (m *ModelsSuite) TestBytes(c *C) {
 	c.Check(err, IsNil)
 	c.Check(string(recovered), Equals, original)
 }
+
+func (m *ModelsSuite) TestCronSchedule(c *C) {
+	var schedule config.CronSchedule
+	original := []byte("*/5 * * * *")
+	err := schedule.UnmarshalText(original)
+	c.Check(err, IsNil)
+	c.Check(schedule.Schedule, Not(IsNil))
+
+	recovered, err := schedule.MarshalText()
+	c.Check(err, IsNil)
+	c.Check(string(recovered), Equals, string(original))
+
+	c.Check(schedule.UnmarshalText([]byte("not a schedule")), Not(IsNil))
+}
+
+func (m *ModelsSuite) TestCacheAgeMode(c *C) {
+	var mode config.CacheAgeMode
+	c.Check(mode.UnmarshalText([]byte("gauge")), IsNil)
+	c.Check(mode, Equals, config.CacheAgeGauge)
+	c.Check(mode.UnmarshalText([]byte("label")), IsNil)
+	c.Check(mode, Equals, config.CacheAgeLabel)
+
+	c.Check(errors.Is(mode.UnmarshalText([]byte("both")), config.ErrInvalidCacheAge), Equals, true)
+}
@@ -0,0 +1,300 @@
+package metricproxy
+
+import (
+	"math"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// ErrAggregationInvalid returned when an aggregation is not correctly configured.
+var ErrAggregationInvalid = errors.New("aggregation is invalid")
+
+// aggregation computes a new metric family from the series of another, like a PromQL
+// aggregation operator.
+type aggregation struct {
+	name   string
+	help   string
+	op     config.AggregationOp
+	metric string
+	// by is nil if without is used
+	by         map[string]struct{}
+	without    map[string]struct{}
+	dropSource bool
+}
+
+// aggregationGroup is the state of aggregating the series of one group.
+type aggregationGroup struct {
+	labels []*dto.LabelPair
+	value  float64
+	count  int
+	// histogram is the sum of the classic histograms of the group
+	histogram *dto.Histogram
+	// exemplar is the latest exemplar of the summed counters of the group
+	exemplar *dto.Exemplar
+}
+
+// newAggregations initializes the aggregations of a path.
+func newAggregations(configs []*config.AggregationConfig) ([]*aggregation, error) {
+	aggregations := make([]*aggregation, 0, len(configs))
+	names := make(map[string]struct{}, len(configs))
+	for _, aggregationConfig := range configs {
+		if !model.IsValidMetricName(model.LabelValue(aggregationConfig.Name)) {
+			return nil, errors.Wrapf(ErrAggregationInvalid, "invalid name %q", aggregationConfig.Name)
+		}
+		if _, found := names[aggregationConfig.Name]; found {
+			return nil, errors.Wrapf(ErrAggregationInvalid, "name %q is used twice", aggregationConfig.Name)
+		}
+		names[aggregationConfig.Name] = struct{}{}
+		if !model.IsValidMetricName(model.LabelValue(aggregationConfig.Metric)) {
+			return nil, errors.Wrapf(ErrAggregationInvalid, "%s: invalid metric %q", aggregationConfig.Name, aggregationConfig.Metric)
+		}
+		if aggregationConfig.Metric == aggregationConfig.Name {
+			return nil, errors.Wrapf(ErrAggregationInvalid, "%s: cannot aggregate into the same metric", aggregationConfig.Name)
+		}
+		switch aggregationConfig.Op {
+		case config.AggregationSum, config.AggregationMin, config.AggregationMax,
+			config.AggregationCount, config.AggregationAvg:
+		default:
+			return nil, errors.Wrapf(ErrAggregationInvalid, "%s: unknown op %q", aggregationConfig.Name, aggregationConfig.Op)
+		}
+		if len(aggregationConfig.By) > 0 && len(aggregationConfig.Without) > 0 {
+			return nil, errors.Wrapf(ErrAggregationInvalid, "%s: only one of by and without can be set", aggregationConfig.Name)
+		}
+
+		newAggregation := &aggregation{
+			name:       aggregationConfig.Name,
+			help:       aggregationConfig.Help,
+			op:         aggregationConfig.Op,
+			metric:     aggregationConfig.Metric,
+			dropSource: aggregationConfig.DropSource,
+		}
+		for _, labelNames := range [][]string{aggregationConfig.By, aggregationConfig.Without} {
+			for _, labelName := range labelNames {
+				if !model.LabelName(labelName).IsValid() {
+					return nil, errors.Wrapf(ErrAggregationInvalid, "%s: invalid label name %q", aggregationConfig.Name, labelName)
+				}
+			}
+		}
+		for _, labelName := range aggregationConfig.Without {
+			if isBucketLabel(labelName) {
+				return nil, errors.Wrapf(ErrAggregationInvalid, "%s: cannot aggregate without %s", aggregationConfig.Name, labelName)
+			}
+		}
+		// Like PromQL, all labels are aggregated away unless without is set. The le and
+		// quantile labels of converted histograms and summaries are always kept.
+		if len(aggregationConfig.Without) > 0 {
+			newAggregation.without = labelNameSet(aggregationConfig.Without)
+		} else {
+			newAggregation.by = labelNameSet(aggregationConfig.By)
+		}
+		aggregations = append(aggregations, newAggregation)
+	}
+	return aggregations, nil
+}
+
+// labelNameSet returns the label names as a set.
+func labelNameSet(labelNames []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(labelNames))
+	for _, labelName := range labelNames {
+		set[labelName] = struct{}{}
+	}
+	return set
+}
+
+// applyAggregations appends the families the aggregations compute to the merged families of
+// a path, and drops the sources of those which drop them. Aggregations are applied in order,
+// so can aggregate the results of those before them.
+func applyAggregations(aggregations []*aggregation, mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	if len(aggregations) == 0 {
+		return mfs
+	}
+
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	dropped := make(map[string]struct{})
+
+	for _, agg := range aggregations {
+		source, found := families[agg.metric]
+		if !found {
+			continue
+		}
+		if _, found := families[agg.name]; found {
+			zap.L().Warn("Aggregation result is already a metric - not aggregating",
+				zap.String("name", agg.name), zap.String("metric", agg.metric))
+			continue
+		}
+		// The source is only dropped if it was aggregated, so it is never silently lost.
+		if result := agg.apply(source); result != nil {
+			families[agg.name] = result
+			mfs = append(mfs, result)
+			if agg.dropSource {
+				dropped[agg.metric] = struct{}{}
+			}
+		}
+	}
+
+	if len(dropped) == 0 {
+		return mfs
+	}
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		if _, found := dropped[mf.GetName()]; !found {
+			kept = append(kept, mf)
+		}
+	}
+	return kept
+}
+
+// apply returns the family the aggregation computes from source, or nil if source has no
+// series it can aggregate. Only counters, gauges and untyped metrics have values to sum,
+// min, max or avg, but series of any type are counted. Classic histograms are summed by
+// bucket if their buckets match the first of their group. Native histogram fields are
+// dropped, and native histograms without classic buckets are not summed. The latest
+// exemplar of summed counters and buckets is kept.
+func (agg *aggregation) apply(source *dto.MetricFamily) *dto.MetricFamily {
+	groups := make(map[string]*aggregationGroup)
+	order := make([]string, 0)
+	sumHistograms := agg.op == config.AggregationSum && isHistogram(source.GetType())
+	nativeSkipped := false
+
+	for _, metric := range source.GetMetric() {
+		value, ok := metricValue(source.GetType(), metric)
+		switch {
+		case agg.op == config.AggregationCount:
+		case sumHistograms:
+			if len(metric.GetHistogram().GetBucket()) == 0 {
+				nativeSkipped = true
+				continue
+			}
+		case !ok:
+			continue
+		}
+
+		labels := agg.groupLabels(metric)
+		key := seriesKey("", labels)
+		group, found := groups[key]
+		if !found {
+			group = &aggregationGroup{labels: labels, value: value}
+			if sumHistograms {
+				group.histogram = classicHistogram(metric.GetHistogram())
+			}
+			groups[key] = group
+			order = append(order, key)
+		}
+		if agg.op == config.AggregationSum && source.GetType() == dto.MetricType_COUNTER {
+			group.exemplar = latestExemplar(group.exemplar, metric.GetCounter().GetExemplar())
+		}
+		if found && sumHistograms && !sameBuckets(group.histogram, metric.GetHistogram()) {
+			zap.L().Warn("Histogram buckets differ from the rest of their group - not aggregating",
+				zap.String("name", agg.name), zap.String("metric", agg.metric))
+			continue
+		}
+		group.count++
+		if !found {
+			continue
+		}
+
+		switch agg.op {
+		case config.AggregationSum, config.AggregationAvg:
+			if sumHistograms {
+				addHistogram(group.histogram, metric.GetHistogram())
+			}
+			group.value += value
+		case config.AggregationMin:
+			// Like PromQL, NaN is only the result if every value is NaN.
+			if value < group.value || math.IsNaN(group.value) {
+				group.value = value
+			}
+		case config.AggregationMax:
+			if value > group.value || math.IsNaN(group.value) {
+				group.value = value
+			}
+		case config.AggregationCount:
+		}
+	}
+	if nativeSkipped {
+		zap.L().Warn("Native histograms without classic buckets cannot be summed - not aggregating them",
+			zap.String("name", agg.name), zap.String("metric", agg.metric))
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	// Sums of counters and histograms keep their type, so can still be rated. Other
+	// results are gauges.
+	resultType := dto.MetricType_GAUGE
+	if agg.op == config.AggregationSum && (source.GetType() == dto.MetricType_COUNTER ||
+		source.GetType() == dto.MetricType_UNTYPED || sumHistograms) {
+		resultType = source.GetType()
+	}
+	result := &dto.MetricFamily{
+		Name: proto.String(agg.name),
+		Type: resultType.Enum(),
+	}
+	if agg.help != "" {
+		result.Help = proto.String(agg.help)
+	}
+	for _, key := range order {
+		group := groups[key]
+		if sumHistograms {
+			result.Metric = append(result.Metric, &dto.Metric{Label: group.labels, Histogram: group.histogram})
+			continue
+		}
+		value := group.value
+		switch agg.op {
+		case config.AggregationCount:
+			value = float64(group.count)
+		case config.AggregationAvg:
+			value /= float64(group.count)
+		case config.AggregationSum, config.AggregationMin, config.AggregationMax:
+		}
+		metric := newValueMetric(resultType, group.labels, value)
+		if resultType == dto.MetricType_COUNTER {
+			metric.Counter.Exemplar = group.exemplar
+		}
+		result.Metric = append(result.Metric, metric)
+	}
+	return result
+}
+
+// groupLabels returns the labels of the group metric is aggregated into.
+func (agg *aggregation) groupLabels(metric *dto.Metric) []*dto.LabelPair {
+	labels := make([]*dto.LabelPair, 0, len(metric.GetLabel()))
+	for _, lp := range metric.GetLabel() {
+		if isBucketLabel(lp.GetName()) {
+			labels = append(labels, &dto.LabelPair{Name: proto.String(lp.GetName()), Value: proto.String(lp.GetValue())})
+			continue
+		}
+		if agg.by != nil {
+			if _, found := agg.by[lp.GetName()]; !found {
+				continue
+			}
+		} else if _, found := agg.without[lp.GetName()]; found {
+			continue
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(lp.GetName()), Value: proto.String(lp.GetValue())})
+	}
+	return labels
+}
+
+// metricValue returns the value of a counter, gauge or untyped metric.
+func metricValue(metricType dto.MetricType, metric *dto.Metric) (float64, bool) {
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		return metric.GetCounter().GetValue(), true
+	case dto.MetricType_GAUGE:
+		return metric.GetGauge().GetValue(), true
+	case dto.MetricType_UNTYPED:
+		return metric.GetUntyped().GetValue(), true
+	case dto.MetricType_SUMMARY, dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+	}
+	return 0, false
+}
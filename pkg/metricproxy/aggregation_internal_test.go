@@ -0,0 +1,133 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+
+	. "gopkg.in/check.v1"
+)
+
+type AggregationSuite struct{}
+
+var _ = Suite(&AggregationSuite{})
+
+// newTestWorkerExporter returns a static exporter with a requests counter per code.
+func newTestWorkerExporter(name string, requestsByCode map[string]float64) *config.StaticExporterConfig {
+	exporter := &config.StaticExporterConfig{Exporter: config.Exporter{Name: name}}
+	for code, requests := range requestsByCode {
+		exporter.Metrics = append(exporter.Metrics, &config.StaticMetricConfig{
+			Name:   "requests_total",
+			Type:   config.MetricTypeCounter,
+			Labels: map[string]string{"code": code},
+			Value:  float64Ptr(requests),
+		})
+	}
+	return exporter
+}
+
+func (s *AggregationSuite) TestAggregations(c *C) {
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path: "/metrics",
+		Exporters: &config.ExportersConfig{
+			StaticExporters: []*config.StaticExporterConfig{
+				newTestWorkerExporter("worker1", map[string]float64{"200": 10, "500": 1}),
+				newTestWorkerExporter("worker2", map[string]float64{"200": 30}),
+			},
+		},
+		Aggregations: []*config.AggregationConfig{
+			{Name: "requests_all_total", Op: config.AggregationSum, Metric: "requests_total", Help: "All requests."},
+			{Name: "requests_by_code_total", Op: config.AggregationSum, Metric: "requests_total", By: []string{"code"}},
+			{Name: "requests_min", Op: config.AggregationMin, Metric: "requests_total", Without: []string{"code"}},
+			{Name: "requests_max", Op: config.AggregationMax, Metric: "requests_total"},
+			{Name: "requests_avg", Op: config.AggregationAvg, Metric: "requests_total", By: []string{"code"}},
+			{Name: "requests_series", Op: config.AggregationCount, Metric: "requests_total", By: []string{"exporter_name"}},
+			// Aggregations can aggregate the results of earlier ones.
+			{Name: "requests_codes", Op: config.AggregationCount, Metric: "requests_by_code_total", DropSource: true},
+			{Name: "missing_total", Op: config.AggregationSum, Metric: "missing"},
+		},
+	}, nil)
+	c.Assert(err, IsNil)
+
+	mfs, err := endpoint.scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	families, names := familiesByName(mfs)
+	c.Check(names, DeepEquals, []string{
+		"requests_all_total", "requests_avg", "requests_codes", "requests_max", "requests_min",
+		"requests_series", "requests_total", backendUpMetricName,
+	})
+
+	c.Check(families["requests_all_total"].GetType(), Equals, dto.MetricType_COUNTER)
+	c.Check(families["requests_all_total"].GetHelp(), Equals, "All requests.")
+	c.Check(familyValues(mfs, "requests_all_total", ""), DeepEquals, map[string]float64{"{}": 41})
+	c.Check(familyValues(mfs, "requests_min", ""), DeepEquals, map[string]float64{
+		`{exporter_name="worker1"}`: 1,
+		`{exporter_name="worker2"}`: 30,
+	})
+	c.Check(families["requests_max"].GetType(), Equals, dto.MetricType_GAUGE)
+	c.Check(familyValues(mfs, "requests_max", ""), DeepEquals, map[string]float64{"{}": 30})
+	c.Check(familyValues(mfs, "requests_avg", ""), DeepEquals, map[string]float64{
+		`{code="200"}`: 20,
+		`{code="500"}`: 1,
+	})
+	c.Check(familyValues(mfs, "requests_series", ""), DeepEquals, map[string]float64{
+		`{exporter_name="worker1"}`: 2,
+		`{exporter_name="worker2"}`: 1,
+	})
+	c.Check(familyValues(mfs, "requests_codes", ""), DeepEquals, map[string]float64{"{}": 2})
+	// The source series are kept unless dropped.
+	c.Check(families["requests_total"].GetMetric(), HasLen, 3)
+}
+
+func (s *AggregationSuite) TestAggregationNaN(c *C) {
+	aggregations, err := newAggregations([]*config.AggregationConfig{
+		{Name: "value_min", Op: config.AggregationMin, Metric: "value"},
+		{Name: "value_max", Op: config.AggregationMax, Metric: "value"},
+	})
+	c.Assert(err, IsNil)
+
+	source := newGaugeFamily("value", "", math.NaN())
+	source.Metric = append(source.Metric, newValueMetric(dto.MetricType_GAUGE, nil, 2))
+	mfs := applyAggregations(aggregations, []*dto.MetricFamily{source})
+	c.Check(familyValues(mfs, "value_min", ""), DeepEquals, map[string]float64{"{}": 2})
+	c.Check(familyValues(mfs, "value_max", ""), DeepEquals, map[string]float64{"{}": 2})
+}
+
+func (s *AggregationSuite) TestAggregationKeepsUnaggregatedSource(c *C) {
+	aggregations, err := newAggregations([]*config.AggregationConfig{
+		{Name: "other", Op: config.AggregationSum, Metric: "value", DropSource: true},
+	})
+	c.Assert(err, IsNil)
+
+	// The source is not dropped if its result is already a metric, and so not aggregated.
+	source := newGaugeFamily("value", "", 1)
+	other := newGaugeFamily("other", "", 2)
+	mfs := applyAggregations(aggregations, []*dto.MetricFamily{source, other})
+	_, names := familiesByName(mfs)
+	c.Check(names, DeepEquals, []string{"other", "value"})
+}
+
+func (s *AggregationSuite) TestInvalidAggregations(c *C) {
+	for _, aggregationConfig := range []*config.AggregationConfig{
+		{Op: config.AggregationSum, Metric: "a"},
+		{Name: "b", Op: config.AggregationSum},
+		{Name: "a", Op: config.AggregationSum, Metric: "a"},
+		{Name: "b", Op: "median", Metric: "a"},
+		{Name: "b", Op: config.AggregationSum, Metric: "a", By: []string{"x"}, Without: []string{"y"}},
+		{Name: "b", Op: config.AggregationSum, Metric: "a", By: []string{"not-a-label"}},
+	} {
+		_, err := newAggregations([]*config.AggregationConfig{aggregationConfig})
+		c.Check(errors.Is(err, ErrAggregationInvalid), Equals, true, Commentf("config: %+v, got error: %v", aggregationConfig, err))
+	}
+
+	_, err := newAggregations([]*config.AggregationConfig{
+		{Name: "b", Op: config.AggregationSum, Metric: "a"},
+		{Name: "b", Op: config.AggregationMax, Metric: "a"},
+	})
+	c.Check(errors.Is(err, ErrAggregationInvalid), Equals, true)
+}
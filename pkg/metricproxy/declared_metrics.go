@@ -0,0 +1,92 @@
+package metricproxy
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// declaredMetrics checks the metrics declared in the configuration of an exporter by name.
+// Declarations with the same name are returned as one family, so must agree on its type
+// and help.
+type declaredMetrics map[string]declaredMetric
+
+type declaredMetric struct {
+	metricType dto.MetricType
+	help       string
+}
+
+// check returns invalidErr if the name or label names of a declared metric are invalid, or
+// if it conflicts with an earlier declaration with the same name.
+func (dm declaredMetrics) check(invalidErr error, name string, metricType config.MetricType, help string, labelNames []string) error {
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return errors.Wrapf(invalidErr, "invalid metric name: %q", name)
+	}
+
+	seen := make(map[string]struct{}, len(labelNames))
+	for _, labelName := range labelNames {
+		if !model.LabelName(labelName).IsValid() || labelName == model.MetricNameLabel {
+			return errors.Wrapf(invalidErr, "%s: invalid label name: %q", name, labelName)
+		}
+		if _, found := seen[labelName]; found {
+			return errors.Wrapf(invalidErr, "%s: label %s is specified twice", name, labelName)
+		}
+		seen[labelName] = struct{}{}
+	}
+
+	declared := declaredMetric{metricType: protoMetricType(metricType), help: help}
+	if existing, found := dm[name]; found && existing != declared {
+		return errors.Wrapf(invalidErr, "%s: declared with different types or help", name)
+	}
+	dm[name] = declared
+	return nil
+}
+
+// protoMetricType returns the protobuf type of a declared metric. Metrics are gauges by default.
+func protoMetricType(metricType config.MetricType) dto.MetricType {
+	switch metricType {
+	case config.MetricTypeCounter:
+		return dto.MetricType_COUNTER
+	case config.MetricTypeUntyped:
+		return dto.MetricType_UNTYPED
+	default:
+		return dto.MetricType_GAUGE
+	}
+}
+
+// newValueMetric returns a metric with a single value of the given type.
+func newValueMetric(metricType dto.MetricType, labels []*dto.LabelPair, value float64) *dto.Metric {
+	metric := &dto.Metric{Label: labels}
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		metric.Counter = &dto.Counter{Value: proto.Float64(value)}
+	case dto.MetricType_UNTYPED:
+		metric.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+	default:
+		metric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+	}
+	return metric
+}
+
+// appendMetric appends a metric to the family with the given name in mfs, creating the
+// family if it is not in families yet. It returns the extended mfs.
+func appendMetric(mfs []*dto.MetricFamily, families map[string]*dto.MetricFamily, name string,
+	metricType dto.MetricType, help string, metric *dto.Metric) []*dto.MetricFamily {
+	mf, found := families[name]
+	if !found {
+		mf = &dto.MetricFamily{
+			Name: proto.String(name),
+			Type: metricType.Enum(),
+		}
+		if help != "" {
+			mf.Help = proto.String(help)
+		}
+		families[name] = mf
+		mfs = append(mfs, mf)
+	}
+	mf.Metric = append(mf.Metric, metric)
+	return mfs
+}
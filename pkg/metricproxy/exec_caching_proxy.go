@@ -0,0 +1,460 @@
+package metricproxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// ensure execCachingProxy implements MetricProxy.
+var _ MetricProxy = &execCachingProxy{}
+
+const execCacheAgeMetricName = "reverse_exporter_exec_cache_age_seconds"
+
+// execCacheAgeLabel is added with the age of the cached result in whole seconds when the
+// cache age mode is config.CacheAgeLabel.
+const execCacheAgeLabel = "cache_age_seconds"
+
+var (
+	// ErrExecTimeout is returned when a script does not exit within its timeout.
+	ErrExecTimeout = errors.New("metric script did not exit before timeout")
+	// ErrExecCachedNoResult is returned when no successful execution has cached a result.
+	ErrExecCachedNoResult = errors.New("no successful execution of metric script")
+	// ErrExecCachedResultStale is returned when the cached result is older than its max age.
+	ErrExecCachedResultStale = errors.New("cached metric script result is stale")
+)
+
+// intervalSchedule implements cron.Schedule for a fixed execution interval.
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+// Next implements cron.Schedule.
+func (is intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(is.interval)
+}
+
+// execCachingProxy implements a caching proxy for metrics produced by a periodically executed script.
+type execCachingProxy struct {
+	commandPath string
+	arguments   []string
+	schedule    cron.Schedule
+	jitter      time.Duration
+	runOnStart  bool
+	rand        *rand.Rand
+	execTimeout time.Duration
+	maxBytes    uint64
+	// sandbox is the privileges and limits the script is executed with
+	sandbox *execSandbox
+
+	maxAge         time.Duration
+	staleAction    config.StaleAction
+	cacheAge       config.CacheAgeMode
+	stderrLogLevel zapcore.Level
+	timestamps     config.TimestampMode
+
+	// schedulerMtx guards the scheduling state below
+	schedulerMtx *sync.Mutex
+	running      bool
+	nextExec     time.Time
+	lastExec     time.Time
+	skippedExecs uint64
+	// execDoneCh is closed once the running execution has finished
+	execDoneCh chan struct{}
+
+	// stopCh is closed to stop the scheduler and kill the running script
+	stopCh   chan struct{}
+	stopOnce *sync.Once
+
+	// status records the result of the last execution
+	status *execStatus
+
+	// lastResult is the result of the last successful execution, produced at lastSuccess
+	lastResult    []*dto.MetricFamily
+	lastSuccess   time.Time
+	lastErr       error
+	resultReadyCh chan struct{}
+	lastResultMtx *sync.RWMutex
+
+	log *zap.Logger
+}
+
+// ExecCachingStatus is the debugging view of a cached exec exporter.
+type ExecCachingStatus struct {
+	ExecStatus
+	Running      bool       `json:"running"`
+	NextExec     time.Time  `json:"next_exec"`
+	LastExec     *time.Time `json:"last_exec,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	SkippedExecs uint64     `json:"skipped_execs"`
+}
+
+// newExecCachingProxy initializes a new execCachingProxy which executes the script in
+// sandbox. The script is not executed until the proxy is started.
+func newExecCachingProxy(config *config.ExecCachingExporterConfig, sandbox *execSandbox) *execCachingProxy {
+	newProxy := execCachingProxy{
+		commandPath: config.Command,
+		arguments:   config.Args,
+		schedule:    intervalSchedule{interval: time.Duration(config.ExecInterval)},
+		jitter:      time.Duration(config.ExecJitter),
+		runOnStart:  config.RunOnStart == nil || *config.RunOnStart,
+		// Seed explicitly so replicas don't all share the same jitter.
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
+		execTimeout: time.Duration(config.ExecTimeout),
+		maxBytes:    config.MaxBytes,
+		sandbox:     sandbox,
+
+		maxAge:         time.Duration(config.MaxAge),
+		staleAction:    config.StaleAction,
+		cacheAge:       config.CacheAge,
+		stderrLogLevel: config.StderrLogLevel,
+		timestamps:     config.Timestamps,
+
+		schedulerMtx: &sync.Mutex{},
+		status:       newExecStatus(),
+		stopCh:       make(chan struct{}),
+		stopOnce:     &sync.Once{},
+
+		lastResult:    make([]*dto.MetricFamily, 0),
+		resultReadyCh: make(chan struct{}),
+		lastResultMtx: &sync.RWMutex{},
+
+		log: zap.L().With(zap.String("name", config.Name)),
+	}
+
+	if config.ExecSchedule.Schedule != nil {
+		newProxy.schedule = config.ExecSchedule.Schedule
+	}
+
+	return &newProxy
+}
+
+// start implements starter by starting the scheduler.
+func (ecp *execCachingProxy) start() {
+	go ecp.scheduler(ecp.resultReadyCh)
+}
+
+// stop implements stopper. The scheduler is stopped, and a running script killed and waited for.
+func (ecp *execCachingProxy) stop() {
+	ecp.stopOnce.Do(func() { close(ecp.stopCh) })
+
+	// The scheduler does not start executions once stopCh is closed.
+	ecp.schedulerMtx.Lock()
+	execDoneCh := ecp.execDoneCh
+	ecp.schedulerMtx.Unlock()
+
+	if execDoneCh != nil {
+		<-execDoneCh
+	}
+}
+
+// scheduler starts executions of the script according to the schedule until the proxy is
+// stopped. Executions are skipped if the previous execution is still running.
+func (ecp *execCachingProxy) scheduler(rdyCh chan<- struct{}) {
+	ecp.log.Debug("ExecCachingProxy started")
+
+	// rdyChOnce ensures the ready channel is only closed once.
+	rdyChOnce := new(sync.Once)
+
+	nextExec := time.Now()
+	if !ecp.runOnStart {
+		nextExec = ecp.schedule.Next(nextExec)
+	}
+
+	for {
+		execAt := nextExec
+		if ecp.jitter > 0 {
+			execAt = execAt.Add(time.Duration(ecp.rand.Int63n(int64(ecp.jitter))))
+		}
+
+		ecp.schedulerMtx.Lock()
+		ecp.nextExec = execAt
+		ecp.schedulerMtx.Unlock()
+
+		ecp.log.Debug("Waiting for next execution", zap.Time("next_exec", execAt))
+		select {
+		case <-time.After(time.Until(execAt)):
+		case <-ecp.stopCh:
+			ecp.log.Debug("ExecCachingProxy stopped")
+			return
+		}
+
+		ecp.schedulerMtx.Lock()
+		select {
+		case <-ecp.stopCh:
+			ecp.schedulerMtx.Unlock()
+			ecp.log.Debug("ExecCachingProxy stopped")
+			return
+		default:
+		}
+		if ecp.running {
+			ecp.skippedExecs++
+			ecp.log.Warn("Skipping execution of metric script since the previous execution is still running",
+				zap.Time("last_exec", ecp.lastExec), zap.Uint64("skipped_execs", ecp.skippedExecs))
+		} else {
+			ecp.running = true
+			ecp.lastExec = time.Now()
+			ecp.execDoneCh = make(chan struct{})
+			go ecp.execer(rdyCh, rdyChOnce, ecp.execDoneCh)
+		}
+		ecp.schedulerMtx.Unlock()
+
+		// Schedule from the nominal execution time so jitter does not accumulate, but never
+		// schedule executions in the past (i.e. after a suspend).
+		nextExec = ecp.schedule.Next(nextExec)
+		if now := time.Now(); nextExec.Before(now) {
+			nextExec = ecp.schedule.Next(now)
+		}
+	}
+}
+
+// execer executes the script once and caches the result if it succeeds. The ready
+// channel is closed after the first execution finishes, whether or not it succeeded, and
+// the done channel after this one has.
+func (ecp *execCachingProxy) execer(rdyCh chan<- struct{}, rdyChOnce *sync.Once, doneCh chan<- struct{}) {
+	defer func() {
+		ecp.schedulerMtx.Lock()
+		ecp.running = false
+		ecp.schedulerMtx.Unlock()
+		close(doneCh)
+	}()
+
+	ecp.log.Debug("Executing metric script on schedule")
+
+	started := time.Now()
+	mfs, err := ecp.doExec(started)
+
+	ecp.lastResultMtx.Lock()
+	ecp.lastErr = err
+	if err == nil {
+		// Cache new metrics, timestamped with when they were produced if requested.
+		ecp.lastSuccess = time.Now()
+		if ecp.timestamps == config.TimestampsProductionTime {
+			setTimestamps(mfs, ecp.lastSuccess)
+		}
+		ecp.lastResult = mfs
+	}
+	rdyChOnce.Do(func() { close(rdyCh) })
+	ecp.lastResultMtx.Unlock()
+}
+
+// doExec runs the script, waits for it to exit and records the outcome.
+func (ecp *execCachingProxy) doExec(started time.Time) ([]*dto.MetricFamily, error) {
+	timeout := ecp.execTimeout
+	if timeout == 0 {
+		timeout = schedulePeriod(ecp.schedule, started)
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+	defer cancelFn()
+
+	cmd := ecp.sandbox.command(context.Background(), ecp.commandPath, ecp.arguments...)
+	setExecProcessGroup(cmd)
+	stderr := newTailBuffer(execStderrTailBytes)
+	cmd.Stderr = stderr
+
+	outRdr, perr := cmd.StdoutPipe()
+	if perr != nil {
+		ecp.log.Error("Error opening stdout pipe to metric script", zap.Error(perr))
+		return nil, perr
+	}
+
+	if err := cmd.Start(); err != nil {
+		ecp.status.record(started, 0, -1, "", err)
+		ecp.log.Error("Error starting metric script", zap.Error(err))
+		return nil, err
+	}
+
+	// Kill the script if it does not exit before the context is done or the proxy is stopped.
+	// Its whole process group is killed, since children left running would keep stdout open.
+	exitedCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ecp.stopCh:
+		case <-exitedCh:
+			return
+		}
+		if err := killExecProcessGroup(cmd); err != nil {
+			ecp.log.Debug("Error killing metric script", zap.Error(err))
+		}
+	}()
+
+	mfs, derr := decodeMetrics(newMaxBytesReader(outRdr, ecp.maxBytes), expfmt.FmtText)
+	if errors.Is(derr, ErrMaxBytesExceeded) {
+		// Stop the script rather than waiting for it to finish writing.
+		cancelFn()
+	} else if _, err := io.Copy(ioutil.Discard, outRdr); err != nil {
+		// Drain any remaining output so the script can't block on a full pipe.
+		ecp.log.Debug("Error draining output of metric script", zap.Error(err))
+	}
+
+	werr := cmd.Wait()
+	close(exitedCh)
+	duration := time.Since(started)
+
+	logExecStderr(ecp.log, ecp.stderrLogLevel, stderr.String())
+
+	stopped := false
+	select {
+	case <-ecp.stopCh:
+		stopped = true
+	default:
+	}
+
+	var err error
+	switch {
+	case stopped && werr != nil:
+		err = werr
+		ecp.log.Info("Metric script killed since the exporter was stopped")
+	case errors.Is(derr, ErrMaxBytesExceeded):
+		err = derr
+		ecp.log.Error("Metric script output is too large - killed it", zap.Error(derr))
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = errors.Wrapf(ErrExecTimeout, "timeout %s", timeout)
+		ecp.log.Error("Metric script killed after timeout", zap.Duration("timeout", timeout))
+	case werr != nil:
+		err = werr
+		ecp.log.Error("Metric script exited with error", zap.Error(werr),
+			zap.Int("exit_code", cmd.ProcessState.ExitCode()), zap.Duration("duration", duration))
+	case derr != nil:
+		err = derr
+		ecp.log.Error("Metric decoding from script output failed", zap.Error(derr))
+	}
+
+	ecp.status.record(started, duration, cmd.ProcessState.ExitCode(), stderr.String(), err)
+	return mfs, err
+}
+
+// schedulePeriod returns the time between the next two executions of schedule after t. It
+// is not the time until the next execution, which is short for executions started just
+// before it (i.e. on startup or with jitter).
+func schedulePeriod(schedule cron.Schedule, t time.Time) time.Duration {
+	next := schedule.Next(t)
+	return schedule.Next(next).Sub(next)
+}
+
+// firstExecStarted returns true once the first execution has started, or if it is started
+// when the proxy is.
+func (ecp *execCachingProxy) firstExecStarted() bool {
+	if ecp.runOnStart {
+		return true
+	}
+	ecp.schedulerMtx.Lock()
+	defer ecp.schedulerMtx.Unlock()
+	return !ecp.lastExec.IsZero()
+}
+
+// cacheAgeSeconds returns the age of the cached result.
+func (ecp *execCachingProxy) cacheAgeSeconds() (float64, bool) {
+	ecp.lastResultMtx.RLock()
+	defer ecp.lastResultMtx.RUnlock()
+	if ecp.lastSuccess.IsZero() {
+		return 0, false
+	}
+	return time.Since(ecp.lastSuccess).Seconds(), true
+}
+
+// Status implements StatusReporter.
+func (ecp *execCachingProxy) Status() interface{} {
+	status := ExecCachingStatus{
+		ExecStatus: ecp.status.Status(),
+	}
+
+	ecp.lastResultMtx.RLock()
+	if !ecp.lastSuccess.IsZero() {
+		lastSuccess := ecp.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+	ecp.lastResultMtx.RUnlock()
+
+	ecp.schedulerMtx.Lock()
+	defer ecp.schedulerMtx.Unlock()
+
+	status.Running = ecp.running
+	status.NextExec = ecp.nextExec
+	status.SkippedExecs = ecp.skippedExecs
+	if !ecp.lastExec.IsZero() {
+		lastExec := ecp.lastExec
+		status.LastExec = &lastExec
+	}
+	return status
+}
+
+// statusMetrics implements statusMetricsProvider.
+func (ecp *execCachingProxy) statusMetrics() []*dto.MetricFamily {
+	mfs := ecp.status.statusMetrics()
+	if ecp.cacheAge == config.CacheAgeGauge {
+		if age, ok := ecp.cacheAgeSeconds(); ok {
+			mfs = append(mfs, newGaugeFamily(execCacheAgeMetricName, "Age of the cached result of the exporter script.", age))
+		}
+	}
+	return mfs
+}
+
+// Scrape retrieves the cached metrics. Scrapes wait for the first execution once it has
+// started, but fail at once while it is still scheduled, which may be hours away.
+func (ecp *execCachingProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	select {
+	case <-ecp.resultReadyCh:
+	default:
+		if !ecp.firstExecStarted() {
+			return nil, errors.Wrap(ErrExecCachedNoResult, "metric script has not been executed yet")
+		}
+	}
+
+	select {
+	case <-ecp.resultReadyCh:
+		ecp.log.Debug("Returning cached results of scrape")
+	case <-ctx.Done():
+		// context cancelled before scrape finished
+		return []*dto.MetricFamily{}, ErrScrapeTimeoutBeforeExecFinished
+	}
+
+	ecp.lastResultMtx.RLock()
+	defer ecp.lastResultMtx.RUnlock()
+
+	if ecp.lastSuccess.IsZero() {
+		return nil, errors.Wrapf(ErrExecCachedNoResult, "last error: %v", ecp.lastErr)
+	}
+
+	age := time.Since(ecp.lastSuccess)
+	stale := ecp.maxAge > 0 && age > ecp.maxAge
+	if stale && ecp.staleAction != config.StaleActionLabel {
+		ecp.log.Debug("Cached result is stale", zap.Duration("age", age), zap.Duration("max_age", ecp.maxAge))
+		if ecp.staleAction == config.StaleActionDrop {
+			return []*dto.MetricFamily{}, nil
+		}
+		return nil, errors.Wrapf(ErrExecCachedResultStale, "age %s, last error: %v", age, ecp.lastErr)
+	}
+
+	// Copy the cached result since it is rewritten by later proxy stages.
+	retMetrics := cloneMetricFamilies(ecp.lastResult)
+
+	labels := model.LabelSet{}
+	if stale {
+		labels[staleLabel] = "true"
+	}
+	if ecp.cacheAge == config.CacheAgeLabel {
+		labels[execCacheAgeLabel] = model.LabelValue(strconv.FormatInt(int64(age.Seconds()), 10))
+	}
+	if len(labels) > 0 {
+		rewriteMetrics(labels, retMetrics)
+	}
+
+	return retMetrics, nil
+}
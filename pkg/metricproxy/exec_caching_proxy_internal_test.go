@@ -3,6 +3,7 @@ package metricproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -67,8 +68,9 @@ func (s *ExecCachingProxySuite) TestExecCachingProxy(c *C) {
 	exporterConfig := s.initProxyScript(c, timestampingExecProxyScript)
 	defer os.Remove(exporterConfig.Command)
 
-	execProxy := newExecCachingProxy(&exporterConfig)
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
 	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
 	c.Check(execProxy.log, Not(IsNil))
 	c.Check(execProxy.arguments, DeepEquals, exporterConfig.Args)
 	c.Check(execProxy.commandPath, Equals, exporterConfig.Command)
@@ -114,3 +116,328 @@ func (s *ExecCachingProxySuite) TestExecCachingProxy(c *C) {
 	c.Assert(timeVals[0], Equals, timeVals[1], Commentf("time vals collected under interval should be identical"))
 	c.Assert(timeVals[2], Not(Equals), timeVals[1], Commentf("third time val should have executed later"))
 }
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyCronSchedule(c *C) {
+	exporterConfig := s.initProxyScript(c, timestampingExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	runOnStart := false
+	exporterConfig.ExecInterval = 0
+	exporterConfig.RunOnStart = &runOnStart
+	c.Assert(exporterConfig.ExecSchedule.UnmarshalText([]byte("@every 2s")), IsNil)
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+
+	// Without run_on_start nothing should be available until the first scheduled run.
+	<-time.After(time.Millisecond * 500)
+	_, err := execProxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrExecCachedNoResult), Equals, true, Commentf("got error: %v", err))
+
+	status, ok := execProxy.Status().(ExecCachingStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.NextExec.After(time.Now()), Equals, true, Commentf("next execution should be in the future"))
+
+	<-time.After(time.Until(status.NextExec) + time.Millisecond*200)
+	mfs, err := execProxy.Scrape(context.Background(), nil)
+	c.Check(err, IsNil)
+	c.Check(len(mfs), Equals, timestampingExecProxyScriptNumMetrics)
+}
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyDoesNotWaitForSchedule(c *C) {
+	exporterConfig := s.initProxyScript(c, timestampingExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	runOnStart := false
+	exporterConfig.ExecInterval = 0
+	exporterConfig.RunOnStart = &runOnStart
+	c.Assert(exporterConfig.ExecSchedule.UnmarshalText([]byte("0 3 * * *")), IsNil)
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+	defer execProxy.stop()
+
+	// Scrapes fail at once rather than waiting hours for the first scheduled run.
+	scrapeStarted := time.Now()
+	_, err := execProxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrExecCachedNoResult), Equals, true, Commentf("got error: %v", err))
+	c.Check(time.Since(scrapeStarted) < time.Second, Equals, true)
+}
+
+func (s *ExecCachingProxySuite) TestSchedulePeriod(c *C) {
+	var schedule config.CronSchedule
+	c.Assert(schedule.UnmarshalText([]byte("0 * * * *")), IsNil)
+
+	// Executions started just before the next one still get the whole period.
+	started := time.Date(2020, 1, 1, 10, 59, 59, 0, time.UTC)
+	c.Check(schedulePeriod(schedule, started), Equals, time.Hour)
+	c.Check(schedulePeriod(intervalSchedule{interval: time.Minute}, started), Equals, time.Minute)
+}
+
+const slowExecProxyScript = `#!/bin/bash
+sleep 2
+cat << EOF
+test_metric_time $(date +%s)
+EOF
+`
+
+func (s *ExecCachingProxySuite) TestExecCachingProxySkipsOverlappingRuns(c *C) {
+	exporterConfig := s.initProxyScript(c, slowExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.ExecInterval = model.Duration(time.Millisecond * 500)
+	exporterConfig.ExecTimeout = model.Duration(time.Second * 5)
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+
+	mfs, err := execProxy.Scrape(context.Background(), nil)
+	c.Check(err, IsNil)
+	c.Check(len(mfs), Equals, timestampingExecProxyScriptNumMetrics)
+
+	status, ok := execProxy.Status().(ExecCachingStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.SkippedExecs > 0, Equals, true, Commentf("overlapping executions should be skipped"))
+	c.Check(status.LastExec, Not(IsNil))
+}
+
+// flakyExecProxyScript succeeds on its first execution and fails on all later executions.
+const flakyExecProxyScript = `#!/bin/bash
+if [ -e "$0.ran" ]; then
+	echo "failed" >&2
+	exit 1
+fi
+touch "$0.ran"
+cat << EOF
+test_metric_time $(date +%s)
+EOF
+`
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyKeepsLastGoodResult(c *C) {
+	exporterConfig := s.initProxyScript(c, flakyExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+	defer os.Remove(exporterConfig.Command + ".ran")
+
+	exporterConfig.ExecInterval = model.Duration(time.Millisecond * 200)
+	exporterConfig.MaxAge = model.Duration(time.Second)
+	exporterConfig.CacheAge = config.CacheAgeGauge
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+
+	ctx := context.Background()
+	mfs, err := execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Check(len(mfs), Equals, timestampingExecProxyScriptNumMetrics)
+
+	// Later executions fail, but the last good result is served until it is stale.
+	<-time.After(time.Millisecond * 500)
+	mfs, err = execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Check(len(mfs), Equals, timestampingExecProxyScriptNumMetrics)
+
+	status, ok := execProxy.Status().(ExecCachingStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.ExitCode, Equals, 1)
+	c.Check(status.Stderr, Equals, "failed\n")
+	c.Check(status.LastSuccess, Not(IsNil))
+
+	statusMetrics := execProxy.statusMetrics()
+	c.Assert(statusMetrics, HasLen, 3)
+	c.Check(statusMetrics[2].GetName(), Equals, execCacheAgeMetricName)
+
+	<-time.After(time.Second)
+	_, err = execProxy.Scrape(ctx, nil)
+	c.Check(errors.Is(err, ErrExecCachedResultStale), Equals, true, Commentf("got error: %v", err))
+}
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyStaleDrop(c *C) {
+	exporterConfig := s.initProxyScript(c, flakyExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+	defer os.Remove(exporterConfig.Command + ".ran")
+
+	exporterConfig.ExecInterval = model.Duration(time.Millisecond * 200)
+	exporterConfig.MaxAge = model.Duration(time.Millisecond * 500)
+	exporterConfig.StaleAction = config.StaleActionDrop
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+
+	ctx := context.Background()
+	mfs, err := execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(mfs), Equals, timestampingExecProxyScriptNumMetrics)
+
+	<-time.After(time.Second)
+	mfs, err = execProxy.Scrape(ctx, nil)
+	c.Check(err, IsNil)
+	c.Check(mfs, HasLen, 0, Commentf("stale metrics should be dropped"))
+}
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyCacheAgeLabel(c *C) {
+	exporterConfig := s.initProxyScript(c, timestampingExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.ExecInterval = model.Duration(time.Hour)
+	exporterConfig.CacheAge = config.CacheAgeLabel
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+	defer execProxy.stop()
+
+	cacheAges := func() []string {
+		mfs, err := execProxy.Scrape(context.Background(), nil)
+		c.Assert(err, IsNil)
+		c.Assert(len(mfs), Equals, timestampingExecProxyScriptNumMetrics)
+		ages := []string{}
+		for _, mf := range mfs {
+			for _, metric := range mf.GetMetric() {
+				for _, lp := range metric.GetLabel() {
+					if lp.GetName() == execCacheAgeLabel {
+						ages = append(ages, lp.GetValue())
+					}
+				}
+			}
+		}
+		return ages
+	}
+
+	c.Check(cacheAges(), DeepEquals, []string{"0"})
+	<-time.After(time.Millisecond * 1100)
+	c.Check(cacheAges(), DeepEquals, []string{"1"}, Commentf("the label should be the age in whole seconds"))
+	c.Check(execProxy.statusMetrics(), HasLen, 2, Commentf("the age is not also exposed as a gauge"))
+}
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyFailsWithoutResult(c *C) {
+	exporterConfig := s.initProxyScript(c, brokenExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+
+	// The scrape should fail as soon as the first execution fails.
+	tctx, cancelFn := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancelFn()
+	_, err := execProxy.Scrape(tctx, nil)
+	c.Check(errors.Is(err, ErrExecCachedNoResult), Equals, true, Commentf("got error: %v", err))
+}
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyStartsWithEndpoint(c *C) {
+	exporterConfig := s.initProxyScript(c, flakyExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+	defer os.Remove(exporterConfig.Command + ".ran")
+
+	duplicateConfig := exporterConfig
+	reverseExporter := &config.ReverseExporterConfig{
+		Path: "/metrics",
+		Exporters: &config.ExportersConfig{
+			ExecCachedExporters: []*config.ExecCachingExporterConfig{&exporterConfig, &duplicateConfig},
+		},
+	}
+
+	// A path rejected after the exporter was configured never executes the script.
+	_, err := NewMetricReverseProxy(reverseExporter, map[string]*ReverseProxyEndpoint{})
+	c.Assert(errors.Is(err, ErrExporterNameUsedTwice), Equals, true, Commentf("got error: %v", err))
+
+	reverseExporter.Exporters.ExecCachedExporters = reverseExporter.Exporters.ExecCachedExporters[:1]
+	endpoint, err := NewMetricReverseProxy(reverseExporter, map[string]*ReverseProxyEndpoint{})
+	c.Assert(err, IsNil)
+
+	<-time.After(time.Millisecond * 500)
+	_, err = os.Stat(exporterConfig.Command + ".ran")
+	c.Check(os.IsNotExist(err), Equals, true, Commentf("script executed before the endpoint was started"))
+
+	endpoint.Start()
+	mfs, err := endpoint.backends[0].Scrape(context.Background(), nil)
+	c.Check(err, IsNil)
+	c.Check(mfs, Not(HasLen), 0)
+	_, err = os.Stat(exporterConfig.Command + ".ran")
+	c.Check(err, IsNil)
+}
+
+// forkingExecProxyScript leaves a child running which holds stdout open.
+const forkingExecProxyScript = `#!/bin/bash
+sleep 60 | cat
+`
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyTimeoutKillsChildren(c *C) {
+	exporterConfig := s.initProxyScript(c, forkingExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.ExecInterval = model.Duration(time.Hour)
+	exporterConfig.ExecTimeout = model.Duration(time.Millisecond * 500)
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+
+	tctx, cancelFn := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancelFn()
+	_, err := execProxy.Scrape(tctx, nil)
+	c.Check(errors.Is(err, ErrExecCachedNoResult), Equals, true, Commentf("got error: %v", err))
+
+	status, ok := execProxy.Status().(ExecCachingStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.Running, Equals, false)
+	c.Check(status.Error, Matches, ".*"+ErrExecTimeout.Error()+".*")
+}
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyStop(c *C) {
+	exporterConfig := s.initProxyScript(c, forkingExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.ExecInterval = model.Duration(time.Hour)
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+
+	<-time.After(time.Millisecond * 200)
+	status, ok := execProxy.Status().(ExecCachingStatus)
+	c.Assert(ok, Equals, true)
+	c.Assert(status.Running, Equals, true)
+
+	// Stopping kills the running script and waits for it.
+	stopStarted := time.Now()
+	execProxy.stop()
+	c.Check(time.Since(stopStarted) < time.Second*5, Equals, true)
+	status, ok = execProxy.Status().(ExecCachingStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.Running, Equals, false)
+}
+
+func (s *ExecCachingProxySuite) TestExecCachingProxyProductionTimestamps(c *C) {
+	exporterConfig := s.initProxyScript(c, timestampingExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.ExecInterval = model.Duration(time.Hour)
+	exporterConfig.Timestamps = config.TimestampsProductionTime
+
+	execProxy := newExecCachingProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+
+	ctx := context.Background()
+	mfs, err := execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(mfs), Equals, timestampingExecProxyScriptNumMetrics)
+	produced := mfs[0].GetMetric()[0].GetTimestampMs()
+
+	// The cached result keeps the time it was produced at, rather than when it is served.
+	<-time.After(time.Millisecond * 100)
+	mfs, err = execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs[0].GetMetric()[0].GetTimestampMs(), Equals, produced)
+
+	status, ok := execProxy.Status().(ExecCachingStatus)
+	c.Assert(ok, Equals, true)
+	c.Assert(status.LastSuccess, NotNil)
+	c.Check(produced, Equals, status.LastSuccess.UnixNano()/int64(time.Millisecond))
+}
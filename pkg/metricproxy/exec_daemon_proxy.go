@@ -0,0 +1,444 @@
+package metricproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// ensure execDaemonProxy implements MetricProxy.
+var _ MetricProxy = &execDaemonProxy{}
+
+const (
+	// execDaemonBlockTerminator is the line which ends a complete block of metrics written
+	// by a daemon script. It matches the OpenMetrics terminator.
+	execDaemonBlockTerminator = "# EOF"
+	// defaultExecDaemonMaxBlockBytes is the largest block of metrics a daemon script may write
+	// by default.
+	defaultExecDaemonMaxBlockBytes = 16 * 1024 * 1024
+
+	defaultExecDaemonRestartBackoff    = time.Second
+	defaultExecDaemonMaxRestartBackoff = time.Minute
+
+	execDaemonRestartsMetricName = "reverse_exporter_exec_daemon_restarts_total"
+)
+
+var (
+	// ErrExecDaemonExited is recorded when a daemon script exits successfully, since it is
+	// expected to run forever.
+	ErrExecDaemonExited = errors.New("metric daemon script exited")
+	// ErrExecDaemonNoResult is returned when the daemon script has not yet written a complete
+	// block of metrics.
+	ErrExecDaemonNoResult = errors.New("no complete block of metrics from metric daemon script")
+)
+
+// execDaemonProxy implements a proxy for metrics produced by a supervised long-running script.
+// The script writes complete blocks of metrics terminated by "# EOF" to stdout, and the last
+// complete block is served.
+type execDaemonProxy struct {
+	commandPath       string
+	arguments         []string
+	restartBackoff    time.Duration
+	maxRestartBackoff time.Duration
+	maxBlockBytes     uint64
+	// sandbox is the privileges and limits the script is executed with
+	sandbox *execSandbox
+
+	maxAge         time.Duration
+	staleAction    config.StaleAction
+	stderrLogLevel zapcore.Level
+	timestamps     config.TimestampMode
+
+	// supervisorMtx guards the supervision state below
+	supervisorMtx *sync.Mutex
+	pid           int
+	started       time.Time
+	nextStart     time.Time
+	restarts      uint64
+
+	// status records the outcome of the last run of the script
+	status *execStatus
+
+	// stopCh is closed to stop the supervisor and kill the script
+	stopCh   chan struct{}
+	stopOnce *sync.Once
+	// doneCh is closed once the started supervisor has exited (guarded by supervisorMtx)
+	doneCh chan struct{}
+
+	// lastResult is the last complete block of metrics, received at lastBlock
+	lastResult    []*dto.MetricFamily
+	lastBlock     time.Time
+	lastErr       error
+	lastResultMtx *sync.RWMutex
+
+	log *zap.Logger
+}
+
+// ExecDaemonStatus is the debugging view of a daemon exec exporter.
+type ExecDaemonStatus struct {
+	ExecStatus
+	Running   bool       `json:"running"`
+	PID       int        `json:"pid,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	NextStart *time.Time `json:"next_start,omitempty"`
+	Restarts  uint64     `json:"restarts"`
+	LastBlock *time.Time `json:"last_block,omitempty"`
+}
+
+// newExecDaemonProxy initializes a new execDaemonProxy which executes the script in sandbox.
+// The script is not executed until the proxy is started.
+func newExecDaemonProxy(config *config.ExecDaemonExporterConfig, sandbox *execSandbox) *execDaemonProxy {
+	newProxy := execDaemonProxy{
+		commandPath:       config.Command,
+		arguments:         config.Args,
+		restartBackoff:    time.Duration(config.RestartBackoff),
+		maxRestartBackoff: time.Duration(config.MaxRestartBackoff),
+		maxBlockBytes:     config.MaxBytes,
+		sandbox:           sandbox,
+
+		maxAge:         time.Duration(config.MaxAge),
+		staleAction:    config.StaleAction,
+		stderrLogLevel: config.StderrLogLevel,
+		timestamps:     config.Timestamps,
+
+		supervisorMtx: &sync.Mutex{},
+		status:        newExecStatus(),
+		stopCh:        make(chan struct{}),
+		stopOnce:      &sync.Once{},
+
+		lastResult:    make([]*dto.MetricFamily, 0),
+		lastResultMtx: &sync.RWMutex{},
+
+		log: zap.L().With(zap.String("name", config.Name)),
+	}
+
+	if newProxy.restartBackoff == 0 {
+		newProxy.restartBackoff = defaultExecDaemonRestartBackoff
+	}
+	if newProxy.maxRestartBackoff == 0 {
+		newProxy.maxRestartBackoff = defaultExecDaemonMaxRestartBackoff
+	}
+	if newProxy.maxRestartBackoff < newProxy.restartBackoff {
+		newProxy.maxRestartBackoff = newProxy.restartBackoff
+	}
+	if newProxy.maxBlockBytes == 0 {
+		newProxy.maxBlockBytes = defaultExecDaemonMaxBlockBytes
+	}
+
+	return &newProxy
+}
+
+// start implements starter by starting the supervisor.
+func (edp *execDaemonProxy) start() {
+	doneCh := make(chan struct{})
+
+	edp.supervisorMtx.Lock()
+	edp.doneCh = doneCh
+	edp.supervisorMtx.Unlock()
+
+	go edp.supervisor(doneCh)
+}
+
+// stop implements stopper. The supervisor is stopped, and the script killed and waited for.
+func (edp *execDaemonProxy) stop() {
+	edp.stopOnce.Do(func() { close(edp.stopCh) })
+
+	edp.supervisorMtx.Lock()
+	doneCh := edp.doneCh
+	edp.supervisorMtx.Unlock()
+
+	if doneCh != nil {
+		<-doneCh
+	}
+}
+
+// supervisor runs the script and restarts it with exponential backoff whenever it exits,
+// until the proxy is stopped. The backoff is reset whenever a run of the script produced a
+// complete block of metrics.
+func (edp *execDaemonProxy) supervisor(doneCh chan<- struct{}) {
+	defer close(doneCh)
+	edp.log.Debug("ExecDaemonProxy started")
+
+	// The parent death signal of the script is sent when the thread which started it exits,
+	// rather than the process, so keep starting it from the same thread.
+	runtime.LockOSThread()
+
+	backoff := edp.restartBackoff
+	for {
+		produced := edp.run()
+		select {
+		case <-edp.stopCh:
+			edp.log.Debug("ExecDaemonProxy stopped")
+			return
+		default:
+		}
+		if produced {
+			backoff = edp.restartBackoff
+		}
+
+		nextStart := time.Now().Add(backoff)
+		edp.supervisorMtx.Lock()
+		edp.nextStart = nextStart
+		edp.supervisorMtx.Unlock()
+
+		edp.log.Warn("Metric daemon script exited - restarting after backoff", zap.Duration("backoff", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-edp.stopCh:
+			edp.log.Debug("ExecDaemonProxy stopped")
+			return
+		}
+
+		edp.supervisorMtx.Lock()
+		edp.restarts++
+		edp.supervisorMtx.Unlock()
+
+		backoff *= 2
+		if backoff > edp.maxRestartBackoff {
+			backoff = edp.maxRestartBackoff
+		}
+	}
+}
+
+// run starts the script and reads blocks of metrics from it until it exits or the proxy is
+// stopped. It returns true if at least one complete block was received.
+func (edp *execDaemonProxy) run() bool {
+	started := time.Now()
+
+	cmd := edp.sandbox.command(context.Background(), edp.commandPath, edp.arguments...)
+	setExecDaemonProcAttr(cmd)
+
+	outRdr, perr := cmd.StdoutPipe()
+	if perr != nil {
+		edp.log.Error("Error opening stdout pipe to metric daemon script", zap.Error(perr))
+		edp.status.record(started, 0, -1, "", perr)
+		return false
+	}
+	errRdr, perr := cmd.StderrPipe()
+	if perr != nil {
+		edp.log.Error("Error opening stderr pipe to metric daemon script", zap.Error(perr))
+		edp.status.record(started, 0, -1, "", perr)
+		return false
+	}
+
+	if err := cmd.Start(); err != nil {
+		edp.log.Error("Error starting metric daemon script", zap.Error(err))
+		edp.status.record(started, 0, -1, "", err)
+		return false
+	}
+
+	edp.supervisorMtx.Lock()
+	edp.pid = cmd.Process.Pid
+	edp.started = started
+	edp.nextStart = time.Time{}
+	edp.supervisorMtx.Unlock()
+
+	edp.log.Info("Metric daemon script started", zap.Int("pid", cmd.Process.Pid))
+
+	// Kill the script if the proxy is stopped while it runs.
+	exitedCh := make(chan struct{})
+	defer close(exitedCh)
+	go func() {
+		select {
+		case <-edp.stopCh:
+			edp.log.Info("Stopping metric daemon script", zap.Int("pid", cmd.Process.Pid))
+			if err := killExecProcessGroup(cmd); err != nil {
+				edp.log.Debug("Error killing metric daemon script", zap.Error(err))
+			}
+		case <-exitedCh:
+		}
+	}()
+
+	// The script runs indefinitely, so stderr is logged line by line as it is written.
+	stderr := newTailBuffer(execStderrTailBytes)
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(errRdr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			stderr.Write([]byte(line + "\n")) //nolint:errcheck
+			logExecStderr(edp.log, edp.stderrLogLevel, line)
+		}
+		// Keep draining if an overlong line stopped the scanner.
+		io.Copy(ioutil.Discard, errRdr) //nolint:errcheck
+	}()
+
+	produced, rerr := edp.readBlocks(outRdr)
+	if rerr != nil {
+		edp.log.Error("Error reading metric daemon script output - killing it", zap.Error(rerr))
+		if err := killExecProcessGroup(cmd); err != nil {
+			edp.log.Debug("Error killing metric daemon script", zap.Error(err))
+		}
+		// Drain any remaining output so the script can't block on a full pipe.
+		if _, err := io.Copy(ioutil.Discard, outRdr); err != nil {
+			edp.log.Debug("Error draining output of metric daemon script", zap.Error(err))
+		}
+	}
+
+	<-stderrDone
+	werr := cmd.Wait()
+	duration := time.Since(started)
+
+	edp.supervisorMtx.Lock()
+	edp.pid = 0
+	edp.supervisorMtx.Unlock()
+
+	err := rerr
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = ErrExecDaemonExited
+	}
+	select {
+	case <-edp.stopCh:
+		edp.log.Info("Metric daemon script stopped", zap.Duration("duration", duration))
+	default:
+		edp.log.Error("Metric daemon script exited", zap.Error(err),
+			zap.Int("exit_code", cmd.ProcessState.ExitCode()), zap.Duration("duration", duration))
+	}
+
+	edp.status.record(started, duration, cmd.ProcessState.ExitCode(), stderr.String(), err)
+
+	edp.lastResultMtx.Lock()
+	edp.lastErr = err
+	edp.lastResultMtx.Unlock()
+
+	return produced
+}
+
+// readBlocks reads blocks of metrics from the script output until it is closed, and caches
+// each complete block which decodes successfully.
+func (edp *execDaemonProxy) readBlocks(rdr io.Reader) (bool, error) {
+	produced := false
+	block := new(bytes.Buffer)
+	bufRdr := bufio.NewReader(rdr)
+
+	for {
+		line, err := bufRdr.ReadString('\n')
+		if err != nil {
+			// An incomplete final block is discarded.
+			if errors.Is(err, io.EOF) {
+				return produced, nil
+			}
+			return produced, err
+		}
+
+		if strings.TrimSpace(line) != execDaemonBlockTerminator {
+			if uint64(block.Len()+len(line)) > edp.maxBlockBytes {
+				return produced, errors.Wrapf(ErrMaxBytesExceeded, "block limit %d bytes", edp.maxBlockBytes)
+			}
+			block.WriteString(line)
+			continue
+		}
+
+		mfs, derr := decodeMetrics(block, expfmt.FmtText)
+		block.Reset()
+
+		edp.lastResultMtx.Lock()
+		if derr != nil {
+			edp.log.Error("Metric decoding from daemon script output failed", zap.Error(derr))
+			edp.lastErr = derr
+		} else {
+			edp.log.Debug("Received block of metrics from daemon script", zap.Int("metric_families", len(mfs)))
+			produced = true
+			edp.lastBlock = time.Now()
+			if edp.timestamps == config.TimestampsProductionTime {
+				setTimestamps(mfs, edp.lastBlock)
+			}
+			edp.lastResult = mfs
+			edp.lastErr = nil
+		}
+		edp.lastResultMtx.Unlock()
+	}
+}
+
+// Status implements StatusReporter.
+func (edp *execDaemonProxy) Status() interface{} {
+	status := ExecDaemonStatus{
+		ExecStatus: edp.status.Status(),
+	}
+
+	edp.lastResultMtx.RLock()
+	if !edp.lastBlock.IsZero() {
+		lastBlock := edp.lastBlock
+		status.LastBlock = &lastBlock
+	}
+	edp.lastResultMtx.RUnlock()
+
+	edp.supervisorMtx.Lock()
+	defer edp.supervisorMtx.Unlock()
+
+	status.Running = edp.pid != 0
+	status.PID = edp.pid
+	status.Restarts = edp.restarts
+	if !edp.started.IsZero() {
+		started := edp.started
+		status.Started = &started
+	}
+	if !edp.nextStart.IsZero() {
+		nextStart := edp.nextStart
+		status.NextStart = &nextStart
+	}
+	return status
+}
+
+// statusMetrics implements statusMetricsProvider.
+func (edp *execDaemonProxy) statusMetrics() []*dto.MetricFamily {
+	mfs := edp.status.statusMetrics()
+
+	edp.supervisorMtx.Lock()
+	restarts := edp.restarts
+	edp.supervisorMtx.Unlock()
+
+	return append(mfs, newCounterFamily(execDaemonRestartsMetricName,
+		"Number of times the exporter daemon script has been restarted.", float64(restarts)))
+}
+
+// Scrape retrieves the last complete block of metrics. Scrapes fail without waiting until
+// the first block is received.
+func (edp *execDaemonProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	edp.lastResultMtx.RLock()
+	defer edp.lastResultMtx.RUnlock()
+
+	if edp.lastBlock.IsZero() {
+		return []*dto.MetricFamily{}, errors.Wrapf(ErrExecDaemonNoResult, "last error: %v", edp.lastErr)
+	}
+	edp.log.Debug("Returning last block of metrics from daemon script")
+
+	age := time.Since(edp.lastBlock)
+	stale := edp.maxAge > 0 && age > edp.maxAge
+	if stale && edp.staleAction != config.StaleActionLabel {
+		edp.log.Debug("Last block of metrics is stale", zap.Duration("age", age), zap.Duration("max_age", edp.maxAge))
+		if edp.staleAction == config.StaleActionDrop {
+			return []*dto.MetricFamily{}, nil
+		}
+		return nil, errors.Wrapf(ErrExecCachedResultStale, "age %s, last error: %v", age, edp.lastErr)
+	}
+
+	// Copy the cached result since it is rewritten by later proxy stages.
+	retMetrics := cloneMetricFamilies(edp.lastResult)
+
+	if stale {
+		rewriteMetrics(model.LabelSet{staleLabel: "true"}, retMetrics)
+	}
+
+	return retMetrics, nil
+}
@@ -0,0 +1,268 @@
+//nolint:errcheck
+package metricproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	. "gopkg.in/check.v1"
+)
+
+// countingExecDaemonScript writes an incrementing counter as a new block every 100ms.
+const countingExecDaemonScript = `#!/bin/bash
+for count in $(seq 1 100); do
+	echo "test_metric_count $count"
+	echo "# EOF"
+	sleep 0.1
+done
+`
+
+// exitingExecDaemonScript writes a partial block, a broken block and a single good block, and exits.
+const exitingExecDaemonScript = `#!/bin/bash
+echo "test_metric_count not_a_number"
+echo "# EOF"
+echo "test_metric_count 1"
+echo "# EOF"
+echo "test_metric_count 2"
+echo "exiting" >&2
+exit 3
+`
+
+type ExecDaemonProxySuite struct {
+}
+
+var _ = Suite(&ExecDaemonProxySuite{})
+
+func (s *ExecDaemonProxySuite) SetUpSuite(c *C) {
+	l, err := zap.NewDevelopment()
+	c.Assert(err, IsNil)
+	zap.ReplaceGlobals(l)
+}
+
+// initProxyScript sets up a dummy exec daemon proxy config from a variable for us.
+func (s *ExecDaemonProxySuite) initProxyScript(c *C, script string) config.ExecDaemonExporterConfig {
+	f, err := ioutil.TempFile("", fmt.Sprintf("exec_daemon_proxy_test_%s", c.TestName()))
+	c.Assert(err, IsNil)
+
+	scriptPath := f.Name()
+
+	f.WriteString(script)
+	f.Chmod(os.FileMode(0700)) // Make the script executable
+	f.Close()
+
+	exporterConfig := config.ExecDaemonExporterConfig{
+		Command: scriptPath,
+		Args:    []string{},
+		Exporter: config.Exporter{
+			Name:      "test_exec_daemon_proxy",
+			NoRewrite: false,
+			Labels:    nil,
+		},
+	}
+
+	return exporterConfig
+}
+
+// waitForBlock waits until the daemon script has written its first complete block.
+func (s *ExecDaemonProxySuite) waitForBlock(c *C, execProxy *execDaemonProxy) {
+	deadline := time.Now().Add(time.Second * 5)
+	for execProxy.Status().(ExecDaemonStatus).LastBlock == nil {
+		if time.Now().After(deadline) {
+			c.Fatal("daemon script did not write a block")
+		}
+		<-time.After(time.Millisecond * 10)
+	}
+}
+
+func (s *ExecDaemonProxySuite) TestExecDaemonProxy(c *C) {
+	exporterConfig := s.initProxyScript(c, countingExecDaemonScript)
+	defer os.Remove(exporterConfig.Command)
+
+	execProxy := newExecDaemonProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+	defer execProxy.stop()
+	s.waitForBlock(c, execProxy)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancelFn()
+
+	mfs, err := execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 1)
+	first := mfs[0].GetMetric()[0].GetUntyped().GetValue()
+
+	<-time.After(time.Millisecond * 500)
+	mfs, err = execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 1)
+	c.Check(mfs[0].GetMetric()[0].GetUntyped().GetValue() > first, Equals, true,
+		Commentf("later scrapes should return later blocks"))
+
+	status, ok := execProxy.Status().(ExecDaemonStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.Running, Equals, true)
+	c.Check(status.Restarts, Equals, uint64(0))
+}
+
+func (s *ExecDaemonProxySuite) TestExecDaemonProxyRestarts(c *C) {
+	exporterConfig := s.initProxyScript(c, exitingExecDaemonScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.RestartBackoff = model.Duration(time.Millisecond * 100)
+	exporterConfig.MaxRestartBackoff = model.Duration(time.Millisecond * 200)
+
+	execProxy := newExecDaemonProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+	defer execProxy.stop()
+	s.waitForBlock(c, execProxy)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancelFn()
+
+	// Only the complete, valid block should ever be served.
+	mfs, err := execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 1)
+	c.Check(mfs[0].GetMetric()[0].GetUntyped().GetValue(), Equals, float64(1))
+
+	<-time.After(time.Millisecond * 500)
+	mfs, err = execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 1)
+	c.Check(mfs[0].GetMetric()[0].GetUntyped().GetValue(), Equals, float64(1))
+
+	status, ok := execProxy.Status().(ExecDaemonStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.Restarts > 0, Equals, true, Commentf("the script should have been restarted"))
+	c.Check(status.ExitCode, Equals, 3)
+	c.Check(status.Stderr, Equals, "exiting\n")
+
+	statusMetrics := execProxy.statusMetrics()
+	c.Assert(statusMetrics, HasLen, 3)
+	c.Check(statusMetrics[2].GetName(), Equals, execDaemonRestartsMetricName)
+	c.Check(statusMetrics[2].GetType(), Equals, dto.MetricType_COUNTER)
+}
+
+func (s *ExecDaemonProxySuite) TestExecDaemonProxyStale(c *C) {
+	exporterConfig := s.initProxyScript(c, exitingExecDaemonScript)
+	defer os.Remove(exporterConfig.Command)
+
+	// The script is not restarted before the block goes stale.
+	exporterConfig.RestartBackoff = model.Duration(time.Second * 10)
+	exporterConfig.MaxAge = model.Duration(time.Millisecond * 200)
+	exporterConfig.StaleAction = config.StaleActionDrop
+
+	execProxy := newExecDaemonProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+	defer execProxy.stop()
+	s.waitForBlock(c, execProxy)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancelFn()
+
+	mfs, err := execProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs, HasLen, 1)
+
+	<-time.After(time.Millisecond * 500)
+	mfs, err = execProxy.Scrape(ctx, nil)
+	c.Check(err, IsNil)
+	c.Check(mfs, HasLen, 0, Commentf("stale metrics should be dropped"))
+}
+
+// slowExecDaemonScript writes its first block after a long delay.
+const slowExecDaemonScript = `#!/bin/bash
+sleep 10
+echo "test_metric_count 1"
+echo "# EOF"
+`
+
+func (s *ExecDaemonProxySuite) TestExecDaemonProxyDoesNotBlockScrapes(c *C) {
+	exporterConfig := s.initProxyScript(c, slowExecDaemonScript)
+	defer os.Remove(exporterConfig.Command)
+
+	execProxy := newExecDaemonProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+	defer execProxy.stop()
+
+	started := time.Now()
+	_, err := execProxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrExecDaemonNoResult), Equals, true, Commentf("got error: %v", err))
+	c.Check(time.Since(started) < time.Second, Equals, true, Commentf("scrape waited for the first block"))
+}
+
+// forkingExecDaemonScript writes the pid of a child process and waits for it.
+const forkingExecDaemonScript = `#!/bin/bash
+sleep 100 &
+echo "test_child_pid $!"
+echo "# EOF"
+wait
+`
+
+func (s *ExecDaemonProxySuite) TestExecDaemonProxyStop(c *C) {
+	exporterConfig := s.initProxyScript(c, forkingExecDaemonScript)
+	defer os.Remove(exporterConfig.Command)
+
+	execProxy := newExecDaemonProxy(&exporterConfig, nil)
+	c.Assert(execProxy, Not(IsNil))
+	execProxy.start()
+	s.waitForBlock(c, execProxy)
+
+	mfs, err := execProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 1)
+	childPid := int(mfs[0].GetMetric()[0].GetUntyped().GetValue())
+
+	status, ok := execProxy.Status().(ExecDaemonStatus)
+	c.Assert(ok, Equals, true)
+	c.Assert(status.Running, Equals, true)
+	pid := status.PID
+
+	// The output of the script stays open while a child holds it, unless the child is killed too.
+	stoppedCh := make(chan struct{})
+	go func() {
+		execProxy.stop()
+		close(stoppedCh)
+	}()
+	select {
+	case <-stoppedCh:
+	case <-time.After(time.Second * 5):
+		c.Fatal("stopping the daemon script did not finish")
+	}
+
+	status, ok = execProxy.Status().(ExecDaemonStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.Running, Equals, false)
+	c.Check(status.NextStart, IsNil, Commentf("a stopped script should not be restarted"))
+	c.Check(processExited(pid), Equals, true)
+
+	// Children of the script are reparented once it exits, so may linger as zombies.
+	deadline := time.Now().Add(time.Second * 5)
+	for !processExited(childPid) {
+		if time.Now().After(deadline) {
+			c.Fatal("child of the daemon script was not killed")
+		}
+		<-time.After(time.Millisecond * 10)
+	}
+}
+
+// processExited returns true if the process does not exist or is a zombie.
+func processExited(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	return err != nil || strings.Contains(string(stat), ") Z ")
+}
@@ -0,0 +1,13 @@
+package metricproxy
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setExecDaemonProcAttr starts a daemon script in its own process group, so it can be
+// killed with its children, and has it killed if reverse_exporter dies without stopping it.
+func setExecDaemonProcAttr(cmd *exec.Cmd) {
+	setExecProcessGroup(cmd)
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package metricproxy
+
+import (
+	"os/exec"
+)
+
+// setExecDaemonProcAttr does nothing on platforms without parent death signals.
+func setExecDaemonProcAttr(cmd *exec.Cmd) {}
@@ -0,0 +1,23 @@
+package metricproxy
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setExecProcessGroup starts a script in its own process group, so it can be killed with
+// its children.
+func setExecProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killExecProcessGroup kills the process group of a script.
+func killExecProcessGroup(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
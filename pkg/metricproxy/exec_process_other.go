@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package metricproxy
+
+import (
+	"os/exec"
+)
+
+// setExecProcessGroup does nothing on platforms where scripts are killed on their own.
+func setExecProcessGroup(cmd *exec.Cmd) {}
+
+// killExecProcessGroup kills a script.
+func killExecProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -2,14 +2,21 @@ package metricproxy
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"net/url"
-	"os/exec"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
 
 	"github.com/wrouesnel/reverse_exporter/pkg/config"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
@@ -18,9 +25,20 @@ import (
 // ensure fileProxy implements MetricProxy.
 var _ MetricProxy = &execProxy{}
 
+// defaultURLParamsEnvPrefix is prepended to the names of url params forwarded to scripts.
+const defaultURLParamsEnvPrefix = "REVERSE_EXPORTER_PARAM_"
+
 var (
 	// ErrScrapeTimeoutBeforeExecFinished returned when a context times out before the exec exporter receives metrics.
 	ErrScrapeTimeoutBeforeExecFinished = errors.New("scrape timed out before exec finished")
+	// ErrExecURLParamsNotWhitelisted returned when url params are forwarded to a script without a whitelist.
+	ErrExecURLParamsNotWhitelisted = errors.New("forward_url_params requires allowed_url_params to be set")
+	// ErrExecURLParamsCollide returned when two whitelisted url params are passed to the script as
+	// the same environment variable.
+	ErrExecURLParamsCollide = errors.New("allowed_url_params map to the same environment variable")
+	// ErrExecArgTemplateFailed returned when the arguments of a script cannot be rendered from
+	// the forwarded url params.
+	ErrExecArgTemplateFailed = errors.New("exec argument template failed")
 )
 
 // scrapeResult is used to communicate the result of a scrape to waiting listeners.
@@ -35,47 +53,173 @@ type execProxyScrapeResult struct {
 type execProxy struct {
 	commandPath string
 	arguments   []string
+	// argTemplates are the parsed arguments, used when url params are forwarded
+	argTemplates []*template.Template
+	// allowedURLParams is the set of url params which will be forwarded to the script
+	allowedURLParams map[string]struct{}
+	urlParamsPrefix  string
+	// groups holds the scrape groups for each distinct set of forwarded url params
+	groups    map[string]*execScrapeGroup
+	groupsMtx *sync.Mutex
+	// sandbox is the privileges and limits the script is executed with
+	sandbox  *execSandbox
+	maxBytes uint64
+	// status records the result of the last execution
+	status         *execStatus
+	stderrLogLevel zapcore.Level
+	// timestamps is set to config.TimestampsProductionTime to timestamp the metrics of
+	// each execution with the time the script exited
+	timestamps config.TimestampMode
+	log        *zap.Logger
+}
+
+// execScrapeGroup coalesces all scrapes which share the same set of forwarded url params
+// into a single script execution.
+type execScrapeGroup struct {
+	arguments   []string
+	environment []string
+	// refs is the number of scrapes currently using this group (guarded by execProxy.groupsMtx)
+	refs int
+	// stopped is set when the group is no longer referenced, and causes the execer to exit
+	stopped bool
 	// waitingScrapes is a map of channels which indicates the number of waiting scrape requests
 	waitingScrapes map[<-chan *execProxyScrapeResult]chan<- *execProxyScrapeResult
 	// drainMtx prevents new scrapes being accepted while results are being distributed.
 	drainMtx *sync.Mutex
 	// shouldScrapeCond is signalled whenever scrapes enter or leave
 	scrapeEventCond *sync.Cond
-	log             *zap.Logger
 }
 
-// execCachingProxy implements a caching proxy for metrics produced by a periodically executed script.
-type execCachingProxy struct {
-	commandPath  string
-	arguments    []string
-	execInterval time.Duration
+// newExecProxy initializes a new execProxy which executes the script in sandbox. Execution
+// goroutines are started on demand by incoming scrapes. An error is returned if the arguments
+// are not valid templates.
+func newExecProxy(config *config.ExecExporterConfig, sandbox *execSandbox) (*execProxy, error) {
+	newProxy := execProxy{
+		commandPath:    config.Command,
+		arguments:      config.Args,
+		groups:         make(map[string]*execScrapeGroup),
+		groupsMtx:      &sync.Mutex{},
+		status:         newExecStatus(),
+		stderrLogLevel: config.StderrLogLevel,
+		maxBytes:       config.MaxBytes,
+		timestamps:     config.Timestamps,
+		sandbox:        sandbox,
+		log:            zap.L().With(zap.String("name", config.Name)),
+	}
+
+	if config.ForwardURLParams {
+		newProxy.allowedURLParams = make(map[string]struct{}, len(config.AllowedURLParams))
+		for _, name := range config.AllowedURLParams {
+			newProxy.allowedURLParams[name] = struct{}{}
+		}
 
-	lastExec      time.Time
-	lastResult    []*dto.MetricFamily
-	resultReadyCh <-chan struct{}
-	lastResultMtx *sync.RWMutex
+		newProxy.urlParamsPrefix = config.URLParamsEnvPrefix
+		if newProxy.urlParamsPrefix == "" {
+			newProxy.urlParamsPrefix = defaultURLParamsEnvPrefix
+		}
 
-	log *zap.Logger
+		argTemplates, err := parseArgTemplates(config.Args)
+		if err != nil {
+			return nil, err
+		}
+		newProxy.argTemplates = argTemplates
+	}
+
+	return &newProxy, nil
 }
 
-// newExecProxy initializes a new execProxy and its goroutines.
-func newExecProxy(config *config.ExecExporterConfig) *execProxy {
-	newProxy := execProxy{
-		commandPath:     config.Command,
-		arguments:       config.Args,
-		waitingScrapes:  map[<-chan *execProxyScrapeResult]chan<- *execProxyScrapeResult{},
-		drainMtx:        &sync.Mutex{},
-		scrapeEventCond: sync.NewCond(&sync.Mutex{}),
-		log:             zap.L(),
+// parseArgTemplates parses a list of exec arguments as text/template's.
+func parseArgTemplates(args []string) ([]*template.Template, error) {
+	argTemplates := make([]*template.Template, 0, len(args))
+	for idx, arg := range args {
+		tmpl, err := template.New(fmt.Sprintf("arg%d", idx)).Option("missingkey=zero").Parse(arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "argument %d", idx)
+		}
+		argTemplates = append(argTemplates, tmpl)
+	}
+	return argTemplates, nil
+}
+
+// urlParamsEnvName converts a url param name to the environment variable it is passed to
+// the script as.
+func urlParamsEnvName(prefix string, name string) string {
+	return prefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return unicode.ToUpper(r)
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// validateURLParams checks that no two whitelisted url params are passed to the script as
+// the same environment variable.
+func validateURLParams(prefix string, names []string) error {
+	if prefix == "" {
+		prefix = defaultURLParamsEnvPrefix
+	}
+	envNames := make(map[string]string, len(names))
+	for _, name := range names {
+		envName := urlParamsEnvName(prefix, name)
+		if other, found := envNames[envName]; found && other != name {
+			return errors.Wrapf(ErrExecURLParamsCollide, "%q and %q are both %s", other, name, envName)
+		}
+		envNames[envName] = name
+	}
+	return nil
+}
+
+// filterURLParams returns only the whitelisted url params from values. Only the first value
+// of each param is passed to the script, so the others are dropped to not split scrapes into
+// groups which execute the same command.
+func (ep *execProxy) filterURLParams(values url.Values) url.Values {
+	filtered := url.Values{}
+	for name := range values {
+		if _, ok := ep.allowedURLParams[name]; ok {
+			filtered.Set(name, values.Get(name))
+		}
+	}
+	return filtered
+}
+
+// commandForParams builds the arguments and additional environment of the script for a
+// set of forwarded url params. An error is returned if an argument template fails, rather
+// than passing the script the unrendered template.
+func (ep *execProxy) commandForParams(params url.Values) ([]string, []string, error) {
+	if ep.argTemplates == nil && len(params) == 0 {
+		return ep.arguments, nil, nil
+	}
+
+	templateData := make(map[string]string, len(params))
+	environment := make([]string, 0, len(params))
+	for name := range params {
+		templateData[name] = params.Get(name)
+		environment = append(environment, fmt.Sprintf("%s=%s", urlParamsEnvName(ep.urlParamsPrefix, name), params.Get(name)))
+	}
+	sort.Strings(environment)
+
+	if ep.argTemplates == nil {
+		return ep.arguments, environment, nil
 	}
 
-	go newProxy.execer()
+	arguments := make([]string, 0, len(ep.argTemplates))
+	for idx, tmpl := range ep.argTemplates {
+		buf := new(strings.Builder)
+		if err := tmpl.Execute(buf, templateData); err != nil {
+			return nil, nil, errors.Wrapf(ErrExecArgTemplateFailed, "argument %d: %v", idx, err)
+		}
+		arguments = append(arguments, buf.String())
+	}
 
-	return &newProxy
+	return arguments, environment, nil
 }
 
 // doExec handles the actual application execution. ctx, when cancelled, cancel's all execution.
-func (ep *execProxy) doExec(ctx context.Context) *execProxyScrapeResult {
+func (ep *execProxy) doExec(ctx context.Context, arguments []string, environment []string) *execProxyScrapeResult {
 	// allocate a new result struct now
 	result := &execProxyScrapeResult{
 		mfs: nil,
@@ -85,7 +229,13 @@ func (ep *execProxy) doExec(ctx context.Context) *execProxyScrapeResult {
 	ep.log.Debug("Executing metric script")
 	// Have at least 1 listener, start executing.
 
-	cmd := exec.Command(ep.commandPath, ep.arguments...) //nolint:gosec
+	cmd := ep.sandbox.command(context.Background(), ep.commandPath, arguments...)
+	if len(environment) > 0 {
+		cmd.Env = append(os.Environ(), environment...)
+	}
+	stderr := newTailBuffer(execStderrTailBytes)
+	cmd.Stderr = stderr
+
 	outRdr, perr := cmd.StdoutPipe()
 	if perr != nil {
 		result.err = perr
@@ -94,8 +244,10 @@ func (ep *execProxy) doExec(ctx context.Context) *execProxyScrapeResult {
 		return result
 	}
 
+	started := time.Now()
 	if err := cmd.Start(); err != nil {
 		result.err = err
+		ep.status.record(started, 0, -1, "", err)
 		ep.log.Error("Error starting metric script", zap.Error(err))
 		return result
 	}
@@ -118,35 +270,122 @@ func (ep *execProxy) doExec(ctx context.Context) *execProxyScrapeResult {
 		}
 	}()
 
-	mfs, derr := decodeMetrics(outRdr, expfmt.FmtText)
+	mfs, derr := decodeMetrics(newMaxBytesReader(outRdr, ep.maxBytes), expfmt.FmtText)
+	if errors.Is(derr, ErrMaxBytesExceeded) {
+		// Stop the script rather than waiting for it to finish writing.
+		if err := cmd.Process.Kill(); err != nil {
+			ep.log.Error("Error during subprocess kill", zap.Error(err))
+		}
+	}
 
 	// Wait for the process to exit.
 	werr := cmd.Wait() //nolint:ifshort
+	duration := time.Since(started)
 	ep.log.Debug("Subprocess finished.")
 	close(finished) // Disable the watchdog above
-	if werr != nil {
-		result.err = werr
-		ep.log.Error("Metric script exited with error", zap.Error(werr))
-		return result
-	}
 
-	if derr != nil {
+	logExecStderr(ep.log, ep.stderrLogLevel, stderr.String())
+
+	switch {
+	case errors.Is(derr, ErrMaxBytesExceeded):
+		result.err = derr
+		ep.log.Error("Metric script output is too large - killed it", zap.Error(derr))
+	case werr != nil:
+		result.err = werr
+		ep.log.Error("Metric script exited with error", zap.Error(werr),
+			zap.Int("exit_code", cmd.ProcessState.ExitCode()), zap.Duration("duration", duration))
+	case derr != nil:
 		result.err = derr
 		ep.log.Error("Metric decoding from script output failed", zap.Error(derr))
-		return result
+	default:
+		if ep.timestamps == config.TimestampsProductionTime {
+			setTimestamps(mfs, started.Add(duration))
+		}
+		result.mfs = mfs
 	}
-	result.mfs = mfs
+
+	ep.status.record(started, duration, cmd.ProcessState.ExitCode(), stderr.String(), result.err)
 	return result
 }
 
-func (ep *execProxy) execer() {
+// logExecStderr logs the captured stderr of a script at the given level.
+func logExecStderr(log *zap.Logger, level zapcore.Level, stderr string) {
+	if stderr == "" {
+		return
+	}
+	if ce := log.Check(level, "Metric script stderr output"); ce != nil {
+		ce.Write(zap.String("stderr", stderr))
+	}
+}
+
+// Status implements StatusReporter.
+func (ep *execProxy) Status() interface{} {
+	return ep.status.Status()
+}
+
+// statusMetrics implements statusMetricsProvider.
+func (ep *execProxy) statusMetrics() []*dto.MetricFamily {
+	return ep.status.statusMetrics()
+}
+
+// acquireGroup returns the scrape group for the given set of url params, starting it with
+// the given command if it does not exist. The group must be returned with releaseGroup.
+func (ep *execProxy) acquireGroup(params url.Values, arguments []string, environment []string) *execScrapeGroup {
+	// url.Values.Encode sorts by key, so it is a stable key for the parameter set.
+	key := params.Encode()
+
+	ep.groupsMtx.Lock()
+	defer ep.groupsMtx.Unlock()
+
+	group, found := ep.groups[key]
+	if !found {
+		group = &execScrapeGroup{
+			arguments:       arguments,
+			environment:     environment,
+			waitingScrapes:  map[<-chan *execProxyScrapeResult]chan<- *execProxyScrapeResult{},
+			drainMtx:        &sync.Mutex{},
+			scrapeEventCond: sync.NewCond(&sync.Mutex{}),
+		}
+		ep.groups[key] = group
+		go ep.execer(group)
+	}
+	group.refs++
+
+	return group
+}
+
+// releaseGroup drops a reference to a scrape group, and stops it once it is unused.
+func (ep *execProxy) releaseGroup(params url.Values, group *execScrapeGroup) {
+	ep.groupsMtx.Lock()
+	defer ep.groupsMtx.Unlock()
+
+	group.refs--
+	if group.refs > 0 {
+		return
+	}
+
+	delete(ep.groups, params.Encode())
+
+	group.scrapeEventCond.L.Lock()
+	group.stopped = true
+	group.scrapeEventCond.L.Unlock()
+	group.scrapeEventCond.Broadcast()
+}
+
+func (ep *execProxy) execer(group *execScrapeGroup) {
 	ep.log.Debug("ExecProxy started")
 
 	for {
-		ep.scrapeEventCond.L.Lock()
+		group.scrapeEventCond.L.Lock()
 		// Wait for some scrapes to arrive
-		for len(ep.waitingScrapes) == 0 {
-			ep.scrapeEventCond.Wait()
+		for len(group.waitingScrapes) == 0 && !group.stopped {
+			group.scrapeEventCond.Wait()
+		}
+
+		if group.stopped {
+			group.scrapeEventCond.L.Unlock()
+			ep.log.Debug("ExecProxy stopped")
+			return
 		}
 
 		// Have waiting scrapes, kick off the the execer
@@ -158,11 +397,11 @@ func (ep *execProxy) execer() {
 		*done = false
 		finishedCh := make(chan struct{})
 		go func(done *bool, doneCh chan<- struct{}) {
-			ep.scrapeEventCond.L.Lock()
+			group.scrapeEventCond.L.Lock()
 			// Watch for number of waiting scrapes to fall to 0
-			for len(ep.waitingScrapes) != 0 && !*done {
-				ep.log.Debug("Waiting scrapers", zap.Int("waiting_scrapers", len(ep.waitingScrapes)))
-				ep.scrapeEventCond.Wait()
+			for len(group.waitingScrapes) != 0 && !*done {
+				ep.log.Debug("Waiting scrapers", zap.Int("waiting_scrapers", len(group.waitingScrapes)))
+				group.scrapeEventCond.Wait()
 			}
 			cancelFn()
 			if *done {
@@ -170,22 +409,22 @@ func (ep *execProxy) execer() {
 			} else {
 				ep.log.Debug("No more listeners, watcher requested subprocess exit")
 			}
-			ep.scrapeEventCond.L.Unlock()
+			group.scrapeEventCond.L.Unlock()
 			close(doneCh)
 		}(done, finishedCh)
 
 		// Allow the above goroutine to start
-		ep.scrapeEventCond.L.Unlock()
+		group.scrapeEventCond.L.Unlock()
 
 		// doExec always returns results (since the goroutine above will cause it's subprocess to
 		// force kill if everyone gives up on it.
-		results := ep.doExec(ctx)
+		results := ep.doExec(ctx, group.arguments, group.environment)
 
 		// Dispatch results
-		ep.scrapeEventCond.L.Lock()
+		group.scrapeEventCond.L.Lock()
 
 		ep.log.Debug("Emitting results to remaining scrapers")
-		for _, outCh := range ep.waitingScrapes {
+		for _, outCh := range group.waitingScrapes {
 			outCh <- results
 		}
 		// Ensure the watcher routine above exits
@@ -193,59 +432,70 @@ func (ep *execProxy) execer() {
 
 		// Order is important here - lock drainMtx to block new scrapers
 		ep.log.Debug("Waiting for scrapers to finish")
-		ep.drainMtx.Lock()
-		ep.scrapeEventCond.L.Unlock()
+		group.drainMtx.Lock()
+		group.scrapeEventCond.L.Unlock()
 
 		// We're unlocked now, wait for the watcher routine above to close the finishedCh when
 		// number of waiting scrapes falls to 0
 		<-finishedCh
-		ep.drainMtx.Unlock() // Allow new scrapers to start accumulating
+		group.drainMtx.Unlock() // Allow new scrapers to start accumulating
 	}
 }
 
 // newScrapeRequest adds a channel to the list of waiting channels.
-func (ep *execProxy) newScrapeRequest() <-chan *execProxyScrapeResult {
+func (group *execScrapeGroup) newScrapeRequest() <-chan *execProxyScrapeResult {
 	// This forms part of a double mutex setup which allows old requests to drain.
 	// See execer for implementations (basically drainMtx is locked while old requests
 	// are cleaning up after results have been distributed).
-	ep.drainMtx.Lock()
+	group.drainMtx.Lock()
 
-	ep.scrapeEventCond.L.Lock()
+	group.scrapeEventCond.L.Lock()
 
 	// Add scrape (use buffered channel to avoid blocking when scrapers would like to exit)
 	waitCh := make(chan *execProxyScrapeResult, 1)
-	ep.waitingScrapes[waitCh] = waitCh
+	group.waitingScrapes[waitCh] = waitCh
 
-	ep.scrapeEventCond.L.Unlock()
+	group.scrapeEventCond.L.Unlock()
 
 	// Signal new scrape event
-	ep.scrapeEventCond.Broadcast()
+	group.scrapeEventCond.Broadcast()
 
-	ep.drainMtx.Unlock()
+	group.drainMtx.Unlock()
 
 	return waitCh
 }
 
 // delScrapeRequest removes a request from the list of waiting channels.
-func (ep *execProxy) delScrapeRequest(waitCh <-chan *execProxyScrapeResult) {
-	ep.scrapeEventCond.L.Lock()
+func (group *execScrapeGroup) delScrapeRequest(waitCh <-chan *execProxyScrapeResult) {
+	group.scrapeEventCond.L.Lock()
 
 	// Delete waiting scrape
-	delete(ep.waitingScrapes, waitCh)
+	delete(group.waitingScrapes, waitCh)
 
-	ep.scrapeEventCond.L.Unlock()
+	group.scrapeEventCond.L.Unlock()
 
 	// Signal new scrape event
-	ep.scrapeEventCond.Broadcast()
+	group.scrapeEventCond.Broadcast()
 }
 
 // Scrape scrapes the underlying metric endpoint. values are URL parameters
-// to be used with the request if needed.
+// to be used with the request if needed. Scrapes are coalesced by the set of
+// forwarded url params.
 func (ep *execProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	params := ep.filterURLParams(values)
+	arguments, environment, err := ep.commandForParams(params)
+	if err != nil {
+		ep.log.Error("Exec arguments could not be rendered from url params", zap.Error(err))
+		return nil, err
+	}
+
+	group := ep.acquireGroup(params, arguments, environment)
+	defer ep.releaseGroup(params, group)
+
 	// Get a new waitCh
-	waitCh := ep.newScrapeRequest()
+	waitCh := group.newScrapeRequest()
 
-	defer ep.delScrapeRequest(waitCh) // Always clean up request afterwards
+	defer group.delScrapeRequest(waitCh) // Always clean up request afterwards
 
 	// Wait for results or for our context to finish
 	select {
@@ -257,98 +507,3 @@ func (ep *execProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.Metr
 		return nil, ErrScrapeTimeoutBeforeExecFinished
 	}
 }
-
-// newExecProxy initializes a new execProxy and its goroutines.
-func newExecCachingProxy(config *config.ExecCachingExporterConfig) *execCachingProxy {
-	rdyCh := make(chan struct{})
-
-	newProxy := execCachingProxy{
-		commandPath:  config.Command,
-		arguments:    config.Args,
-		execInterval: time.Duration(config.ExecInterval),
-
-		lastResult:    make([]*dto.MetricFamily, 0),
-		resultReadyCh: rdyCh,
-		lastResultMtx: &sync.RWMutex{},
-
-		log: zap.L(),
-	}
-
-	go newProxy.execer(rdyCh)
-
-	return &newProxy
-}
-
-func (ecp *execCachingProxy) execer(rdyCh chan<- struct{}) {
-	ecp.log.Debug("ExecCachingProxy started")
-
-	for {
-		nextExec := ecp.lastExec.Add(ecp.execInterval)
-		ecp.log.Debug("Waiting for next interval", zap.Time("next_exec", nextExec))
-		<-time.After(time.Until(nextExec))
-		ecp.log.Debug("Executing metric script on timeout")
-
-		ecp.lastExec = time.Now()
-		cmd := exec.Command(ecp.commandPath, ecp.arguments...) //nolint:gosec
-		outRdr, perr := cmd.StdoutPipe()
-		if perr != nil {
-			ecp.log.Error("Error opening stdout pipe to metric script", zap.Error(perr))
-			continue
-		}
-
-		if err := cmd.Start(); err != nil {
-			ecp.log.Error("Error starting metric script", zap.Error(err))
-			continue
-		}
-
-		//if err := cmd.Wait(); err != nil {
-		//	ecp.log.With("error", err.Error()).
-		//		Errorln("Metric script exited with error")
-		//	continue
-		//}
-
-		mfs, derr := decodeMetrics(outRdr, expfmt.FmtText)
-		// Hard kill the script once metric decoding finishes. It's the only way to be sure.
-		// Maybe sigterm with a timeout?
-		if err := cmd.Process.Kill(); err != nil {
-			ecp.log.
-				Error("Error sending kill signal to subprocess", zap.Error(derr))
-		}
-		if derr != nil {
-			ecp.log.Error("Metric decoding from script output failed", zap.Error(derr))
-			continue
-		}
-
-		// Cache new metrics
-		ecp.lastResultMtx.Lock()
-		ecp.lastResult = mfs
-		if rdyCh != nil {
-			// Better way?
-			close(rdyCh)
-			rdyCh = nil
-		}
-		ecp.lastResultMtx.Unlock()
-	}
-}
-
-// Scrape simply retrieves the cached metrics, or waits until they are available.
-func (ecp *execCachingProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
-	var rerr error
-
-	select {
-	case <-ecp.resultReadyCh:
-		zap.L().Debug("Returning cached results of scrape")
-	case <-ctx.Done():
-		// context cancelled before scrape finished
-		rerr = ErrScrapeTimeoutBeforeExecFinished
-		return []*dto.MetricFamily{}, rerr
-	}
-
-	var retMetrics []*dto.MetricFamily
-
-	ecp.lastResultMtx.RLock()
-	retMetrics = ecp.lastResult
-	ecp.lastResultMtx.RUnlock()
-
-	return retMetrics, rerr
-}
@@ -3,11 +3,15 @@ package metricproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/wrouesnel/reverse_exporter/pkg/config"
 
 	. "gopkg.in/check.v1"
@@ -67,7 +71,8 @@ func (s *ExecProxySuite) TestExecProxy(c *C) {
 	exporterConfig := s.initProxyScript(c, execProxyScript)
 	defer os.Remove(exporterConfig.Command)
 
-	execProxy := newExecProxy(&exporterConfig)
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
 	c.Assert(execProxy, Not(IsNil))
 	c.Check(execProxy.log, Not(IsNil))
 	c.Check(execProxy.arguments, DeepEquals, exporterConfig.Args)
@@ -85,7 +90,8 @@ func (s *ExecProxySuite) TestExecProxyWithBrokenScript(c *C) {
 	exporterConfig := s.initProxyScript(c, brokenExecProxyScript)
 	defer os.Remove(exporterConfig.Command)
 
-	execProxy := newExecProxy(&exporterConfig)
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
 	c.Assert(execProxy, Not(IsNil))
 	c.Check(execProxy.log, Not(IsNil))
 	c.Check(execProxy.arguments, DeepEquals, exporterConfig.Args)
@@ -106,7 +112,8 @@ func (s *ExecProxySuite) TestExecProxyWithNeverendingScript(c *C) {
 	cmdFile, rerr := ioutil.ReadFile(exporterConfig.Command)
 	c.Assert(rerr, IsNil)
 
-	execProxy := newExecProxy(&exporterConfig)
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
 	c.Assert(execProxy, Not(IsNil))
 	c.Check(execProxy.log, Not(IsNil))
 	c.Check(execProxy.arguments, DeepEquals, exporterConfig.Args)
@@ -127,7 +134,8 @@ func (s *ExecProxySuite) TestExecProxyQueuesCorrectly(c *C) {
 	cmdFile, rerr := ioutil.ReadFile(exporterConfig.Command)
 	c.Assert(rerr, IsNil)
 
-	execProxy := newExecProxy(&exporterConfig)
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
 	c.Assert(execProxy, Not(IsNil))
 	c.Check(execProxy.log, Not(IsNil))
 	c.Check(execProxy.arguments, DeepEquals, exporterConfig.Args)
@@ -172,3 +180,322 @@ func (s *ExecProxySuite) TestExecProxyQueuesCorrectly(c *C) {
 		}
 	}
 }
+
+const paramsExecProxyScript = `#!/bin/bash
+cat << EOF
+test_metric_params{arg1="$1",target="${REVERSE_EXPORTER_PARAM_TARGET}",module="${REVERSE_EXPORTER_PARAM_MODULE}"} 1
+EOF
+`
+
+func (s *ExecProxySuite) TestExecProxyForwardsURLParams(c *C) {
+	exporterConfig := s.initProxyScript(c, paramsExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.Args = []string{"{{ .target }}"}
+	exporterConfig.ForwardURLParams = true
+	exporterConfig.AllowedURLParams = []string{"target"}
+
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
+	c.Assert(execProxy, Not(IsNil))
+
+	ctx := context.Background()
+	for _, target := range []string{"db1", "db2"} {
+		mfs, err := execProxy.Scrape(ctx, url.Values{"target": []string{target}, "module": []string{"evil"}})
+		c.Assert(err, IsNil)
+		c.Assert(len(mfs), Equals, 1)
+
+		labels := map[string]string{}
+		for _, lp := range mfs[0].GetMetric()[0].GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		c.Check(labels["arg1"], Equals, target, Commentf("args template was not rendered"))
+		c.Check(labels["target"], Equals, target, Commentf("url param was not passed as environment"))
+		c.Check(labels["module"], Equals, "", Commentf("non-whitelisted url param was forwarded"))
+	}
+}
+
+// releasedExecProxyScript records its first argument, then blocks until the release file
+// exists.
+const releasedExecProxyScript = `#!/bin/bash
+echo "$1" >> "$0.started"
+while [ ! -e "$0.release" ]; do
+	sleep 0.01
+done
+echo "test_metric_released 1"
+`
+
+func (s *ExecProxySuite) TestExecProxyCoalescesByURLParams(c *C) {
+	exporterConfig := s.initProxyScript(c, releasedExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+	defer os.Remove(exporterConfig.Command + ".started")
+	defer os.Remove(exporterConfig.Command + ".release")
+
+	exporterConfig.Args = []string{"{{ .target }}"}
+	exporterConfig.ForwardURLParams = true
+	exporterConfig.AllowedURLParams = []string{"target"}
+
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancelFn()
+
+	doneCh := make(chan struct{})
+	for _, target := range []string{"db1", "db2", "db2"} {
+		go func(target string) {
+			_, err := execProxy.Scrape(ctx, url.Values{"target": []string{target}})
+			c.Check(err, IsNil)
+			doneCh <- struct{}{}
+		}(target)
+	}
+
+	// The scripts block until released, so every scrape joins its group before any finish.
+	groupRefs := func() (int, int) {
+		execProxy.groupsMtx.Lock()
+		defer execProxy.groupsMtx.Unlock()
+		refs := 0
+		for _, group := range execProxy.groups {
+			refs += group.refs
+		}
+		return len(execProxy.groups), refs
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for _, refs := groupRefs(); refs != 3; _, refs = groupRefs() {
+		if time.Now().After(deadline) {
+			c.Fatal("scrapes did not join their groups")
+		}
+		<-time.After(time.Millisecond * 10)
+	}
+	groups, _ := groupRefs()
+	c.Check(groups, Equals, 2, Commentf("scrapes should be grouped by url params"))
+
+	c.Assert(ioutil.WriteFile(exporterConfig.Command+".release", nil, os.FileMode(0600)), IsNil)
+	for i := 0; i < 3; i++ {
+		<-doneCh
+	}
+
+	started, err := ioutil.ReadFile(exporterConfig.Command + ".started")
+	c.Assert(err, IsNil)
+	c.Check(strings.Fields(string(started)), HasLen, 2, Commentf("the script should run once per group"))
+
+	groups, _ = groupRefs()
+	c.Check(groups, Equals, 0, Commentf("unused groups should be removed"))
+}
+
+func (s *ExecProxySuite) TestExecProxyGroupsByFirstURLParamValue(c *C) {
+	exporterConfig := s.initProxyScript(c, paramsExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.ForwardURLParams = true
+	exporterConfig.AllowedURLParams = []string{"target"}
+
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
+	c.Assert(execProxy, Not(IsNil))
+
+	filtered := execProxy.filterURLParams(url.Values{"target": []string{"db1", "db2"}})
+	c.Check(filtered, DeepEquals, execProxy.filterURLParams(url.Values{"target": []string{"db1"}}),
+		Commentf("only the first value of a url param is passed to the script"))
+}
+
+func (s *ExecProxySuite) TestExecProxyArgTemplateErrors(c *C) {
+	exporterConfig := s.initProxyScript(c, paramsExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.ForwardURLParams = true
+	exporterConfig.AllowedURLParams = []string{"target"}
+
+	exporterConfig.Args = []string{"{{ .target"}
+	_, err := newExecProxy(&exporterConfig, nil)
+	c.Check(err, Not(IsNil))
+
+	// Templates which fail to render fail the scrape, rather than the script being passed
+	// the unrendered template.
+	exporterConfig.Args = []string{`{{ template "missing" }}`}
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
+
+	mfs, err := execProxy.Scrape(context.Background(), url.Values{"target": []string{"db1"}})
+	c.Check(errors.Is(err, ErrExecArgTemplateFailed), Equals, true, Commentf("got error: %v", err))
+	c.Check(mfs, HasLen, 0)
+	c.Check(execProxy.status.Status().LastRun, IsNil, Commentf("the script should not be executed"))
+}
+
+func (s *ExecProxySuite) TestValidateURLParams(c *C) {
+	c.Check(validateURLParams("", []string{"target", "module"}), IsNil)
+	c.Check(errors.Is(validateURLParams("", []string{"a-b", "a.b"}), ErrExecURLParamsCollide), Equals, true)
+	c.Check(errors.Is(validateURLParams("P_", []string{"a_b", "A_B"}), ErrExecURLParamsCollide), Equals, true)
+}
+
+const stderrExecProxyScript = `#!/bin/bash
+echo "something went wrong" >&2
+exit 3
+`
+
+func (s *ExecProxySuite) TestExecProxyRecordsStatus(c *C) {
+	exporterConfig := s.initProxyScript(c, stderrExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
+	c.Assert(execProxy, Not(IsNil))
+	c.Check(execProxy.statusMetrics(), HasLen, 0, Commentf("no status metrics should exist before execution"))
+
+	// Scrape through a rewriteProxy so status metrics are returned with the error
+	rewriter := &rewriteProxy{
+		name:   exporterConfig.Name,
+		proxy:  execProxy,
+		labels: model.LabelSet{reverseProxyNameLabel: model.LabelValue(exporterConfig.Name)},
+	}
+
+	mfs, err := rewriter.Scrape(context.Background(), nil)
+	c.Check(err, Not(IsNil))
+	c.Assert(mfs, HasLen, 3)
+	c.Check(mfs[0].GetName(), Equals, execExitCodeMetricName)
+	c.Check(mfs[0].GetMetric()[0].GetGauge().GetValue(), Equals, float64(3))
+	c.Check(mfs[0].GetMetric()[0].GetLabel()[0].GetValue(), Equals, exporterConfig.Name)
+	c.Check(mfs[1].GetName(), Equals, execDurationMetricName)
+	c.Check(mfs[2].GetName(), Equals, backendUpMetricName)
+	c.Check(mfs[2].GetMetric()[0].GetGauge().GetValue(), Equals, float64(0))
+
+	status, ok := rewriter.Status().(ExecStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.ExitCode, Equals, 3)
+	c.Check(status.Stderr, Equals, "something went wrong\n")
+	c.Check(status.LastRun, Not(IsNil))
+	c.Check(status.Error, Not(Equals), "")
+}
+
+func (s *ExecProxySuite) TestExecProxyStatusWithoutRewrite(c *C) {
+	exporterConfig := s.initProxyScript(c, stderrExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
+	c.Assert(execProxy, Not(IsNil))
+
+	// Without rewriting, status metrics are still labelled with the backend name so the
+	// status of two backends on one path are distinct series.
+	rewriter := &rewriteProxy{
+		name:   exporterConfig.Name,
+		proxy:  execProxy,
+		labels: model.LabelSet{},
+	}
+
+	mfs, err := rewriter.Scrape(context.Background(), nil)
+	c.Check(err, Not(IsNil))
+	c.Assert(len(mfs) > 0, Equals, true)
+	c.Check(mfs[0].GetName(), Equals, execExitCodeMetricName)
+	c.Assert(mfs[0].GetMetric()[0].GetLabel(), HasLen, 1)
+	c.Check(mfs[0].GetMetric()[0].GetLabel()[0].GetName(), Equals, reverseProxyNameLabel)
+	c.Check(mfs[0].GetMetric()[0].GetLabel()[0].GetValue(), Equals, exporterConfig.Name)
+}
+
+func (s *ExecProxySuite) TestTailBuffer(c *C) {
+	tb := newTailBuffer(8)
+	tb.Write([]byte("0123"))
+	c.Check(tb.String(), Equals, "0123")
+	tb.Write([]byte("456789"))
+	c.Check(tb.String(), Equals, "23456789")
+	tb.Write([]byte("abcdefghijk"))
+	c.Check(tb.String(), Equals, "defghijk")
+}
+
+const sandboxedExecProxyScript = `#!/bin/bash
+cat << EOF
+test_open_files $(ulimit -n)
+test_cpu_time $(ulimit -t)
+test_address_space_kb $(ulimit -v)
+test_nice $(nice)
+EOF
+`
+
+const uidExecProxyScript = `#!/bin/bash
+echo "test_uid $(id -u)"
+`
+
+func (s *ExecProxySuite) TestExecProxySandbox(c *C) {
+	exporterConfig := s.initProxyScript(c, sandboxedExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	nice := 5
+	exporterConfig.OpenFilesLimit = 64
+	exporterConfig.CPUTimeLimit = model.Duration(time.Millisecond * 1500)
+	exporterConfig.AddressSpaceLimit = 1 << 30
+	exporterConfig.Nice = &nice
+
+	sandbox, err := newExecSandbox(&exporterConfig.ExecSandboxConfig)
+	c.Assert(err, IsNil)
+	execProxy, err := newExecProxy(&exporterConfig, sandbox)
+	c.Assert(err, IsNil)
+	c.Assert(execProxy, Not(IsNil))
+	c.Assert(execProxy.sandbox, Not(IsNil))
+
+	mfs, err := execProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil, Commentf("stderr: %s", execProxy.status.Status().Stderr))
+
+	values := map[string]float64{}
+	for _, mf := range mfs {
+		values[mf.GetName()] = mf.GetMetric()[0].GetUntyped().GetValue()
+	}
+	c.Check(values["test_open_files"], Equals, float64(64))
+	c.Check(values["test_cpu_time"], Equals, float64(2), Commentf("cpu time should be rounded up to seconds"))
+	c.Check(values["test_address_space_kb"], Equals, float64(1<<20))
+	c.Check(values["test_nice"], Equals, float64(5))
+}
+
+func (s *ExecProxySuite) TestExecProxySandboxUser(c *C) {
+	if os.Getuid() != 0 {
+		c.Skip("changing the exec user requires root")
+	}
+
+	exporterConfig := s.initProxyScript(c, uidExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+	os.Chmod(exporterConfig.Command, os.FileMode(0755))
+
+	exporterConfig.User = "65534"
+
+	sandbox, err := newExecSandbox(&exporterConfig.ExecSandboxConfig)
+	c.Assert(err, IsNil)
+	execProxy, err := newExecProxy(&exporterConfig, sandbox)
+	c.Assert(err, IsNil)
+	c.Assert(execProxy, Not(IsNil))
+
+	mfs, err := execProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil, Commentf("stderr: %s", execProxy.status.Status().Stderr))
+
+	c.Assert(mfs, HasLen, 1)
+	c.Check(mfs[0].GetMetric()[0].GetUntyped().GetValue(), Equals, float64(65534))
+}
+
+func (s *ExecProxySuite) TestExecSandboxUnknownUser(c *C) {
+	_, err := newExecSandbox(&config.ExecSandboxConfig{User: "reverse-exporter-no-such-user"})
+	c.Check(errors.Is(err, ErrExecSandboxUnknownUser), Equals, true, Commentf("got error: %v", err))
+}
+
+// floodingExecProxyScript writes metrics forever.
+const floodingExecProxyScript = `#!/bin/bash
+while true; do
+	echo "test_metric_flood 1"
+done
+`
+
+func (s *ExecProxySuite) TestExecProxyMaxBytes(c *C) {
+	exporterConfig := s.initProxyScript(c, floodingExecProxyScript)
+	defer os.Remove(exporterConfig.Command)
+
+	exporterConfig.MaxBytes = 4096
+
+	execProxy, err := newExecProxy(&exporterConfig, nil)
+	c.Assert(err, IsNil)
+	c.Assert(execProxy, Not(IsNil))
+
+	tctx, cancelFn := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancelFn()
+
+	// The script is killed once it exceeds the limit rather than running until the timeout.
+	_, err = execProxy.Scrape(tctx, nil)
+	c.Check(errors.Is(err, ErrMaxBytesExceeded), Equals, true, Commentf("got error: %v", err))
+	c.Check(tctx.Err(), IsNil)
+}
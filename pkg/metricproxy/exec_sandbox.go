@@ -0,0 +1,175 @@
+package metricproxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/moby/moby/pkg/reexec"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+)
+
+// execSandboxReexecName is the name the binary is re-executed under to apply resource
+// limits before executing a script.
+const execSandboxReexecName = "reverse_exporter-exec-sandbox"
+
+const (
+	execSandboxFlagCPU    = "rlimit-cpu"
+	execSandboxFlagAS     = "rlimit-as"
+	execSandboxFlagNoFile = "rlimit-nofile"
+	execSandboxFlagNice   = "nice"
+)
+
+var (
+	// ErrExecSandboxUnsupported is returned when privileges or limits are configured on a
+	// platform which does not support them.
+	ErrExecSandboxUnsupported = errors.New("exec user, group and resource limits are not supported on this platform")
+	// ErrExecSandboxUnknownUser is returned when the user or group of a script can't be found.
+	ErrExecSandboxUnknownUser = errors.New("could not find exec user or group")
+)
+
+// execSandbox holds the resolved privileges and resource limits scripts are executed with.
+type execSandbox struct {
+	uid *uint32
+	gid *uint32
+	// cpuTimeLimit is in seconds
+	cpuTimeLimit      uint64
+	addressSpaceLimit uint64
+	openFilesLimit    uint64
+	nice              *int
+}
+
+// newExecSandbox resolves the sandbox configuration of a script. It returns nil if no
+// sandboxing is configured.
+func newExecSandbox(config *config.ExecSandboxConfig) (*execSandbox, error) {
+	if config.User == "" && config.Group == "" && config.CPUTimeLimit == 0 &&
+		config.AddressSpaceLimit == 0 && config.OpenFilesLimit == 0 && config.Nice == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	if !execSandboxSupported {
+		return nil, ErrExecSandboxUnsupported
+	}
+
+	sandbox := &execSandbox{
+		addressSpaceLimit: config.AddressSpaceLimit,
+		openFilesLimit:    config.OpenFilesLimit,
+		nice:              config.Nice,
+	}
+
+	if config.CPUTimeLimit > 0 {
+		// RLIMIT_CPU has a resolution of seconds, so round up.
+		sandbox.cpuTimeLimit = uint64(math.Ceil(time.Duration(config.CPUTimeLimit).Seconds()))
+	}
+
+	if config.User != "" {
+		execUser, err := lookupUser(config.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := parseID(execUser.Uid)
+		if err != nil {
+			return nil, errors.Wrapf(err, "user %s", config.User)
+		}
+		gid, err := parseID(execUser.Gid)
+		if err != nil {
+			return nil, errors.Wrapf(err, "user %s", config.User)
+		}
+		sandbox.uid = &uid
+		sandbox.gid = &gid
+	}
+
+	if config.Group != "" {
+		execGroup, err := lookupGroup(config.Group)
+		if err != nil {
+			return nil, err
+		}
+		gid, err := parseID(execGroup.Gid)
+		if err != nil {
+			return nil, errors.Wrapf(err, "group %s", config.Group)
+		}
+		sandbox.gid = &gid
+	}
+
+	return sandbox, nil
+}
+
+// lookupUser finds a user by name or uid.
+func lookupUser(name string) (*user.User, error) {
+	execUser, err := user.Lookup(name)
+	if err == nil {
+		return execUser, nil
+	}
+	execUser, err = user.LookupId(name)
+	if err != nil {
+		return nil, errors.Wrapf(ErrExecSandboxUnknownUser, "user %s: %v", name, err)
+	}
+	return execUser, nil
+}
+
+// lookupGroup finds a group by name or gid.
+func lookupGroup(name string) (*user.Group, error) {
+	execGroup, err := user.LookupGroup(name)
+	if err == nil {
+		return execGroup, nil
+	}
+	execGroup, err = user.LookupGroupId(name)
+	if err != nil {
+		return nil, errors.Wrapf(ErrExecSandboxUnknownUser, "group %s: %v", name, err)
+	}
+	return execGroup, nil
+}
+
+func parseID(id string) (uint32, error) {
+	parsed, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid id %s", id)
+	}
+	return uint32(parsed), nil
+}
+
+// hasLimits returns true if the sandbox requires the helper process to apply limits.
+func (sb *execSandbox) hasLimits() bool {
+	return sb.cpuTimeLimit > 0 || sb.addressSpaceLimit > 0 || sb.openFilesLimit > 0 || sb.nice != nil
+}
+
+// command returns an exec.Cmd which executes the script at path inside the sandbox. A nil
+// sandbox executes the script directly.
+func (sb *execSandbox) command(ctx context.Context, path string, args ...string) *exec.Cmd {
+	if sb == nil {
+		return exec.CommandContext(ctx, path, args...) //nolint:gosec
+	}
+
+	var cmd *exec.Cmd
+	if sb.hasLimits() {
+		// Re-execute ourselves as a helper which applies the limits and then execs the script.
+		helperArgs := []string{execSandboxReexecName}
+		if sb.cpuTimeLimit > 0 {
+			helperArgs = append(helperArgs, fmt.Sprintf("--%s=%d", execSandboxFlagCPU, sb.cpuTimeLimit))
+		}
+		if sb.addressSpaceLimit > 0 {
+			helperArgs = append(helperArgs, fmt.Sprintf("--%s=%d", execSandboxFlagAS, sb.addressSpaceLimit))
+		}
+		if sb.openFilesLimit > 0 {
+			helperArgs = append(helperArgs, fmt.Sprintf("--%s=%d", execSandboxFlagNoFile, sb.openFilesLimit))
+		}
+		if sb.nice != nil {
+			helperArgs = append(helperArgs, fmt.Sprintf("--%s=%d", execSandboxFlagNice, *sb.nice))
+		}
+		helperArgs = append(helperArgs, "--", path)
+		helperArgs = append(helperArgs, args...)
+
+		cmd = exec.CommandContext(ctx, reexec.Self())
+		cmd.Args = helperArgs
+	} else {
+		cmd = exec.CommandContext(ctx, path, args...) //nolint:gosec
+	}
+
+	sb.applyCredential(cmd)
+	return cmd
+}
@@ -0,0 +1,105 @@
+//go:build !windows
+// +build !windows
+
+package metricproxy
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/moby/moby/pkg/reexec"
+)
+
+const execSandboxSupported = true
+
+//nolint:gochecknoinits
+func init() {
+	reexec.Register(execSandboxReexecName, execSandboxMain)
+}
+
+// applyCredential sets the user and group the command is executed as.
+func (sb *execSandbox) applyCredential(cmd *exec.Cmd) {
+	if sb.uid == nil && sb.gid == nil {
+		return
+	}
+
+	credential := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+	if sb.uid != nil {
+		credential.Uid = *sb.uid
+	}
+	if sb.gid != nil {
+		credential.Gid = *sb.gid
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+}
+
+// execSandboxMain is the entrypoint of the re-executed sandbox helper. It applies the
+// resource limits given on the command line to itself, and then execs the script.
+func execSandboxMain() {
+	// The nice level is set on the calling thread only, so exec from the same thread.
+	runtime.LockOSThread()
+
+	flags := flag.NewFlagSet(execSandboxReexecName, flag.ContinueOnError)
+	cpuTimeLimit := flags.Uint64(execSandboxFlagCPU, 0, "RLIMIT_CPU in seconds")
+	addressSpaceLimit := flags.Uint64(execSandboxFlagAS, 0, "RLIMIT_AS in bytes")
+	openFilesLimit := flags.Uint64(execSandboxFlagNoFile, 0, "RLIMIT_NOFILE")
+	nice := flags.Int(execSandboxFlagNice, 0, "nice level")
+
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		execSandboxFail(err)
+	}
+
+	if flags.NArg() < 1 {
+		execSandboxFail(fmt.Errorf("no command specified")) //nolint:goerr113
+	}
+
+	limits := map[int]uint64{
+		syscall.RLIMIT_CPU:    *cpuTimeLimit,
+		syscall.RLIMIT_AS:     *addressSpaceLimit,
+		syscall.RLIMIT_NOFILE: *openFilesLimit,
+	}
+	for resource, limit := range limits {
+		if limit == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			execSandboxFail(fmt.Errorf("setrlimit %d failed: %w", resource, err))
+		}
+	}
+
+	niceSet := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == execSandboxFlagNice {
+			niceSet = true
+		}
+	})
+	if niceSet {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *nice); err != nil {
+			execSandboxFail(fmt.Errorf("setpriority failed: %w", err))
+		}
+	}
+
+	command, err := exec.LookPath(flags.Arg(0))
+	if err != nil {
+		execSandboxFail(err)
+	}
+
+	if err := syscall.Exec(command, flags.Args(), os.Environ()); err != nil { //nolint:gosec
+		execSandboxFail(fmt.Errorf("exec failed: %w", err))
+	}
+}
+
+// execSandboxFail reports a sandbox helper failure on stderr, where it is captured
+// as the script's stderr, and exits.
+func execSandboxFail(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", execSandboxReexecName, err)
+	os.Exit(127) //nolint:gomnd
+}
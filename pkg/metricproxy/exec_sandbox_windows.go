@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package metricproxy
+
+import (
+	"os/exec"
+)
+
+const execSandboxSupported = false
+
+// applyCredential is a no-op since sandboxing is not supported on Windows.
+func (sb *execSandbox) applyCredential(cmd *exec.Cmd) {}
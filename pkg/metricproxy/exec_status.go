@@ -0,0 +1,150 @@
+package metricproxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// execStderrTailBytes is the maximum amount of stderr retained from a script execution.
+	execStderrTailBytes = 4096
+
+	execExitCodeMetricName = "reverse_exporter_exec_exit_code"
+	execDurationMetricName = "reverse_exporter_exec_duration_seconds"
+)
+
+// tailBuffer is an io.Writer which retains only the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{
+		max: max,
+		buf: make([]byte, 0, max),
+	}
+}
+
+// Write implements io.Writer.
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	written := len(p)
+	if len(p) >= tb.max {
+		tb.buf = append(tb.buf[:0], p[len(p)-tb.max:]...)
+		return written, nil
+	}
+
+	if overflow := len(tb.buf) + len(p) - tb.max; overflow > 0 {
+		tb.buf = append(tb.buf[:0], tb.buf[overflow:]...)
+	}
+	tb.buf = append(tb.buf, p...)
+	return written, nil
+}
+
+// String returns the retained tail of the written data.
+func (tb *tailBuffer) String() string {
+	return string(tb.buf)
+}
+
+// execStatus records the outcome of the most recent execution of a script.
+type execStatus struct {
+	mtx *sync.RWMutex
+
+	hasRun   bool
+	lastRun  time.Time
+	exitCode int
+	duration time.Duration
+	stderr   string
+	err      error
+}
+
+// ExecStatus is the debugging view of the last execution of a script.
+type ExecStatus struct {
+	LastRun         *time.Time `json:"last_run,omitempty"`
+	ExitCode        int        `json:"exit_code"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Stderr          string     `json:"stderr"`
+	Error           string     `json:"error,omitempty"`
+}
+
+func newExecStatus() *execStatus {
+	return &execStatus{
+		mtx: &sync.RWMutex{},
+	}
+}
+
+// record stores the outcome of an execution.
+func (es *execStatus) record(started time.Time, duration time.Duration, exitCode int, stderr string, err error) {
+	es.mtx.Lock()
+	defer es.mtx.Unlock()
+
+	es.hasRun = true
+	es.lastRun = started
+	es.duration = duration
+	es.exitCode = exitCode
+	es.stderr = stderr
+	es.err = err
+}
+
+// Status returns the debugging view of the last execution.
+func (es *execStatus) Status() ExecStatus {
+	es.mtx.RLock()
+	defer es.mtx.RUnlock()
+
+	status := ExecStatus{
+		ExitCode:        es.exitCode,
+		DurationSeconds: es.duration.Seconds(),
+		Stderr:          es.stderr,
+	}
+	if es.hasRun {
+		lastRun := es.lastRun
+		status.LastRun = &lastRun
+	}
+	if es.err != nil {
+		status.Error = es.err.Error()
+	}
+	return status
+}
+
+// statusMetrics returns synthetic metrics describing the last execution. Nothing is
+// returned if the script has not run yet.
+func (es *execStatus) statusMetrics() []*dto.MetricFamily {
+	es.mtx.RLock()
+	defer es.mtx.RUnlock()
+
+	if !es.hasRun {
+		return []*dto.MetricFamily{}
+	}
+
+	return []*dto.MetricFamily{
+		newGaugeFamily(execExitCodeMetricName, "Exit code of the last execution of the exporter script.", float64(es.exitCode)),
+		newGaugeFamily(execDurationMetricName, "Duration of the last execution of the exporter script.", es.duration.Seconds()),
+	}
+}
+
+// newGaugeFamily returns a metric family containing a single unlabelled gauge.
+func newGaugeFamily(name string, help string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(value)}},
+		},
+	}
+}
+
+// newCounterFamily returns a metric family containing a single unlabelled counter.
+func newCounterFamily(name string, help string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{Counter: &dto.Counter{Value: proto.Float64(value)}},
+		},
+	}
+}
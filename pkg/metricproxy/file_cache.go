@@ -0,0 +1,199 @@
+package metricproxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// textfileLoader reads and decodes a file of metrics, returning the info of the file which
+// was actually read.
+type textfileLoader func(ctx context.Context, path string) ([]*dto.MetricFamily, os.FileInfo, error)
+
+// textfileCache caches the decoded metrics of files so they are only re-parsed when they
+// change. Changes are detected with inotify where available, and otherwise (and additionally)
+// by comparing the identity, mtime and size of the file with the one which was parsed.
+type textfileCache struct {
+	mtx     *sync.Mutex
+	entries map[string]*textfileCacheEntry
+	// changes counts the change events received for each path which is cached or matches
+	changes map[string]uint64
+	// matches returns true for the paths of files which may be read through the cache
+	matches func(path string) bool
+
+	// watcher is nil if inotify is unavailable
+	watcher     *fsnotify.Watcher
+	watchedDirs map[string]struct{}
+
+	log *zap.Logger
+}
+
+// textfileCacheEntry is the parsed content of a file.
+type textfileCacheEntry struct {
+	info os.FileInfo
+	mfs  []*dto.MetricFamily
+	// changes is the number of change events received before the file was read
+	changes uint64
+}
+
+// newTextfileCache initializes a new textfileCache. Change events are only counted for
+// cached paths and those matches returns true for, so events of other files in watched
+// directories (i.e. the temporary files of atomic writes) are not tracked.
+func newTextfileCache(log *zap.Logger, matches func(path string) bool) *textfileCache {
+	cache := &textfileCache{
+		mtx:         &sync.Mutex{},
+		entries:     make(map[string]*textfileCacheEntry),
+		changes:     make(map[string]uint64),
+		matches:     matches,
+		watchedDirs: make(map[string]struct{}),
+		log:         log,
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warn("File watching unavailable - falling back to checking mtime and size", zap.Error(err))
+		return cache
+	}
+	cache.watcher = watcher
+	go cache.watch()
+
+	return cache
+}
+
+// watch records change events from the watcher until it is closed.
+func (tc *textfileCache) watch() {
+	for {
+		select {
+		case event, ok := <-tc.watcher.Events:
+			if !ok {
+				return
+			}
+			path := filepath.Clean(event.Name)
+			tc.mtx.Lock()
+			if _, found := tc.entries[path]; found || tc.matches(path) {
+				tc.changes[path]++
+			}
+			tc.mtx.Unlock()
+		case err, ok := <-tc.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost, so invalidate everything.
+			tc.log.Warn("Error watching files - invalidating cache", zap.Error(err))
+			tc.mtx.Lock()
+			for path := range tc.entries {
+				tc.changes[path]++
+			}
+			tc.mtx.Unlock()
+		}
+	}
+}
+
+// get returns a copy of the metrics of the file at path, reading it with load if it has
+// changed since it was last read. The returned info is of the file the metrics were read from.
+func (tc *textfileCache) get(ctx context.Context, path string, load textfileLoader) ([]*dto.MetricFamily, os.FileInfo, error) {
+	path = filepath.Clean(path)
+
+	st, err := os.Stat(path)
+	if err != nil {
+		tc.mtx.Lock()
+		delete(tc.entries, path)
+		tc.mtx.Unlock()
+	}
+
+	tc.mtx.Lock()
+	entry := tc.entries[path]
+	changes := tc.changes[path]
+	tc.mtx.Unlock()
+
+	if err == nil && entry != nil && entry.changes == changes && sameFileInfo(entry.info, st) {
+		return cloneMetricFamilies(entry.mfs), entry.info, nil
+	}
+
+	// Watch the directory rather than the file so replacing the file by rename is seen.
+	tc.watchDir(filepath.Dir(path))
+
+	// The file is opened once by load, so an atomic rename is either wholly seen or not.
+	mfs, info, err := load(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tc.mtx.Lock()
+	tc.entries[path] = &textfileCacheEntry{
+		info:    info,
+		mfs:     mfs,
+		changes: changes,
+	}
+	tc.mtx.Unlock()
+
+	return cloneMetricFamilies(mfs), info, nil
+}
+
+// close stops watching for changes.
+func (tc *textfileCache) close() {
+	if tc.watcher == nil {
+		return
+	}
+	if err := tc.watcher.Close(); err != nil {
+		tc.log.Debug("Error closing file watcher", zap.Error(err))
+	}
+}
+
+// watchDir starts watching a directory if it is not already watched.
+func (tc *textfileCache) watchDir(dir string) {
+	if tc.watcher == nil {
+		return
+	}
+
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+
+	if _, found := tc.watchedDirs[dir]; found {
+		return
+	}
+	if err := tc.watcher.Add(dir); err != nil {
+		tc.log.Debug("Could not watch directory - relying on mtime and size", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+	tc.watchedDirs[dir] = struct{}{}
+}
+
+// prune removes the entries of files which are not in paths.
+func (tc *textfileCache) prune(paths []string) {
+	keep := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		keep[filepath.Clean(path)] = struct{}{}
+	}
+
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	for path := range tc.entries {
+		if _, found := keep[path]; !found {
+			delete(tc.entries, path)
+			delete(tc.changes, path)
+		}
+	}
+}
+
+// sameFileInfo returns true if two infos describe the same unmodified file.
+func sameFileInfo(a os.FileInfo, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// cloneMetricFamilies deep copies metric families so cached values can't be modified by
+// later proxy stages.
+func cloneMetricFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	cloned := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		cloned = append(cloned, proto.Clone(mf).(*dto.MetricFamily)) //nolint:forcetypeassert
+	}
+	return cloned
+}
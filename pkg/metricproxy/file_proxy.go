@@ -2,33 +2,100 @@ package metricproxy
 
 import (
 	"context"
+	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/wrouesnel/reverse_exporter/pkg/config"
 	"go.uber.org/zap"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hashicorp/errwrap"
 	"github.com/moby/moby/pkg/ioutils"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 // ensure fileProxy implements MetricProxy.
 var _ MetricProxy = &fileProxy{}
 
+// textfileCompressedExts are the extensions of compressed files read from a directory.
+var textfileCompressedExts = []string{".gz", ".zst"} //nolint:gochecknoglobals
+
+const (
+	// textfileDirectoryGlob is the pattern of files read from a directory, which may also
+	// have a compression extension.
+	textfileDirectoryGlob = "*.prom"
+	// textfileLabel is the label identifying the file metrics were read from.
+	textfileLabel = "file"
+	// textfileGlobChars are the characters which make a path a glob.
+	textfileGlobChars = "*?["
+
+	textfileMtimeMetricName       = "reverse_exporter_textfile_mtime_seconds"
+	textfileAgeMetricName         = "reverse_exporter_textfile_age_seconds"
+	textfileScrapeErrorMetricName = "reverse_exporter_textfile_scrape_error"
+)
+
 // fileProxy implements a reverse metric proxy which simply reads a file
 // of text-formatted metrics from disk (similar to the node_exporter textfile collector).
+// If the path is a directory or a glob, all matching files are read and merged.
 type fileProxy struct {
-	filePath string
-	log      *zap.Logger
+	filePath    string
+	fileLabel   bool
+	maxAge      time.Duration
+	staleAction config.StaleAction
+	maxBytes    uint64
+	// timestamps is set to config.TimestampsProductionTime to timestamp the metrics of
+	// each file with its mtime
+	timestamps config.TimestampMode
+
+	// cache holds the parsed metrics of each file until it changes
+	cache *textfileCache
+
+	// lastFiles is the status of each file at the last scrape
+	lastFiles    []TextfileStatus
+	lastFilesMtx *sync.Mutex
+
+	log *zap.Logger
+}
+
+// TextfileStatus is the debugging view of a file read by a file exporter.
+type TextfileStatus struct {
+	Path string `json:"path"`
+	// Name is the file label value of the file, its path relative to the directory or glob.
+	Name  string     `json:"name"`
+	Mtime *time.Time `json:"mtime,omitempty"`
+	Stale bool       `json:"stale"`
+	Error string     `json:"error,omitempty"`
 }
 
 func newFileProxy(config *config.FileExporterConfig) *fileProxy {
-	return &fileProxy{
-		filePath: config.Path,
-		log:      zap.L(),
+	log := zap.L()
+	newProxy := &fileProxy{
+		filePath:     config.Path,
+		fileLabel:    config.FileLabel,
+		maxAge:       time.Duration(config.MaxAge),
+		staleAction:  config.StaleAction,
+		maxBytes:     config.MaxBytes,
+		timestamps:   config.Timestamps,
+		lastFiles:    make([]TextfileStatus, 0),
+		lastFilesMtx: &sync.Mutex{},
+		log:          log,
 	}
+	newProxy.cache = newTextfileCache(log, newProxy.matchesFile)
+	return newProxy
+}
+
+// stop implements stopper by closing the file watcher of the cache.
+func (fp *fileProxy) stop() {
+	fp.cache.close()
 }
 
 // Scrape scrapes the underlying metric endpoint. values are URL parameters
@@ -36,9 +103,154 @@ func newFileProxy(config *config.FileExporterConfig) *fileProxy {
 func (fp *fileProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
 	retMetrics := make([]*dto.MetricFamily, 0)
 
-	metricFile, ferr := os.Open(fp.filePath)
+	patterns, root, multi := fp.globPatterns()
+	if !multi {
+		fileName := textfileName(root, fp.filePath)
+		mfs, status, err := fp.scrapeFile(ctx, fp.filePath, fileName)
+		fp.setLastFiles([]TextfileStatus{status})
+		if err != nil {
+			return retMetrics, err
+		}
+		return mfs, nil
+	}
+
+	paths := make([]string, 0)
+	for _, pattern := range patterns {
+		matches, gerr := filepath.Glob(pattern)
+		if gerr != nil {
+			return retMetrics, errwrap.Wrap(ErrFileProxyScrapeError, gerr)
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	mtimeFamily := newTextfileFamily(textfileMtimeMetricName, "Unixtime mtime of textfiles successfully read.")
+	errorFamily := newTextfileFamily(textfileScrapeErrorMetricName, "1 if there was an error reading the textfile, 0 otherwise.")
+	statuses := make([]TextfileStatus, 0, len(paths))
+	merged := make(map[string]*dto.MetricFamily)
+
+	for _, path := range paths {
+		fileName := textfileName(root, path)
+
+		mfs, status, err := fp.scrapeFile(ctx, path, fileName)
+		if err == nil {
+			err = mergeTextfileFamilies(merged, mfs)
+		}
+
+		if err != nil {
+			// A broken file is skipped rather than failing the whole exporter.
+			fp.log.Error("Skipping file which could not be read", zap.String("path", path), zap.Error(err))
+			status.Error = err.Error()
+			addTextfileMetric(errorFamily, fileName, 1)
+		} else {
+			addTextfileMetric(errorFamily, fileName, 0)
+		}
+		if status.Mtime != nil {
+			addTextfileMetric(mtimeFamily, fileName, float64(status.Mtime.UnixNano())/float64(time.Second))
+		}
+		statuses = append(statuses, status)
+	}
+	fp.setLastFiles(statuses)
+	fp.cache.prune(paths)
+
+	// Return the merged families, followed by the per-file metadata.
+	retMetrics = append(retMetrics, orderedTextfileFamilies(merged)...)
+	if len(mtimeFamily.Metric) > 0 {
+		retMetrics = append(retMetrics, mtimeFamily)
+	}
+	if len(errorFamily.Metric) > 0 {
+		retMetrics = append(retMetrics, errorFamily)
+	}
+
+	return retMetrics, nil
+}
+
+// scrapeFile returns the metrics of a single file, and applies the stale action if the file
+// is older than the max age. name is the file label value of the file.
+func (fp *fileProxy) scrapeFile(ctx context.Context, path string, name string) ([]*dto.MetricFamily, TextfileStatus, error) {
+	status := TextfileStatus{Path: path, Name: name}
+
+	mfs, info, err := fp.cache.get(ctx, path, fp.readFile)
+	if err != nil {
+		status.Error = err.Error()
+		return nil, status, err
+	}
+	if fp.fileLabel {
+		rewriteMetrics(model.LabelSet{textfileLabel: model.LabelValue(name)}, mfs)
+	}
+
+	mtime := info.ModTime()
+	status.Mtime = &mtime
+
+	age := time.Since(mtime)
+	if fp.maxAge == 0 || age <= fp.maxAge {
+		return mfs, status, nil
+	}
+
+	status.Stale = true
+	fp.log.Debug("File is stale", zap.String("path", path), zap.Duration("age", age), zap.Duration("max_age", fp.maxAge))
+
+	switch fp.staleAction {
+	case config.StaleActionDrop:
+		return []*dto.MetricFamily{}, status, nil
+	case config.StaleActionLabel:
+		rewriteMetrics(model.LabelSet{staleLabel: "true"}, mfs)
+		return mfs, status, nil
+	default:
+		err := errors.Wrapf(ErrFileProxyStale, "age %s", age)
+		status.Error = err.Error()
+		return nil, status, err
+	}
+}
+
+// globPatterns returns the globs of files to read, the directory files are named relative
+// to, and whether the path refers to multiple files (a directory or a glob).
+func (fp *fileProxy) globPatterns() ([]string, string, bool) {
+	if strings.ContainsAny(fp.filePath, textfileGlobChars) {
+		// Files are named relative to the deepest directory without a glob, so files with
+		// the same name in different matched directories are distinguished.
+		root := fp.filePath
+		for strings.ContainsAny(root, textfileGlobChars) {
+			root = filepath.Dir(root)
+		}
+		return []string{fp.filePath}, root, true
+	}
+	if st, err := os.Stat(fp.filePath); err == nil && st.IsDir() {
+		patterns := make([]string, 0, len(textfileCompressedExts)+1)
+		patterns = append(patterns, filepath.Join(fp.filePath, textfileDirectoryGlob))
+		for _, ext := range textfileCompressedExts {
+			patterns = append(patterns, filepath.Join(fp.filePath, textfileDirectoryGlob+ext))
+		}
+		return patterns, fp.filePath, true
+	}
+	return []string{fp.filePath}, filepath.Dir(fp.filePath), false
+}
+
+// matchesFile returns true if path is one of the files the proxy reads.
+func (fp *fileProxy) matchesFile(path string) bool {
+	patterns, _, _ := fp.globPatterns()
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(filepath.Clean(pattern), path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// textfileName returns the file label value of a file, its path relative to root.
+func textfileName(root string, path string) string {
+	name, err := filepath.Rel(root, path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(name)
+}
+
+// readFile reads and decodes a single file of metrics, returning the info of the opened file.
+func (fp *fileProxy) readFile(ctx context.Context, path string) ([]*dto.MetricFamily, os.FileInfo, error) {
+	metricFile, ferr := os.Open(path)
 	if ferr != nil {
-		return retMetrics, errwrap.Wrap(ErrFileProxyScrapeError, ferr)
+		return nil, nil, errwrap.Wrap(ErrFileProxyScrapeError, ferr)
 	}
 
 	// Ensure weird file behavior doesn't leave multiple open processes
@@ -49,10 +261,116 @@ func (fp *fileProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.Metr
 		}
 	}()
 
-	mfs, derr := decodeMetrics(readCloser, expfmt.FmtText)
+	st, serr := metricFile.Stat()
+	if serr != nil {
+		return nil, nil, errwrap.Wrap(ErrFileProxyScrapeError, serr)
+	}
+
+	// Both the compressed and decompressed sizes are limited.
+	decompressor, cerr := newDecompressingReader(newMaxBytesReader(readCloser, fp.maxBytes), path)
+	if cerr != nil {
+		return nil, nil, errwrap.Wrap(ErrFileProxyScrapeError, cerr)
+	}
+	defer decompressor.Close()
+
+	mfs, derr := decodeMetrics(newMaxBytesReader(decompressor, fp.maxBytes), expfmt.FmtText)
+	if errors.Is(derr, ErrMaxBytesExceeded) {
+		return nil, nil, errors.Wrapf(derr, "file %s", path)
+	}
 	if derr != nil {
-		return retMetrics, errwrap.Wrap(ErrFileProxyScrapeError, derr)
+		return nil, nil, errwrap.Wrap(ErrFileProxyScrapeError, derr)
+	}
+
+	if fp.timestamps == config.TimestampsProductionTime {
+		setTimestamps(mfs, st.ModTime())
+	}
+
+	return mfs, st, nil
+}
+
+// setLastFiles records the status of the files read by the last scrape.
+func (fp *fileProxy) setLastFiles(statuses []TextfileStatus) {
+	fp.lastFilesMtx.Lock()
+	defer fp.lastFilesMtx.Unlock()
+	fp.lastFiles = statuses
+}
+
+// Status implements StatusReporter.
+func (fp *fileProxy) Status() interface{} {
+	fp.lastFilesMtx.Lock()
+	defer fp.lastFilesMtx.Unlock()
+	return fp.lastFiles
+}
+
+// statusMetrics implements statusMetricsProvider. The age of each file read by the last
+// scrape is returned even if the file is stale.
+func (fp *fileProxy) statusMetrics() []*dto.MetricFamily {
+	ageFamily := newTextfileFamily(textfileAgeMetricName, "Age in seconds of the mtime of textfiles.")
+
+	fp.lastFilesMtx.Lock()
+	for _, status := range fp.lastFiles {
+		if status.Mtime != nil {
+			addTextfileMetric(ageFamily, status.Name, time.Since(*status.Mtime).Seconds())
+		}
+	}
+	fp.lastFilesMtx.Unlock()
+
+	if len(ageFamily.Metric) == 0 {
+		return []*dto.MetricFamily{}
+	}
+	return []*dto.MetricFamily{ageFamily}
+}
+
+// mergeTextfileFamilies merges the families of one file into merged. Nothing is merged if
+// a family conflicts with the type of a family of the same name from another file.
+func mergeTextfileFamilies(merged map[string]*dto.MetricFamily, mfs []*dto.MetricFamily) error {
+	for _, mf := range mfs {
+		if existing, found := merged[mf.GetName()]; found && existing.GetType() != mf.GetType() {
+			return errwrap.Wrap(ErrFileProxyScrapeError, fmt.Errorf("metric family %s has type %s but is %s in another file", //nolint:goerr113
+				mf.GetName(), mf.GetType(), existing.GetType()))
+		}
+	}
+
+	for _, mf := range mfs {
+		existing, found := merged[mf.GetName()]
+		if !found {
+			merged[mf.GetName()] = mf
+			continue
+		}
+		existing.Metric = append(existing.Metric, mf.Metric...)
+	}
+	return nil
+}
+
+// orderedTextfileFamilies returns the merged families sorted by name.
+func orderedTextfileFamilies(merged map[string]*dto.MetricFamily) []*dto.MetricFamily {
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+
+	mfs := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		mfs = append(mfs, merged[name])
+	}
+	return mfs
+}
+
+// newTextfileFamily returns an empty gauge family for per-file metadata.
+func newTextfileFamily(name string, help string) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Help:   proto.String(help),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: make([]*dto.Metric, 0),
+	}
+}
 
-	return mfs, nil
+// addTextfileMetric adds a gauge for the given file to a per-file metadata family.
+func addTextfileMetric(mf *dto.MetricFamily, fileName string, value float64) {
+	mf.Metric = append(mf.Metric, &dto.Metric{
+		Label: []*dto.LabelPair{{Name: proto.String(textfileLabel), Value: proto.String(fileName)}},
+		Gauge: &dto.Gauge{Value: proto.Float64(value)},
+	})
 }
@@ -2,13 +2,24 @@
 package metricproxy
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 
 	"github.com/wrouesnel/reverse_exporter/pkg/config"
 
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -87,3 +98,300 @@ func (s *FileProxySuite) TestFileProxy(c *C) {
 	c.Check(err, Not(IsNil), Commentf("no error when file does not exist?"))
 	c.Check(len(mfs), Equals, 0, Commentf("got metrics but file shouldn't exist?"))
 }
+
+func (s *FileProxySuite) TestFileProxyDirectory(c *C) {
+	dir, err := ioutil.TempDir("", "file_proxy_test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.prom"), []byte(testFileMetrics), os.FileMode(0644))
+	ioutil.WriteFile(filepath.Join(dir, "b.prom"), []byte(testFileMetrics), os.FileMode(0644))
+	ioutil.WriteFile(filepath.Join(dir, "broken.prom"), []byte("constant_file_metric not_a_number\n"), os.FileMode(0644))
+	ioutil.WriteFile(filepath.Join(dir, "ignored.txt"), []byte("ignored_metric 1\n"), os.FileMode(0644))
+
+	config := config.FileExporterConfig{
+		Path:      dir,
+		FileLabel: true,
+		Exporter: config.Exporter{
+			Name: "test-file-exporter",
+		},
+	}
+
+	fileProxy := newFileProxy(&config)
+	c.Assert(fileProxy, Not(IsNil), Commentf("newFileProxy returned nil with valid config"))
+
+	mfs, err := fileProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil, Commentf("broken files should not fail the scrape"))
+
+	families := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	c.Assert(families, HasLen, 3)
+
+	// Metrics from both good files are merged into one family and labelled by file.
+	mf := families[testFileMetricName]
+	c.Assert(mf, Not(IsNil))
+	c.Assert(mf.GetMetric(), HasLen, 2)
+	for idx, fileName := range []string{"a.prom", "b.prom"} {
+		c.Check(mf.GetMetric()[idx].GetLabel()[0].GetName(), Equals, textfileLabel)
+		c.Check(mf.GetMetric()[idx].GetLabel()[0].GetValue(), Equals, fileName)
+	}
+
+	c.Check(families[textfileMtimeMetricName].GetMetric(), HasLen, 2)
+
+	scrapeErrors := make(map[string]float64)
+	for _, m := range families[textfileScrapeErrorMetricName].GetMetric() {
+		scrapeErrors[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+	}
+	c.Check(scrapeErrors, DeepEquals, map[string]float64{"a.prom": 0, "b.prom": 0, "broken.prom": 1})
+
+	// A glob selects only the matching files.
+	fileProxy.filePath = filepath.Join(dir, "a*")
+	mfs, err = fileProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs[0].GetMetric(), HasLen, 1)
+}
+
+func (s *FileProxySuite) TestFileProxyGlobSameName(c *C) {
+	dir, err := ioutil.TempDir("", "file_proxy_test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	for _, job := range []string{"backup", "cleanup"} {
+		c.Assert(os.Mkdir(filepath.Join(dir, job), os.FileMode(0755)), IsNil)
+		ioutil.WriteFile(filepath.Join(dir, job, "metrics.prom"), []byte(testFileMetrics), os.FileMode(0644))
+	}
+
+	config := config.FileExporterConfig{
+		Path:      filepath.Join(dir, "*", "metrics.prom"),
+		FileLabel: true,
+		Exporter: config.Exporter{
+			Name: "test-file-exporter",
+		},
+	}
+
+	fileProxy := newFileProxy(&config)
+	mfs, err := fileProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+
+	// Files are named relative to the glob root, so files with the same name are distinguished.
+	expected := []string{"backup/metrics.prom", "cleanup/metrics.prom"}
+	families := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	for _, name := range []string{testFileMetricName, textfileMtimeMetricName, textfileScrapeErrorMetricName} {
+		c.Assert(families[name].GetMetric(), HasLen, 2)
+		for idx, fileName := range expected {
+			c.Check(families[name].GetMetric()[idx].GetLabel()[0].GetValue(), Equals, fileName, Commentf("metric: %s", name))
+		}
+	}
+
+	ages := fileProxy.statusMetrics()
+	c.Assert(ages, HasLen, 1)
+	c.Assert(ages[0].GetMetric(), HasLen, 2)
+	for idx, fileName := range expected {
+		c.Check(ages[0].GetMetric()[idx].GetLabel()[0].GetValue(), Equals, fileName)
+	}
+}
+
+func (s *FileProxySuite) TestFileProxyCache(c *C) {
+	dir, err := ioutil.TempDir("", "file_proxy_test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "metrics.prom")
+	c.Assert(ioutil.WriteFile(filename, []byte("cached_metric 1\n"), os.FileMode(0644)), IsNil)
+
+	config := config.FileExporterConfig{
+		Path: filename,
+		Exporter: config.Exporter{
+			Name: "test-file-exporter",
+		},
+	}
+
+	fileProxy := newFileProxy(&config)
+	c.Assert(fileProxy, Not(IsNil), Commentf("newFileProxy returned nil with valid config"))
+
+	ctx := context.Background()
+	mfs, err := fileProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 1)
+	c.Check(fileProxy.cache.entries, HasLen, 1)
+
+	// Modifying returned metrics must not modify the cache.
+	mfs[0].GetMetric()[0].GetUntyped().Value = nil
+	mfs, err = fileProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs[0].GetMetric()[0].GetUntyped().GetValue(), Equals, float64(1))
+
+	// Atomically replacing the file is seen on the next scrape.
+	tempname := filepath.Join(dir, "metrics.prom.tmp")
+	c.Assert(ioutil.WriteFile(tempname, []byte("cached_metric 2\n"), os.FileMode(0644)), IsNil)
+	c.Assert(os.Rename(tempname, filename), IsNil)
+
+	mfs, err = fileProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs[0].GetMetric()[0].GetUntyped().GetValue(), Equals, float64(2))
+
+	// Only the changes of the read file are tracked, not those of the temporary file.
+	<-time.After(time.Millisecond * 100)
+	fileProxy.cache.mtx.Lock()
+	_, found := fileProxy.cache.changes[tempname]
+	fileProxy.cache.mtx.Unlock()
+	c.Check(found, Equals, false)
+
+	// An in-place rewrite is seen as well.
+	c.Assert(ioutil.WriteFile(filename, []byte("cached_metric 3\n"), os.FileMode(0644)), IsNil)
+	c.Assert(os.Chtimes(filename, time.Unix(0, 0), time.Unix(0, 0)), IsNil)
+
+	mfs, err = fileProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs[0].GetMetric()[0].GetUntyped().GetValue(), Equals, float64(3))
+
+	// Stopping closes the file watcher.
+	fileProxy.stop()
+	c.Check(fileProxy.cache.watcher.Add(dir), NotNil)
+}
+
+func (s *FileProxySuite) TestFileProxyMaxAge(c *C) {
+	dir, err := ioutil.TempDir("", "file_proxy_test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "metrics.prom")
+	c.Assert(ioutil.WriteFile(filename, []byte(testFileMetrics), os.FileMode(0644)), IsNil)
+	old := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(filename, old, old), IsNil)
+
+	exporterConfig := config.FileExporterConfig{
+		Path:   filename,
+		MaxAge: model.Duration(time.Minute),
+		Exporter: config.Exporter{
+			Name: "test-file-exporter",
+		},
+	}
+
+	// The default action fails the scrape, but the age is still reported.
+	fileProxy := newFileProxy(&exporterConfig)
+	ctx := context.Background()
+	_, err = fileProxy.Scrape(ctx, nil)
+	c.Check(errors.Is(err, ErrFileProxyStale), Equals, true, Commentf("got error: %v", err))
+
+	statusMetrics := fileProxy.statusMetrics()
+	c.Assert(statusMetrics, HasLen, 1)
+	c.Check(statusMetrics[0].GetName(), Equals, textfileAgeMetricName)
+	c.Check(statusMetrics[0].GetMetric()[0].GetGauge().GetValue() >= time.Hour.Seconds(), Equals, true)
+
+	exporterConfig.StaleAction = config.StaleActionDrop
+	fileProxy = newFileProxy(&exporterConfig)
+	mfs, err := fileProxy.Scrape(ctx, nil)
+	c.Check(err, IsNil)
+	c.Check(mfs, HasLen, 0, Commentf("stale metrics should be dropped"))
+
+	exporterConfig.StaleAction = config.StaleActionLabel
+	fileProxy = newFileProxy(&exporterConfig)
+	mfs, err = fileProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, testFileMetricsLen)
+	c.Check(mfs[0].GetMetric()[0].GetLabel()[0].GetName(), Equals, staleLabel)
+	c.Check(mfs[0].GetMetric()[0].GetLabel()[0].GetValue(), Equals, "true")
+
+	// Touching the file makes it fresh again.
+	c.Assert(os.Chtimes(filename, time.Now(), time.Now()), IsNil)
+	mfs, err = fileProxy.Scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs[0].GetMetric()[0].GetLabel(), HasLen, 0)
+}
+
+func (s *FileProxySuite) TestFileProxyCompressed(c *C) {
+	dir, err := ioutil.TempDir("", "file_proxy_test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	gzipped := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write([]byte(testFileMetrics))
+	gzipWriter.Close()
+
+	zstdWriter, err := zstd.NewWriter(nil)
+	c.Assert(err, IsNil)
+	zstded := zstdWriter.EncodeAll([]byte(testFileMetrics), nil)
+
+	// Compression is detected by extension, or by magic bytes.
+	ioutil.WriteFile(filepath.Join(dir, "a.prom.gz"), gzipped.Bytes(), os.FileMode(0644))
+	ioutil.WriteFile(filepath.Join(dir, "b.prom.zst"), zstded, os.FileMode(0644))
+	ioutil.WriteFile(filepath.Join(dir, "c.prom"), gzipped.Bytes(), os.FileMode(0644))
+
+	exporterConfig := config.FileExporterConfig{
+		Path:      dir,
+		FileLabel: true,
+		Exporter: config.Exporter{
+			Name: "test-file-exporter",
+		},
+	}
+
+	fileProxy := newFileProxy(&exporterConfig)
+	mfs, err := fileProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs[0].GetName(), Equals, testFileMetricName)
+	c.Assert(mfs[0].GetMetric(), HasLen, 3)
+	for idx, fileName := range []string{"a.prom.gz", "b.prom.zst", "c.prom"} {
+		c.Check(mfs[0].GetMetric()[idx].GetLabel()[0].GetValue(), Equals, fileName)
+		c.Check(mfs[0].GetMetric()[idx].GetGauge().GetValue(), Equals, testFileMetricValue)
+	}
+}
+
+func (s *FileProxySuite) TestFileProxyMaxBytes(c *C) {
+	dir, err := ioutil.TempDir("", "file_proxy_test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// A small compressed file which decompresses to much more than the limit.
+	gzipped := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write([]byte(strings.Repeat("# padding comment\n", 1000)))
+	gzipWriter.Write([]byte(testFileMetrics))
+	gzipWriter.Close()
+
+	filename := filepath.Join(dir, "metrics.prom.gz")
+	ioutil.WriteFile(filename, gzipped.Bytes(), os.FileMode(0644))
+
+	exporterConfig := config.FileExporterConfig{
+		Path:     filename,
+		MaxBytes: 4096,
+		Exporter: config.Exporter{
+			Name: "test-file-exporter",
+		},
+	}
+	c.Assert(uint64(gzipped.Len()) < exporterConfig.MaxBytes, Equals, true)
+
+	fileProxy := newFileProxy(&exporterConfig)
+	_, err = fileProxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrMaxBytesExceeded), Equals, true, Commentf("got error: %v", err))
+
+	exporterConfig.MaxBytes = 1 << 20
+	fileProxy = newFileProxy(&exporterConfig)
+	mfs, err := fileProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs, HasLen, testFileMetricsLen)
+}
+
+func (s *FileProxySuite) TestFileProxyProductionTimestamps(c *C) {
+	dir := c.MkDir()
+	filename := filepath.Join(dir, "metrics.prom")
+	ioutil.WriteFile(filename, []byte(testFileMetricName+" 1 1500000000000\n"), os.FileMode(0644))
+	mtime := time.Unix(1600000000, 0)
+	c.Assert(os.Chtimes(filename, mtime, mtime), IsNil)
+
+	fileProxy := newFileProxy(&config.FileExporterConfig{
+		Path:     filename,
+		Exporter: config.Exporter{Name: "test-file-exporter", Timestamps: config.TimestampsProductionTime},
+	})
+	mfs, err := fileProxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 1)
+	// The timestamp the file had is replaced with its mtime.
+	c.Check(mfs[0].GetMetric()[0].GetTimestampMs(), Equals, int64(1600000000000))
+}
@@ -0,0 +1,352 @@
+package metricproxy
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// ErrHistogramConversionInvalid returned when the histogram conversion of an exporter is not
+// correctly configured.
+var ErrHistogramConversionInvalid = errors.New("histogram conversion is invalid")
+
+const (
+	bucketSuffix = "_bucket"
+	sumSuffix    = "_sum"
+	countSuffix  = "_count"
+)
+
+// defaultHistogramQuantiles are the quantiles histograms converted to summaries have.
+var defaultHistogramQuantiles = []float64{0.5, 0.9, 0.99} //nolint:gochecknoglobals
+
+// isHistogram returns true for the metric types whose metrics are histograms.
+func isHistogram(metricType dto.MetricType) bool {
+	return metricType == dto.MetricType_HISTOGRAM || metricType == dto.MetricType_GAUGE_HISTOGRAM
+}
+
+// isNativeHistogram returns true if the histogram has native histogram fields.
+func isNativeHistogram(histogram *dto.Histogram) bool {
+	return histogram.Schema != nil || histogram.ZeroThreshold != nil ||
+		len(histogram.GetPositiveSpan()) > 0 || len(histogram.GetNegativeSpan()) > 0
+}
+
+// isBucketLabel returns true for the labels histograms and summaries expose their buckets
+// and quantiles with. They cannot be set or aggregated away without breaking the metric.
+func isBucketLabel(name string) bool {
+	return name == model.BucketLabel || name == model.QuantileLabel
+}
+
+// formatLabelFloat formats a bucket bound or quantile like the text format does.
+func formatLabelFloat(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// exposedSeries returns the labels, including __name__, of each series a metric is exposed
+// as: the _bucket, _sum and _count series of classic histograms, and the quantile, _sum and
+// _count series of summaries. Native histograms are exposed as a single series.
+func exposedSeries(mf *dto.MetricFamily, metric *dto.Metric) []map[string]string {
+	newSeries := func(name string, extraName string, extraValue string) map[string]string {
+		labels := make(map[string]string, len(metric.GetLabel())+2) //nolint:gomnd
+		for _, lp := range metric.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		labels[model.MetricNameLabel] = name
+		if extraName != "" {
+			labels[extraName] = extraValue
+		}
+		return labels
+	}
+
+	name := mf.GetName()
+	switch {
+	case isHistogram(mf.GetType()):
+		histogram := metric.GetHistogram()
+		series := make([]map[string]string, 0, len(histogram.GetBucket())+4) //nolint:gomnd
+		if isNativeHistogram(histogram) {
+			series = append(series, newSeries(name, "", ""))
+		}
+		if len(histogram.GetBucket()) > 0 || !isNativeHistogram(histogram) {
+			hasInf := false
+			for _, bucket := range histogram.GetBucket() {
+				hasInf = hasInf || math.IsInf(bucket.GetUpperBound(), +1)
+				series = append(series, newSeries(name+bucketSuffix, model.BucketLabel, formatLabelFloat(bucket.GetUpperBound())))
+			}
+			if !hasInf {
+				series = append(series, newSeries(name+bucketSuffix, model.BucketLabel, "+Inf"))
+			}
+		}
+		return append(series, newSeries(name+sumSuffix, "", ""), newSeries(name+countSuffix, "", ""))
+	case mf.GetType() == dto.MetricType_SUMMARY:
+		summary := metric.GetSummary()
+		series := make([]map[string]string, 0, len(summary.GetQuantile())+2) //nolint:gomnd
+		for _, quantile := range summary.GetQuantile() {
+			series = append(series, newSeries(name, model.QuantileLabel, formatLabelFloat(quantile.GetQuantile())))
+		}
+		return append(series, newSeries(name+sumSuffix, "", ""), newSeries(name+countSuffix, "", ""))
+	default:
+		return []map[string]string{newSeries(name, "", "")}
+	}
+}
+
+// bucketCount returns the cumulative count of a bucket, which may be an integer or a float.
+func bucketCount(bucket *dto.Bucket) float64 {
+	if bucket.CumulativeCountFloat != nil {
+		return bucket.GetCumulativeCountFloat()
+	}
+	return float64(bucket.GetCumulativeCount())
+}
+
+// histogramCount returns the count of a histogram, which may be an integer or a float.
+func histogramCount(histogram *dto.Histogram) float64 {
+	if histogram.SampleCountFloat != nil {
+		return histogram.GetSampleCountFloat()
+	}
+	return float64(histogram.GetSampleCount())
+}
+
+// sameBuckets returns true if the classic histograms have the same bucket bounds.
+func sameBuckets(a *dto.Histogram, b *dto.Histogram) bool {
+	if len(a.GetBucket()) != len(b.GetBucket()) {
+		return false
+	}
+	for idx, bucket := range a.GetBucket() {
+		if bucket.GetUpperBound() != b.GetBucket()[idx].GetUpperBound() {
+			return false
+		}
+	}
+	return true
+}
+
+// classicHistogram returns a copy of the classic part of a histogram, with float counts if
+// the histogram has them.
+func classicHistogram(histogram *dto.Histogram) *dto.Histogram {
+	classic := &dto.Histogram{
+		SampleSum: proto.Float64(histogram.GetSampleSum()),
+		Bucket:    make([]*dto.Bucket, 0, len(histogram.GetBucket())),
+	}
+	if histogram.SampleCountFloat != nil {
+		classic.SampleCountFloat = proto.Float64(histogram.GetSampleCountFloat())
+	} else {
+		classic.SampleCount = proto.Uint64(histogram.GetSampleCount())
+	}
+	for _, bucket := range histogram.GetBucket() {
+		classic.Bucket = append(classic.Bucket, proto.Clone(bucket).(*dto.Bucket))
+	}
+	return classic
+}
+
+// addHistogram adds the classic part of src to dst, which must have the same buckets. The
+// latest exemplar of each bucket is kept. Counts become floats if either has float counts.
+func addHistogram(dst *dto.Histogram, src *dto.Histogram) {
+	dst.SampleSum = proto.Float64(dst.GetSampleSum() + src.GetSampleSum())
+	if dst.SampleCountFloat != nil || src.SampleCountFloat != nil {
+		dst.SampleCountFloat = proto.Float64(histogramCount(dst) + histogramCount(src))
+		dst.SampleCount = nil
+	} else {
+		dst.SampleCount = proto.Uint64(dst.GetSampleCount() + src.GetSampleCount())
+	}
+
+	for idx, bucket := range dst.GetBucket() {
+		srcBucket := src.GetBucket()[idx]
+		if bucket.CumulativeCountFloat != nil || srcBucket.CumulativeCountFloat != nil {
+			bucket.CumulativeCountFloat = proto.Float64(bucketCount(bucket) + bucketCount(srcBucket))
+			bucket.CumulativeCount = nil
+		} else {
+			bucket.CumulativeCount = proto.Uint64(bucket.GetCumulativeCount() + srcBucket.GetCumulativeCount())
+		}
+		bucket.Exemplar = latestExemplar(bucket.GetExemplar(), srcBucket.GetExemplar())
+	}
+}
+
+// latestExemplar returns the exemplar with the latest timestamp. Exemplars without a
+// timestamp are older than those with one.
+func latestExemplar(a *dto.Exemplar, b *dto.Exemplar) *dto.Exemplar {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case b.GetTimestamp().AsTime().After(a.GetTimestamp().AsTime()):
+		return b
+	default:
+		return a
+	}
+}
+
+// histogramConversion converts the classic histograms an exporter returns.
+type histogramConversion struct {
+	mode      config.HistogramConversion
+	quantiles []float64
+}
+
+// newHistogramConversion returns the histogram conversion of an exporter.
+func newHistogramConversion(exporter config.Exporter) (histogramConversion, error) {
+	conversion := histogramConversion{mode: exporter.ConvertHistograms, quantiles: exporter.HistogramQuantiles}
+	if len(conversion.quantiles) > 0 && conversion.mode != config.HistogramConversionSummary {
+		return conversion, errors.Wrap(ErrHistogramConversionInvalid, "histogram_quantiles requires convert_histograms: summary")
+	}
+	for _, quantile := range conversion.quantiles {
+		if quantile < 0 || quantile > 1 || math.IsNaN(quantile) {
+			return conversion, errors.Wrapf(ErrHistogramConversionInvalid, "quantile %v is not between 0 and 1", quantile)
+		}
+	}
+	if conversion.mode == config.HistogramConversionSummary && len(conversion.quantiles) == 0 {
+		conversion.quantiles = defaultHistogramQuantiles
+	}
+	return conversion, nil
+}
+
+// convert returns the metric families with their classic histograms converted. Families
+// with native histograms are not converted, as their native buckets would be lost.
+func (hc histogramConversion) convert(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	if hc.mode == config.HistogramConversionNone {
+		return mfs
+	}
+
+	converted := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		if !isHistogram(mf.GetType()) || hasNativeHistograms(mf) {
+			converted = append(converted, mf)
+			continue
+		}
+
+		switch hc.mode {
+		case config.HistogramConversionSeries:
+			converted = append(converted, histogramSeriesFamilies(mf)...)
+		case config.HistogramConversionSummary:
+			converted = append(converted, hc.summaryFamily(mf))
+		case config.HistogramConversionNone:
+		}
+	}
+	return converted
+}
+
+// hasNativeHistograms returns true if any metric of the family is a native histogram.
+func hasNativeHistograms(mf *dto.MetricFamily) bool {
+	for _, metric := range mf.GetMetric() {
+		if isNativeHistogram(metric.GetHistogram()) {
+			return true
+		}
+	}
+	return false
+}
+
+// histogramSeriesFamilies returns classic histograms as the untyped _bucket, _sum and _count
+// families they are exposed as. Untyped families keep their names in every exposition
+// format, but cannot carry exemplars.
+func histogramSeriesFamilies(mf *dto.MetricFamily) []*dto.MetricFamily {
+	newFamily := func(suffix string) *dto.MetricFamily {
+		return &dto.MetricFamily{Name: proto.String(mf.GetName() + suffix), Help: mf.Help, Type: dto.MetricType_UNTYPED.Enum()}
+	}
+	buckets, sums, counts := newFamily(bucketSuffix), newFamily(sumSuffix), newFamily(countSuffix)
+	newMetric := func(metric *dto.Metric, labels []*dto.LabelPair, value float64) *dto.Metric {
+		return &dto.Metric{Label: labels, Untyped: &dto.Untyped{Value: proto.Float64(value)}, TimestampMs: metric.TimestampMs}
+	}
+
+	for _, metric := range mf.GetMetric() {
+		histogram := metric.GetHistogram()
+		hasInf := false
+		for _, bucket := range histogram.GetBucket() {
+			hasInf = hasInf || math.IsInf(bucket.GetUpperBound(), +1)
+			buckets.Metric = append(buckets.Metric,
+				newMetric(metric, withLabel(metric.GetLabel(), model.BucketLabel, formatLabelFloat(bucket.GetUpperBound())), bucketCount(bucket)))
+		}
+		if !hasInf {
+			buckets.Metric = append(buckets.Metric,
+				newMetric(metric, withLabel(metric.GetLabel(), model.BucketLabel, "+Inf"), histogramCount(histogram)))
+		}
+		sums.Metric = append(sums.Metric, newMetric(metric, metric.GetLabel(), histogram.GetSampleSum()))
+		counts.Metric = append(counts.Metric, newMetric(metric, metric.GetLabel(), histogramCount(histogram)))
+	}
+	return []*dto.MetricFamily{buckets, sums, counts}
+}
+
+// summaryFamily returns classic histograms as summaries with quantiles estimated from their
+// buckets, like PromQL histogram_quantile.
+func (hc histogramConversion) summaryFamily(mf *dto.MetricFamily) *dto.MetricFamily {
+	summaries := &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: dto.MetricType_SUMMARY.Enum()}
+	for _, metric := range mf.GetMetric() {
+		histogram := metric.GetHistogram()
+		summary := &dto.Summary{
+			SampleCount: proto.Uint64(uint64(histogramCount(histogram))),
+			SampleSum:   proto.Float64(histogram.GetSampleSum()),
+		}
+		for _, quantile := range hc.quantiles {
+			summary.Quantile = append(summary.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(quantile),
+				Value:    proto.Float64(bucketQuantile(quantile, histogram)),
+			})
+		}
+		summaries.Metric = append(summaries.Metric, &dto.Metric{
+			Label:       metric.GetLabel(),
+			Summary:     summary,
+			TimestampMs: metric.TimestampMs,
+		})
+	}
+	return summaries
+}
+
+// bucketQuantile estimates a quantile from the buckets of a classic histogram by linear
+// interpolation within the bucket it falls in, like PromQL histogram_quantile.
+func bucketQuantile(quantile float64, histogram *dto.Histogram) float64 {
+	buckets := append([]*dto.Bucket{}, histogram.GetBucket()...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].GetUpperBound() < buckets[j].GetUpperBound() })
+	if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), +1) {
+		buckets = append(buckets, &dto.Bucket{
+			UpperBound:           proto.Float64(math.Inf(+1)),
+			CumulativeCountFloat: proto.Float64(histogramCount(histogram)),
+		})
+	}
+	if len(buckets) < 2 { //nolint:gomnd
+		return math.NaN()
+	}
+	observations := bucketCount(buckets[len(buckets)-1])
+	if observations == 0 {
+		return math.NaN()
+	}
+
+	rank := quantile * observations
+	idx := sort.Search(len(buckets)-1, func(i int) bool { return bucketCount(buckets[i]) >= rank })
+	if idx == len(buckets)-1 {
+		// The quantile is in the +Inf bucket, so the best estimate is its lower bound.
+		return buckets[len(buckets)-2].GetUpperBound()
+	}
+	if idx == 0 && buckets[0].GetUpperBound() <= 0 {
+		return buckets[0].GetUpperBound()
+	}
+
+	bucketStart := 0.0
+	bucketEnd := buckets[idx].GetUpperBound()
+	count := bucketCount(buckets[idx])
+	if idx > 0 {
+		bucketStart = buckets[idx-1].GetUpperBound()
+		count -= bucketCount(buckets[idx-1])
+		rank -= bucketCount(buckets[idx-1])
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+// withLabel returns sorted labels with an additional label.
+func withLabel(labels []*dto.LabelPair, name string, value string) []*dto.LabelPair {
+	result := make([]*dto.LabelPair, 0, len(labels)+1)
+	result = append(result, labels...)
+	result = append(result, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result
+}
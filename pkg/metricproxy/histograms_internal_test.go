@@ -0,0 +1,301 @@
+//nolint:errcheck,testpackage,gochecknoglobals
+package metricproxy
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	. "gopkg.in/check.v1"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "update the golden files of the histogram tests")
+
+type HistogramSuite struct{}
+
+var _ = Suite(&HistogramSuite{})
+
+// checkGolden compares actual with the golden file of the given name, or updates it.
+func checkGolden(c *C, name string, actual string) {
+	path := filepath.Join("test_data", "golden", name+".golden")
+	if *updateGolden {
+		c.Assert(ioutil.WriteFile(path, []byte(actual), 0o644), IsNil)
+	}
+	expected, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(actual, Equals, string(expected), Commentf("golden file: %s", path))
+}
+
+// testLabelPairs returns a single label pair.
+func testLabelPairs(name string, value string) []*dto.LabelPair {
+	return []*dto.LabelPair{{Name: proto.String(name), Value: proto.String(value)}}
+}
+
+// newTestExemplar returns an exemplar with a trace_id label.
+func newTestExemplar(traceID string, value float64, timestamp time.Time) *dto.Exemplar {
+	return &dto.Exemplar{
+		Label:     testLabelPairs("trace_id", traceID),
+		Value:     proto.Float64(value),
+		Timestamp: timestamppb.New(timestamp),
+	}
+}
+
+func (s *HistogramSuite) TestGoldenMetricTypes(c *C) {
+	for _, testCase := range []struct {
+		golden     string
+		input      string
+		metric     string
+		conversion config.HistogramConversion
+		quantiles  []float64
+	}{
+		{golden: "counter", input: "counter", metric: "http_requests_total"},
+		{golden: "gauge", input: "gauge", metric: "queue_length"},
+		{golden: "untyped", input: "untyped", metric: "temperature_celsius"},
+		{golden: "histogram", input: "histogram", metric: "request_duration_seconds"},
+		{golden: "summary", input: "summary", metric: "rpc_duration_seconds"},
+		{golden: "histogram_series", input: "histogram", metric: "request_duration_seconds_bucket",
+			conversion: config.HistogramConversionSeries},
+		{golden: "histogram_summary", input: "histogram", metric: "request_duration_seconds",
+			conversion: config.HistogramConversionSummary, quantiles: []float64{0.25, 0.5, 0.95, 1}},
+	} {
+		// Every type goes through the whole pipeline: label rewriting, a sum and a count
+		// aggregation, and the match filter.
+		endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+			Path: "/metrics",
+			Exporters: &config.ExportersConfig{
+				FileExporters: []*config.FileExporterConfig{{
+					Exporter: config.Exporter{
+						Name:               "app",
+						Labels:             map[string]string{"region": "eu"},
+						ConvertHistograms:  testCase.conversion,
+						HistogramQuantiles: testCase.quantiles,
+					},
+					Path: filepath.Join("test_data", "golden", testCase.input+".prom"),
+				}},
+			},
+			Aggregations: []*config.AggregationConfig{
+				{Name: "sum:" + testCase.metric, Op: config.AggregationSum, Metric: testCase.metric},
+				{Name: "count:" + testCase.metric, Op: config.AggregationCount, Metric: testCase.metric, By: []string{"region"}},
+			},
+			MatchFilter: true,
+		}, nil)
+		c.Assert(err, IsNil, Commentf("golden: %s", testCase.golden))
+
+		// The reverse exporter's own metrics, like the textfile age, are filtered out.
+		code, body := getMetrics(endpoint, "/metrics?match[]="+url.QueryEscape(`{__name__=~".+",__name__!~"reverse_exporter_.*"}`), "")
+		c.Assert(code, Equals, http.StatusOK, Commentf("golden: %s, body: %s", testCase.golden, body))
+		checkGolden(c, testCase.golden, body)
+	}
+}
+
+func (s *HistogramSuite) TestGoldenExemplars(c *C) {
+	newFamilies := func(traceID string, timestamp time.Time) []*dto.MetricFamily {
+		requests := newValueMetric(dto.MetricType_COUNTER, testLabelPairs("code", "200"), 10)
+		requests.Counter.Exemplar = newTestExemplar(traceID, 1, timestamp)
+		return []*dto.MetricFamily{
+			{Name: proto.String("http_requests_total"), Type: dto.MetricType_COUNTER.Enum(), Metric: []*dto.Metric{requests}},
+			{Name: proto.String("request_duration_seconds"), Type: dto.MetricType_HISTOGRAM.Enum(), Metric: []*dto.Metric{{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(10),
+					SampleSum:   proto.Float64(3.5),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(8), Exemplar: newTestExemplar(traceID, 0.25, timestamp)},
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(10)},
+					},
+				},
+			}}},
+		}
+	}
+	older := newTestServer("", string(expfmt.FmtProtoDelim), constBody(protobufBody(newFamilies("aaaa", time.Unix(1600000000, 0))...)))
+	defer older.Close()
+	newer := newTestServer("", string(expfmt.FmtProtoDelim), constBody(protobufBody(newFamilies("bbbb", time.Unix(1600000060, 0))...)))
+	defer newer.Close()
+
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path: "/metrics",
+		Exporters: &config.ExportersConfig{
+			HTTPExporters: []*config.HTTPExporterConfig{
+				{Exporter: config.Exporter{Name: "older"}, Address: older.URL},
+				{Exporter: config.Exporter{Name: "newer"}, Address: newer.URL},
+			},
+		},
+		Aggregations: []*config.AggregationConfig{
+			{Name: "all_requests_total", Op: config.AggregationSum, Metric: "http_requests_total"},
+			{Name: "all_request_duration_seconds", Op: config.AggregationSum, Metric: "request_duration_seconds"},
+		},
+		OpenMetrics: true,
+	}, nil)
+	c.Assert(err, IsNil)
+
+	// Exemplars are carried through to scrapers which accept OpenMetrics if it is enabled,
+	// and the sums keep the latest of them.
+	code, body := getMetrics(endpoint, "/metrics", string(expfmt.FmtOpenMetrics))
+	c.Assert(code, Equals, http.StatusOK, Commentf("body: %s", body))
+	checkGolden(c, "exemplars", body)
+
+	// The text format cannot carry them.
+	code, body = getMetrics(endpoint, "/metrics", "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Check(strings.Contains(body, "trace_id"), Equals, false)
+}
+
+func (s *HistogramSuite) TestOpenMetricsOptIn(c *C) {
+	// The Accept header Prometheus scrapes with, which prefers OpenMetrics.
+	const prometheusAccept = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75," +
+		"text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+	exporter := newTestStaticExporter("service", "service_uptime_seconds")
+	exporter.Metrics[0].Type = config.MetricTypeCounter
+	reverseExporter := &config.ReverseExporterConfig{
+		Path:      "/metrics",
+		Exporters: &config.ExportersConfig{StaticExporters: []*config.StaticExporterConfig{exporter}},
+	}
+
+	// Counters without a _total suffix keep their type in the text format served by default.
+	endpoint, err := NewMetricReverseProxy(reverseExporter, nil)
+	c.Assert(err, IsNil)
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", prometheusAccept)
+	endpoint.ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Check(recorder.Header().Get(contentTypeHeader), Equals, string(expfmt.FmtText))
+	c.Check(strings.Contains(recorder.Body.String(), "# TYPE service_uptime_seconds counter\n"), Equals, true,
+		Commentf("body: %s", recorder.Body.String()))
+
+	reverseExporter.OpenMetrics = true
+	endpoint, err = NewMetricReverseProxy(reverseExporter, nil)
+	c.Assert(err, IsNil)
+	code, body := getMetrics(endpoint, "/metrics", prometheusAccept)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Check(strings.HasSuffix(body, "# EOF\n"), Equals, true, Commentf("body: %s", body))
+}
+
+func (s *HistogramSuite) TestGoldenNativeHistograms(c *C) {
+	newHistogram := func(classic bool) *dto.Histogram {
+		histogram := &dto.Histogram{
+			SampleCount:   proto.Uint64(12),
+			SampleSum:     proto.Float64(18.5),
+			Schema:        proto.Int32(0),
+			ZeroThreshold: proto.Float64(0.001),
+			ZeroCount:     proto.Uint64(2),
+			PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(3)}},
+			PositiveDelta: []int64{4, -1, 3},
+		}
+		if classic {
+			histogram.Bucket = []*dto.Bucket{
+				{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(6)},
+				{UpperBound: proto.Float64(4), CumulativeCount: proto.Uint64(12)},
+			}
+		}
+		return histogram
+	}
+	backend := newTestServer("", string(expfmt.FmtProtoDelim), constBody(protobufBody(&dto.MetricFamily{
+		Name: proto.String("rpc_latency_seconds"),
+		Help: proto.String("RPC latency."),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{Label: testLabelPairs("kind", "native"), Histogram: newHistogram(false)},
+			{Label: testLabelPairs("kind", "both"), Histogram: newHistogram(true)},
+		},
+	})))
+	defer backend.Close()
+
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path: "/metrics",
+		Exporters: &config.ExportersConfig{
+			HTTPExporters: []*config.HTTPExporterConfig{{
+				Exporter: config.Exporter{Name: "rpc", ConvertHistograms: config.HistogramConversionSummary},
+				Address:  backend.URL,
+			}},
+		},
+		Aggregations: []*config.AggregationConfig{
+			{Name: "all_rpc_latency_seconds", Op: config.AggregationSum, Metric: "rpc_latency_seconds"},
+		},
+	}, nil)
+	c.Assert(err, IsNil)
+
+	// Families with native histograms pass through unconverted, and only the classic buckets
+	// of those which have them are summed.
+	code, body := getMetrics(endpoint, "/metrics", string(expfmt.FmtProtoText))
+	c.Assert(code, Equals, http.StatusOK, Commentf("body: %s", body))
+	checkGolden(c, "native_histogram", body)
+}
+
+func (s *HistogramSuite) TestHistogramMatchFilter(c *C) {
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path: "/federate",
+		Exporters: &config.ExportersConfig{
+			FileExporters: []*config.FileExporterConfig{
+				{Exporter: config.Exporter{Name: "app"}, Path: filepath.Join("test_data", "golden", "histogram.prom")},
+				{Exporter: config.Exporter{Name: "rpc"}, Path: filepath.Join("test_data", "golden", "summary.prom")},
+			},
+		},
+		MatchFilter: true,
+	}, nil)
+	c.Assert(err, IsNil)
+
+	// Selecting a series a histogram or summary is exposed as keeps all of its series.
+	code, body := getMetrics(endpoint, "/federate?match[]="+url.QueryEscape(`request_duration_seconds_bucket{code="500",le="+Inf"}`)+
+		"&match[]="+url.QueryEscape(`rpc_duration_seconds{quantile="0.99",service="db"}`), "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Check(body, Matches, `(?s).*request_duration_seconds_bucket\{code="500",exporter_name="app",le="0.1"\} 0\n.*`)
+	c.Check(body, Matches, `(?s).*request_duration_seconds_count\{code="500",exporter_name="app"\} 10\n.*`)
+	c.Check(strings.Contains(body, `code="200"`), Equals, false)
+	c.Check(body, Matches, `(?s).*rpc_duration_seconds\{exporter_name="rpc",service="db",quantile="0.5"\} 0.003\n.*`)
+	c.Check(strings.Contains(body, `service="auth"`), Equals, false)
+}
+
+func (s *HistogramSuite) TestBucketQuantile(c *C) {
+	histogram := &dto.Histogram{
+		SampleCount: proto.Uint64(100),
+		Bucket: []*dto.Bucket{
+			{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(50)},
+			{UpperBound: proto.Float64(2), CumulativeCount: proto.Uint64(90)},
+			{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(100)},
+		},
+	}
+	for quantile, expected := range map[float64]float64{0: 0, 0.25: 0.5, 0.5: 1, 0.7: 1.5, 0.9: 2, 0.99: 2} {
+		c.Check(bucketQuantile(quantile, histogram), Equals, expected, Commentf("quantile: %v", quantile))
+	}
+	c.Check(math.IsNaN(bucketQuantile(0.5, &dto.Histogram{})), Equals, true)
+}
+
+func (s *HistogramSuite) TestBucketLabelsRejected(c *C) {
+	_, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path: "/metrics",
+		Exporters: &config.ExportersConfig{
+			StaticExporters: []*config.StaticExporterConfig{
+				{Exporter: config.Exporter{Name: "app", Labels: map[string]string{"le": "1"}}},
+			},
+		},
+	}, nil)
+	c.Check(errors.Is(err, ErrBucketLabelOverride), Equals, true, Commentf("got error: %v", err))
+
+	_, err = newAggregations([]*config.AggregationConfig{
+		{Name: "b", Op: config.AggregationSum, Metric: "a", Without: []string{"quantile"}},
+	})
+	c.Check(errors.Is(err, ErrAggregationInvalid), Equals, true, Commentf("got error: %v", err))
+
+	for _, exporter := range []config.Exporter{
+		{Name: "app", HistogramQuantiles: []float64{0.5}},
+		{Name: "app", ConvertHistograms: config.HistogramConversionSummary, HistogramQuantiles: []float64{1.5}},
+	} {
+		_, err = newHistogramConversion(exporter)
+		c.Check(errors.Is(err, ErrHistogramConversionInvalid), Equals, true, Commentf("exporter: %+v, got error: %v", exporter, err))
+	}
+}
@@ -0,0 +1,506 @@
+package metricproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	// ErrHTTPSDInvalid returned when an http_sd exporter is not correctly configured.
+	ErrHTTPSDInvalid = errors.New("http_sd exporter is invalid")
+	// ErrHTTPSDDiscoveryFailed returned when targets could not be discovered from a source.
+	ErrHTTPSDDiscoveryFailed = errors.New("http_sd target discovery failed")
+)
+
+const (
+	defaultHTTPSDRefreshInterval = 30 * time.Second
+	defaultHTTPSDScheme          = "http"
+	defaultHTTPSDMetricsPath     = "/metrics"
+	defaultHTTPSDNameTemplate    = "{{ .Name }}-{{ .Address }}"
+
+	// httpSDSchemeLabel and httpSDMetricsPathLabel override the scheme and path of a file_sd
+	// target, like in Prometheus.
+	httpSDSchemeLabel      = "__scheme__"
+	httpSDMetricsPathLabel = "__metrics_path__"
+
+	httpSDTargetsMetricName = "reverse_exporter_http_sd_targets"
+)
+
+// ensure httpSDProxy implements MetricProxy.
+var _ MetricProxy = &httpSDProxy{}
+
+// httpSDProxy implements a reverse metric proxy which scrapes the http exporters it discovers.
+// Each target is scraped through its own rewriteProxy, so is named and limited like any
+// other backend.
+type httpSDProxy struct {
+	name             string
+	nameLabel        model.LabelName
+	noRewrite        bool
+	limits           scrapeLimits
+	files            []string
+	dnsSRVNames      []string
+	resolver         *net.Resolver
+	refreshInterval  time.Duration
+	scheme           string
+	metricsPath      string
+	nameTemplate     *template.Template
+	deadline         time.Duration
+	forwardURLParams bool
+	maxBytes         uint64
+	// stopCh is closed to stop the discovery goroutine
+	stopCh   chan struct{}
+	stopOnce *sync.Once
+
+	// targetsMtx guards the discovery state below
+	targetsMtx  *sync.RWMutex
+	targets     map[string]*httpSDTarget
+	lastRefresh time.Time
+	lastErr     error
+
+	log *zap.Logger
+}
+
+// httpSDTarget is a discovered target.
+type httpSDTarget struct {
+	name    string
+	address string
+	labels  model.LabelSet
+	proxy   *rewriteProxy
+}
+
+// httpSDTemplateData is the data the name template is executed with.
+type httpSDTemplateData struct {
+	// Name is the name of the http_sd exporter
+	Name string
+	// Address is the host:port of the target
+	Address string
+	// Labels are the labels of the target
+	Labels map[string]string
+}
+
+// fileSDGroup is a group of targets in a Prometheus file_sd file.
+type fileSDGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// HTTPSDStatus is the debugging view of an http_sd exporter.
+type HTTPSDStatus struct {
+	Targets     []HTTPSDTargetStatus `json:"targets"`
+	LastRefresh *time.Time           `json:"last_refresh,omitempty"`
+	Error       string               `json:"error,omitempty"`
+}
+
+// HTTPSDTargetStatus is the debugging view of a discovered target.
+type HTTPSDTargetStatus struct {
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// newHTTPSDProxy initializes a new httpSDProxy. Targets are not discovered until the proxy is
+// started, and are given their name in nameLabel. An error is returned if it is not
+// correctly configured.
+func newHTTPSDProxy(config *config.HTTPSDExporterConfig, nameLabel model.LabelName) (*httpSDProxy, error) {
+	newProxy := httpSDProxy{
+		name:             config.Name,
+		nameLabel:        nameLabel,
+		noRewrite:        config.NoRewrite,
+		limits:           newScrapeLimits(config.Exporter),
+		files:            config.Files,
+		dnsSRVNames:      config.DNSSRVNames,
+		resolver:         net.DefaultResolver,
+		refreshInterval:  time.Duration(config.RefreshInterval),
+		scheme:           config.Scheme,
+		metricsPath:      config.MetricsPath,
+		deadline:         time.Duration(config.Timeout),
+		forwardURLParams: config.ForwardURLParams,
+		maxBytes:         config.MaxBytes,
+		stopCh:           make(chan struct{}),
+		stopOnce:         &sync.Once{},
+
+		targetsMtx: &sync.RWMutex{},
+		targets:    make(map[string]*httpSDTarget),
+
+		log: zap.L().With(zap.String("name", config.Name)),
+	}
+
+	if newProxy.refreshInterval == 0 {
+		newProxy.refreshInterval = defaultHTTPSDRefreshInterval
+	}
+	if newProxy.scheme == "" {
+		newProxy.scheme = defaultHTTPSDScheme
+	}
+	if newProxy.metricsPath == "" {
+		newProxy.metricsPath = defaultHTTPSDMetricsPath
+	}
+	nameTemplate := config.NameTemplate
+	if nameTemplate == "" {
+		nameTemplate = defaultHTTPSDNameTemplate
+	}
+
+	if len(config.Files) == 0 && len(config.DNSSRVNames) == 0 {
+		return nil, errors.Wrap(ErrHTTPSDInvalid, "at least one of files or dns_srv_names is required")
+	}
+	if newProxy.scheme != "http" && newProxy.scheme != "https" {
+		return nil, errors.Wrapf(ErrHTTPSDInvalid, "scheme must be http or https: %q", newProxy.scheme)
+	}
+	for _, pattern := range config.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(ErrHTTPSDInvalid, "invalid file pattern %q: %v", pattern, err)
+		}
+	}
+	var err error
+	if newProxy.nameTemplate, err = template.New("name").Option("missingkey=zero").Parse(nameTemplate); err != nil {
+		return nil, errors.Wrapf(ErrHTTPSDInvalid, "invalid name_template: %v", err)
+	}
+	if config.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(config.DNSServer); err != nil {
+			return nil, errors.Wrapf(ErrHTTPSDInvalid, "dns_server must be host:port: %v", err)
+		}
+		newProxy.resolver = newStubResolver(config.DNSServer)
+	}
+
+	return &newProxy, nil
+}
+
+// start implements starter by discovering the targets and starting the discovery goroutine.
+func (hp *httpSDProxy) start() {
+	// Files are watched before they are first read, so no change is missed.
+	var watcher *fsnotify.Watcher
+	if len(hp.files) > 0 {
+		var err error
+		if watcher, err = hp.watchFiles(); err != nil {
+			hp.log.Warn("File watching unavailable - re-reading files every refresh interval", zap.Error(err))
+		}
+	}
+
+	hp.refresh(context.Background())
+	go hp.discoverer(watcher)
+}
+
+// stop implements stopper by stopping the discovery goroutine and its file watcher.
+func (hp *httpSDProxy) stop() {
+	hp.stopOnce.Do(func() { close(hp.stopCh) })
+}
+
+// newStubResolver returns a resolver which sends all queries to server.
+func newStubResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Scrape scrapes all discovered targets concurrently and merges their metrics. Targets
+// which fail are reported by their backend up metric.
+func (hp *httpSDProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	hp.targetsMtx.RLock()
+	targets := lo.Values(hp.targets)
+	hp.targetsMtx.RUnlock()
+
+	results := make([][]*dto.MetricFamily, len(targets))
+	wg := new(sync.WaitGroup)
+	for idx, target := range targets {
+		wg.Add(1)
+		go func(idx int, target *httpSDTarget) {
+			defer wg.Done()
+			mfs, err := target.proxy.Scrape(ctx, values)
+			if err != nil {
+				hp.log.Debug("Error scraping discovered target", zap.String("target", target.name), zap.Error(err))
+			}
+			results[idx] = mfs
+		}(idx, target)
+	}
+	wg.Wait()
+
+	return mergeBackendMetricFamilies(results), nil
+}
+
+// statusMetrics implements statusMetricsProvider.
+func (hp *httpSDProxy) statusMetrics() []*dto.MetricFamily {
+	hp.targetsMtx.RLock()
+	defer hp.targetsMtx.RUnlock()
+	mfs := []*dto.MetricFamily{
+		newGaugeFamily(httpSDTargetsMetricName, "Number of targets currently discovered.", float64(len(hp.targets))),
+	}
+	// The exporter doesn't add its name to the metrics of its targets, so adds it here.
+	rewriteMetrics(model.LabelSet{hp.nameLabel: model.LabelValue(hp.name)}, mfs)
+	return mfs
+}
+
+// Status implements StatusReporter.
+func (hp *httpSDProxy) Status() interface{} {
+	hp.targetsMtx.RLock()
+	defer hp.targetsMtx.RUnlock()
+
+	status := HTTPSDStatus{Targets: make([]HTTPSDTargetStatus, 0, len(hp.targets))}
+	for _, target := range hp.targets {
+		targetStatus := HTTPSDTargetStatus{Name: target.name, Address: target.address}
+		if len(target.labels) > 0 {
+			targetStatus.Labels = make(map[string]string, len(target.labels))
+			for name, value := range target.labels {
+				targetStatus.Labels[string(name)] = string(value)
+			}
+		}
+		status.Targets = append(status.Targets, targetStatus)
+	}
+	sort.Slice(status.Targets, func(i, j int) bool { return status.Targets[i].Name < status.Targets[j].Name })
+
+	if !hp.lastRefresh.IsZero() {
+		lastRefresh := hp.lastRefresh
+		status.LastRefresh = &lastRefresh
+	}
+	if hp.lastErr != nil {
+		status.Error = hp.lastErr.Error()
+	}
+	return status
+}
+
+// discoverer re-discovers targets periodically, and when watcher sees the file_sd files
+// change, until the proxy is stopped. watcher may be nil.
+func (hp *httpSDProxy) discoverer(watcher *fsnotify.Watcher) {
+	ticker := time.NewTicker(hp.refreshInterval)
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	if watcher != nil {
+		defer watcher.Close()
+		events = watcher.Events
+	}
+
+	for {
+		select {
+		case <-hp.stopCh:
+			return
+		case <-ticker.C:
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			hp.log.Debug("file_sd file changed", zap.String("file", event.Name))
+		}
+		hp.refresh(context.Background())
+	}
+}
+
+// watchFiles watches the directories of the file_sd files, so files replaced by rename
+// are seen.
+func (hp *httpSDProxy) watchFiles() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating watcher failed")
+	}
+	dirs := make(map[string]struct{})
+	for _, pattern := range hp.files {
+		dirs[filepath.Dir(pattern)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, errors.Wrapf(err, "watching %s failed", dir)
+		}
+	}
+	return watcher, nil
+}
+
+// refresh discovers the targets and replaces the current ones. Targets which are unchanged
+// keep their backend. If a source fails, the targets last discovered from it are lost, so
+// the current targets are kept instead.
+func (hp *httpSDProxy) refresh(ctx context.Context) {
+	discovered, err := hp.discover(ctx)
+
+	hp.targetsMtx.Lock()
+	defer hp.targetsMtx.Unlock()
+
+	hp.lastRefresh = time.Now()
+	hp.lastErr = err
+	if err != nil {
+		hp.log.Error("Target discovery failed - keeping current targets", zap.Error(err))
+		return
+	}
+
+	targets := make(map[string]*httpSDTarget, len(discovered))
+	names := make(map[string]struct{}, len(discovered))
+	for _, target := range discovered {
+		key := target.address + target.labels.String()
+		if _, found := targets[key]; found {
+			continue
+		}
+		if target.name == "" {
+			hp.log.Warn("Discovered target has an empty name - ignoring target", zap.String("address", target.address))
+			continue
+		}
+		if _, found := names[target.name]; found {
+			hp.log.Warn("Discovered target name is used twice - ignoring target",
+				zap.String("target", target.name), zap.String("address", target.address))
+			continue
+		}
+		names[target.name] = struct{}{}
+
+		if existing, found := hp.targets[key]; found && existing.name == target.name {
+			targets[key] = existing
+			continue
+		}
+		targets[key] = target
+	}
+
+	added, removed := 0, 0
+	for key := range targets {
+		if _, found := hp.targets[key]; !found {
+			added++
+		}
+	}
+	for key := range hp.targets {
+		if _, found := targets[key]; !found {
+			removed++
+		}
+	}
+	if added > 0 || removed > 0 {
+		hp.log.Info("Discovered targets changed",
+			zap.Int("added", added), zap.Int("removed", removed), zap.Int("targets", len(targets)))
+	}
+	hp.targets = targets
+}
+
+// discover returns the targets of all sources.
+func (hp *httpSDProxy) discover(ctx context.Context) ([]*httpSDTarget, error) {
+	targets := make([]*httpSDTarget, 0)
+
+	for _, pattern := range hp.files {
+		// The only possible error is ErrBadPattern, which was checked on startup.
+		paths, _ := filepath.Glob(pattern)
+		sort.Strings(paths)
+		for _, path := range paths {
+			groups, err := readFileSD(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, group := range groups {
+				for _, address := range group.Targets {
+					target, err := hp.newTarget(address, group.Labels)
+					if err != nil {
+						return nil, errors.Wrapf(err, "file %s", path)
+					}
+					targets = append(targets, target)
+				}
+			}
+		}
+	}
+
+	for _, srvName := range hp.dnsSRVNames {
+		_, records, err := hp.resolver.LookupSRV(ctx, "", "", srvName)
+		if err != nil {
+			return nil, errors.Wrapf(ErrHTTPSDDiscoveryFailed, "looking up SRV records of %s: %v", srvName, err)
+		}
+		for _, record := range records {
+			address := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+			target, err := hp.newTarget(address, nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "SRV name %s", srvName)
+			}
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, nil
+}
+
+// readFileSD reads the target groups of a file_sd file. JSON files are read as YAML, which
+// they are a subset of.
+func readFileSD(path string) ([]fileSDGroup, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(ErrHTTPSDDiscoveryFailed, "reading %s: %v", path, err)
+	}
+	groups := make([]fileSDGroup, 0)
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, errors.Wrapf(ErrHTTPSDDiscoveryFailed, "decoding %s: %v", path, err)
+	}
+	return groups, nil
+}
+
+// newTarget returns a target for an address with the given discovered labels. Labels
+// starting with __ configure the target and are not added to its metrics. The others are
+// checked like the labels of an exporter.
+func (hp *httpSDProxy) newTarget(address string, discoveredLabels map[string]string) (*httpSDTarget, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, errors.Wrapf(ErrHTTPSDDiscoveryFailed, "target %q is not host:port", address)
+	}
+
+	scheme := hp.scheme
+	metricsPath := hp.metricsPath
+	targetLabels := make(map[string]string, len(discoveredLabels))
+	for name, value := range discoveredLabels {
+		switch {
+		case name == httpSDSchemeLabel:
+			scheme = value
+		case name == httpSDMetricsPathLabel:
+			metricsPath = value
+		case strings.HasPrefix(name, model.ReservedLabelPrefix):
+		default:
+			targetLabels[name] = value
+		}
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, errors.Wrapf(ErrHTTPSDDiscoveryFailed, "target %s scheme must be http or https: %q", address, scheme)
+	}
+	labels, err := newStaticLabels(targetLabels, hp.nameLabel)
+	if err != nil {
+		return nil, errors.Wrapf(ErrHTTPSDDiscoveryFailed, "target %s has invalid labels: %v", address, err)
+	}
+
+	var name strings.Builder
+	data := httpSDTemplateData{Name: hp.name, Address: address, Labels: discoveredLabels}
+	if err := hp.nameTemplate.Execute(&name, data); err != nil {
+		return nil, errors.Wrapf(ErrHTTPSDDiscoveryFailed, "executing name_template for %s: %v", address, err)
+	}
+
+	targetURL := url.URL{Scheme: scheme, Host: address, Path: metricsPath}
+	target := &httpSDTarget{
+		name:    name.String(),
+		address: address,
+		labels:  labels,
+	}
+
+	proxyLabels := labels.Clone()
+	if !hp.noRewrite {
+		proxyLabels[hp.nameLabel] = model.LabelValue(target.name)
+	}
+	target.proxy = &rewriteProxy{
+		name:      target.name,
+		nameLabel: hp.nameLabel,
+		proxy: &netProxy{
+			address:            targetURL.String(),
+			deadline:           hp.deadline,
+			forwardQueryParams: hp.forwardURLParams,
+			maxBytes:           hp.maxBytes,
+		},
+		labels: proxyLabels,
+		limits: hp.limits,
+	}
+	return target, nil
+}
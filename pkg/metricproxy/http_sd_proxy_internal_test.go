@@ -0,0 +1,230 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type HTTPSDProxySuite struct{}
+
+var _ = Suite(&HTTPSDProxySuite{})
+
+func (s *HTTPSDProxySuite) TestFileSD(c *C) {
+	first := newTestServer("/metrics", "", constBody("first_metric 1\n"))
+	defer first.Close()
+	second := newTestServer("/other", "", constBody("second_metric 1\n"))
+	defer second.Close()
+	firstAddress := strings.TrimPrefix(first.URL, "http://")
+	secondAddress := strings.TrimPrefix(second.URL, "http://")
+
+	dir := c.MkDir()
+	sdFile := filepath.Join(dir, "targets.json")
+	c.Assert(ioutil.WriteFile(sdFile, []byte(fmt.Sprintf(`[
+		{"targets": [%q], "labels": {"env": "prod"}},
+		{"targets": [%q], "labels": {"__metrics_path__": "/other"}}
+	]`, firstAddress, secondAddress)), 0o600), IsNil)
+
+	proxy, err := newHTTPSDProxy(&config.HTTPSDExporterConfig{
+		Exporter:        config.Exporter{Name: "sd"},
+		Files:           []string{filepath.Join(dir, "*.json")},
+		RefreshInterval: model.Duration(time.Hour),
+	}, reverseProxyNameLabel)
+	c.Assert(err, IsNil)
+	proxy.start()
+	defer proxy.stop()
+
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	families, names := familiesByName(mfs)
+	c.Check(names, DeepEquals, []string{"first_metric", backendUpMetricName, "second_metric"})
+	c.Check(metricLabels(families["first_metric"].GetMetric()[0]), DeepEquals,
+		map[string]string{reverseProxyNameLabel: "sd-" + firstAddress, "env": "prod"})
+	c.Check(metricLabels(families["second_metric"].GetMetric()[0]), DeepEquals,
+		map[string]string{reverseProxyNameLabel: "sd-" + secondAddress})
+	c.Check(families[backendUpMetricName].GetMetric(), HasLen, 2)
+	for _, metric := range families[backendUpMetricName].GetMetric() {
+		c.Check(metric.GetGauge().GetValue(), Equals, 1.0)
+	}
+	c.Check(proxy.statusMetrics()[0].GetMetric()[0].GetGauge().GetValue(), Equals, 2.0)
+
+	// Removed targets are no longer scraped. Files are replaced atomically, so the watcher
+	// never reads a partially written file.
+	c.Assert(writeFileAtomic(sdFile, []byte(fmt.Sprintf(`[{"targets": [%q]}]`, firstAddress))), IsNil)
+	proxy.refresh(context.Background())
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	_, names = familiesByName(mfs)
+	c.Check(names, DeepEquals, []string{"first_metric", backendUpMetricName})
+
+	// A broken file keeps the current targets.
+	c.Assert(writeFileAtomic(sdFile, []byte("{not json")), IsNil)
+	proxy.refresh(context.Background())
+	status, ok := proxy.Status().(HTTPSDStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.Error, Not(Equals), "")
+	c.Assert(status.Targets, HasLen, 1)
+	c.Check(status.Targets[0].Address, Equals, firstAddress)
+}
+
+func (s *HTTPSDProxySuite) TestFileSDWatched(c *C) {
+	dir := c.MkDir()
+	sdFile := filepath.Join(dir, "targets.yml")
+	c.Assert(ioutil.WriteFile(sdFile, []byte("- targets: ['host1:9100']\n  labels: {instance: one}\n"), 0o600), IsNil)
+
+	proxy, err := newHTTPSDProxy(&config.HTTPSDExporterConfig{
+		Exporter:        config.Exporter{Name: "sd"},
+		Files:           []string{sdFile},
+		RefreshInterval: model.Duration(time.Hour),
+		NameTemplate:    "{{ .Labels.instance }}",
+	}, reverseProxyNameLabel)
+	c.Assert(err, IsNil)
+	proxy.start()
+	defer proxy.stop()
+	c.Check(proxy.Status().(HTTPSDStatus).Targets, HasLen, 1)
+
+	c.Assert(ioutil.WriteFile(sdFile, []byte(
+		"- targets: ['host1:9100']\n  labels: {instance: one}\n- targets: ['host2:9100']\n  labels: {instance: two}\n"),
+		0o600), IsNil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(proxy.Status().(HTTPSDStatus).Targets) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	targets := proxy.Status().(HTTPSDStatus).Targets
+	c.Assert(targets, HasLen, 2)
+	c.Check(targets[0].Name, Equals, "one")
+	c.Check(targets[1].Name, Equals, "two")
+
+	// Changes are no longer watched once the proxy is stopped.
+	proxy.stop()
+	c.Assert(writeFileAtomic(sdFile, []byte("- targets: ['host1:9100']\n  labels: {instance: one}\n")), IsNil)
+	time.Sleep(200 * time.Millisecond)
+	c.Check(proxy.Status().(HTTPSDStatus).Targets, HasLen, 2)
+}
+
+// serveTestSRV answers every DNS query on conn with the given SRV records, which are
+// "priority weight port target" strings.
+func serveTestSRV(conn net.PacketConn, records ...string) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+		if len(query) < 12 {
+			continue
+		}
+		// The question ends after the name and its type and class.
+		questionEnd := 12
+		for questionEnd < len(query) && query[questionEnd] != 0 {
+			questionEnd += int(query[questionEnd]) + 1
+		}
+		questionEnd += 5
+		if questionEnd > len(query) {
+			continue
+		}
+
+		response := make([]byte, 12, 512)
+		copy(response, query[:2])
+		binary.BigEndian.PutUint16(response[2:], 0x8180)
+		binary.BigEndian.PutUint16(response[4:], 1)
+		binary.BigEndian.PutUint16(response[6:], uint16(len(records)))
+		response = append(response, query[12:questionEnd]...)
+		for _, record := range records {
+			var priority, weight, port uint16
+			var target string
+			fmt.Sscanf(record, "%d %d %d %s", &priority, &weight, &port, &target)
+
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[0:], priority)
+			binary.BigEndian.PutUint16(rdata[2:], weight)
+			binary.BigEndian.PutUint16(rdata[4:], port)
+			for _, label := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+				rdata = append(rdata, byte(len(label)))
+				rdata = append(rdata, label...)
+			}
+			rdata = append(rdata, 0)
+
+			// A pointer to the question name, type SRV, class IN and a TTL of 60s.
+			answer := []byte{0xc0, 0x0c, 0, 33, 0, 1, 0, 0, 0, 60, 0, 0}
+			binary.BigEndian.PutUint16(answer[10:], uint16(len(rdata)))
+			response = append(response, answer...)
+			response = append(response, rdata...)
+		}
+		conn.WriteTo(response, addr)
+	}
+}
+
+func (s *HTTPSDProxySuite) TestDNSSRV(c *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	go serveTestSRV(conn, "10 10 9100 node1.example.com.", "10 10 9200 node2.example.com.")
+
+	proxy, err := newHTTPSDProxy(&config.HTTPSDExporterConfig{
+		Exporter:        config.Exporter{Name: "sd"},
+		DNSSRVNames:     []string{"_metrics._tcp.example.com."},
+		DNSServer:       conn.LocalAddr().String(),
+		RefreshInterval: model.Duration(time.Hour),
+	}, reverseProxyNameLabel)
+	c.Assert(err, IsNil)
+	proxy.start()
+	defer proxy.stop()
+
+	status := proxy.Status().(HTTPSDStatus)
+	c.Check(status.Error, Equals, "")
+	c.Assert(status.Targets, HasLen, 2)
+	c.Check(status.Targets[0], DeepEquals, HTTPSDTargetStatus{Name: "sd-node1.example.com:9100", Address: "node1.example.com:9100"})
+	c.Check(status.Targets[1], DeepEquals, HTTPSDTargetStatus{Name: "sd-node2.example.com:9200", Address: "node2.example.com:9200"})
+	c.Check(status.LastRefresh, NotNil)
+}
+
+func (s *HTTPSDProxySuite) TestInvalidConfig(c *C) {
+	for _, exporter := range []*config.HTTPSDExporterConfig{
+		{},
+		{Files: []string{"/targets/*.json"}, Scheme: "ftp"},
+		{Files: []string{"/targets/[.json"}},
+		{Files: []string{"/targets/*.json"}, NameTemplate: "{{ .Name"},
+		{DNSSRVNames: []string{"_metrics._tcp.example.com"}, DNSServer: "127.0.0.1"},
+	} {
+		_, err := newHTTPSDProxy(exporter, reverseProxyNameLabel)
+		c.Check(errors.Is(err, ErrHTTPSDInvalid), Equals, true, Commentf("got error: %v", err))
+	}
+}
+
+func (s *HTTPSDProxySuite) TestInvalidTargets(c *C) {
+	proxy, err := newHTTPSDProxy(&config.HTTPSDExporterConfig{
+		Exporter: config.Exporter{Name: "sd"},
+		Files:    []string{"/targets/*.json"},
+	}, reverseProxyNameLabel)
+	c.Assert(err, IsNil)
+
+	for _, labels := range []map[string]string{
+		{"le": "1"},
+		{"quantile": "0.5"},
+		{reverseProxyNameLabel: "other"},
+		{"not-a-label": "x"},
+		{httpSDSchemeLabel: "ftp"},
+	} {
+		_, err := proxy.newTarget("host1:9100", labels)
+		c.Check(errors.Is(err, ErrHTTPSDDiscoveryFailed), Equals, true, Commentf("labels: %v, got error: %v", labels, err))
+	}
+
+	target, err := proxy.newTarget("host1:9100", map[string]string{httpSDSchemeLabel: "https", "env": "prod"})
+	c.Assert(err, IsNil)
+	c.Check(target.labels, DeepEquals, model.LabelSet{"env": "prod"})
+}
@@ -0,0 +1,63 @@
+package metricproxy
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ensure includeProxy implements MetricProxy.
+var _ MetricProxy = &includeProxy{}
+
+// includeProxy implements a reverse metric proxy which scrapes the backends of another
+// endpoint in-process. Scrapes are coalesced with those of the other endpoint.
+type includeProxy struct {
+	endpoint    *ReverseProxyEndpoint
+	keepMetrics []config.Regexp
+	dropMetrics []config.Regexp
+}
+
+func newIncludeProxy(endpoint *ReverseProxyEndpoint, config *config.IncludeExporterConfig) *includeProxy {
+	return &includeProxy{
+		endpoint:    endpoint,
+		keepMetrics: config.KeepMetrics,
+		dropMetrics: config.DropMetrics,
+	}
+}
+
+// Scrape scrapes the backends of the included endpoint and filters their metrics.
+func (ip *includeProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	mfs, err := ip.endpoint.scrape(ctx, values)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := mfs[:0]
+	for _, mf := range mfs {
+		if ip.keep(mf.GetName()) {
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered, nil
+}
+
+// keep returns true if a metric family with the given name passes the filters.
+func (ip *includeProxy) keep(name string) bool {
+	for _, drop := range ip.dropMetrics {
+		if drop.MatchString(name) {
+			return false
+		}
+	}
+	if len(ip.keepMetrics) == 0 {
+		return true
+	}
+	for _, keep := range ip.keepMetrics {
+		if keep.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+
+	. "gopkg.in/check.v1"
+)
+
+type IncludeProxySuite struct{}
+
+var _ = Suite(&IncludeProxySuite{})
+
+// familiesByName returns metric families by name, and their sorted names.
+func familiesByName(mfs []*dto.MetricFamily) (map[string]*dto.MetricFamily, []string) {
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	names := lo.Keys(families)
+	sort.Strings(names)
+	return families, names
+}
+
+// newTestStaticExporter returns a static exporter with a gauge of value 1 for each name.
+func newTestStaticExporter(name string, metricNames ...string) *config.StaticExporterConfig {
+	exporter := &config.StaticExporterConfig{Exporter: config.Exporter{Name: name}}
+	for _, metricName := range metricNames {
+		exporter.Metrics = append(exporter.Metrics, &config.StaticMetricConfig{Name: metricName, Value: float64Ptr(1)})
+	}
+	return exporter
+}
+
+func (s *IncludeProxySuite) TestIncludeProxy(c *C) {
+	fullConfig := &config.ReverseExporterConfig{
+		Path: "/metrics",
+		Exporters: &config.ExportersConfig{
+			StaticExporters: []*config.StaticExporterConfig{
+				newTestStaticExporter("app", "app_requests", "app_debug_info"),
+				newTestStaticExporter("db", "db_connections"),
+			},
+		},
+	}
+	coreConfig := &config.ReverseExporterConfig{
+		Path: "/metrics/core",
+		Exporters: &config.ExportersConfig{
+			IncludeExporters: []*config.IncludeExporterConfig{{
+				Exporter:    config.Exporter{Name: "core", Labels: map[string]string{"view": "core"}},
+				Path:        "/metrics",
+				KeepMetrics: []config.Regexp{{Regexp: regexp.MustCompile("^(app|db)_")}},
+				DropMetrics: []config.Regexp{{Regexp: regexp.MustCompile("_debug_")}},
+			}},
+		},
+	}
+
+	endpoints := make(map[string]*ReverseProxyEndpoint)
+	_, err := NewMetricReverseProxy(coreConfig, endpoints)
+	c.Check(errors.Is(err, ErrIncludedPathNotInitialized), Equals, true, Commentf("got error: %v", err))
+
+	full, err := NewMetricReverseProxy(fullConfig, endpoints)
+	c.Assert(err, IsNil)
+	endpoints[fullConfig.Path] = full
+	c.Check(full.coalescer, IsNil, Commentf("only included endpoints coalesce scrapes"))
+	core, err := NewMetricReverseProxy(coreConfig, endpoints)
+	c.Assert(err, IsNil)
+	c.Check(full.coalescer, NotNil)
+	c.Check(core.coalescer, IsNil)
+
+	// A path which uses another exporter label can't include the path, as it would then
+	// serve both labels.
+	relabelledConfig := *coreConfig
+	relabelledConfig.ExporterLabel = "job_component"
+	_, err = NewMetricReverseProxy(&relabelledConfig, endpoints)
+	c.Check(errors.Is(err, ErrIncludedLabelMismatch), Equals, true, Commentf("got error: %v", err))
+
+	mfs, err := core.scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	families, names := familiesByName(mfs)
+	// The up metrics of the included backends are filtered, and the include has its own.
+	c.Check(names, DeepEquals, []string{"app_requests", "db_connections", backendUpMetricName})
+	c.Check(metricLabels(families["app_requests"].GetMetric()[0]), DeepEquals,
+		map[string]string{reverseProxyNameLabel: "app", "view": "core"})
+	c.Check(metricLabels(families["db_connections"].GetMetric()[0]), DeepEquals,
+		map[string]string{reverseProxyNameLabel: "db", "view": "core"})
+	c.Check(metricLabels(families[backendUpMetricName].GetMetric()[0]), DeepEquals,
+		map[string]string{reverseProxyNameLabel: "core", "view": "core"})
+
+	// Scraping the include doesn't change the metrics of the included endpoint.
+	mfs, err = full.scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	families, names = familiesByName(mfs)
+	c.Check(names, DeepEquals, []string{"app_debug_info", "app_requests", "db_connections", backendUpMetricName})
+	c.Check(metricLabels(families["app_requests"].GetMetric()[0]), DeepEquals, map[string]string{reverseProxyNameLabel: "app"})
+	c.Check(families[backendUpMetricName].GetMetric(), HasLen, 2)
+}
+
+// blockingTestProxy is a MetricProxy which counts its scrapes and blocks them until released.
+type blockingTestProxy struct {
+	scrapes   int32
+	releaseCh chan struct{}
+	cancelled int32
+}
+
+func (btp *blockingTestProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	atomic.AddInt32(&btp.scrapes, 1)
+	select {
+	case <-btp.releaseCh:
+		return []*dto.MetricFamily{newGaugeFamily("blocking_test", "", 1)}, nil
+	case <-ctx.Done():
+		atomic.AddInt32(&btp.cancelled, 1)
+		return nil, ctx.Err()
+	}
+}
+
+func (s *IncludeProxySuite) TestScrapeCoalescer(c *C) {
+	backend := &blockingTestProxy{releaseCh: make(chan struct{})}
+	endpoint := &ReverseProxyEndpoint{backends: []MetricProxy{backend}, coalescer: newScrapeCoalescer()}
+
+	resultsCh := make(chan []*dto.MetricFamily, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			mfs, err := endpoint.scrape(context.Background(), url.Values{"target": []string{"a"}})
+			c.Check(err, IsNil)
+			resultsCh <- mfs
+		}()
+	}
+	for atomic.LoadInt32(&backend.scrapes) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the second scrape time to join the first.
+	time.Sleep(50 * time.Millisecond)
+	close(backend.releaseCh)
+
+	first, second := <-resultsCh, <-resultsCh
+	c.Check(atomic.LoadInt32(&backend.scrapes), Equals, int32(1))
+	c.Assert(first, HasLen, 1)
+	c.Assert(second, HasLen, 1)
+	// Each scrape has its own copy of the metrics.
+	c.Check(first[0] == second[0], Equals, false)
+}
+
+func (s *IncludeProxySuite) TestScrapeCoalescerCancelled(c *C) {
+	backend := &blockingTestProxy{releaseCh: make(chan struct{})}
+	endpoint := &ReverseProxyEndpoint{backends: []MetricProxy{backend}, coalescer: newScrapeCoalescer()}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFn()
+	_, err := endpoint.scrape(ctx, nil)
+	c.Check(errors.Is(err, context.DeadlineExceeded), Equals, true, Commentf("got error: %v", err))
+
+	// The backend is cancelled once nothing is waiting for it.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&backend.cancelled) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(atomic.LoadInt32(&backend.cancelled), Equals, int32(1))
+}
+
+// deadlineTestProxy is a MetricProxy which records the deadline of its last scrape.
+type deadlineTestProxy struct {
+	deadline time.Time
+}
+
+func (dtp *deadlineTestProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	dtp.deadline, _ = ctx.Deadline()
+	return nil, nil
+}
+
+func (s *IncludeProxySuite) TestScrapeKeepsDeadline(c *C) {
+	backend := &deadlineTestProxy{}
+	endpoint := &ReverseProxyEndpoint{backends: []MetricProxy{backend}}
+
+	// Endpoints which are not included scrape their backends with the request deadline.
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelFn()
+	_, err := endpoint.scrape(ctx, nil)
+	c.Assert(err, IsNil)
+	deadline, _ := ctx.Deadline()
+	c.Check(backend.deadline.Equal(deadline), Equals, true)
+}
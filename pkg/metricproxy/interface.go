@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/wrouesnel/reverse_exporter/pkg/config"
@@ -20,10 +21,17 @@ import (
 
 var (
 	ErrNameFieldOverrideAttempted = errors.New("cannot override name field with additional labels")
+	ErrBucketLabelOverride        = errors.New("cannot set the le or quantile labels of histograms and summaries")
 	ErrFileProxyScrapeError       = errors.New("file proxy file read failed")
+	ErrFileProxyStale             = errors.New("file proxy file is older than its max age")
 	ErrNetProxyScrapeError        = errors.New("HTTP proxy failed to read backend")
 	ErrUnknownExporterType        = errors.New("cannot configure unknown exporter type")
 	ErrExporterNameUsedTwice      = errors.New("cannot use the same exporter name twice for one endpoint")
+	ErrExecScheduleInvalid        = errors.New("exactly one of exec_interval or exec_schedule must be specified")
+	ErrIncludedPathNotInitialized = errors.New("included path must be initialized before the paths which include it")
+	ErrExporterLabelInvalid       = errors.New("exporter label must be a valid, unreserved label name")
+	ErrStaticLabelInvalid         = errors.New("invalid static label name")
+	ErrIncludedLabelMismatch      = errors.New("included path must use the same exporter label as the path which includes it")
 )
 
 // MetricProxy presents an interface which allows a context-cancellable scrape of a backend proxy.
@@ -32,92 +40,341 @@ type MetricProxy interface {
 	Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error)
 }
 
-// NewMetricReverseProxy initializes a new reverse proxy from the given configuration.
+// StatusReporter is implemented by metric proxies which can report their internal state
+// for debugging.
+type StatusReporter interface {
+	// Status returns a JSON serializable description of the proxy state.
+	Status() interface{}
+}
+
+// starter is implemented by metric proxies which run goroutines or processes in the
+// background. They are started once every endpoint has been configured.
+type starter interface {
+	start()
+}
+
+// stopper is implemented by metric proxies which must be stopped, or save their state, on
+// shutdown.
+type stopper interface {
+	stop()
+}
+
+// statusMetricsProvider is implemented by metric proxies which emit synthetic metrics
+// about themselves. These are returned even when the scrape itself fails.
+type statusMetricsProvider interface {
+	statusMetrics() []*dto.MetricFamily
+}
+
+// NewMetricReverseProxy initializes a new reverse proxy from the given configuration. endpoints
+// are the already initialized reverse proxies by path, which include exporters share the
+// backends of. See config.IncludeOrder. The backends do not run until the endpoint is started.
+//
 //nolint:cyclop
-func NewMetricReverseProxy(reverseExporter *config.ReverseExporterConfig) (http.Handler, error) {
+func NewMetricReverseProxy(reverseExporter *config.ReverseExporterConfig,
+	endpoints map[string]*ReverseProxyEndpoint) (*ReverseProxyEndpoint, error) {
 	log := zap.L().With(zap.String("path", reverseExporter.Path))
 
 	// Initialize a basic reverse proxy
 	backend := &ReverseProxyEndpoint{
-		metricPath: reverseExporter.Path,
-		backends:   make([]MetricProxy, 0),
+		metricPath:   reverseExporter.Path,
+		backends:     make([]MetricProxy, 0),
+		pushHandlers: make(map[string]http.Handler),
+		matchFilter:  reverseExporter.MatchFilter,
+		openMetrics:  reverseExporter.OpenMetrics,
 	}
 	backend.handler = backend.serveMetricsHTTP
 
+	nameLabel, err := newExporterLabel(reverseExporter.ExporterLabel)
+	if err != nil {
+		log.Error("Exporter label is invalid", zap.Error(err))
+		return nil, errors.Wrapf(err, "invalid exporter label for %s", reverseExporter.Path)
+	}
+	backend.nameLabel = nameLabel
+	pathLabels, err := newStaticLabels(reverseExporter.Labels, nameLabel)
+	if err != nil {
+		log.Error("Path labels are invalid", zap.Error(err))
+		return nil, errors.Wrapf(err, "invalid labels for %s", reverseExporter.Path)
+	}
+
 	usedNames := make(map[string]struct{})
+	// includedEndpoints coalesce their scrapes once this endpoint is valid
+	includedEndpoints := make([]*ReverseProxyEndpoint, 0)
 
 	// Start adding backends
 	for _, exporter := range reverseExporter.Exporters.All() {
 		var newExporter MetricProxy
+		// keepNameLabel is set for exporters whose metrics already have a name label
+		keepNameLabel := false
+		// producesMetrics is set for exporters which know when their metrics were produced
+		producesMetrics := false
 
 		baseExporter := exporter.GetBaseExporter()
 		eLog := log.With(zap.String("name", baseExporter.Name))
+		limits := newScrapeLimits(baseExporter)
+
+		// Keep track of reverseExporter name use to pre-empt collisions
+		if _, found := usedNames[baseExporter.Name]; !found {
+			usedNames[baseExporter.Name] = struct{}{}
+		} else {
+			eLog.Error("Exporter name re-use even if rewrite is disabled is not allowed")
+			return nil, ErrExporterNameUsedTwice
+		}
 
 		//nolint:varnamelen
 		switch e := exporter.(type) {
 		case *config.FileExporterConfig:
 			eLog.Debug("Adding new file reverseExporter proxy")
 			newExporter = newFileProxy(e)
+			producesMetrics = true
 		case *config.ExecExporterConfig:
 			eLog.Debug("Adding new exec reverseExporter proxy")
-			newExporter = newExecProxy(e)
+			if e.ForwardURLParams {
+				if len(e.AllowedURLParams) == 0 {
+					eLog.Error("Exec exporter forwards url params without a whitelist")
+					return nil, ErrExecURLParamsNotWhitelisted
+				}
+				if err := validateURLParams(e.URLParamsEnvPrefix, e.AllowedURLParams); err != nil {
+					eLog.Error("Exec exporter url params are passed as the same variable", zap.Error(err))
+					return nil, errors.Wrapf(err, "invalid exec url params for %s", baseExporter.Name)
+				}
+			}
+			sandbox, err := newExecSandbox(&e.ExecSandboxConfig)
+			if err != nil {
+				eLog.Error("Exec exporter sandbox configuration is invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid exec sandbox for %s", baseExporter.Name)
+			}
+			execProxy, err := newExecProxy(e, sandbox)
+			if err != nil {
+				eLog.Error("Exec exporter arguments are not valid templates", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid exec arguments for %s", baseExporter.Name)
+			}
+			newExporter = execProxy
+			producesMetrics = true
 		case *config.ExecCachingExporterConfig:
 			eLog.Debug("Adding new caching exec reverseExporter proxy")
-			newExporter = newExecCachingProxy(e)
+			if (e.ExecInterval > 0) == (e.ExecSchedule.Schedule != nil) {
+				eLog.Error("Caching exec exporter requires exactly one of exec_interval or exec_schedule")
+				return nil, ErrExecScheduleInvalid
+			}
+			sandbox, err := newExecSandbox(&e.ExecSandboxConfig)
+			if err != nil {
+				eLog.Error("Caching exec exporter sandbox configuration is invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid exec sandbox for %s", baseExporter.Name)
+			}
+			newExporter = newExecCachingProxy(e, sandbox)
+			producesMetrics = true
+		case *config.ExecDaemonExporterConfig:
+			eLog.Debug("Adding new daemon exec reverseExporter proxy")
+			sandbox, err := newExecSandbox(&e.ExecSandboxConfig)
+			if err != nil {
+				eLog.Error("Daemon exec exporter sandbox configuration is invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid exec sandbox for %s", baseExporter.Name)
+			}
+			newExporter = newExecDaemonProxy(e, sandbox)
+			producesMetrics = true
+		case *config.StaticExporterConfig:
+			eLog.Debug("Adding new static reverseExporter proxy")
+			if err := validateStaticMetrics(e.Metrics); err != nil {
+				eLog.Error("Static exporter metrics are invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid static metrics for %s", baseExporter.Name)
+			}
+			newExporter = newStaticProxy(e)
+		case *config.PushExporterConfig:
+			eLog.Debug("Adding new push reverseExporter proxy")
+			if !strings.HasPrefix(e.Path, "/") {
+				eLog.Error("Push exporter path must be absolute", zap.String("push_path", e.Path))
+				return nil, errors.Wrapf(ErrPushPathInvalid, "%s: %q", baseExporter.Name, e.Path)
+			}
+			if _, found := backend.pushHandlers[e.Path]; found {
+				eLog.Error("Push exporter path re-use is not allowed", zap.String("push_path", e.Path))
+				return nil, ErrPushPathUsedTwice
+			}
+			pushProxy := newPushProxy(e)
+			pushHandler, err := auth.SetupAuthHandler(reverseExporter.Auth, pushProxy)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed configuring push auth: %s", e.Path)
+			}
+			backend.pushHandlers[e.Path] = pushHandler
+			newExporter = pushProxy
+		case *config.JSONExporterConfig:
+			eLog.Debug("Adding new json reverseExporter proxy")
+			jsonProxy, err := newJSONProxy(e)
+			if err != nil {
+				eLog.Error("JSON exporter metrics are invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid json metrics for %s", baseExporter.Name)
+			}
+			newExporter = jsonProxy
+		case *config.ProbeExporterConfig:
+			eLog.Debug("Adding new probe reverseExporter proxy")
+			if err := validateProbeTargets(e.Targets); err != nil {
+				eLog.Error("Probe exporter targets are invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid probe targets for %s", baseExporter.Name)
+			}
+			newExporter = newProbeProxy(e)
+		case *config.ProcessExporterConfig:
+			eLog.Debug("Adding new process reverseExporter proxy")
+			if err := validateProcessGroups(e.Groups); err != nil {
+				eLog.Error("Process exporter groups are invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid process groups for %s", baseExporter.Name)
+			}
+			newExporter = newProcessProxy(e)
+		case *config.LogtailExporterConfig:
+			eLog.Debug("Adding new logtail reverseExporter proxy")
+			logtailProxy, err := newLogtailProxy(e)
+			if err != nil {
+				eLog.Error("Logtail exporter configuration is invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid logtail exporter %s", baseExporter.Name)
+			}
+			newExporter = logtailProxy
+		case *config.IncludeExporterConfig:
+			eLog.Debug("Adding new include reverseExporter proxy", zap.String("included_path", e.Path))
+			endpoint, found := endpoints[e.Path]
+			if !found {
+				eLog.Error("Included path is not initialized", zap.String("included_path", e.Path))
+				return nil, errors.Wrapf(ErrIncludedPathNotInitialized, "%s: %q", baseExporter.Name, e.Path)
+			}
+			// The included backends are told apart by their own names, so one path never
+			// serves two exporter labels.
+			if endpoint.nameLabel != nameLabel {
+				eLog.Error("Included path uses another exporter label", zap.String("included_path", e.Path),
+					zap.String("exporter_label", string(nameLabel)), zap.String("included_exporter_label", string(endpoint.nameLabel)))
+				return nil, errors.Wrapf(ErrIncludedLabelMismatch, "%s: %q uses %s, not %s",
+					baseExporter.Name, e.Path, endpoint.nameLabel, nameLabel)
+			}
+			newExporter = newIncludeProxy(endpoint, e)
+			includedEndpoints = append(includedEndpoints, endpoint)
+			keepNameLabel = true
+		case *config.HTTPSDExporterConfig:
+			eLog.Debug("Adding new http_sd reverseExporter proxy")
+			httpSDProxy, err := newHTTPSDProxy(e, nameLabel)
+			if err != nil {
+				eLog.Error("http_sd exporter configuration is invalid", zap.Error(err))
+				return nil, errors.Wrapf(err, "invalid http_sd exporter %s", baseExporter.Name)
+			}
+			newExporter = httpSDProxy
+			// The discovered targets are told apart by their own names, and limited individually.
+			keepNameLabel = true
+			limits = scrapeLimits{}
 		case *config.HTTPExporterConfig:
 			eLog.Debug("Adding new http reverseExporter proxy")
 			newExporter = &netProxy{
 				address:            e.Address,
 				deadline:           time.Duration(e.Timeout),
 				forwardQueryParams: e.ForwardURLParams,
+				maxBytes:           e.MaxBytes,
 			}
 		default:
 			eLog.Error("Unknown proxy configuration item found", zap.String("type", fmt.Sprintf("%T", e)))
 			return nil, ErrUnknownExporterType
 		}
 
-		// Got reverseExporter, now add a rewrite proxy in front of it
-		labels := make(model.LabelSet)
-
-		// Keep track of reverseExporter name use to pre-empt collisions
-		if _, found := usedNames[baseExporter.Name]; !found {
-			usedNames[baseExporter.Name] = struct{}{}
-		} else {
-			eLog.Error("Exporter name re-use even if rewrite is disabled is not allowed")
-			return nil, ErrExporterNameUsedTwice
+		if baseExporter.Timestamps == config.TimestampsProductionTime && !producesMetrics {
+			eLog.Error("Only exec and file exporters can set timestamps to their production time")
+			return nil, errors.Wrapf(ErrTimestampsInvalid, "%s: %s", baseExporter.Name, baseExporter.Timestamps)
 		}
 
+		// Got reverseExporter, now add a rewrite proxy in front of it. The labels of the path
+		// apply to every exporter, unless the exporter sets them itself.
+		labels := pathLabels.Clone()
+
 		// If not rewriting, eLog it.
-		if !baseExporter.NoRewrite {
-			labels[reverseProxyNameLabel] = model.LabelValue(baseExporter.Name)
+		if !baseExporter.NoRewrite && !keepNameLabel {
+			labels[nameLabel] = model.LabelValue(baseExporter.Name)
 		} else {
 			eLog.Debug("Disabled explicit reverseExporter name")
 		}
 
 		// Set the additional labels.
-		for k, v := range baseExporter.Labels {
-			if k == reverseProxyNameLabel {
-				return nil, ErrNameFieldOverrideAttempted
-			}
-			labels[model.LabelName(k)] = model.LabelValue(v)
+		exporterLabels, err := newStaticLabels(baseExporter.Labels, nameLabel)
+		if err != nil {
+			eLog.Error("Exporter labels are invalid", zap.Error(err))
+			return nil, errors.Wrapf(err, "invalid labels for %s", baseExporter.Name)
+		}
+		labels = labels.Merge(exporterLabels)
+
+		histograms, err := newHistogramConversion(baseExporter)
+		if err != nil {
+			eLog.Error("Histogram conversion is invalid", zap.Error(err))
+			return nil, errors.Wrapf(err, "invalid exporter %s", baseExporter.Name)
 		}
 
 		// Configure the rewriting proxy shim.
 		rewriteProxy := &rewriteProxy{
-			proxy:  newExporter,
-			labels: labels,
+			name:       baseExporter.Name,
+			nameLabel:  nameLabel,
+			proxy:      newExporter,
+			labels:     labels,
+			limits:     limits,
+			histograms: histograms,
+			timestamps: baseExporter.Timestamps,
 		}
 
 		// Add the new backend to the endpoint
 		backend.backends = append(backend.backends, rewriteProxy)
 	}
 
-	var err error
+	if reverseExporter.Routing != nil {
+		router, err := newTargetRouter(reverseExporter.Routing, backend.backends, nameLabel, pathLabels)
+		if err != nil {
+			log.Error("Routing is invalid", zap.Error(err))
+			return nil, errors.Wrapf(err, "invalid routing for %s", reverseExporter.Path)
+		}
+		backend.router = router
+	}
+
+	aggregations, err := newAggregations(reverseExporter.Aggregations)
+	if err != nil {
+		log.Error("Aggregations are invalid", zap.Error(err))
+		return nil, errors.Wrapf(err, "invalid aggregations for %s", reverseExporter.Path)
+	}
+	backend.aggregations = aggregations
+
 	backend.handler, err = auth.SetupAuthHandler(reverseExporter.Auth, backend.handler)
 	if err != nil {
 		return backend, errors.Wrapf(err, "failed configuring reverseExporter auth: %s",
 			reverseExporter.Path)
 	}
 
+	backend.debugHandler, err = auth.SetupAuthHandler(reverseExporter.Auth, http.HandlerFunc(backend.serveDebugHTTP))
+	if err != nil {
+		return backend, errors.Wrapf(err, "failed configuring reverseExporter debug auth: %s",
+			reverseExporter.Path)
+	}
+
+	for _, endpoint := range includedEndpoints {
+		endpoint.coalesce()
+	}
+
 	return backend, nil
 }
+
+// newExporterLabel returns the name of the label metrics are given the name of their
+// exporter in. An empty name is the default exporter_name.
+func newExporterLabel(name string) (model.LabelName, error) {
+	if name == "" {
+		return reverseProxyNameLabel, nil
+	}
+	labelName := model.LabelName(name)
+	if !labelName.IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) || isBucketLabel(name) {
+		return "", errors.Wrapf(ErrExporterLabelInvalid, "%q", name)
+	}
+	return labelName, nil
+}
+
+// newStaticLabels returns static labels as a label set. The exporter label and the le and
+// quantile labels cannot be set.
+func newStaticLabels(labels map[string]string, nameLabel model.LabelName) (model.LabelSet, error) {
+	labelSet := make(model.LabelSet, len(labels))
+	for name, value := range labels {
+		switch {
+		case model.LabelName(name) == nameLabel:
+			return nil, errors.Wrapf(ErrNameFieldOverrideAttempted, "%s", name)
+		case isBucketLabel(name):
+			return nil, errors.Wrapf(ErrBucketLabelOverride, "%s", name)
+		case !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix):
+			return nil, errors.Wrapf(ErrStaticLabelInvalid, "%q", name)
+		}
+		labelSet[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return labelSet, nil
+}
@@ -0,0 +1,315 @@
+package metricproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/PaesslerAG/jsonpath"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// ErrJSONMetricInvalid returned when a JSON metric is not correctly declared.
+	ErrJSONMetricInvalid = errors.New("json metric is invalid")
+	// ErrJSONValueInvalid returned when a value selected from a JSON document can't be converted.
+	ErrJSONValueInvalid = errors.New("json value can't be converted")
+)
+
+const (
+	jsonAcceptHeader = "application/json"
+
+	jsonSkippedValuesMetricName = "reverse_exporter_json_skipped_values"
+)
+
+// ensure jsonProxy implements MetricProxy.
+var _ MetricProxy = &jsonProxy{}
+
+// jsonProxy implements a reverse metric proxy which retrieves a JSON document from an HTTP
+// endpoint and converts the values selected by its metric rules into metrics.
+type jsonProxy struct {
+	address            string
+	deadline           time.Duration
+	forwardQueryParams bool
+	maxBytes           uint64
+
+	metrics []*jsonMetric
+
+	// skippedValues is the number of values skipped by the last scrape
+	skippedValues uint64
+
+	log *zap.Logger
+}
+
+// jsonMetric is a compiled JSONMetricConfig.
+type jsonMetric struct {
+	name       string
+	metricType dto.MetricType
+	help       string
+	path       gval.Evaluable
+	// valuePath is nil if elements are used as the value directly
+	valuePath  gval.Evaluable
+	keyLabel   string
+	labels     map[string]string
+	labelPaths map[string]gval.Evaluable
+}
+
+// jsonElement is a single value selected by the path of a jsonMetric.
+type jsonElement struct {
+	// key is the key of the value in the object selected by the path, if a key label is used
+	key   string
+	value interface{}
+}
+
+// newJSONProxy initializes a new jsonProxy. An error is returned if the metrics are not
+// correctly declared.
+func newJSONProxy(config *config.JSONExporterConfig) (*jsonProxy, error) {
+	newProxy := jsonProxy{
+		address:            config.Address,
+		deadline:           time.Duration(config.Timeout),
+		forwardQueryParams: config.ForwardURLParams,
+		maxBytes:           config.MaxBytes,
+		metrics:            make([]*jsonMetric, 0, len(config.Metrics)),
+		log:                zap.L().With(zap.String("name", config.Name)),
+	}
+
+	declared := make(declaredMetrics)
+	for _, metricConfig := range config.Metrics {
+		labelNames := append(lo.Keys(metricConfig.Labels), lo.Keys(metricConfig.LabelPaths)...)
+		if metricConfig.KeyLabel != "" {
+			labelNames = append(labelNames, metricConfig.KeyLabel)
+		}
+		if err := declared.check(ErrJSONMetricInvalid, metricConfig.Name, metricConfig.Type, metricConfig.Help, labelNames); err != nil {
+			return nil, err
+		}
+
+		metric, err := compileJSONMetric(metricConfig)
+		if err != nil {
+			return nil, err
+		}
+		newProxy.metrics = append(newProxy.metrics, metric)
+	}
+
+	return &newProxy, nil
+}
+
+// compileJSONMetric compiles the JSONPath expressions of a JSON metric.
+func compileJSONMetric(metricConfig *config.JSONMetricConfig) (*jsonMetric, error) {
+	if metricConfig.Path == "" {
+		return nil, errors.Wrapf(ErrJSONMetricInvalid, "%s: path is required", metricConfig.Name)
+	}
+
+	metric := &jsonMetric{
+		name:       metricConfig.Name,
+		metricType: protoMetricType(metricConfig.Type),
+		help:       metricConfig.Help,
+		keyLabel:   metricConfig.KeyLabel,
+		labels:     metricConfig.Labels,
+		labelPaths: make(map[string]gval.Evaluable, len(metricConfig.LabelPaths)),
+	}
+
+	var err error
+	if metric.path, err = jsonpath.New(metricConfig.Path); err != nil {
+		return nil, errors.Wrapf(ErrJSONMetricInvalid, "%s: invalid path %q: %v", metricConfig.Name, metricConfig.Path, err)
+	}
+	if metricConfig.ValuePath != "" {
+		if metric.valuePath, err = jsonpath.New(metricConfig.ValuePath); err != nil {
+			return nil, errors.Wrapf(ErrJSONMetricInvalid, "%s: invalid value_path %q: %v",
+				metricConfig.Name, metricConfig.ValuePath, err)
+		}
+	}
+	for labelName, labelPath := range metricConfig.LabelPaths {
+		if metric.labelPaths[labelName], err = jsonpath.New(labelPath); err != nil {
+			return nil, errors.Wrapf(ErrJSONMetricInvalid, "%s: invalid path %q of label %s: %v",
+				metricConfig.Name, labelPath, labelName, err)
+		}
+	}
+
+	return metric, nil
+}
+
+// Scrape retrieves the JSON document and converts it to metrics. Values which can't be
+// selected or converted, or which have the same labels as an earlier value, are skipped.
+func (jp *jsonProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	requestValues := url.Values{}
+	if jp.forwardQueryParams {
+		requestValues = values
+	}
+
+	var document interface{}
+	err := fetch(ctx, jp.deadline, jp.address, requestValues, jp.maxBytes, jsonAcceptHeader, func(resp *http.Response, body io.Reader) error {
+		if err := json.NewDecoder(body).Decode(&document); err != nil {
+			return errors.Wrap(err, "decoding JSON failed")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	families := make(map[string]*dto.MetricFamily)
+	mfs := make([]*dto.MetricFamily, 0, len(jp.metrics))
+	// seen holds the series returned, as a path selecting several elements without labels
+	// telling them apart would return duplicate series
+	seen := make(map[string]struct{})
+	var skipped uint64
+
+	for _, jm := range jp.metrics {
+		elements, err := jm.elements(ctx, document)
+		if err != nil {
+			jp.log.Debug("Skipping JSON metric", zap.String("metric", jm.name), zap.Error(err))
+			skipped++
+			continue
+		}
+
+		for _, element := range elements {
+			metric, err := jm.newMetric(ctx, element)
+			if err != nil {
+				jp.log.Debug("Skipping JSON value", zap.String("metric", jm.name), zap.Error(err))
+				skipped++
+				continue
+			}
+			key := seriesKey(jm.name, metric.GetLabel())
+			if _, found := seen[key]; found {
+				jp.log.Debug("Skipping JSON value with duplicate labels", zap.String("metric", jm.name))
+				skipped++
+				continue
+			}
+			seen[key] = struct{}{}
+			mfs = appendMetric(mfs, families, jm.name, jm.metricType, jm.help, metric)
+		}
+	}
+
+	atomic.StoreUint64(&jp.skippedValues, skipped)
+	return mfs, nil
+}
+
+// statusMetrics implements statusMetricsProvider.
+func (jp *jsonProxy) statusMetrics() []*dto.MetricFamily {
+	return []*dto.MetricFamily{
+		newGaugeFamily(jsonSkippedValuesMetricName, "Number of JSON values which could not be selected or converted, or duplicated another series, by the last scrape.",
+			float64(atomic.LoadUint64(&jp.skippedValues))),
+	}
+}
+
+// elements returns the values selected by the path of the metric. Arrays are returned as
+// their elements, and objects as their entries if a key label is used.
+func (jm *jsonMetric) elements(ctx context.Context, document interface{}) ([]jsonElement, error) {
+	selected, err := jm.path(ctx, document)
+	if err != nil {
+		return nil, errors.Wrap(err, "selecting path failed")
+	}
+
+	if jm.keyLabel != "" {
+		object, ok := selected.(map[string]interface{})
+		if !ok {
+			return nil, errors.Wrapf(ErrJSONValueInvalid, "key_label requires path to select an object, not %T", selected)
+		}
+		keys := lo.Keys(object)
+		sort.Strings(keys)
+		elements := make([]jsonElement, 0, len(keys))
+		for _, key := range keys {
+			elements = append(elements, jsonElement{key: key, value: object[key]})
+		}
+		return elements, nil
+	}
+
+	if list, ok := selected.([]interface{}); ok {
+		elements := make([]jsonElement, 0, len(list))
+		for _, value := range list {
+			elements = append(elements, jsonElement{value: value})
+		}
+		return elements, nil
+	}
+	return []jsonElement{{value: selected}}, nil
+}
+
+// newMetric converts a selected element to a metric.
+func (jm *jsonMetric) newMetric(ctx context.Context, element jsonElement) (*dto.Metric, error) {
+	value := element.value
+	if jm.valuePath != nil {
+		var err error
+		if value, err = jm.valuePath(ctx, element.value); err != nil {
+			return nil, errors.Wrap(err, "selecting value_path failed")
+		}
+	}
+	number, err := jsonNumber(value)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make([]*dto.LabelPair, 0, len(jm.labels)+len(jm.labelPaths)+1)
+	for name, labelValue := range jm.labels {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labelValue)})
+	}
+	if jm.keyLabel != "" {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(jm.keyLabel), Value: proto.String(element.key)})
+	}
+	for name, labelPath := range jm.labelPaths {
+		selected, err := labelPath(ctx, element.value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "selecting label %s failed", name)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(jsonLabelValue(selected))})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+	return newValueMetric(jm.metricType, labels, number), nil
+}
+
+// jsonNumber converts a JSON value to a sample value. Booleans are 1 or 0, and strings are
+// parsed as numbers.
+func jsonNumber(value interface{}) (float64, error) {
+	switch typedValue := value.(type) {
+	case float64:
+		return typedValue, nil
+	case bool:
+		if typedValue {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(typedValue), 64)
+		if err != nil {
+			return 0, errors.Wrapf(ErrJSONValueInvalid, "string is not a number: %q", typedValue)
+		}
+		return number, nil
+	default:
+		return 0, errors.Wrapf(ErrJSONValueInvalid, "%T is not a number", value)
+	}
+}
+
+// jsonLabelValue converts a JSON value to a label value. Arrays and objects are JSON encoded.
+func jsonLabelValue(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typedValue
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(typedValue)
+	default:
+		encoded, err := json.Marshal(typedValue)
+		if err != nil {
+			return fmt.Sprint(typedValue)
+		}
+		return string(encoded)
+	}
+}
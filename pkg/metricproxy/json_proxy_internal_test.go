@@ -0,0 +1,140 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"errors"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+
+	. "gopkg.in/check.v1"
+)
+
+const testJSONDocument = `{
+	"healthy": true,
+	"version": "1.2.3",
+	"uptime": 3600,
+	"queues": {
+		"email": {"depth": 3, "workers": 2},
+		"sms": {"depth": "7", "workers": 1}
+	},
+	"disks": [
+		{"device": "sda", "state": "ACTIVE", "used": 0.5},
+		{"device": "sdb", "state": "FAILED", "used": 0.25},
+		{"device": "sdc", "state": "ACTIVE"}
+	]
+}`
+
+type JSONProxySuite struct{}
+
+var _ = Suite(&JSONProxySuite{})
+
+func (s *JSONProxySuite) TestJSONProxy(c *C) {
+	server := newTestServer("", "application/json", constBody(testJSONDocument))
+	defer server.Close()
+
+	exporterConfig := &config.JSONExporterConfig{
+		HTTPExporterConfig: config.HTTPExporterConfig{Address: server.URL},
+		Metrics: []*config.JSONMetricConfig{
+			// Labels from the same object as the value are selected by selecting the object.
+			{Name: "service_healthy", Path: "$", ValuePath: "$.healthy", LabelPaths: map[string]string{"version": "$.version"}},
+			{Name: "service_uptime_seconds", Type: config.MetricTypeCounter, Path: "$.uptime", Labels: map[string]string{"service": "test"}},
+			{Name: "queue_depth", Path: "$.queues", KeyLabel: "queue", ValuePath: "$.depth"},
+			{Name: "disk_used_ratio", Path: `$.disks[?(@.state == "ACTIVE")]`, ValuePath: "$.used", LabelPaths: map[string]string{"device": "$.device"}},
+			{Name: "missing", Path: "$.missing"},
+			// Only the first element is returned, as nothing tells the elements apart.
+			{Name: "disk_used_first_ratio", Path: "$.disks[*]", ValuePath: "$.used"},
+		},
+	}
+	proxy, err := newJSONProxy(exporterConfig)
+	c.Assert(err, IsNil)
+
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	c.Assert(families, HasLen, 5)
+
+	healthy := families["service_healthy"]
+	c.Check(healthy.GetType(), Equals, dto.MetricType_GAUGE)
+	c.Assert(healthy.GetMetric(), HasLen, 1)
+	c.Check(healthy.GetMetric()[0].GetGauge().GetValue(), Equals, 1.0)
+	c.Check(metricLabels(healthy.GetMetric()[0]), DeepEquals, map[string]string{"version": "1.2.3"})
+
+	uptime := families["service_uptime_seconds"]
+	c.Check(uptime.GetType(), Equals, dto.MetricType_COUNTER)
+	c.Check(uptime.GetMetric()[0].GetCounter().GetValue(), Equals, 3600.0)
+	c.Check(metricLabels(uptime.GetMetric()[0]), DeepEquals, map[string]string{"service": "test"})
+
+	// Object entries are returned in key order, and numeric strings are parsed.
+	depth := families["queue_depth"]
+	c.Assert(depth.GetMetric(), HasLen, 2)
+	c.Check(metricLabels(depth.GetMetric()[0]), DeepEquals, map[string]string{"queue": "email"})
+	c.Check(depth.GetMetric()[0].GetGauge().GetValue(), Equals, 3.0)
+	c.Check(metricLabels(depth.GetMetric()[1]), DeepEquals, map[string]string{"queue": "sms"})
+	c.Check(depth.GetMetric()[1].GetGauge().GetValue(), Equals, 7.0)
+
+	// sdc has no value and is skipped.
+	used := families["disk_used_ratio"]
+	c.Assert(used.GetMetric(), HasLen, 1)
+	c.Check(metricLabels(used.GetMetric()[0]), DeepEquals, map[string]string{"device": "sda"})
+	c.Check(used.GetMetric()[0].GetGauge().GetValue(), Equals, 0.5)
+
+	first := families["disk_used_first_ratio"]
+	c.Assert(first.GetMetric(), HasLen, 1)
+	c.Check(first.GetMetric()[0].GetGauge().GetValue(), Equals, 0.5)
+
+	// The missing metric, the sdc values and the duplicate sdb value were skipped.
+	statusMfs := proxy.statusMetrics()
+	c.Assert(statusMfs, HasLen, 1)
+	c.Check(statusMfs[0].GetName(), Equals, jsonSkippedValuesMetricName)
+	c.Check(statusMfs[0].GetMetric()[0].GetGauge().GetValue(), Equals, 4.0)
+}
+
+func (s *JSONProxySuite) TestJSONProxyErrors(c *C) {
+	server := newTestServer("", "application/json", constBody("{not json"))
+	defer server.Close()
+
+	proxy, err := newJSONProxy(&config.JSONExporterConfig{
+		HTTPExporterConfig: config.HTTPExporterConfig{Address: server.URL},
+		Metrics:            []*config.JSONMetricConfig{{Name: "value", Path: "$.value"}},
+	})
+	c.Assert(err, IsNil)
+	_, err = proxy.Scrape(context.Background(), nil)
+	c.Check(err, Not(IsNil))
+
+	largeServer := newTestServer("", "application/json", constBody(testJSONDocument))
+	defer largeServer.Close()
+	proxy, err = newJSONProxy(&config.JSONExporterConfig{
+		HTTPExporterConfig: config.HTTPExporterConfig{Address: largeServer.URL, MaxBytes: 16},
+		Metrics:            []*config.JSONMetricConfig{{Name: "uptime", Path: "$.uptime"}},
+	})
+	c.Assert(err, IsNil)
+	_, err = proxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrMaxBytesExceeded), Equals, true, Commentf("got error: %v", err))
+}
+
+func (s *JSONProxySuite) TestJSONProxyInvalidMetrics(c *C) {
+	invalidMetrics := [][]*config.JSONMetricConfig{
+		{{Name: "invalid-name", Path: "$.value"}},
+		{{Name: "no_path"}},
+		{{Name: "bad_path", Path: "$.[["}},
+		{{Name: "bad_value_path", Path: "$.value", ValuePath: "$.[["}},
+		{{Name: "bad_label_path", Path: "$.value", LabelPaths: map[string]string{"label": "$.[["}}},
+		{{Name: "bad_label", Path: "$.value", Labels: map[string]string{"bad-label": "a"}}},
+		{{Name: "duplicate_label", Path: "$.value", KeyLabel: "a", Labels: map[string]string{"a": "a"}}},
+		{
+			{Name: "conflicting_type", Path: "$.value"},
+			{Name: "conflicting_type", Type: config.MetricTypeCounter, Path: "$.value"},
+		},
+	}
+
+	for _, metrics := range invalidMetrics {
+		_, err := newJSONProxy(&config.JSONExporterConfig{Metrics: metrics})
+		c.Check(errors.Is(err, ErrJSONMetricInvalid), Equals, true, Commentf("%s: got error: %v", metrics[0].Name, err))
+	}
+}
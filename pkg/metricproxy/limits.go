@@ -0,0 +1,113 @@
+package metricproxy
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	// ErrSampleLimitExceeded returned when a backend returns more samples than its sample_limit.
+	ErrSampleLimitExceeded = errors.New("sample limit exceeded")
+	// ErrLabelLimitExceeded returned when a series of a backend has more labels than its label_limit.
+	ErrLabelLimitExceeded = errors.New("label limit exceeded")
+	// ErrLabelNameLengthLimitExceeded returned when a label name of a backend is longer than its
+	// label_name_length_limit.
+	ErrLabelNameLengthLimitExceeded = errors.New("label name length limit exceeded")
+	// ErrLabelValueLengthLimitExceeded returned when a label value of a backend is longer than its
+	// label_value_length_limit.
+	ErrLabelValueLengthLimitExceeded = errors.New("label value length limit exceeded")
+)
+
+// scrapeLimits bounds the metrics a single backend may return. A limit of 0 is unlimited.
+type scrapeLimits struct {
+	sampleLimit           uint64
+	labelLimit            uint64
+	labelNameLengthLimit  uint64
+	labelValueLengthLimit uint64
+}
+
+// newScrapeLimits returns the limits configured for an exporter.
+func newScrapeLimits(exporter config.Exporter) scrapeLimits {
+	return scrapeLimits{
+		sampleLimit:           exporter.SampleLimit,
+		labelLimit:            exporter.LabelLimit,
+		labelNameLengthLimit:  exporter.LabelNameLengthLimit,
+		labelValueLengthLimit: exporter.LabelValueLengthLimit,
+	}
+}
+
+// check returns an error if the metrics exceed any of the limits. Like Prometheus, the
+// metric name counts as the __name__ label.
+func (sl scrapeLimits) check(mfs []*dto.MetricFamily) error {
+	var samples uint64
+
+	for _, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			samples += countSamples(mf.GetType(), metric)
+
+			if sl.labelLimit > 0 && uint64(len(metric.GetLabel())+1) > sl.labelLimit {
+				return errors.Wrapf(ErrLabelLimitExceeded, "%s has %d labels, limit %d",
+					mf.GetName(), len(metric.GetLabel())+1, sl.labelLimit)
+			}
+
+			if err := sl.checkLabel(model.MetricNameLabel, mf.GetName()); err != nil {
+				return err
+			}
+			for _, lp := range metric.GetLabel() {
+				if err := sl.checkLabel(lp.GetName(), lp.GetValue()); err != nil {
+					return errors.Wrapf(err, "metric %s", mf.GetName())
+				}
+			}
+		}
+	}
+
+	if sl.sampleLimit > 0 && samples > sl.sampleLimit {
+		return errors.Wrapf(ErrSampleLimitExceeded, "%d samples, limit %d", samples, sl.sampleLimit)
+	}
+
+	return nil
+}
+
+// checkLabel checks the length of a single label name and value.
+func (sl scrapeLimits) checkLabel(name string, value string) error {
+	if sl.labelNameLengthLimit > 0 && uint64(len(name)) > sl.labelNameLengthLimit {
+		return errors.Wrapf(ErrLabelNameLengthLimitExceeded, "label %s, limit %d", name, sl.labelNameLengthLimit)
+	}
+	if sl.labelValueLengthLimit > 0 && uint64(len(value)) > sl.labelValueLengthLimit {
+		return errors.Wrapf(ErrLabelValueLengthLimitExceeded, "label %s, limit %d", name, sl.labelValueLengthLimit)
+	}
+	return nil
+}
+
+// countSamples returns the number of samples a metric is exposed as. Histograms and
+// summaries expose a sample per bucket or quantile in addition to their sum and count. A
+// native histogram is a single sample, plus its classic buckets if it also has them.
+func countSamples(metricType dto.MetricType, metric *dto.Metric) uint64 {
+	switch metricType {
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		histogram := metric.GetHistogram()
+		buckets := histogram.GetBucket()
+		samples := uint64(2) //nolint:gomnd
+		if isNativeHistogram(histogram) {
+			samples++
+			if len(buckets) == 0 {
+				return samples
+			}
+		}
+		samples += uint64(len(buckets))
+		// The +Inf bucket is exposed even if it is implicit.
+		if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), +1) {
+			samples++
+		}
+		return samples
+	case dto.MetricType_SUMMARY:
+		return uint64(len(metric.GetSummary().GetQuantile())) + 2 //nolint:gomnd
+	default:
+		return 1
+	}
+}
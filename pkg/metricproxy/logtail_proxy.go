@@ -0,0 +1,591 @@
+package metricproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// ErrLogtailPathInvalid returned when the paths of a logtail exporter are not correctly configured.
+	ErrLogtailPathInvalid = errors.New("logtail path is invalid")
+	// ErrLogtailRuleInvalid returned when a logtail rule is not correctly declared.
+	ErrLogtailRuleInvalid = errors.New("logtail rule is invalid")
+)
+
+const (
+	defaultLogtailPollInterval        = time.Second
+	defaultLogtailPersistenceInterval = 10 * time.Second
+
+	// logtailMaxLineBytes is the maximum length of a line. Longer lines are discarded.
+	logtailMaxLineBytes = 1024 * 1024
+	// logtailReadBytes is the size of the reads of followed files.
+	logtailReadBytes = 32 * 1024
+)
+
+// ensure logtailProxy implements MetricProxy.
+var _ MetricProxy = &logtailProxy{}
+
+// logtailProxy implements a reverse metric proxy which follows log files and derives
+// metrics from the lines appended to them.
+type logtailProxy struct {
+	patterns            []string
+	pollInterval        time.Duration
+	fromBeginning       bool
+	persistenceFile     string
+	persistenceInterval time.Duration
+	rules               []*logtailRule
+	// stopCh is closed to stop the polling and persistence goroutines
+	stopCh   chan struct{}
+	stopOnce *sync.Once
+
+	// mtx guards the state below
+	mtx *sync.Mutex
+	// initialPoll is true until the files which exist on startup have been opened
+	initialPoll bool
+	files       map[string]*logtailFile
+	// restoredOffsets are the persisted offsets of files which haven't been opened yet
+	restoredOffsets map[string]int64
+	series          map[string]*logtailSeries
+	skippedLines    uint64
+	dirty           bool
+	lastPersisted   time.Time
+
+	log *zap.Logger
+}
+
+// logtailRule is a compiled LogtailRuleConfig.
+type logtailRule struct {
+	name       string
+	metricType dto.MetricType
+	help       string
+	regex      *regexp.Regexp
+	// valueIdx is the index of the value group in the submatches, or -1
+	valueIdx int
+	// groupLabels maps the indexes of the submatches which are labels to the label name
+	groupLabels map[int]string
+	labels      map[string]string
+}
+
+// logtailFile is a followed file.
+type logtailFile struct {
+	file   *os.File
+	info   os.FileInfo
+	offset int64
+	// partial is the end of the file after the last complete line
+	partial []byte
+	// discarding is set while the rest of an overlong line is skipped
+	discarding bool
+	lines      uint64
+}
+
+// logtailSeries is the current value of a series derived by a rule.
+type logtailSeries struct {
+	rule   *logtailRule
+	labels []*dto.LabelPair
+	value  float64
+}
+
+// LogtailStatus is the debugging view of a logtail exporter.
+type LogtailStatus struct {
+	Files         []LogtailFileStatus `json:"files"`
+	Series        int                 `json:"series"`
+	SkippedLines  uint64              `json:"skipped_lines"`
+	LastPersisted *time.Time          `json:"last_persisted,omitempty"`
+}
+
+// LogtailFileStatus is the debugging view of a followed file.
+type LogtailFileStatus struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Lines  uint64 `json:"lines"`
+}
+
+// newLogtailProxy initializes a new logtailProxy. The files are not followed until the proxy
+// is started. An error is returned if the paths or rules are not correctly configured.
+func newLogtailProxy(config *config.LogtailExporterConfig) (*logtailProxy, error) {
+	newProxy := logtailProxy{
+		patterns:            config.Paths,
+		pollInterval:        time.Duration(config.PollInterval),
+		fromBeginning:       config.FromBeginning,
+		persistenceFile:     config.PersistenceFile,
+		persistenceInterval: time.Duration(config.PersistenceInterval),
+		rules:               make([]*logtailRule, 0, len(config.Rules)),
+		stopCh:              make(chan struct{}),
+		stopOnce:            &sync.Once{},
+
+		mtx:             &sync.Mutex{},
+		initialPoll:     true,
+		files:           make(map[string]*logtailFile),
+		restoredOffsets: make(map[string]int64),
+		series:          make(map[string]*logtailSeries),
+
+		log: zap.L().With(zap.String("name", config.Name)),
+	}
+
+	if newProxy.pollInterval == 0 {
+		newProxy.pollInterval = defaultLogtailPollInterval
+	}
+	if newProxy.persistenceInterval == 0 {
+		newProxy.persistenceInterval = defaultLogtailPersistenceInterval
+	}
+
+	if len(config.Paths) == 0 {
+		return nil, errors.Wrap(ErrLogtailPathInvalid, "at least one path is required")
+	}
+	for _, pattern := range config.Paths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(ErrLogtailPathInvalid, "invalid path pattern %q: %v", pattern, err)
+		}
+	}
+
+	declared := make(declaredMetrics)
+	for _, ruleConfig := range config.Rules {
+		rule, err := compileLogtailRule(declared, ruleConfig)
+		if err != nil {
+			return nil, err
+		}
+		newProxy.rules = append(newProxy.rules, rule)
+	}
+
+	if newProxy.persistenceFile != "" {
+		if err := newProxy.restore(); err != nil {
+			newProxy.log.Error("Could not restore persisted log offsets - following from the end",
+				zap.String("persistence_file", newProxy.persistenceFile), zap.Error(err))
+		}
+	}
+
+	return &newProxy, nil
+}
+
+// start implements starter by opening the files the proxy follows, and starting its polling
+// and persistence goroutines.
+func (lp *logtailProxy) start() {
+	lp.poll()
+	go lp.poller()
+	if lp.persistenceFile != "" {
+		go lp.persister()
+	}
+}
+
+// compileLogtailRule checks the declaration of a logtail rule and compiles it.
+func compileLogtailRule(declared declaredMetrics, ruleConfig *config.LogtailRuleConfig) (*logtailRule, error) {
+	metricType := ruleConfig.Type
+	if metricType == "" {
+		metricType = config.MetricTypeCounter
+	}
+	if metricType != config.MetricTypeCounter && metricType != config.MetricTypeGauge {
+		return nil, errors.Wrapf(ErrLogtailRuleInvalid, "%s: type must be counter or gauge", ruleConfig.Name)
+	}
+	if ruleConfig.Regex.Regexp == nil {
+		return nil, errors.Wrapf(ErrLogtailRuleInvalid, "%s: regex is required", ruleConfig.Name)
+	}
+
+	rule := &logtailRule{
+		name:        ruleConfig.Name,
+		metricType:  protoMetricType(metricType),
+		help:        ruleConfig.Help,
+		regex:       ruleConfig.Regex.Regexp,
+		valueIdx:    -1,
+		groupLabels: make(map[int]string),
+		labels:      ruleConfig.Labels,
+	}
+
+	for idx, groupName := range rule.regex.SubexpNames() {
+		switch {
+		case groupName == "":
+		case groupName == ruleConfig.ValueGroup:
+			rule.valueIdx = idx
+		default:
+			rule.groupLabels[idx] = groupName
+		}
+	}
+	if ruleConfig.ValueGroup != "" && rule.valueIdx < 0 {
+		return nil, errors.Wrapf(ErrLogtailRuleInvalid, "%s: regex has no group named %s", ruleConfig.Name, ruleConfig.ValueGroup)
+	}
+	if metricType == config.MetricTypeGauge && rule.valueIdx < 0 {
+		return nil, errors.Wrapf(ErrLogtailRuleInvalid, "%s: gauges require value_group", ruleConfig.Name)
+	}
+
+	labelNames := append(lo.Keys(ruleConfig.Labels), lo.Values(rule.groupLabels)...)
+	if err := declared.check(ErrLogtailRuleInvalid, ruleConfig.Name, metricType, ruleConfig.Help, labelNames); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// Scrape reads the lines appended to the followed files since the last poll, and returns
+// the metrics derived from all lines read since startup.
+func (lp *logtailProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	lp.poll()
+
+	lp.mtx.Lock()
+	defer lp.mtx.Unlock()
+
+	keys := lo.Keys(lp.series)
+	sort.Strings(keys)
+
+	families := make(map[string]*dto.MetricFamily)
+	mfs := make([]*dto.MetricFamily, 0)
+	for _, key := range keys {
+		series := lp.series[key]
+		mfs = appendMetric(mfs, families, series.rule.name, series.rule.metricType, series.rule.help,
+			newValueMetric(series.rule.metricType, series.labels, series.value))
+	}
+	return mfs, nil
+}
+
+// Status implements StatusReporter.
+func (lp *logtailProxy) Status() interface{} {
+	lp.mtx.Lock()
+	defer lp.mtx.Unlock()
+
+	status := LogtailStatus{
+		Files:        make([]LogtailFileStatus, 0, len(lp.files)),
+		Series:       len(lp.series),
+		SkippedLines: lp.skippedLines,
+	}
+	paths := lo.Keys(lp.files)
+	sort.Strings(paths)
+	for _, path := range paths {
+		status.Files = append(status.Files, LogtailFileStatus{
+			Path:   path,
+			Offset: lp.files[path].offset,
+			Lines:  lp.files[path].lines,
+		})
+	}
+	if !lp.lastPersisted.IsZero() {
+		lastPersisted := lp.lastPersisted
+		status.LastPersisted = &lastPersisted
+	}
+	return status
+}
+
+// poller periodically reads the lines appended to the followed files until the proxy is
+// stopped.
+func (lp *logtailProxy) poller() {
+	ticker := time.NewTicker(lp.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lp.stopCh:
+			return
+		case <-ticker.C:
+			lp.poll()
+		}
+	}
+}
+
+// poll reads the lines appended to the followed files. Files which have been replaced or
+// removed are read to the end and closed, and files which have been truncated are read
+// from the beginning.
+func (lp *logtailProxy) poll() {
+	lp.mtx.Lock()
+	defer lp.mtx.Unlock()
+
+	paths := make(map[string]struct{})
+	for _, pattern := range lp.patterns {
+		// The only possible error is ErrBadPattern, which was checked on startup.
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			paths[filepath.Clean(path)] = struct{}{}
+		}
+	}
+
+	for path, followed := range lp.files {
+		if _, found := paths[path]; !found {
+			lp.closeFile(path, followed)
+		}
+	}
+
+	sortedPaths := lo.Keys(paths)
+	sort.Strings(sortedPaths)
+	for _, path := range sortedPaths {
+		lp.follow(path)
+	}
+
+	lp.initialPoll = false
+}
+
+// follow reads the lines appended to the file at path, opening it if it is not followed yet.
+func (lp *logtailProxy) follow(path string) {
+	st, err := os.Stat(path)
+	followed := lp.files[path]
+	if err != nil {
+		if followed != nil {
+			lp.closeFile(path, followed)
+		}
+		return
+	}
+
+	if followed != nil && !os.SameFile(followed.info, st) {
+		// The file was rotated, so finish reading the old one and start on the new one.
+		lp.closeFile(path, followed)
+		followed = nil
+	}
+
+	if followed == nil {
+		if followed, err = lp.openFile(path); err != nil {
+			lp.log.Warn("Could not open log file", zap.String("path", path), zap.Error(err))
+			return
+		}
+		lp.files[path] = followed
+	} else if st.Size() < followed.offset {
+		lp.log.Info("Log file was truncated - reading from the beginning", zap.String("path", path))
+		if _, err := followed.file.Seek(0, io.SeekStart); err != nil {
+			lp.log.Warn("Could not seek truncated log file", zap.String("path", path), zap.Error(err))
+			lp.closeFile(path, followed)
+			return
+		}
+		followed.offset = 0
+		followed.partial = nil
+		followed.discarding = false
+		lp.dirty = true
+	}
+
+	lp.read(path, followed)
+}
+
+// openFile opens a file to follow. Files are followed from their persisted offset if they
+// have one. Otherwise files which exist on startup are followed from the end unless
+// fromBeginning is set, and files which appear later are followed from the beginning.
+func (lp *logtailProxy) openFile(path string) (*logtailFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening file failed")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "reading file info failed")
+	}
+
+	var offset int64
+	if restoredOffset, found := lp.restoredOffsets[path]; found {
+		delete(lp.restoredOffsets, path)
+		// A shorter file must have been replaced while the exporter was not running.
+		if restoredOffset <= info.Size() {
+			offset = restoredOffset
+		}
+	} else if lp.initialPoll && !lp.fromBeginning {
+		offset = info.Size()
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "seeking file failed")
+	}
+	lp.dirty = true
+
+	return &logtailFile{file: file, info: info, offset: offset}, nil
+}
+
+// closeFile reads the rest of a followed file, including any unterminated last line, and
+// stops following it.
+func (lp *logtailProxy) closeFile(path string, followed *logtailFile) {
+	lp.read(path, followed)
+	if len(followed.partial) > 0 {
+		lp.applyLine(followed.partial)
+		followed.lines++
+	}
+	followed.file.Close()
+	delete(lp.files, path)
+	lp.dirty = true
+}
+
+// read applies the rules to the complete lines appended to a followed file.
+func (lp *logtailProxy) read(path string, followed *logtailFile) {
+	buf := make([]byte, logtailReadBytes)
+	for {
+		bytesRead, err := followed.file.Read(buf)
+		if bytesRead > 0 {
+			followed.offset += int64(bytesRead)
+			lp.dirty = true
+
+			data := append(followed.partial, buf[:bytesRead]...)
+			if followed.discarding {
+				// The rest of an overlong line is not a line of its own.
+				end := bytes.IndexByte(data, '\n')
+				if end < 0 {
+					data = nil
+				} else {
+					data = data[end+1:]
+					followed.discarding = false
+				}
+			}
+			for {
+				end := bytes.IndexByte(data, '\n')
+				if end < 0 {
+					break
+				}
+				lp.applyLine(data[:end])
+				followed.lines++
+				data = data[end+1:]
+			}
+			if len(data) > logtailMaxLineBytes {
+				lp.log.Warn("Discarding overlong log line", zap.String("path", path))
+				lp.skippedLines++
+				data = nil
+				followed.discarding = true
+			}
+			followed.partial = append([]byte(nil), data...)
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			lp.log.Warn("Could not read log file", zap.String("path", path), zap.Error(err))
+			return
+		}
+	}
+}
+
+// applyLine updates the series of the rules which match a line.
+func (lp *logtailProxy) applyLine(rawLine []byte) {
+	line := strings.TrimSuffix(string(rawLine), "\r")
+	for _, rule := range lp.rules {
+		submatches := rule.regex.FindStringSubmatch(line)
+		if submatches == nil {
+			continue
+		}
+
+		value := 1.0
+		if rule.valueIdx >= 0 {
+			var err error
+			value, err = strconv.ParseFloat(strings.TrimSpace(submatches[rule.valueIdx]), 64)
+			if err != nil || (rule.metricType == dto.MetricType_COUNTER && value < 0) {
+				lp.log.Debug("Skipping log line with invalid value", zap.String("rule", rule.name),
+					zap.String("value", submatches[rule.valueIdx]))
+				lp.skippedLines++
+				continue
+			}
+		}
+
+		labels := make([]*dto.LabelPair, 0, len(rule.labels)+len(rule.groupLabels))
+		for name, labelValue := range rule.labels {
+			labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labelValue)})
+		}
+		for idx, name := range rule.groupLabels {
+			labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(submatches[idx])})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+		key := seriesKey(rule.name, labels)
+		series, found := lp.series[key]
+		if !found {
+			series = &logtailSeries{rule: rule, labels: labels}
+			lp.series[key] = series
+		}
+		if rule.metricType == dto.MetricType_COUNTER {
+			series.value += value
+		} else {
+			series.value = value
+		}
+	}
+}
+
+// persister periodically saves changed offsets to the persistence file until the proxy is
+// stopped.
+func (lp *logtailProxy) persister() {
+	ticker := time.NewTicker(lp.persistenceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lp.stopCh:
+			return
+		case <-ticker.C:
+			lp.persistLogged()
+		}
+	}
+}
+
+// stop implements stopper. Changed offsets are saved a last time so lines read since the last
+// save are not counted again after a restart.
+func (lp *logtailProxy) stop() {
+	lp.stopOnce.Do(func() { close(lp.stopCh) })
+	if lp.persistenceFile != "" {
+		lp.persistLogged()
+	}
+}
+
+// persistLogged saves changed offsets to the persistence file, logging any error.
+func (lp *logtailProxy) persistLogged() {
+	if err := lp.persist(); err != nil {
+		lp.log.Error("Could not persist log offsets",
+			zap.String("persistence_file", lp.persistenceFile), zap.Error(err))
+	}
+}
+
+// persist saves the offsets of the followed files to the persistence file if they have
+// changed. Offsets are saved after the last complete line read.
+func (lp *logtailProxy) persist() error {
+	lp.mtx.Lock()
+	defer lp.mtx.Unlock()
+
+	if !lp.dirty {
+		return nil
+	}
+
+	// Files which haven't been opened since the offsets were restored keep them, so they
+	// are not read again from the beginning when they reappear.
+	offsets := make(map[string]int64, len(lp.restoredOffsets)+len(lp.files))
+	for path, offset := range lp.restoredOffsets {
+		offsets[path] = offset
+	}
+	for path, followed := range lp.files {
+		offsets[path] = followed.offset - int64(len(followed.partial))
+	}
+
+	content, err := json.Marshal(offsets)
+	if err != nil {
+		return errors.Wrap(err, "encoding log offsets failed")
+	}
+	if err := writeFileAtomic(lp.persistenceFile, content); err != nil {
+		return err
+	}
+
+	lp.dirty = false
+	lp.lastPersisted = time.Now()
+	return nil
+}
+
+// restore loads the offsets of files from the persistence file. A missing file is not an error.
+func (lp *logtailProxy) restore() error {
+	content, err := ioutil.ReadFile(lp.persistenceFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading persistence file failed")
+	}
+
+	offsets := make(map[string]int64)
+	if err := json.Unmarshal(content, &offsets); err != nil {
+		return errors.Wrap(err, "decoding persistence file failed")
+	}
+
+	lp.mtx.Lock()
+	defer lp.mtx.Unlock()
+	lp.restoredOffsets = offsets
+	return nil
+}
@@ -0,0 +1,261 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type LogtailProxySuite struct{}
+
+var _ = Suite(&LogtailProxySuite{})
+
+// appendLog appends content to the file at path, creating it if needed.
+func appendLog(c *C, path string, content string) {
+	logFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0644))
+	c.Assert(err, IsNil)
+	_, err = logFile.WriteString(content)
+	c.Assert(err, IsNil)
+	c.Assert(logFile.Close(), IsNil)
+}
+
+// newTestLogtailConfig returns a config which only polls on scrape, with a rule counting
+// lines containing "error".
+func newTestLogtailConfig(paths ...string) *config.LogtailExporterConfig {
+	return &config.LogtailExporterConfig{
+		Paths:        paths,
+		PollInterval: model.Duration(time.Hour),
+		Rules: []*config.LogtailRuleConfig{
+			{Name: "errors_total", Regex: config.Regexp{Regexp: regexp.MustCompile("error")}},
+		},
+	}
+}
+
+func (s *LogtailProxySuite) TestLogtailProxy(c *C) {
+	logDir := c.MkDir()
+	appLog := filepath.Join(logDir, "app.log")
+	// Lines written before startup are not counted.
+	appendLog(c, appLog, "level=error msg=old\n")
+
+	proxy, err := newLogtailProxy(&config.LogtailExporterConfig{
+		Paths:        []string{filepath.Join(logDir, "*.log")},
+		PollInterval: model.Duration(time.Hour),
+		Rules: []*config.LogtailRuleConfig{
+			{Name: "log_lines_total", Regex: config.Regexp{Regexp: regexp.MustCompile(`level=(?P<level>\w+)`)},
+				Labels: map[string]string{"app": "test"}},
+			{Name: "queue_depth", Type: config.MetricTypeGauge, ValueGroup: "depth",
+				Regex: config.Regexp{Regexp: regexp.MustCompile(`queue=(?P<queue>\w+) depth=(?P<depth>\S+)`)}},
+			{Name: "sent_bytes_total", ValueGroup: "bytes",
+				Regex: config.Regexp{Regexp: regexp.MustCompile(`sent (?P<bytes>\S+) bytes`)}},
+		},
+	})
+	c.Assert(err, IsNil)
+	proxy.start()
+
+	appendLog(c, appLog, "level=error msg=failed\r\nlevel=warn msg=slow\nlevel=error msg=failed again\n")
+	appendLog(c, appLog, "queue=email depth=5\nqueue=email depth=3\nqueue=sms depth=invalid\n")
+	appendLog(c, appLog, "sent 100 bytes\nsent 50 bytes\nsent -1 bytes\nsent 1")
+	// Files which appear later are read from the beginning.
+	appendLog(c, filepath.Join(logDir, "other.log"), "level=error msg=other\n")
+
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+
+	c.Check(familyValues(mfs, "log_lines_total", ""), DeepEquals, map[string]float64{
+		`{app="test", level="error"}`: 3,
+		`{app="test", level="warn"}`:  1,
+	})
+	c.Check(familyValues(mfs, "queue_depth", ""), DeepEquals, map[string]float64{`{queue="email"}`: 3})
+	// The unterminated line is not read yet.
+	c.Check(familyValues(mfs, "sent_bytes_total", ""), DeepEquals, map[string]float64{`{}`: 150})
+
+	appendLog(c, appLog, "0 bytes\n")
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "sent_bytes_total", ""), DeepEquals, map[string]float64{`{}`: 160})
+
+	status, ok := proxy.Status().(LogtailStatus)
+	c.Assert(ok, Equals, true)
+	c.Check(status.Files, HasLen, 2)
+	c.Check(status.SkippedLines, Equals, uint64(2))
+}
+
+func (s *LogtailProxySuite) TestLogtailProxyRotation(c *C) {
+	appLog := filepath.Join(c.MkDir(), "app.log")
+	proxy, err := newLogtailProxy(newTestLogtailConfig(appLog))
+	c.Assert(err, IsNil)
+	proxy.start()
+
+	appendLog(c, appLog, "error\nerr")
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 1})
+
+	// The rest of the rotated file is read before the new file.
+	appendLog(c, appLog, "or\nerror")
+	c.Assert(os.Rename(appLog, appLog+".1"), IsNil)
+	appendLog(c, appLog, "error\n")
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 4})
+
+	c.Assert(os.Truncate(appLog, 0), IsNil)
+	proxy.poll()
+	appendLog(c, appLog, "error\n")
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 5})
+
+	// Removed files are read until the exporter sees they are gone.
+	c.Assert(os.Remove(appLog), IsNil)
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 5})
+	c.Check(proxy.Status().(LogtailStatus).Files, HasLen, 0)
+}
+
+func (s *LogtailProxySuite) TestLogtailProxyOverlongLine(c *C) {
+	appLog := filepath.Join(c.MkDir(), "app.log")
+	appendLog(c, appLog, strings.Repeat("x", logtailMaxLineBytes+1))
+
+	exporterConfig := newTestLogtailConfig(appLog)
+	exporterConfig.FromBeginning = true
+	proxy, err := newLogtailProxy(exporterConfig)
+	c.Assert(err, IsNil)
+	proxy.start()
+
+	// The end of the overlong line is discarded with it, rather than matched as a line.
+	appendLog(c, appLog, "error\nerror\n")
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 1})
+	c.Check(proxy.Status().(LogtailStatus).SkippedLines, Equals, uint64(1))
+}
+
+func (s *LogtailProxySuite) TestLogtailProxyPersistence(c *C) {
+	logDir := c.MkDir()
+	appLog := filepath.Join(logDir, "app.log")
+	appendLog(c, appLog, "error\nerror\n")
+
+	exporterConfig := newTestLogtailConfig(appLog)
+	exporterConfig.FromBeginning = true
+	exporterConfig.PersistenceFile = filepath.Join(logDir, "offsets.json")
+
+	proxy, err := newLogtailProxy(exporterConfig)
+	c.Assert(err, IsNil)
+	proxy.start()
+	appendLog(c, appLog, "error\nerr")
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 3})
+	c.Assert(proxy.persist(), IsNil)
+
+	// The restarted exporter continues from the start of the unterminated line.
+	appendLog(c, appLog, "or\n")
+	restarted, err := newLogtailProxy(exporterConfig)
+	c.Assert(err, IsNil)
+	restarted.start()
+	mfs, err = restarted.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 1})
+}
+
+func (s *LogtailProxySuite) TestLogtailProxyPersistenceKeepsUnopenedFiles(c *C) {
+	logDir := c.MkDir()
+	appLog := filepath.Join(logDir, "app.log")
+	otherLog := filepath.Join(logDir, "other.log")
+	appendLog(c, appLog, "error\n")
+	appendLog(c, otherLog, "error\n")
+
+	exporterConfig := newTestLogtailConfig(filepath.Join(logDir, "*.log"))
+	exporterConfig.FromBeginning = true
+	exporterConfig.PersistenceFile = filepath.Join(logDir, "offsets.json")
+
+	proxy, err := newLogtailProxy(exporterConfig)
+	c.Assert(err, IsNil)
+	proxy.start()
+	c.Assert(proxy.persist(), IsNil)
+
+	// other.log is missing while the exporter runs, so its offset is never opened.
+	c.Assert(os.Rename(otherLog, otherLog+".moved"), IsNil)
+	restarted, err := newLogtailProxy(exporterConfig)
+	c.Assert(err, IsNil)
+	restarted.start()
+	appendLog(c, appLog, "error\n")
+	_, err = restarted.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(restarted.persist(), IsNil)
+
+	// Once it is back, only the lines appended since the first exporter are counted.
+	c.Assert(os.Rename(otherLog+".moved", otherLog), IsNil)
+	appendLog(c, otherLog, "error\n")
+	restarted, err = newLogtailProxy(exporterConfig)
+	c.Assert(err, IsNil)
+	restarted.start()
+	mfs, err := restarted.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 1})
+}
+
+func (s *LogtailProxySuite) TestLogtailProxyPersistenceOnStop(c *C) {
+	logDir := c.MkDir()
+	appLog := filepath.Join(logDir, "app.log")
+	appendLog(c, appLog, "error\n")
+
+	exporterConfig := newTestLogtailConfig(appLog)
+	exporterConfig.Name = "app"
+	exporterConfig.FromBeginning = true
+	exporterConfig.PersistenceFile = filepath.Join(logDir, "offsets.json")
+	exporterConfig.PersistenceInterval = model.Duration(time.Hour)
+
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path:      "/logs",
+		Exporters: &config.ExportersConfig{LogtailExporters: []*config.LogtailExporterConfig{exporterConfig}},
+	}, nil)
+	c.Assert(err, IsNil)
+	endpoint.Start()
+
+	// Offsets read since the last periodic save are saved when the endpoint is stopped, so
+	// the restarted exporter does not count the lines again.
+	endpoint.Stop()
+	appendLog(c, appLog, "error\n")
+	restarted, err := newLogtailProxy(exporterConfig)
+	c.Assert(err, IsNil)
+	restarted.start()
+	mfs, err := restarted.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, "errors_total", ""), DeepEquals, map[string]float64{`{}`: 1})
+}
+
+func (s *LogtailProxySuite) TestLogtailProxyInvalidConfig(c *C) {
+	logPath := filepath.Join(c.MkDir(), "app.log")
+	invalidRules := [][]*config.LogtailRuleConfig{
+		{{Name: "no_regex"}},
+		{{Name: "invalid-name", Regex: config.Regexp{Regexp: regexp.MustCompile("error")}}},
+		{{Name: "untyped", Type: config.MetricTypeUntyped, Regex: config.Regexp{Regexp: regexp.MustCompile("error")}}},
+		{{Name: "gauge_without_value", Type: config.MetricTypeGauge, Regex: config.Regexp{Regexp: regexp.MustCompile("error")}}},
+		{{Name: "missing_value_group", ValueGroup: "value", Regex: config.Regexp{Regexp: regexp.MustCompile("error")}}},
+		{{Name: "duplicate_label", Labels: map[string]string{"level": "error"},
+			Regex: config.Regexp{Regexp: regexp.MustCompile(`level=(?P<level>\w+)`)}}},
+	}
+
+	for _, rules := range invalidRules {
+		_, err := newLogtailProxy(&config.LogtailExporterConfig{Paths: []string{logPath}, Rules: rules})
+		c.Check(errors.Is(err, ErrLogtailRuleInvalid), Equals, true, Commentf("%s: got error: %v", rules[0].Name, err))
+	}
+
+	_, err := newLogtailProxy(&config.LogtailExporterConfig{})
+	c.Check(errors.Is(err, ErrLogtailPathInvalid), Equals, true, Commentf("got error: %v", err))
+	_, err = newLogtailProxy(&config.LogtailExporterConfig{Paths: []string{"[invalid"}})
+	c.Check(errors.Is(err, ErrLogtailPathInvalid), Equals, true, Commentf("got error: %v", err))
+}
@@ -3,6 +3,7 @@ package metricproxy
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"sync"
@@ -26,6 +27,8 @@ const (
 
 const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,*/*;q=0.1`
 
+// reverseProxyNameLabel is the default label metrics are given the name of their exporter
+// in. Paths can use another with exporter_label.
 const reverseProxyNameLabel = "exporter_name"
 
 var userAgentHeader = fmt.Sprintf("Prometheus Reverse Exporter/%s", version.Version) //nolint:gochecknoglobals
@@ -39,6 +42,7 @@ type netProxy struct {
 	address            string
 	deadline           time.Duration
 	forwardQueryParams bool
+	maxBytes           uint64
 	log                *zap.Logger
 }
 
@@ -54,7 +58,7 @@ func (mrp *netProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.Metr
 		requestValues = values
 	}
 
-	mfs, err := scrape(childCtx, mrp.deadline, mrp.address, requestValues)
+	mfs, err := scrape(childCtx, mrp.deadline, mrp.address, requestValues, mrp.maxBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -62,13 +66,31 @@ func (mrp *netProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.Metr
 }
 
 // scrape decodes MetricFamily's from the wire format, and returns them ready to be proxied.
-func scrape(ctx context.Context, deadline time.Duration, address string, values url.Values) ([]*dto.MetricFamily, error) {
+// A maxBytes of 0 does not limit the size of the response.
+func scrape(ctx context.Context, deadline time.Duration, address string, values url.Values, maxBytes uint64) ([]*dto.MetricFamily, error) {
+	var mfs []*dto.MetricFamily
+	err := fetch(ctx, deadline, address, values, maxBytes, acceptHeader, func(resp *http.Response, body io.Reader) error {
+		var err error
+		mfs, err = decodeMetrics(body, expfmt.ResponseFormat(resp.Header))
+		return err
+	})
+	return mfs, err
+}
+
+// fetch requests address and passes the response to handleFn if it was successful. The body
+// passed to handleFn is decompressed, and fails once more than maxBytes have been read either
+// before or after decompression. A maxBytes of 0 does not limit the size of the response.
+func fetch(ctx context.Context, deadline time.Duration, address string, values url.Values, maxBytes uint64,
+	accept string, handleFn func(resp *http.Response, body io.Reader) error) error {
 	req, err := http.NewRequest(http.MethodGet, address, nil)
 	if err != nil {
-		return nil, errors.Wrapf(err, "creating HTTP request failed")
+		return errors.Wrapf(err, "creating HTTP request failed")
 	}
-	req.Header.Add("Accept", acceptHeader)
+	req.Header.Add("Accept", accept)
 	req.Header.Set("User-Agent", userAgentHeader)
+	// Requesting compression explicitly stops the client transparently decompressing the
+	// response, so the compressed bytes can be limited too.
+	req.Header.Set(acceptEncodingHeader, "gzip")
 	//req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", s.timeout.Seconds()))
 
 	// Replace query parameters only if specified
@@ -89,14 +111,24 @@ func scrape(ctx context.Context, deadline time.Duration, address string, values
 
 	resp, err := http.DefaultClient.Do(req.WithContext(proxyCtx))
 	if err != nil {
-		return nil, errors.Wrap(err, "http scrape failure")
+		return errors.Wrap(err, "http scrape failure")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Wrapf(ErrNetProxyScrapeError, "server returned HTTP status %s", resp.Status)
+		return errors.Wrapf(ErrNetProxyScrapeError, "server returned HTTP status %s", resp.Status)
 	}
 
-	mfs, err := decodeMetrics(resp.Body, expfmt.ResponseFormat(resp.Header))
-	return mfs, err
+	if maxBytes > 0 && resp.ContentLength > int64(maxBytes) {
+		return errors.Wrapf(ErrMaxBytesExceeded, "content length %d exceeds limit %d bytes", resp.ContentLength, maxBytes)
+	}
+
+	// Both the compressed and decompressed sizes are limited.
+	body, err := newDecompressingReader(newMaxBytesReader(resp.Body, maxBytes), "")
+	if err != nil {
+		return errors.Wrap(err, "http scrape failure")
+	}
+	defer body.Close()
+
+	return handleFn(resp, newMaxBytesReader(body, maxBytes))
 }
@@ -0,0 +1,59 @@
+package metricproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type NetProxySuite struct{}
+
+var _ = Suite(&NetProxySuite{})
+
+func (s *NetProxySuite) TestScrapeMaxBytesCompressed(c *C) {
+	// A comment of random bytes barely compresses, so the response is larger compressed
+	// than decompressed.
+	comment := make([]byte, 4096)
+	rnd := rand.New(rand.NewSource(1)) //nolint:gosec
+	rnd.Read(comment)                  //nolint:errcheck
+	for idx := range comment {
+		if comment[idx] == '\n' {
+			comment[idx] = ' '
+		}
+	}
+	plain := "# " + string(comment) + "\ntest_metric 1\n"
+
+	compressed := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(compressed)
+	gzipWriter.Write([]byte(plain)) //nolint:errcheck
+	gzipWriter.Close()
+	c.Assert(compressed.Len() > len(plain)+1, Equals, true)
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if !strings.Contains(req.Header.Get(acceptEncodingHeader), "gzip") {
+			wr.Write([]byte(plain)) //nolint:errcheck
+			return
+		}
+		wr.Header().Set(contentEncodingHeader, "gzip")
+		// Flushing before writing the body sends it chunked, without a Content-Length.
+		wr.(http.Flusher).Flush()
+		wr.Write(compressed.Bytes()) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	_, err := scrape(context.Background(), 0, server.URL, nil, uint64(len(plain)+1))
+	c.Check(errors.Is(err, ErrMaxBytesExceeded), Equals, true, Commentf("got error: %v", err))
+
+	mfs, err := scrape(context.Background(), 0, server.URL, nil, uint64(compressed.Len()+1))
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 1)
+	c.Check(mfs[0].GetName(), Equals, "test_metric")
+	c.Check(mfs[0].GetMetric()[0].GetUntyped().GetValue(), Equals, float64(1))
+}
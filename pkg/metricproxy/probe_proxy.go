@@ -0,0 +1,334 @@
+package metricproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// ErrProbeTargetInvalid returned when a probe target is not correctly configured.
+	ErrProbeTargetInvalid = errors.New("probe target is invalid")
+	// ErrProbeFailed returned when a probe connects but the response is not successful.
+	ErrProbeFailed = errors.New("probe failed")
+)
+
+const (
+	// probeTargetLabel identifies the target of probe metrics.
+	probeTargetLabel = "target"
+
+	probeSuccessMetricName               = "probe_success"
+	probeDurationMetricName              = "probe_duration_seconds"
+	probeHTTPStatusCodeMetricName        = "probe_http_status_code"
+	probeSSLEarliestCertExpiryMetricName = "probe_ssl_earliest_cert_expiry"
+
+	// probeMaxBodyBytes is the maximum size of a response body matched against a body regex.
+	probeMaxBodyBytes = 1024 * 1024
+)
+
+// ensure probeProxy implements MetricProxy.
+var _ MetricProxy = &probeProxy{}
+
+// probeProxy implements a reverse metric proxy which probes the health of its targets
+// when it is scraped.
+type probeProxy struct {
+	timeout time.Duration
+	targets []*config.ProbeTargetConfig
+
+	// lastResults holds the result of the last probe of each target
+	lastResults    []ProbeStatus
+	lastResultsMtx *sync.Mutex
+
+	log *zap.Logger
+}
+
+// probeResult is the result of probing a single target.
+type probeResult struct {
+	duration time.Duration
+	// statusCode is the HTTP status code of the response, or 0
+	statusCode int
+	// certExpiry is the earliest expiry of the certificates of the target, if TLS was used
+	certExpiry time.Time
+	err        error
+}
+
+// ProbeStatus is the debugging view of the last probe of a target.
+type ProbeStatus struct {
+	Target   string    `json:"target"`
+	Time     time.Time `json:"time"`
+	Success  bool      `json:"success"`
+	Duration float64   `json:"duration_seconds"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newProbeProxy(config *config.ProbeExporterConfig) *probeProxy {
+	return &probeProxy{
+		timeout:        time.Duration(config.Timeout),
+		targets:        config.Targets,
+		lastResultsMtx: &sync.Mutex{},
+		log:            zap.L().With(zap.String("name", config.Name)),
+	}
+}
+
+// probeTargetName returns the value of the target label of a target.
+func probeTargetName(target *config.ProbeTargetConfig) string {
+	if target.Name != "" {
+		return target.Name
+	}
+	return target.Address
+}
+
+// validateProbeTargets checks the targets of a probe exporter are correctly configured.
+func validateProbeTargets(targets []*config.ProbeTargetConfig) error {
+	names := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		name := probeTargetName(target)
+		if target.Address == "" {
+			return errors.Wrapf(ErrProbeTargetInvalid, "%s: address is required", name)
+		}
+		if _, found := names[name]; found {
+			return errors.Wrapf(ErrProbeTargetInvalid, "%s: target name is used twice", name)
+		}
+		names[name] = struct{}{}
+
+		switch target.Type {
+		case config.ProbeTCP:
+			if _, _, err := net.SplitHostPort(target.Address); err != nil {
+				return errors.Wrapf(ErrProbeTargetInvalid, "%s: address must be host:port: %v", name, err)
+			}
+		case config.ProbeHTTP:
+			u, err := url.Parse(target.Address)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return errors.Wrapf(ErrProbeTargetInvalid, "%s: address must be an http or https URL", name)
+			}
+		default:
+			return errors.Wrapf(ErrProbeTargetInvalid, "%s: unknown probe type: %q", name, target.Type)
+		}
+	}
+	return nil
+}
+
+// Scrape probes all targets concurrently and returns the results.
+func (pp *probeProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	probeCtx := ctx
+	if pp.timeout > 0 {
+		childCtx, cancelFn := context.WithTimeout(ctx, pp.timeout)
+		defer cancelFn()
+		probeCtx = childCtx
+	}
+
+	results := make([]probeResult, len(pp.targets))
+	wg := new(sync.WaitGroup)
+	for idx, target := range pp.targets {
+		wg.Add(1)
+		go func(idx int, target *config.ProbeTargetConfig) {
+			defer wg.Done()
+			results[idx] = probe(probeCtx, target)
+		}(idx, target)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	statuses := make([]ProbeStatus, 0, len(pp.targets))
+
+	successMf := &dto.MetricFamily{
+		Name: proto.String(probeSuccessMetricName),
+		Help: proto.String("Whether the probe was a success."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	durationMf := &dto.MetricFamily{
+		Name: proto.String(probeDurationMetricName),
+		Help: proto.String("Returns how long the probe took to complete in seconds."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	statusCodeMf := &dto.MetricFamily{
+		Name: proto.String(probeHTTPStatusCodeMetricName),
+		Help: proto.String("Response HTTP status code."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	certExpiryMf := &dto.MetricFamily{
+		Name: proto.String(probeSSLEarliestCertExpiryMetricName),
+		Help: proto.String("Returns earliest SSL cert expiry date."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+
+	for idx, target := range pp.targets {
+		result := results[idx]
+		name := probeTargetName(target)
+		labels := []*dto.LabelPair{{Name: proto.String(probeTargetLabel), Value: proto.String(name)}}
+
+		status := ProbeStatus{
+			Target:   name,
+			Time:     now,
+			Success:  result.err == nil,
+			Duration: result.duration.Seconds(),
+		}
+		success := 0.0
+		if result.err == nil {
+			success = 1
+		} else {
+			status.Error = result.err.Error()
+			pp.log.Debug("Probe failed", zap.String("target", name), zap.Error(result.err))
+		}
+		statuses = append(statuses, status)
+
+		successMf.Metric = append(successMf.Metric, newValueMetric(dto.MetricType_GAUGE, labels, success))
+		durationMf.Metric = append(durationMf.Metric, newValueMetric(dto.MetricType_GAUGE, labels, result.duration.Seconds()))
+		if result.statusCode != 0 {
+			statusCodeMf.Metric = append(statusCodeMf.Metric, newValueMetric(dto.MetricType_GAUGE, labels, float64(result.statusCode)))
+		}
+		if !result.certExpiry.IsZero() {
+			certExpiryMf.Metric = append(certExpiryMf.Metric, newValueMetric(dto.MetricType_GAUGE, labels, float64(result.certExpiry.Unix())))
+		}
+	}
+
+	pp.lastResultsMtx.Lock()
+	pp.lastResults = statuses
+	pp.lastResultsMtx.Unlock()
+
+	mfs := []*dto.MetricFamily{successMf, durationMf}
+	for _, mf := range []*dto.MetricFamily{statusCodeMf, certExpiryMf} {
+		if len(mf.GetMetric()) > 0 {
+			mfs = append(mfs, mf)
+		}
+	}
+	return mfs, nil
+}
+
+// Status implements StatusReporter.
+func (pp *probeProxy) Status() interface{} {
+	pp.lastResultsMtx.Lock()
+	defer pp.lastResultsMtx.Unlock()
+	return pp.lastResults
+}
+
+// probe probes a single target.
+func probe(ctx context.Context, target *config.ProbeTargetConfig) probeResult {
+	started := time.Now()
+	var result probeResult
+	switch target.Type {
+	case config.ProbeTCP:
+		result = probeTCP(ctx, target)
+	case config.ProbeHTTP:
+		result = probeHTTP(ctx, target)
+	default:
+		result.err = errors.Wrapf(ErrProbeTargetInvalid, "unknown probe type: %q", target.Type)
+	}
+	result.duration = time.Since(started)
+	return result
+}
+
+// probeTCP connects to the target, and performs a TLS handshake if configured.
+func probeTCP(ctx context.Context, target *config.ProbeTargetConfig) probeResult {
+	var result probeResult
+	dialer := &net.Dialer{}
+
+	if !target.TLS {
+		conn, err := dialer.DialContext(ctx, "tcp", target.Address)
+		if err != nil {
+			result.err = errors.Wrap(err, "connecting failed")
+			return result
+		}
+		conn.Close()
+		return result
+	}
+
+	tlsDialer := &tls.Dialer{
+		NetDialer: dialer,
+		Config:    &tls.Config{InsecureSkipVerify: target.InsecureSkipVerify}, //nolint:gosec
+	}
+	conn, err := tlsDialer.DialContext(ctx, "tcp", target.Address)
+	if err != nil {
+		result.err = errors.Wrap(err, "TLS connection failed")
+		return result
+	}
+	defer conn.Close()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		result.certExpiry = earliestCertExpiry(tlsConn.ConnectionState().PeerCertificates)
+	}
+	return result
+}
+
+// probeHTTP requests the target URL and checks the response.
+func probeHTTP(ctx context.Context, target *config.ProbeTargetConfig) probeResult {
+	var result probeResult
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		result.err = errors.New("BUG: default HTTP transport is not an *http.Transport")
+		return result
+	}
+	transport = transport.Clone()
+	// Every probe must make a new connection.
+	transport.DisableKeepAlives = true
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: target.InsecureSkipVerify} //nolint:gosec
+	client := &http.Client{Transport: transport}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.Address, nil)
+	if err != nil {
+		result.err = errors.Wrap(err, "creating HTTP request failed")
+		return result
+	}
+	req.Header.Set("User-Agent", userAgentHeader)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.err = errors.Wrap(err, "HTTP request failed")
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.statusCode = resp.StatusCode
+	if resp.TLS != nil {
+		result.certExpiry = earliestCertExpiry(resp.TLS.PeerCertificates)
+	}
+
+	validStatus := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if len(target.ValidStatusCodes) > 0 {
+		validStatus = target.ValidStatusCodes[resp.StatusCode]
+	}
+	if !validStatus {
+		result.err = errors.Wrapf(ErrProbeFailed, "invalid HTTP status %s", resp.Status)
+		return result
+	}
+
+	if target.BodyRegex.Regexp != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, probeMaxBodyBytes))
+		if err != nil {
+			result.err = errors.Wrap(err, "reading HTTP body failed")
+			return result
+		}
+		if !target.BodyRegex.Match(body) {
+			result.err = errors.Wrapf(ErrProbeFailed, "body does not match %q", target.BodyRegex.String())
+			return result
+		}
+	}
+
+	return result
+}
+
+// earliestCertExpiry returns the earliest expiry of the given certificates.
+func earliestCertExpiry(certs []*x509.Certificate) time.Time {
+	var earliest time.Time
+	for _, cert := range certs {
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+	return earliest
+}
@@ -0,0 +1,142 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProbeProxySuite struct{}
+
+var _ = Suite(&ProbeProxySuite{})
+
+// closedAddress returns the address of a TCP port nothing is listening on.
+func closedAddress(c *C) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func (s *ProbeProxySuite) TestProbeProxy(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(wr, req)
+			return
+		}
+		wr.Write([]byte("status: ok"))
+	}))
+	defer server.Close()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write([]byte("status: ok"))
+	}))
+	defer tlsServer.Close()
+	certExpiry := float64(tlsServer.Certificate().NotAfter.Unix())
+
+	notFound := config.HTTPStatusRange{}
+	c.Assert(notFound.FromString("404"), IsNil)
+
+	targets := []*config.ProbeTargetConfig{
+		{Name: "tcp_open", Type: config.ProbeTCP, Address: server.Listener.Addr().String()},
+		{Name: "tcp_closed", Type: config.ProbeTCP, Address: closedAddress(c)},
+		{Name: "tcp_tls", Type: config.ProbeTCP, Address: tlsServer.Listener.Addr().String(), TLS: true, InsecureSkipVerify: true},
+		{Name: "tcp_tls_unverified", Type: config.ProbeTCP, Address: tlsServer.Listener.Addr().String(), TLS: true},
+		{Name: "http_ok", Type: config.ProbeHTTP, Address: server.URL, BodyRegex: config.Regexp{Regexp: regexp.MustCompile("status: ok")}},
+		{Name: "http_body_mismatch", Type: config.ProbeHTTP, Address: server.URL, BodyRegex: config.Regexp{Regexp: regexp.MustCompile("status: failed")}},
+		{Name: "http_missing", Type: config.ProbeHTTP, Address: server.URL + "/missing"},
+		{Name: "http_expected_missing", Type: config.ProbeHTTP, Address: server.URL + "/missing", ValidStatusCodes: notFound},
+		{Name: "https", Type: config.ProbeHTTP, Address: tlsServer.URL, InsecureSkipVerify: true},
+	}
+	c.Assert(validateProbeTargets(targets), IsNil)
+
+	proxy := newProbeProxy(&config.ProbeExporterConfig{Targets: targets, Timeout: model.Duration(5 * time.Second)})
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+
+	c.Check(familyValues(mfs, probeSuccessMetricName, probeTargetLabel), DeepEquals, map[string]float64{
+		"tcp_open":              1,
+		"tcp_closed":            0,
+		"tcp_tls":               1,
+		"tcp_tls_unverified":    0,
+		"http_ok":               1,
+		"http_body_mismatch":    0,
+		"http_missing":          0,
+		"http_expected_missing": 1,
+		"https":                 1,
+	})
+	c.Check(familyValues(mfs, probeDurationMetricName, probeTargetLabel), HasLen, len(targets))
+	c.Check(familyValues(mfs, probeHTTPStatusCodeMetricName, probeTargetLabel), DeepEquals, map[string]float64{
+		"http_ok":               200,
+		"http_body_mismatch":    200,
+		"http_missing":          404,
+		"http_expected_missing": 404,
+		"https":                 200,
+	})
+	c.Check(familyValues(mfs, probeSSLEarliestCertExpiryMetricName, probeTargetLabel), DeepEquals, map[string]float64{
+		"tcp_tls": certExpiry,
+		"https":   certExpiry,
+	})
+
+	statuses, ok := proxy.Status().([]ProbeStatus)
+	c.Assert(ok, Equals, true)
+	c.Assert(statuses, HasLen, len(targets))
+	c.Check(statuses[1].Target, Equals, "tcp_closed")
+	c.Check(statuses[1].Error, Not(Equals), "")
+}
+
+func (s *ProbeProxySuite) TestProbeProxyTimeout(c *C) {
+	blockCh := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		select {
+		case <-blockCh:
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(blockCh)
+
+	proxy := newProbeProxy(&config.ProbeExporterConfig{
+		Targets: []*config.ProbeTargetConfig{{Type: config.ProbeHTTP, Address: server.URL}},
+		Timeout: model.Duration(100 * time.Millisecond),
+	})
+
+	started := time.Now()
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(time.Since(started) < 5*time.Second, Equals, true)
+	// The address is the default target name.
+	c.Check(familyValues(mfs, probeSuccessMetricName, probeTargetLabel), DeepEquals, map[string]float64{server.URL: 0})
+}
+
+func (s *ProbeProxySuite) TestValidateProbeTargets(c *C) {
+	invalidTargets := [][]*config.ProbeTargetConfig{
+		{{Type: config.ProbeTCP}},
+		{{Type: "udp", Address: "127.0.0.1:53"}},
+		{{Type: config.ProbeTCP, Address: "127.0.0.1"}},
+		{{Type: config.ProbeHTTP, Address: "127.0.0.1:80"}},
+		{{Type: config.ProbeHTTP, Address: "ftp://127.0.0.1/"}},
+		{
+			{Name: "duplicate", Type: config.ProbeTCP, Address: "127.0.0.1:80"},
+			{Name: "duplicate", Type: config.ProbeTCP, Address: "127.0.0.1:443"},
+		},
+	}
+
+	for _, targets := range invalidTargets {
+		err := validateProbeTargets(targets)
+		c.Check(errors.Is(err, ErrProbeTargetInvalid), Equals, true,
+			Commentf("%s: got error: %v", strings.Join([]string{string(targets[0].Type), targets[0].Address}, " "), err))
+	}
+}
@@ -0,0 +1,328 @@
+package metricproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/procfs"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// ErrProcessGroupInvalid returned when a process group is not correctly configured.
+	ErrProcessGroupInvalid = errors.New("process group is invalid")
+	// ErrProcfsUnavailable returned when procfs can't be read.
+	ErrProcfsUnavailable = errors.New("procfs could not be read")
+)
+
+const (
+	// processGroupLabel identifies the group of process metrics.
+	processGroupLabel = "groupname"
+
+	processNumProcsMetricName        = "namedprocess_namegroup_num_procs"
+	processCPUSecondsMetricName      = "namedprocess_namegroup_cpu_seconds_total"
+	processMemoryBytesMetricName     = "namedprocess_namegroup_memory_bytes"
+	processOpenFDsMetricName         = "namedprocess_namegroup_open_filedesc"
+	processNumThreadsMetricName      = "namedprocess_namegroup_num_threads"
+	processOldestStartTimeMetricName = "namedprocess_namegroup_oldest_start_time_seconds"
+
+	// defaultProcPath is the default mount point of procfs.
+	defaultProcPath = procfs.DefaultMountPoint
+
+	// processUserHZ is the clock tick rate of the times in /proc/<pid>/stat.
+	processUserHZ = 100
+)
+
+// ensure processProxy implements MetricProxy.
+var _ MetricProxy = &processProxy{}
+
+// processProxy implements a reverse metric proxy which reports the resource usage of
+// named groups of processes read from procfs when it is scraped.
+type processProxy struct {
+	procPath string
+	groups   []*config.ProcessGroupConfig
+
+	// mtx guards the state below
+	mtx *sync.Mutex
+	// lastProcs are the matched processes seen by the last scrape by pid
+	lastProcs map[int]processCPU
+	// cpuTotals are the CPU seconds of each group, including the processes which have exited
+	cpuTotals []processCPUSeconds
+
+	log *zap.Logger
+}
+
+// processCPUSeconds is the user and system CPU time of a process or group.
+type processCPUSeconds struct {
+	user   float64
+	system float64
+}
+
+// processCPU is the CPU time of a process seen by a scrape. A pid is only the same process
+// if its start time is unchanged.
+type processCPU struct {
+	group     int
+	startTime uint64
+	seconds   processCPUSeconds
+}
+
+// processGroupStats is the summed resource usage of the processes of a group.
+type processGroupStats struct {
+	numProcs      int
+	userSeconds   float64
+	systemSeconds float64
+	residentBytes int
+	openFDs       int
+	numThreads    int
+	// oldestStartTime is the start time of the oldest process in seconds since the epoch, or 0
+	oldestStartTime float64
+}
+
+func newProcessProxy(config *config.ProcessExporterConfig) *processProxy {
+	newProxy := processProxy{
+		procPath:  config.ProcPath,
+		groups:    config.Groups,
+		mtx:       &sync.Mutex{},
+		lastProcs: make(map[int]processCPU),
+		cpuTotals: make([]processCPUSeconds, len(config.Groups)),
+		log:       zap.L().With(zap.String("name", config.Name)),
+	}
+	if newProxy.procPath == "" {
+		newProxy.procPath = defaultProcPath
+	}
+	return &newProxy
+}
+
+// validateProcessGroups checks the groups of a process exporter are correctly configured.
+func validateProcessGroups(groups []*config.ProcessGroupConfig) error {
+	names := make(map[string]struct{}, len(groups))
+	for _, group := range groups {
+		if group.Name == "" {
+			return errors.Wrap(ErrProcessGroupInvalid, "name is required")
+		}
+		if _, found := names[group.Name]; found {
+			return errors.Wrapf(ErrProcessGroupInvalid, "%s: group name is used twice", group.Name)
+		}
+		names[group.Name] = struct{}{}
+
+		if len(group.Comm) == 0 && group.Cmdline.Regexp == nil && group.Pidfile == "" {
+			return errors.Wrapf(ErrProcessGroupInvalid, "%s: one of comm, cmdline or pidfile is required", group.Name)
+		}
+	}
+	return nil
+}
+
+// Scrape reads procfs and returns the resource usage of each group. Processes which exit
+// while they are being read are skipped. Like process-exporter, the CPU time of a group is
+// the whole CPU time of every process seen in it, including that used before the process
+// was first seen, so it does not decrease when processes exit.
+func (pp *processProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	pp.mtx.Lock()
+	defer pp.mtx.Unlock()
+
+	fs, err := procfs.NewFS(pp.procPath)
+	if err != nil {
+		return nil, errors.Wrapf(ErrProcfsUnavailable, "%s: %v", pp.procPath, err)
+	}
+	kernelStat, err := fs.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(ErrProcfsUnavailable, "%s: %v", pp.procPath, err)
+	}
+	procs, err := fs.AllProcs()
+	if err != nil {
+		return nil, errors.Wrapf(ErrProcfsUnavailable, "%s: %v", pp.procPath, err)
+	}
+
+	pidfilePids := pp.readPidfiles()
+
+	stats := make([]processGroupStats, len(pp.groups))
+	cpuTotals := append(make([]processCPUSeconds, 0, len(pp.cpuTotals)), pp.cpuTotals...)
+	seenProcs := make(map[int]processCPU, len(pp.lastProcs))
+	for _, proc := range procs {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrap(err, "process scrape cancelled")
+		}
+
+		procStat, err := proc.Stat()
+		if err != nil {
+			pp.log.Debug("Skipping unreadable process", zap.Int("pid", proc.PID), zap.Error(err))
+			continue
+		}
+
+		groupIdx := pp.matchGroup(proc, procStat.Comm, pidfilePids)
+		if groupIdx < 0 {
+			continue
+		}
+
+		openFDs, err := proc.FileDescriptorsLen()
+		if err != nil {
+			// Reading the descriptors of other users' processes is not permitted.
+			pp.log.Debug("Could not read process file descriptors", zap.Int("pid", proc.PID), zap.Error(err))
+		}
+
+		cpu := processCPU{
+			group:     groupIdx,
+			startTime: procStat.Starttime,
+			seconds: processCPUSeconds{
+				user:   float64(procStat.UTime) / processUserHZ,
+				system: float64(procStat.STime) / processUserHZ,
+			},
+		}
+		seenProcs[proc.PID] = cpu
+		// Only the CPU time used since the last scrape is added for processes already seen.
+		delta := cpu.seconds
+		if last, found := pp.lastProcs[proc.PID]; found && last.group == cpu.group && last.startTime == cpu.startTime {
+			delta.user = math.Max(delta.user-last.seconds.user, 0)
+			delta.system = math.Max(delta.system-last.seconds.system, 0)
+		}
+		cpuTotals[groupIdx].user += delta.user
+		cpuTotals[groupIdx].system += delta.system
+
+		groupStats := &stats[groupIdx]
+		groupStats.numProcs++
+		groupStats.residentBytes += procStat.ResidentMemory()
+		groupStats.openFDs += openFDs
+		groupStats.numThreads += procStat.NumThreads
+
+		startTime := float64(kernelStat.BootTime) + float64(procStat.Starttime)/processUserHZ
+		if groupStats.oldestStartTime == 0 || startTime < groupStats.oldestStartTime {
+			groupStats.oldestStartTime = startTime
+		}
+	}
+
+	pp.lastProcs = seenProcs
+	pp.cpuTotals = cpuTotals
+	for idx := range stats {
+		stats[idx].userSeconds = cpuTotals[idx].user
+		stats[idx].systemSeconds = cpuTotals[idx].system
+	}
+
+	return pp.metricFamilies(stats), nil
+}
+
+// readPidfiles returns the pid read from the pidfile of each group which has one. Groups
+// whose pidfile can't be read are omitted.
+func (pp *processProxy) readPidfiles() map[int]int {
+	pids := make(map[int]int)
+	for idx, group := range pp.groups {
+		if group.Pidfile == "" {
+			continue
+		}
+		contents, err := ioutil.ReadFile(group.Pidfile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				pp.log.Warn("Could not read pidfile", zap.String("pidfile", group.Pidfile), zap.Error(err))
+			}
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+		if err != nil {
+			pp.log.Warn("Pidfile does not contain a pid", zap.String("pidfile", group.Pidfile))
+			continue
+		}
+		pids[idx] = pid
+	}
+	return pids
+}
+
+// matchGroup returns the index of the first group which matches the process, or -1.
+func (pp *processProxy) matchGroup(proc procfs.Proc, comm string, pidfilePids map[int]int) int {
+	var cmdline *string
+	for idx, group := range pp.groups {
+		if pid, found := pidfilePids[idx]; found && pid == proc.PID {
+			return idx
+		}
+		for _, groupComm := range group.Comm {
+			if groupComm == comm {
+				return idx
+			}
+		}
+		if group.Cmdline.Regexp != nil {
+			// The command line is only read if a group needs it.
+			if cmdline == nil {
+				args, err := proc.CmdLine()
+				if err != nil {
+					pp.log.Debug("Could not read process cmdline", zap.Int("pid", proc.PID), zap.Error(err))
+				}
+				joined := strings.Join(args, " ")
+				cmdline = &joined
+			}
+			if group.Cmdline.MatchString(*cmdline) {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+// metricFamilies converts the group stats to metrics.
+func (pp *processProxy) metricFamilies(stats []processGroupStats) []*dto.MetricFamily {
+	numProcsMf := &dto.MetricFamily{
+		Name: proto.String(processNumProcsMetricName),
+		Help: proto.String("Number of processes in this group."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	cpuSecondsMf := &dto.MetricFamily{
+		Name: proto.String(processCPUSecondsMetricName),
+		Help: proto.String("CPU time consumed in seconds by the processes of this group, including processes which have exited."),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+	memoryBytesMf := &dto.MetricFamily{
+		Name: proto.String(processMemoryBytesMetricName),
+		Help: proto.String("Number of bytes of memory in use."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	openFDsMf := &dto.MetricFamily{
+		Name: proto.String(processOpenFDsMetricName),
+		Help: proto.String("Number of open file descriptors for this group."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	numThreadsMf := &dto.MetricFamily{
+		Name: proto.String(processNumThreadsMetricName),
+		Help: proto.String("Number of threads in this group."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	oldestStartTimeMf := &dto.MetricFamily{
+		Name: proto.String(processOldestStartTimeMetricName),
+		Help: proto.String("Start time in seconds since the epoch of the oldest process in this group."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+
+	for idx, group := range pp.groups {
+		groupStats := stats[idx]
+		labels := []*dto.LabelPair{{Name: proto.String(processGroupLabel), Value: proto.String(group.Name)}}
+		labelsWith := func(name, value string) []*dto.LabelPair {
+			return []*dto.LabelPair{labels[0], {Name: proto.String(name), Value: proto.String(value)}}
+		}
+
+		numProcsMf.Metric = append(numProcsMf.Metric, newValueMetric(dto.MetricType_GAUGE, labels, float64(groupStats.numProcs)))
+		cpuSecondsMf.Metric = append(cpuSecondsMf.Metric,
+			newValueMetric(dto.MetricType_COUNTER, labelsWith("mode", "user"), groupStats.userSeconds),
+			newValueMetric(dto.MetricType_COUNTER, labelsWith("mode", "system"), groupStats.systemSeconds))
+		memoryBytesMf.Metric = append(memoryBytesMf.Metric,
+			newValueMetric(dto.MetricType_GAUGE, labelsWith("memtype", "resident"), float64(groupStats.residentBytes)))
+		openFDsMf.Metric = append(openFDsMf.Metric, newValueMetric(dto.MetricType_GAUGE, labels, float64(groupStats.openFDs)))
+		numThreadsMf.Metric = append(numThreadsMf.Metric, newValueMetric(dto.MetricType_GAUGE, labels, float64(groupStats.numThreads)))
+		if groupStats.numProcs > 0 {
+			oldestStartTimeMf.Metric = append(oldestStartTimeMf.Metric,
+				newValueMetric(dto.MetricType_GAUGE, labels, groupStats.oldestStartTime))
+		}
+	}
+
+	mfs := []*dto.MetricFamily{numProcsMf, cpuSecondsMf, memoryBytesMf, openFDsMf, numThreadsMf}
+	if len(oldestStartTimeMf.GetMetric()) > 0 {
+		mfs = append(mfs, oldestStartTimeMf)
+	}
+	return mfs
+}
@@ -0,0 +1,175 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+const testBootTime = 1600000000
+
+type ProcessProxySuite struct{}
+
+var _ = Suite(&ProcessProxySuite{})
+
+// fakeProcess is the contents of a process directory in a fake procfs.
+type fakeProcess struct {
+	pid        int
+	comm       string
+	cmdline    []string
+	utime      int
+	stime      int
+	numThreads int
+	starttime  int
+	rssPages   int
+	openFDs    int
+}
+
+// newFakeProcfs writes a procfs containing the given processes to a temporary directory.
+func newFakeProcfs(c *C, processes ...fakeProcess) string {
+	procPath := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(procPath, "stat"),
+		[]byte(fmt.Sprintf("cpu  1 2 3 4 5 6 7 8 9 10\nbtime %d\n", testBootTime)), os.FileMode(0644)), IsNil)
+
+	for _, process := range processes {
+		processPath := filepath.Join(procPath, strconv.Itoa(process.pid))
+		c.Assert(os.MkdirAll(filepath.Join(processPath, "fd"), os.FileMode(0755)), IsNil)
+
+		// Fields after rss which are not used are zero.
+		stat := fmt.Sprintf("%d (%s) S 1 1 1 0 -1 0 0 0 0 0 %d %d 0 0 20 0 %d 0 %d 1000 %d%s\n",
+			process.pid, process.comm, process.utime, process.stime, process.numThreads, process.starttime,
+			process.rssPages, strings.Repeat(" 0", 18))
+		c.Assert(ioutil.WriteFile(filepath.Join(processPath, "stat"), []byte(stat), os.FileMode(0644)), IsNil)
+
+		cmdline := strings.Join(process.cmdline, "\x00") + "\x00"
+		c.Assert(ioutil.WriteFile(filepath.Join(processPath, "cmdline"), []byte(cmdline), os.FileMode(0644)), IsNil)
+
+		for fd := 0; fd < process.openFDs; fd++ {
+			c.Assert(ioutil.WriteFile(filepath.Join(processPath, "fd", strconv.Itoa(fd)), nil, os.FileMode(0644)), IsNil)
+		}
+	}
+	return procPath
+}
+
+func (s *ProcessProxySuite) TestProcessProxy(c *C) {
+	procPath := newFakeProcfs(c,
+		fakeProcess{pid: 100, comm: "nginx", cmdline: []string{"nginx", "-g", "daemon off;"},
+			utime: 200, stime: 100, numThreads: 1, starttime: 1000, rssPages: 10, openFDs: 3},
+		fakeProcess{pid: 101, comm: "nginx", cmdline: []string{"nginx: worker process"},
+			utime: 50, stime: 50, numThreads: 2, starttime: 500, rssPages: 20, openFDs: 4},
+		fakeProcess{pid: 200, comm: "python3", cmdline: []string{"python3", "/srv/app.py", "--debug"},
+			utime: 100, numThreads: 4, starttime: 2000, rssPages: 5, openFDs: 1},
+		fakeProcess{pid: 300, comm: "daemon", cmdline: []string{"/usr/sbin/daemon"}, numThreads: 1, starttime: 3000},
+		// Matches both the nginx and app groups, but is reported in the first.
+		fakeProcess{pid: 400, comm: "nginx", cmdline: []string{"python3", "/srv/app.py"}, numThreads: 1, starttime: 4000},
+		fakeProcess{pid: 500, comm: "bash", cmdline: []string{"bash"}, numThreads: 1, starttime: 100},
+	)
+	// A process which exited while procfs was being read.
+	c.Assert(os.Mkdir(filepath.Join(procPath, "600"), os.FileMode(0755)), IsNil)
+
+	pidfile := filepath.Join(c.MkDir(), "daemon.pid")
+	c.Assert(ioutil.WriteFile(pidfile, []byte("300\n"), os.FileMode(0644)), IsNil)
+
+	groups := []*config.ProcessGroupConfig{
+		{Name: "nginx", Comm: []string{"nginx"}},
+		{Name: "app", Cmdline: config.Regexp{Regexp: regexp.MustCompile(`^python3? .*app\.py`)}},
+		{Name: "daemon", Pidfile: pidfile},
+		{Name: "stopped", Comm: []string{"stopped"}, Pidfile: filepath.Join(c.MkDir(), "missing.pid")},
+	}
+	c.Assert(validateProcessGroups(groups), IsNil)
+
+	proxy := newProcessProxy(&config.ProcessExporterConfig{ProcPath: procPath, Groups: groups})
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+
+	pageSize := float64(os.Getpagesize())
+	c.Check(familyValues(mfs, processNumProcsMetricName, processGroupLabel), DeepEquals, map[string]float64{
+		"nginx": 3, "app": 1, "daemon": 1, "stopped": 0,
+	})
+	c.Check(familyValues(mfs, processCPUSecondsMetricName, ""), DeepEquals, map[string]float64{
+		`{groupname="nginx", mode="user"}`: 2.5, `{groupname="nginx", mode="system"}`: 1.5,
+		`{groupname="app", mode="user"}`: 1, `{groupname="app", mode="system"}`: 0,
+		`{groupname="daemon", mode="user"}`: 0, `{groupname="daemon", mode="system"}`: 0,
+		`{groupname="stopped", mode="user"}`: 0, `{groupname="stopped", mode="system"}`: 0,
+	})
+	c.Check(familyValues(mfs, processMemoryBytesMetricName, processGroupLabel), DeepEquals, map[string]float64{
+		"nginx": 30 * pageSize, "app": 5 * pageSize, "daemon": 0, "stopped": 0,
+	})
+	c.Check(familyValues(mfs, processOpenFDsMetricName, processGroupLabel), DeepEquals, map[string]float64{
+		"nginx": 7, "app": 1, "daemon": 0, "stopped": 0,
+	})
+	c.Check(familyValues(mfs, processNumThreadsMetricName, processGroupLabel), DeepEquals, map[string]float64{
+		"nginx": 4, "app": 4, "daemon": 1, "stopped": 0,
+	})
+	// Groups without processes have no start time.
+	c.Check(familyValues(mfs, processOldestStartTimeMetricName, processGroupLabel), DeepEquals, map[string]float64{
+		"nginx": testBootTime + 5, "app": testBootTime + 20, "daemon": testBootTime + 30,
+	})
+}
+
+func (s *ProcessProxySuite) TestProcessProxyCPUSeconds(c *C) {
+	groups := []*config.ProcessGroupConfig{{Name: "nginx", Comm: []string{"nginx"}}}
+	procPath := newFakeProcfs(c,
+		fakeProcess{pid: 100, comm: "nginx", utime: 100, stime: 100, starttime: 1000},
+		fakeProcess{pid: 101, comm: "nginx", utime: 200, stime: 100, starttime: 1000},
+	)
+	proxy := newProcessProxy(&config.ProcessExporterConfig{ProcPath: procPath, Groups: groups})
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, processCPUSecondsMetricName, "mode"), DeepEquals,
+		map[string]float64{"user": 3, "system": 2})
+
+	// 100 used another second, 101 exited, and its pid was reused by a new process. The time
+	// of the exited process stays counted, and all the time of the new process is added.
+	proxy.procPath = newFakeProcfs(c,
+		fakeProcess{pid: 100, comm: "nginx", utime: 200, stime: 100, starttime: 1000},
+		fakeProcess{pid: 101, comm: "nginx", utime: 50, stime: 100, starttime: 2000},
+	)
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, processCPUSecondsMetricName, "mode"), DeepEquals,
+		map[string]float64{"user": 4.5, "system": 3})
+
+	// All processes exited.
+	proxy.procPath = newFakeProcfs(c)
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(familyValues(mfs, processCPUSecondsMetricName, "mode"), DeepEquals,
+		map[string]float64{"user": 4.5, "system": 3})
+}
+
+func (s *ProcessProxySuite) TestProcessProxyProcfsUnavailable(c *C) {
+	proxy := newProcessProxy(&config.ProcessExporterConfig{
+		ProcPath: filepath.Join(c.MkDir(), "missing"),
+		Groups:   []*config.ProcessGroupConfig{{Name: "nginx", Comm: []string{"nginx"}}},
+	})
+	_, err := proxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrProcfsUnavailable), Equals, true, Commentf("got error: %v", err))
+}
+
+func (s *ProcessProxySuite) TestValidateProcessGroups(c *C) {
+	invalidGroups := [][]*config.ProcessGroupConfig{
+		{{Comm: []string{"nginx"}}},
+		{{Name: "nothing"}},
+		{
+			{Name: "duplicate", Comm: []string{"nginx"}},
+			{Name: "duplicate", Comm: []string{"httpd"}},
+		},
+	}
+
+	for _, groups := range invalidGroups {
+		err := validateProcessGroups(groups)
+		c.Check(errors.Is(err, ErrProcessGroupInvalid), Equals, true, Commentf("%s: got error: %v", groups[0].Name, err))
+	}
+}
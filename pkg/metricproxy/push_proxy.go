@@ -0,0 +1,492 @@
+package metricproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	"go.uber.org/zap"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	// ErrPushPathInvalid returned when a push exporter does not have an absolute path.
+	ErrPushPathInvalid = errors.New("push exporter path must be an absolute URL path")
+	// ErrPushPathUsedTwice returned when push exporters of an endpoint share a path.
+	ErrPushPathUsedTwice = errors.New("cannot use the same push path twice for one endpoint")
+	// ErrPushGroupingKeyInvalid returned when the grouping key of a push URL is invalid.
+	ErrPushGroupingKeyInvalid = errors.New("invalid push grouping key")
+	// ErrPushMetricsInvalid returned when pushed metrics are inconsistent.
+	ErrPushMetricsInvalid = errors.New("invalid pushed metrics")
+)
+
+const (
+	// pushURLPrefix is the prefix of push URLs below the path of a push exporter. It is
+	// followed by the grouping key.
+	pushURLPrefix = "/metrics/"
+	// pushBase64Suffix marks a grouping key label whose value is base64url encoded.
+	pushBase64Suffix = "@base64"
+	// pushJobLabel is the grouping key label every push has.
+	pushJobLabel = "job"
+
+	pushTimeMetricName = "push_time_seconds"
+
+	// defaultPushMaxBytes is the maximum size of a push request body if not configured.
+	defaultPushMaxBytes uint64 = 16 * 1024 * 1024
+	// defaultPushPersistenceInterval is the interval changes are saved at if not configured.
+	defaultPushPersistenceInterval = 5 * time.Minute
+)
+
+// ensure pushProxy implements MetricProxy.
+var _ MetricProxy = &pushProxy{}
+
+// pushGroup holds the metrics most recently pushed with a grouping key.
+type pushGroup struct {
+	labels   model.LabelSet
+	pushTime time.Time
+	// metrics holds the pushed metric families by name
+	metrics map[string]*dto.MetricFamily
+}
+
+// pushProxy implements a reverse metric proxy which returns metrics pushed to it by
+// short-lived jobs, with the same job and grouping key semantics as the Pushgateway.
+type pushProxy struct {
+	persistenceFile     string
+	persistenceInterval time.Duration
+	maxBytes            uint64
+	// stopCh is closed to stop the persistence goroutine
+	stopCh   chan struct{}
+	stopOnce *sync.Once
+
+	// groupsMtx guards the state below
+	groupsMtx     *sync.RWMutex
+	groups        map[string]*pushGroup
+	dirty         bool
+	lastPersisted time.Time
+
+	log *zap.Logger
+}
+
+// PushStatus is the debugging view of a push exporter.
+type PushStatus struct {
+	Groups        []PushGroupStatus `json:"groups"`
+	LastPersisted *time.Time        `json:"last_persisted,omitempty"`
+}
+
+// PushGroupStatus is the debugging view of a group of pushed metrics.
+type PushGroupStatus struct {
+	Labels   map[string]string `json:"labels"`
+	PushTime time.Time         `json:"push_time"`
+	Metrics  int               `json:"metrics"`
+}
+
+// persistedPushGroup is the persisted form of a pushGroup. Metric families are stored in
+// the protobuf format.
+type persistedPushGroup struct {
+	Labels   map[string]string `json:"labels"`
+	PushTime time.Time         `json:"push_time"`
+	Metrics  [][]byte          `json:"metrics"`
+}
+
+// newPushProxy initializes a new pushProxy, restoring persisted metrics if configured. They
+// are not saved until the proxy is started.
+func newPushProxy(config *config.PushExporterConfig) *pushProxy {
+	newProxy := pushProxy{
+		persistenceFile:     config.PersistenceFile,
+		persistenceInterval: time.Duration(config.PersistenceInterval),
+		maxBytes:            config.MaxBytes,
+		stopCh:              make(chan struct{}),
+		stopOnce:            &sync.Once{},
+
+		groupsMtx: &sync.RWMutex{},
+		groups:    make(map[string]*pushGroup),
+
+		log: zap.L().With(zap.String("name", config.Name)),
+	}
+
+	if newProxy.persistenceInterval == 0 {
+		newProxy.persistenceInterval = defaultPushPersistenceInterval
+	}
+	if newProxy.maxBytes == 0 {
+		newProxy.maxBytes = defaultPushMaxBytes
+	}
+
+	if newProxy.persistenceFile != "" {
+		if err := newProxy.restore(); err != nil {
+			newProxy.log.Error("Could not restore persisted pushed metrics - starting empty",
+				zap.String("persistence_file", newProxy.persistenceFile), zap.Error(err))
+		}
+	}
+
+	return &newProxy
+}
+
+// start implements starter by starting the persistence goroutine if configured.
+func (pp *pushProxy) start() {
+	if pp.persistenceFile != "" {
+		go pp.persister()
+	}
+}
+
+// ServeHTTP implements http.Handler. It accepts requests to pushURLPrefix followed by the
+// grouping key, and expects the path of the push exporter to have been stripped.
+func (pp *pushProxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, pushURLPrefix) {
+		http.NotFound(wr, req)
+		return
+	}
+
+	labels, err := parsePushGroupingKey(strings.TrimPrefix(req.URL.Path, pushURLPrefix))
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log := pp.log.With(zap.String("grouping_key", labels.String()))
+
+	switch req.Method {
+	case http.MethodDelete:
+		pp.delete(labels)
+		log.Debug("Deleted pushed metrics")
+		wr.WriteHeader(http.StatusAccepted)
+		return
+	case http.MethodPut, http.MethodPost:
+	default:
+		wr.Header().Set("Allow", strings.Join([]string{http.MethodPut, http.MethodPost, http.MethodDelete}, ", "))
+		http.Error(wr, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	mfs, err := decodeMetrics(newMaxBytesReader(req.Body, pp.maxBytes), expfmt.ResponseFormat(req.Header))
+	if err != nil {
+		log.Debug("Could not decode pushed metrics", zap.Error(err))
+		if errors.Is(err, ErrMaxBytesExceeded) {
+			http.Error(wr, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(wr, fmt.Sprintf("could not decode pushed metrics: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := pp.push(labels, mfs, req.Method == http.MethodPut); err != nil {
+		log.Debug("Rejected pushed metrics", zap.Error(err))
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Debug("Accepted pushed metrics", zap.Int("metric_families", len(mfs)))
+	wr.WriteHeader(http.StatusOK)
+}
+
+// parsePushGroupingKey parses a grouping key of the form job/<job>{/<label>/<value>}. The
+// job and label values may be base64url encoded by suffixing the label name with @base64.
+func parsePushGroupingKey(groupingKey string) (model.LabelSet, error) {
+	segments := strings.Split(groupingKey, "/")
+	if len(segments)%2 != 0 {
+		return nil, errors.Wrapf(ErrPushGroupingKeyInvalid, "odd number of path segments: %s", groupingKey)
+	}
+	if strings.TrimSuffix(segments[0], pushBase64Suffix) != pushJobLabel {
+		return nil, errors.Wrapf(ErrPushGroupingKeyInvalid, "grouping key must start with the job: %s", groupingKey)
+	}
+
+	labels := make(model.LabelSet, len(segments)/2) //nolint:gomnd
+	for idx := 0; idx < len(segments); idx += 2 {
+		name, value := segments[idx], segments[idx+1]
+		if strings.HasSuffix(name, pushBase64Suffix) {
+			name = strings.TrimSuffix(name, pushBase64Suffix)
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, errors.Wrapf(ErrPushGroupingKeyInvalid, "invalid base64 value for label %s: %v", name, err)
+			}
+			value = string(decoded)
+		}
+
+		labelName := model.LabelName(name)
+		if !labelName.IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nil, errors.Wrapf(ErrPushGroupingKeyInvalid, "invalid label name: %q", name)
+		}
+		if _, found := labels[labelName]; found {
+			return nil, errors.Wrapf(ErrPushGroupingKeyInvalid, "label %s is specified twice", name)
+		}
+		labels[labelName] = model.LabelValue(value)
+	}
+
+	if labels[pushJobLabel] == "" {
+		return nil, errors.Wrap(ErrPushGroupingKeyInvalid, "job name is required")
+	}
+
+	return labels, nil
+}
+
+// push stores pushed metrics under the grouping key labels. If replace is true all metrics
+// of the group are replaced, otherwise only metric families with the same name.
+func (pp *pushProxy) push(labels model.LabelSet, mfs []*dto.MetricFamily, replace bool) error {
+	for _, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			if metric.TimestampMs != nil {
+				return errors.Wrapf(ErrPushMetricsInvalid, "%s: pushed metrics must not have timestamps", mf.GetName())
+			}
+			for _, lp := range metric.GetLabel() {
+				groupValue, found := labels[model.LabelName(lp.GetName())]
+				if found && string(groupValue) != lp.GetValue() {
+					return errors.Wrapf(ErrPushMetricsInvalid, "%s: label %s=%q conflicts with the grouping key",
+						mf.GetName(), lp.GetName(), lp.GetValue())
+				}
+			}
+		}
+	}
+	// All pushed metrics carry the labels of their grouping key.
+	rewriteMetrics(labels, mfs)
+
+	key := labels.String()
+
+	pp.groupsMtx.Lock()
+	defer pp.groupsMtx.Unlock()
+
+	// Metric families with the same name are merged when scraped, so they must agree on
+	// their type with every other group.
+	for otherKey, group := range pp.groups {
+		if otherKey == key {
+			continue
+		}
+		for _, mf := range mfs {
+			existing, found := group.metrics[mf.GetName()]
+			if found && existing.GetType() != mf.GetType() {
+				return errors.Wrapf(ErrPushMetricsInvalid, "%s: pushed as %s but is %s in group %s",
+					mf.GetName(), mf.GetType(), existing.GetType(), otherKey)
+			}
+		}
+	}
+
+	group, found := pp.groups[key]
+	if !found || replace {
+		group = &pushGroup{
+			labels:  labels,
+			metrics: make(map[string]*dto.MetricFamily, len(mfs)),
+		}
+		pp.groups[key] = group
+	}
+	group.pushTime = time.Now()
+	for _, mf := range mfs {
+		group.metrics[mf.GetName()] = mf
+	}
+	pp.dirty = true
+
+	return nil
+}
+
+// delete removes all metrics of the grouping key labels.
+func (pp *pushProxy) delete(labels model.LabelSet) {
+	pp.groupsMtx.Lock()
+	defer pp.groupsMtx.Unlock()
+	if _, found := pp.groups[labels.String()]; found {
+		delete(pp.groups, labels.String())
+		pp.dirty = true
+	}
+}
+
+// sortedGroups returns the groups ordered by grouping key. groupsMtx must be held.
+func (pp *pushProxy) sortedGroups() []*pushGroup {
+	keys := make([]string, 0, len(pp.groups))
+	for key := range pp.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	groups := make([]*pushGroup, 0, len(keys))
+	for _, key := range keys {
+		groups = append(groups, pp.groups[key])
+	}
+	return groups
+}
+
+// Scrape returns the pushed metrics of all groups, and the time each group was last pushed.
+func (pp *pushProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	pp.groupsMtx.RLock()
+	defer pp.groupsMtx.RUnlock()
+
+	mfs := make([]*dto.MetricFamily, 0)
+	pushTimes := &dto.MetricFamily{
+		Name: proto.String(pushTimeMetricName),
+		Help: proto.String("Last Unix time when this group was changed in the Pushgateway."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+
+	for _, group := range pp.sortedGroups() {
+		names := make([]string, 0, len(group.metrics))
+		for name := range group.metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			mfs = append(mfs, group.metrics[name])
+		}
+
+		pushTime := newGaugeFamily(pushTimeMetricName, "", float64(group.pushTime.UnixNano())/float64(time.Second))
+		rewriteMetrics(group.labels, []*dto.MetricFamily{pushTime})
+		pushTimes.Metric = append(pushTimes.Metric, pushTime.GetMetric()...)
+	}
+
+	mfs = mergeMetricFamilies(cloneMetricFamilies(mfs))
+	if len(pushTimes.GetMetric()) > 0 {
+		mfs = append(mfs, pushTimes)
+	}
+	return mfs, nil
+}
+
+// Status implements StatusReporter.
+func (pp *pushProxy) Status() interface{} {
+	pp.groupsMtx.RLock()
+	defer pp.groupsMtx.RUnlock()
+
+	status := PushStatus{
+		Groups: make([]PushGroupStatus, 0, len(pp.groups)),
+	}
+	for _, group := range pp.sortedGroups() {
+		labels := make(map[string]string, len(group.labels))
+		for name, value := range group.labels {
+			labels[string(name)] = string(value)
+		}
+		status.Groups = append(status.Groups, PushGroupStatus{
+			Labels:   labels,
+			PushTime: group.pushTime,
+			Metrics:  len(group.metrics),
+		})
+	}
+	if !pp.lastPersisted.IsZero() {
+		lastPersisted := pp.lastPersisted
+		status.LastPersisted = &lastPersisted
+	}
+	return status
+}
+
+// persister periodically saves changed metrics to the persistence file until the proxy is
+// stopped.
+func (pp *pushProxy) persister() {
+	ticker := time.NewTicker(pp.persistenceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pp.stopCh:
+			return
+		case <-ticker.C:
+			pp.persistLogged()
+		}
+	}
+}
+
+// stop implements stopper. Changed metrics are saved a last time so metrics pushed since the
+// last save are not lost on shutdown.
+func (pp *pushProxy) stop() {
+	if pp.persistenceFile == "" {
+		return
+	}
+	pp.stopOnce.Do(func() { close(pp.stopCh) })
+	pp.persistLogged()
+}
+
+// persistLogged saves changed metrics to the persistence file, logging any error.
+func (pp *pushProxy) persistLogged() {
+	if err := pp.persist(); err != nil {
+		pp.log.Error("Could not persist pushed metrics",
+			zap.String("persistence_file", pp.persistenceFile), zap.Error(err))
+	}
+}
+
+// persist saves the pushed metrics to the persistence file if they have changed. The file is
+// replaced atomically so it is never partially written.
+func (pp *pushProxy) persist() error {
+	pp.groupsMtx.Lock()
+	defer pp.groupsMtx.Unlock()
+
+	if !pp.dirty {
+		return nil
+	}
+
+	persisted := make([]persistedPushGroup, 0, len(pp.groups))
+	for _, group := range pp.sortedGroups() {
+		persistedGroup := persistedPushGroup{
+			Labels:   make(map[string]string, len(group.labels)),
+			PushTime: group.pushTime,
+			Metrics:  make([][]byte, 0, len(group.metrics)),
+		}
+		for name, value := range group.labels {
+			persistedGroup.Labels[string(name)] = string(value)
+		}
+		for _, mf := range group.metrics {
+			encoded, err := proto.Marshal(mf)
+			if err != nil {
+				return errors.Wrapf(err, "encoding %s failed", mf.GetName())
+			}
+			persistedGroup.Metrics = append(persistedGroup.Metrics, encoded)
+		}
+		persisted = append(persisted, persistedGroup)
+	}
+
+	content, err := json.Marshal(persisted)
+	if err != nil {
+		return errors.Wrap(err, "encoding pushed metrics failed")
+	}
+
+	if err := writeFileAtomic(pp.persistenceFile, content); err != nil {
+		return err
+	}
+
+	pp.dirty = false
+	pp.lastPersisted = time.Now()
+	return nil
+}
+
+// restore loads the pushed metrics from the persistence file. A missing file is not an error.
+func (pp *pushProxy) restore() error {
+	content, err := ioutil.ReadFile(pp.persistenceFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading persistence file failed")
+	}
+
+	persisted := make([]persistedPushGroup, 0)
+	if err := json.Unmarshal(content, &persisted); err != nil {
+		return errors.Wrap(err, "decoding persistence file failed")
+	}
+
+	groups := make(map[string]*pushGroup, len(persisted))
+	for _, persistedGroup := range persisted {
+		group := &pushGroup{
+			labels:   make(model.LabelSet, len(persistedGroup.Labels)),
+			pushTime: persistedGroup.PushTime,
+			metrics:  make(map[string]*dto.MetricFamily, len(persistedGroup.Metrics)),
+		}
+		for name, value := range persistedGroup.Labels {
+			group.labels[model.LabelName(name)] = model.LabelValue(value)
+		}
+		for _, encoded := range persistedGroup.Metrics {
+			mf := &dto.MetricFamily{}
+			if err := proto.Unmarshal(encoded, mf); err != nil {
+				return errors.Wrap(err, "decoding persisted metric family failed")
+			}
+			group.metrics[mf.GetName()] = mf
+		}
+		groups[group.labels.String()] = group
+	}
+
+	pp.groupsMtx.Lock()
+	defer pp.groupsMtx.Unlock()
+	pp.groups = groups
+	return nil
+}
@@ -0,0 +1,194 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	. "gopkg.in/check.v1"
+)
+
+type PushProxySuite struct{}
+
+var _ = Suite(&PushProxySuite{})
+
+// doPush sends a push request to the push proxy and returns the response status code.
+func doPush(proxy http.Handler, method string, path string, body string) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// pushedFamilies returns the metric families returned by the push proxy by name.
+func pushedFamilies(c *C, proxy MetricProxy) map[string]*dto.MetricFamily {
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		_, found := families[mf.GetName()]
+		c.Assert(found, Equals, false, Commentf("metric family %s returned twice", mf.GetName()))
+		families[mf.GetName()] = mf
+	}
+	return families
+}
+
+// metricLabels returns the labels of a metric as a map.
+func metricLabels(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(metric.GetLabel()))
+	for _, lp := range metric.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	return labels
+}
+
+func (s *PushProxySuite) TestPushProxy(c *C) {
+	proxy := newPushProxy(&config.PushExporterConfig{})
+
+	c.Check(doPush(proxy, http.MethodPut, "/metrics/job/batch/instance/a", "some_metric 1\nother_metric 2\n"), Equals, http.StatusOK)
+	c.Check(doPush(proxy, http.MethodPut, "/metrics/job/batch/instance/b", "some_metric 3\n"), Equals, http.StatusOK)
+
+	families := pushedFamilies(c, proxy)
+	c.Assert(families, HasLen, 3)
+	c.Assert(families["some_metric"].GetMetric(), HasLen, 2)
+	c.Check(metricLabels(families["some_metric"].GetMetric()[0]), DeepEquals, map[string]string{"job": "batch", "instance": "a"})
+	c.Check(families["some_metric"].GetMetric()[0].GetUntyped().GetValue(), Equals, 1.0)
+	c.Check(metricLabels(families["some_metric"].GetMetric()[1]), DeepEquals, map[string]string{"job": "batch", "instance": "b"})
+	c.Check(families[pushTimeMetricName].GetMetric(), HasLen, 2)
+	c.Check(families[pushTimeMetricName].GetMetric()[0].GetGauge().GetValue() > 0, Equals, true)
+
+	// POST only replaces metrics with the same name.
+	c.Check(doPush(proxy, http.MethodPost, "/metrics/job/batch/instance/a", "some_metric 4\n"), Equals, http.StatusOK)
+	families = pushedFamilies(c, proxy)
+	c.Check(families["some_metric"].GetMetric()[0].GetUntyped().GetValue(), Equals, 4.0)
+	c.Check(families["other_metric"].GetMetric(), HasLen, 1)
+
+	// PUT replaces all metrics of the group.
+	c.Check(doPush(proxy, http.MethodPut, "/metrics/job/batch/instance/a", "some_metric 5\n"), Equals, http.StatusOK)
+	families = pushedFamilies(c, proxy)
+	c.Check(families["some_metric"].GetMetric()[0].GetUntyped().GetValue(), Equals, 5.0)
+	c.Check(families["other_metric"], IsNil)
+
+	// DELETE removes the group.
+	c.Check(doPush(proxy, http.MethodDelete, "/metrics/job/batch/instance/a", ""), Equals, http.StatusAccepted)
+	families = pushedFamilies(c, proxy)
+	c.Assert(families["some_metric"].GetMetric(), HasLen, 1)
+	c.Check(metricLabels(families["some_metric"].GetMetric()[0])["instance"], Equals, "b")
+	c.Check(families[pushTimeMetricName].GetMetric(), HasLen, 1)
+
+	status, ok := proxy.Status().(PushStatus)
+	c.Assert(ok, Equals, true)
+	c.Assert(status.Groups, HasLen, 1)
+	c.Check(status.Groups[0].Labels, DeepEquals, map[string]string{"job": "batch", "instance": "b"})
+}
+
+func (s *PushProxySuite) TestPushProxyGroupingKey(c *C) {
+	proxy := newPushProxy(&config.PushExporterConfig{})
+
+	// "a/b" and "" base64url encoded.
+	c.Check(doPush(proxy, http.MethodPut, "/metrics/job@base64/YS9i/path@base64/=", "some_metric 1\n"), Equals, http.StatusOK)
+	families := pushedFamilies(c, proxy)
+	c.Assert(families["some_metric"].GetMetric(), HasLen, 1)
+	c.Check(metricLabels(families["some_metric"].GetMetric()[0]), DeepEquals, map[string]string{"job": "a/b", "path": ""})
+
+	invalidPaths := []string{
+		"/metrics/job/",
+		"/metrics/job/batch/instance",
+		"/metrics/instance/a/job/batch",
+		"/metrics/job/batch/job/other",
+		"/metrics/job/batch/bad-label/a",
+		"/metrics/job/batch/__reserved/a",
+		"/metrics/job@base64/!!!",
+	}
+	for _, path := range invalidPaths {
+		c.Check(doPush(proxy, http.MethodPut, path, "some_metric 1\n"), Equals, http.StatusBadRequest, Commentf(path))
+	}
+	c.Check(doPush(proxy, http.MethodPut, "/other/job/batch", "some_metric 1\n"), Equals, http.StatusNotFound)
+	c.Check(doPush(proxy, http.MethodGet, "/metrics/job/batch", ""), Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *PushProxySuite) TestPushProxyRejectsInvalidMetrics(c *C) {
+	proxy := newPushProxy(&config.PushExporterConfig{MaxBytes: 64})
+
+	c.Check(doPush(proxy, http.MethodPut, "/metrics/job/batch", "# TYPE some_metric counter\nsome_metric 1\n"), Equals, http.StatusOK)
+
+	invalidPushes := []struct {
+		path string
+		body string
+		code int
+	}{
+		{"/metrics/job/batch", "not metrics", http.StatusBadRequest},
+		{"/metrics/job/batch", "some_metric 1 1000\n", http.StatusBadRequest},
+		{"/metrics/job/batch", "some_metric{job=\"other\"} 1\n", http.StatusBadRequest},
+		// The type conflicts with the metric pushed to another group.
+		{"/metrics/job/other", "# TYPE some_metric gauge\nsome_metric 1\n", http.StatusBadRequest},
+		{"/metrics/job/batch", strings.Repeat("some_metric 1\n", 10), http.StatusRequestEntityTooLarge},
+	}
+	for _, push := range invalidPushes {
+		c.Check(doPush(proxy, http.MethodPut, push.path, push.body), Equals, push.code, Commentf("%s: %q", push.path, push.body))
+	}
+
+	// The type may change within a group.
+	c.Check(doPush(proxy, http.MethodPut, "/metrics/job/batch", "# TYPE some_metric gauge\nsome_metric 1\n"), Equals, http.StatusOK)
+
+	families := pushedFamilies(c, proxy)
+	c.Check(families["some_metric"].GetType(), Equals, dto.MetricType_GAUGE)
+	c.Check(families["some_metric"].GetMetric(), HasLen, 1)
+}
+
+func (s *PushProxySuite) TestPushProxyPersistence(c *C) {
+	persistenceFile := filepath.Join(c.MkDir(), "push.json")
+	exporterConfig := &config.PushExporterConfig{PersistenceFile: persistenceFile}
+
+	proxy := newPushProxy(exporterConfig)
+	c.Check(doPush(proxy, http.MethodPut, "/metrics/job/batch/instance/a", "# TYPE some_metric counter\nsome_metric 1\n"), Equals, http.StatusOK)
+	c.Assert(proxy.persist(), IsNil)
+
+	restored := newPushProxy(exporterConfig)
+	families := pushedFamilies(c, restored)
+	c.Assert(families["some_metric"].GetMetric(), HasLen, 1)
+	c.Check(families["some_metric"].GetType(), Equals, dto.MetricType_COUNTER)
+	c.Check(families["some_metric"].GetMetric()[0].GetCounter().GetValue(), Equals, 1.0)
+	c.Check(metricLabels(families["some_metric"].GetMetric()[0]), DeepEquals, map[string]string{"job": "batch", "instance": "a"})
+	c.Check(restored.Status().(PushStatus).Groups[0].PushTime.Equal(proxy.Status().(PushStatus).Groups[0].PushTime), Equals, true)
+
+	// Deletes are persisted too.
+	c.Check(doPush(restored, http.MethodDelete, "/metrics/job/batch/instance/a", ""), Equals, http.StatusAccepted)
+	c.Assert(restored.persist(), IsNil)
+	c.Check(pushedFamilies(c, newPushProxy(exporterConfig)), HasLen, 0)
+}
+
+func (s *PushProxySuite) TestPushProxyPersistenceOnStop(c *C) {
+	persistenceFile := filepath.Join(c.MkDir(), "push.json")
+	exporterConfig := &config.PushExporterConfig{
+		Exporter:            config.Exporter{Name: "batch"},
+		Path:                "/push",
+		PersistenceFile:     persistenceFile,
+		PersistenceInterval: model.Duration(time.Hour),
+	}
+
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path:      "/metrics",
+		Exporters: &config.ExportersConfig{PushExporters: []*config.PushExporterConfig{exporterConfig}},
+	}, nil)
+	c.Assert(err, IsNil)
+	endpoint.Start()
+	pushHandler := http.StripPrefix("/push", endpoint.PushHandlers()["/push"])
+	c.Check(doPush(pushHandler, http.MethodPut, "/push/metrics/job/batch", "some_metric 1\n"), Equals, http.StatusOK)
+
+	// Metrics pushed since the last periodic save are saved when the endpoint is stopped.
+	c.Check(pushedFamilies(c, newPushProxy(exporterConfig)), HasLen, 0)
+	endpoint.Stop()
+	families := pushedFamilies(c, newPushProxy(exporterConfig))
+	c.Assert(families["some_metric"].GetMetric(), HasLen, 1)
+	c.Check(metricLabels(families["some_metric"].GetMetric()[0]), DeepEquals, map[string]string{"job": "batch"})
+}
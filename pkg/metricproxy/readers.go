@@ -0,0 +1,101 @@
+package metricproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// ErrMaxBytesExceeded is returned when the output of an exporter is larger than its max_bytes.
+var ErrMaxBytesExceeded = errors.New("exporter output exceeds max_bytes")
+
+//nolint:gochecknoglobals
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// maxBytesReader is an io.Reader which fails with ErrMaxBytesExceeded once more than max
+// bytes have been read from the underlying reader.
+type maxBytesReader struct {
+	rdr       io.Reader
+	max       uint64
+	remaining uint64
+}
+
+// newMaxBytesReader limits rdr to max bytes. A max of 0 does not limit rdr.
+func newMaxBytesReader(rdr io.Reader, max uint64) io.Reader {
+	if max == 0 {
+		return rdr
+	}
+	return &maxBytesReader{
+		rdr:       rdr,
+		max:       max,
+		remaining: max,
+	}
+}
+
+// Read implements io.Reader.
+func (mbr *maxBytesReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit to tell a reader which ends exactly at the limit from one
+	// which exceeds it.
+	if uint64(len(p)) > mbr.remaining+1 {
+		p = p[:mbr.remaining+1]
+	}
+	n, err := mbr.rdr.Read(p)
+	if uint64(n) > mbr.remaining {
+		n = int(mbr.remaining)
+		mbr.remaining = 0
+		return n, errors.Wrapf(ErrMaxBytesExceeded, "limit %d bytes", mbr.max)
+	}
+	mbr.remaining -= uint64(n)
+	return n, err //nolint:wrapcheck
+}
+
+// newDecompressingReader returns a reader which decompresses rdr if it is gzip or zstd
+// compressed. Compression is detected from the extension of name (.gz or .zst) or from the
+// magic bytes of the content.
+func newDecompressingReader(rdr io.Reader, name string) (io.ReadCloser, error) {
+	bufRdr := bufio.NewReader(rdr)
+	// A short read just means the content is too short to be compressed.
+	magic, _ := bufRdr.Peek(len(zstdMagic))
+
+	switch ext := filepath.Ext(name); {
+	case ext == ".gz" || bytes.HasPrefix(magic, gzipMagic):
+		gzipRdr, err := gzip.NewReader(bufRdr)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip decompression failed")
+		}
+		return gzipRdr, nil
+	case ext == ".zst" || bytes.HasPrefix(magic, zstdMagic):
+		zstdRdr, err := zstd.NewReader(bufRdr, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "zstd decompression failed")
+		}
+		return zstdRdr.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(bufRdr), nil
+	}
+}
+
+// errRecordingReader records the first error other than io.EOF returned by rdr, as the text
+// format parser treats any error at the start of a line as the end of its input.
+type errRecordingReader struct {
+	rdr io.Reader
+	err error
+}
+
+// Read implements io.Reader.
+func (rr *errRecordingReader) Read(p []byte) (int, error) {
+	n, err := rr.rdr.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && rr.err == nil {
+		rr.err = err
+	}
+	return n, err //nolint:wrapcheck
+}
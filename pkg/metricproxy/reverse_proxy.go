@@ -1,11 +1,17 @@
 package metricproxy
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/url"
 	"sync"
 
-	dto "github.com/prometheus/client_model/go"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 )
 
 // ReverseProxyEndpoint wraps a collection of ReverseProxyBackends. It exposes an HTTP endpoint
@@ -17,6 +23,23 @@ type ReverseProxyEndpoint struct {
 	backends []MetricProxy
 	// handler is the (possibly wrapped) function which provides the real ServeHTTP
 	handler http.HandlerFunc
+	// debugHandler is the (possibly wrapped) function which serves the debug status
+	debugHandler http.HandlerFunc
+	// pushHandlers are the (possibly wrapped) handlers accepting pushes, by push path
+	pushHandlers map[string]http.Handler
+	// coalescer coalesces concurrent scrapes of the backends, including scrapes by the
+	// include exporters of other endpoints. It is only set if the endpoint is included.
+	coalescer *scrapeCoalescer
+	// router selects the backends scraped by a url param, if the endpoint is routed
+	router *targetRouter
+	// matchFilter filters the served metrics by the series selectors of the match[] params
+	matchFilter bool
+	// openMetrics serves the OpenMetrics format to scrapers which accept it
+	openMetrics bool
+	// nameLabel is the label the metrics of the backends are given their exporter name in
+	nameLabel model.LabelName
+	// aggregations compute new metrics from the merged metrics of the backends
+	aggregations []*aggregation
 }
 
 // ServeHTTP implements http.Handler by calling the designated wrapper function.
@@ -24,52 +47,161 @@ func (rpe *ReverseProxyEndpoint) ServeHTTP(wr http.ResponseWriter, req *http.Req
 	rpe.handler(wr, req)
 }
 
+// DebugHandler returns a handler which serves the debug status of the backends of the
+// endpoint. It is protected by the same authentication as the endpoint.
+func (rpe *ReverseProxyEndpoint) DebugHandler() http.Handler {
+	return rpe.debugHandler
+}
+
+// PushHandlers returns the handlers of the push exporters of the endpoint by their path.
+// Each handler expects the path to be stripped from requests, and is protected by the same
+// authentication as the endpoint.
+func (rpe *ReverseProxyEndpoint) PushHandlers() map[string]http.Handler {
+	return rpe.pushHandlers
+}
+
+// Start starts the backends which run in the background, such as scheduled scripts. It is
+// called once every endpoint has been configured, so an invalid configuration starts nothing.
+func (rpe *ReverseProxyEndpoint) Start() {
+	for _, backend := range rpe.backends {
+		if starter, ok := backend.(starter); ok {
+			starter.start()
+		}
+	}
+}
+
+// Stop stops the backends which run in the background, such as scheduled scripts, and saves
+// the state of those which persist it, such as pushed metrics, so it survives a restart. It
+// is called on shutdown, after the endpoint stops being served.
+func (rpe *ReverseProxyEndpoint) Stop() {
+	for _, backend := range rpe.backends {
+		if stopper, ok := backend.(stopper); ok {
+			stopper.stop()
+		}
+	}
+}
+
+// Status returns the debug status of all backends which report one, by backend name.
+func (rpe *ReverseProxyEndpoint) Status() map[string]interface{} {
+	statuses := make(map[string]interface{})
+	for _, backend := range rpe.backends {
+		rewriter, ok := backend.(*rewriteProxy)
+		if !ok {
+			continue
+		}
+		if status := rewriter.Status(); status != nil {
+			statuses[rewriter.name] = status
+		}
+	}
+	return statuses
+}
+
+// serveDebugHTTP serves the debug status of the backends as JSON.
+func (rpe *ReverseProxyEndpoint) serveDebugHTTP(wr http.ResponseWriter, req *http.Request) {
+	wr.Header().Set(contentTypeHeader, "application/json")
+	enc := json.NewEncoder(wr)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rpe.Status()); err != nil {
+		zap.L().Debug("Error writing to requestor", zap.Error(err))
+	}
+}
+
 // serveMetricsHTTP implements http.Handler. Specifically: it serves the aggregated rewritten
 // Prometheus endpoints contained underneath it. This function is the direct handler -
 // ServeHTTP on the interface varies based on the other wrappers used to construct it.
 func (rpe *ReverseProxyEndpoint) serveMetricsHTTP(wr http.ResponseWriter, req *http.Request) {
-	log := zap.L()
-	ctx := req.Context()
+	values := req.URL.Query()
+
+	var selectors []seriesSelector
+	if rpe.matchFilter {
+		var err error
+		if selectors, err = parseSeriesSelectors(values[matchParam]); err != nil {
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// As an appliance, we return nothing till we know the result of our reverse
 	// proxied metrics.
+	allMfs, err := rpe.scrape(req.Context(), values)
+	if errors.Is(err, ErrRouteNotFound) {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		zap.L().Debug("Scrape ended before the backends returned", zap.Error(err))
+	}
+	// Selectors filter the rewritten metrics, so can match the labels added by the exporter.
+	if len(selectors) > 0 {
+		allMfs = filterMetricFamilies(allMfs, selectors)
+	}
+	// serialize the resulting metrics to the Prometheus format and return them
+	handleSerializeMetrics(wr, req, allMfs, rpe.openMetrics)
+}
+
+// scrape returns the merged metrics of all backends, or of the backends the url params
+// select if the endpoint is routed. If the endpoint is included by others, concurrent
+// scrapes with the same url params share a single scrape of the backends.
+func (rpe *ReverseProxyEndpoint) scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	backends := rpe.backends
+	var routeLabels model.LabelSet
+	if rpe.router != nil {
+		var err error
+		if backends, routeLabels, err = rpe.router.route(values); err != nil {
+			return nil, err
+		}
+	}
+
+	gather := func(ctx context.Context) []*dto.MetricFamily {
+		mfs := rpe.gather(ctx, backends, values)
+		if routeLabels != nil {
+			rewriteMetrics(routeLabels, mfs)
+		}
+		return applyAggregations(rpe.aggregations, mfs)
+	}
+	if rpe.coalescer == nil {
+		return gather(ctx), nil
+	}
+	return rpe.coalescer.scrape(ctx, values.Encode(), gather)
+}
+
+// coalesce makes concurrent scrapes of the endpoint share a single scrape of the backends.
+// It is set once the endpoint is included by another, so the scrapes of both are coalesced.
+func (rpe *ReverseProxyEndpoint) coalesce() {
+	if rpe.coalescer == nil {
+		rpe.coalescer = newScrapeCoalescer()
+	}
+}
+
+// gather scrapes backends concurrently and merges their metrics in the order of the
+// backends, so the output does not depend on which backend returns first. Backends which
+// fail are logged and omitted.
+func (rpe *ReverseProxyEndpoint) gather(ctx context.Context, backends []MetricProxy, values url.Values) []*dto.MetricFamily {
+	log := zap.L()
+
 	wg := new(sync.WaitGroup)
-	// This channel is guarded by wg - it will be closed when the waitgroup
-	// finishes.
-	mfsCh := make(chan []*dto.MetricFamily)
-	mfsResultCh := make(chan []*dto.MetricFamily)
+	// Each scraper writes only its own result, and they are read once wg finishes.
+	results := make([][]*dto.MetricFamily, len(backends))
 
 	// On request, request all included exporters to return values.
-	log.Debug("Scraping", zap.Int("num_exporters", len(rpe.backends)))
-	for _, backend := range rpe.backends {
+	log.Debug("Scraping", zap.Int("num_exporters", len(backends)))
+	for idx, backend := range backends {
 		wg.Add(1)
-		go func(mfsCh chan<- []*dto.MetricFamily, backend MetricProxy) {
+		go func(idx int, backend MetricProxy) {
 			defer wg.Done()
-			mfs, err := backend.Scrape(ctx, req.URL.Query())
+			mfs, err := backend.Scrape(ctx, values)
 			if err != nil {
 				log.Error("Error while scraping backend handler for endpoint", zap.Error(err))
-				return
 			}
-			mfsCh <- mfs
-		}(mfsCh, backend)
+			// Failed backends may still return status metrics
+			results[idx] = mfs
+		}(idx, backend)
 	}
-	// metric aggregator combines all the scraped metrics and emits them to the
-	// result channel.
-	go func(chan<- []*dto.MetricFamily) {
-		mfs := []*dto.MetricFamily{}
-		for inpMfs := range mfsCh {
-			mfs = append(mfs, inpMfs...)
-		}
-		mfsResultCh <- mfs
-		close(mfsResultCh)
-	}(mfsResultCh)
 
-	// Wait for all scrapers to return and results to aggregate
+	// Wait for all scrapers to return
 	log.Debug("Waiting for scrapers to return")
 	wg.Wait()
-	close(mfsCh)
-	// collect results from mfsResultCh
-	allMfs := <-mfsResultCh
-	// serialize the resulting metrics to the Prometheus format and return them
-	handleSerializeMetrics(wr, req, allMfs)
+
+	// combine the results, and merge families which several backends returned
+	return mergeBackendMetricFamilies(results)
 }
@@ -3,8 +3,10 @@ package metricproxy
 import (
 	"context"
 	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
@@ -12,25 +14,100 @@ import (
 
 var _ MetricProxy = &rewriteProxy{}
 
+const backendUpMetricName = "reverse_exporter_backend_up"
+
 // rewriteProxy implements the MetricProxy interface by proxying to another proxy
 // and rewriting the metrics it returns.
 type rewriteProxy struct {
-	proxy  MetricProxy
-	labels model.LabelSet
+	name string
+	// nameLabel is the label the up metric is given the name in. Empty is exporter_name.
+	nameLabel model.LabelName
+	proxy     MetricProxy
+	labels    model.LabelSet
+	limits    scrapeLimits
+	// histograms converts the classic histograms of the proxy before they are rewritten
+	histograms histogramConversion
+	// timestamps is how the sample timestamps of the proxy are handled
+	timestamps config.TimestampMode
 }
 
 // Scrape scrapes using the underlying metric proxy, and rewrites the results with the
-// attached labelset.
+// attached labelset. If the scrape fails, any status metrics of the underlying proxy are
+// still returned alongside the error. Whether the scrape succeeded is always returned as
+// the backend up metric.
 func (rpb *rewriteProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
 	// Derive a new context from the request
 	childCtx, cancelFn := context.WithCancel(ctx)
 	defer cancelFn()
 	// Do the metric scrape
+	scrapeTime := time.Now()
 	mfs, err := rpb.proxy.Scrape(childCtx, values)
 	if err != nil {
-		return nil, errors.Wrap(err, "underlying metric proxy scrape error")
+		mfs = nil
+		err = errors.Wrap(err, "underlying metric proxy scrape error")
 	}
-	// Rewrite the metric set before returning it.
+	// Convert histograms and rewrite the metric set, and then check it against the limits
+	// like Prometheus would.
+	mfs = rpb.histograms.convert(mfs)
 	rewriteMetrics(rpb.labels, mfs)
-	return mfs, nil
+	applyTimestamps(rpb.timestamps, mfs, scrapeTime)
+	if err == nil {
+		if lerr := rpb.limits.check(mfs); lerr != nil {
+			mfs = nil
+			err = errors.Wrap(lerr, "metric proxy scrape exceeded limits")
+		}
+	}
+	// Append status metrics from the proxy
+	if provider, ok := rpb.proxy.(statusMetricsProvider); ok {
+		statusMfs := provider.statusMetrics()
+		rewriteMetrics(rpb.backendLabels(), statusMfs)
+		mfs = append(mfs, statusMfs...)
+	}
+	return append(mfs, rpb.upMetric(err == nil)), err
+}
+
+// upMetric returns the backend up metric.
+func (rpb *rewriteProxy) upMetric(up bool) *dto.MetricFamily {
+	value := 0.0
+	if up {
+		value = 1.0
+	}
+	upMfs := []*dto.MetricFamily{
+		newGaugeFamily(backendUpMetricName, "1 if the scrape of the backend succeeded, 0 otherwise.", value),
+	}
+	rewriteMetrics(rpb.backendLabels(), upMfs)
+	return upMfs[0]
+}
+
+// backendLabels returns the labels of the status and up metrics of the backend. They are
+// always labelled with the backend name so backends can be told apart even if rewriting is
+// disabled.
+func (rpb *rewriteProxy) backendLabels() model.LabelSet {
+	nameLabel := rpb.nameLabel
+	if nameLabel == "" {
+		nameLabel = reverseProxyNameLabel
+	}
+	return rpb.labels.Merge(model.LabelSet{nameLabel: model.LabelValue(rpb.name)})
+}
+
+// start implements starter by starting the underlying proxy.
+func (rpb *rewriteProxy) start() {
+	if starter, ok := rpb.proxy.(starter); ok {
+		starter.start()
+	}
+}
+
+// stop implements stopper by stopping the underlying proxy.
+func (rpb *rewriteProxy) stop() {
+	if stopper, ok := rpb.proxy.(stopper); ok {
+		stopper.stop()
+	}
+}
+
+// Status implements StatusReporter by returning the status of the underlying proxy.
+func (rpb *rewriteProxy) Status() interface{} {
+	if reporter, ok := rpb.proxy.(StatusReporter); ok {
+		return reporter.Status()
+	}
+	return nil
 }
@@ -0,0 +1,246 @@
+package metricproxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+	. "gopkg.in/check.v1"
+)
+
+// staticTestProxy is a MetricProxy which returns copies of a fixed set of metrics.
+type staticTestProxy struct {
+	mfs []*dto.MetricFamily
+	err error
+}
+
+func (stp *staticTestProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	return cloneMetricFamilies(stp.mfs), stp.err
+}
+
+type RewriteProxySuite struct{}
+
+var _ = Suite(&RewriteProxySuite{})
+
+func newTestHistogramFamily() *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String("test_histogram"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("path"), Value: proto.String("/some/long/path")}},
+			Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(2),
+				SampleSum:   proto.Float64(3),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+					{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(2)},
+				},
+			},
+		}},
+	}
+}
+
+// backendUp returns the value of the backend up metric in mfs.
+func backendUp(c *C, mfs []*dto.MetricFamily) float64 {
+	for _, mf := range mfs {
+		if mf.GetName() == backendUpMetricName {
+			c.Assert(mf.GetMetric(), HasLen, 1)
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	c.Fatalf("no %s metric returned", backendUpMetricName)
+	return math.NaN()
+}
+
+func (s *RewriteProxySuite) TestRewriteProxyUp(c *C) {
+	proxy := &rewriteProxy{
+		name:   "test",
+		proxy:  &staticTestProxy{mfs: []*dto.MetricFamily{newTestHistogramFamily()}},
+		labels: model.LabelSet{},
+	}
+
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs, HasLen, 2)
+	c.Check(backendUp(c, mfs), Equals, 1.0)
+
+	// The up metric is labelled with the name even if rewriting is disabled.
+	upLabels := mfs[1].GetMetric()[0].GetLabel()
+	c.Assert(upLabels, HasLen, 1)
+	c.Check(upLabels[0].GetName(), Equals, reverseProxyNameLabel)
+	c.Check(upLabels[0].GetValue(), Equals, "test")
+
+	proxy.proxy = &staticTestProxy{err: errors.New("failed")}
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Check(err, Not(IsNil))
+	c.Check(mfs, HasLen, 1)
+	c.Check(backendUp(c, mfs), Equals, 0.0)
+}
+
+func (s *RewriteProxySuite) TestRewriteProxyLimits(c *C) {
+	limitTests := []struct {
+		limits scrapeLimits
+		err    error
+	}{
+		// A histogram with 2 buckets is 4 samples.
+		{scrapeLimits{sampleLimit: 4}, nil},
+		{scrapeLimits{sampleLimit: 3}, ErrSampleLimitExceeded},
+		// The name, path and rewritten exporter_name labels.
+		{scrapeLimits{labelLimit: 3}, nil},
+		{scrapeLimits{labelLimit: 2}, ErrLabelLimitExceeded},
+		{scrapeLimits{labelNameLengthLimit: uint64(len(reverseProxyNameLabel))}, nil},
+		{scrapeLimits{labelNameLengthLimit: uint64(len(reverseProxyNameLabel)) - 1}, ErrLabelNameLengthLimitExceeded},
+		{scrapeLimits{labelValueLengthLimit: uint64(len("/some/long/path"))}, nil},
+		{scrapeLimits{labelValueLengthLimit: uint64(len("test_histogram"))}, ErrLabelValueLengthLimitExceeded},
+	}
+
+	for _, limitTest := range limitTests {
+		proxy := &rewriteProxy{
+			name:   "test",
+			proxy:  &staticTestProxy{mfs: []*dto.MetricFamily{newTestHistogramFamily()}},
+			labels: model.LabelSet{reverseProxyNameLabel: "test"},
+			limits: limitTest.limits,
+		}
+
+		mfs, err := proxy.Scrape(context.Background(), nil)
+		if limitTest.err == nil {
+			c.Check(err, IsNil, Commentf("limits: %+v", limitTest.limits))
+			c.Check(backendUp(c, mfs), Equals, 1.0)
+			continue
+		}
+		c.Check(errors.Is(err, limitTest.err), Equals, true, Commentf("limits: %+v got error: %v", limitTest.limits, err))
+		c.Check(mfs, HasLen, 1, Commentf("only the up metric should be returned"))
+		c.Check(backendUp(c, mfs), Equals, 0.0)
+	}
+
+	// Labels added by rewriting are checked too.
+	proxy := &rewriteProxy{
+		name:   "test",
+		proxy:  &staticTestProxy{mfs: []*dto.MetricFamily{newTestHistogramFamily()}},
+		labels: model.LabelSet{"instance": model.LabelValue(strings.Repeat("x", 64))},
+		limits: scrapeLimits{labelValueLengthLimit: 32},
+	}
+	_, err := proxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrLabelValueLengthLimitExceeded), Equals, true, Commentf("got error: %v", err))
+}
+
+func (s *RewriteProxySuite) TestRewriteProxyTimestamps(c *C) {
+	source := newTestHistogramFamily()
+	source.Metric[0].TimestampMs = proto.Int64(1600000000000)
+
+	for mode, expected := range map[config.TimestampMode]*int64{
+		"":                          proto.Int64(1600000000000),
+		config.TimestampsKeep:       proto.Int64(1600000000000),
+		config.TimestampsStrip:      nil,
+		config.TimestampsScrapeTime: proto.Int64(0),
+	} {
+		proxy := &rewriteProxy{
+			name:       "test",
+			proxy:      &staticTestProxy{mfs: []*dto.MetricFamily{source}},
+			labels:     model.LabelSet{},
+			timestamps: mode,
+		}
+
+		before := time.Now()
+		mfs, err := proxy.Scrape(context.Background(), nil)
+		c.Assert(err, IsNil)
+		families, _ := familiesByName(mfs)
+		timestampMs := families["test_histogram"].GetMetric()[0].TimestampMs
+		// The up metric is never timestamped.
+		c.Check(families[backendUpMetricName].GetMetric()[0].TimestampMs, IsNil)
+
+		switch {
+		case expected == nil:
+			c.Check(timestampMs, IsNil, Commentf("mode: %s", mode))
+		case mode == config.TimestampsScrapeTime:
+			c.Assert(timestampMs, NotNil, Commentf("mode: %s", mode))
+			c.Check(*timestampMs >= before.UnixNano()/int64(time.Millisecond), Equals, true)
+			c.Check(*timestampMs <= time.Now().UnixNano()/int64(time.Millisecond), Equals, true)
+		default:
+			c.Check(timestampMs, DeepEquals, expected, Commentf("mode: %s", mode))
+		}
+	}
+
+	// Only exec and file exporters know when their metrics were produced.
+	_, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path: "/metrics",
+		Exporters: &config.ExportersConfig{
+			StaticExporters: []*config.StaticExporterConfig{{
+				Exporter: config.Exporter{Name: "static", Timestamps: config.TimestampsProductionTime},
+			}},
+		},
+	}, nil)
+	c.Check(errors.Is(err, ErrTimestampsInvalid), Equals, true, Commentf("got error: %v", err))
+}
+
+func (s *RewriteProxySuite) TestPathLabels(c *C) {
+	core := newTestStaticExporter("core", "core_requests")
+	edge := newTestStaticExporter("edge", "edge_requests")
+	edge.Labels = map[string]string{"site": "edge", "exporter_name": "edge_exporter"}
+
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path:          "/metrics",
+		ExporterLabel: "job_component",
+		Labels:        map[string]string{"appliance_id": "appliance-01", "site": "core"},
+		Exporters: &config.ExportersConfig{
+			StaticExporters: []*config.StaticExporterConfig{core, edge},
+		},
+	}, nil)
+	c.Assert(err, IsNil)
+
+	mfs, err := endpoint.scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	families, _ := familiesByName(mfs)
+	c.Check(metricLabels(families["core_requests"].GetMetric()[0]), DeepEquals,
+		map[string]string{"job_component": "core", "appliance_id": "appliance-01", "site": "core"})
+	// Exporter labels override path labels, and exporter_name is an ordinary label once
+	// the exporter label is renamed.
+	c.Check(metricLabels(families["edge_requests"].GetMetric()[0]), DeepEquals,
+		map[string]string{"job_component": "edge", "appliance_id": "appliance-01", "site": "edge",
+			"exporter_name": "edge_exporter"})
+	for _, metric := range families[backendUpMetricName].GetMetric() {
+		c.Check(metricLabels(metric)["job_component"], Not(Equals), "")
+		c.Check(metricLabels(metric)["appliance_id"], Equals, "appliance-01")
+	}
+
+	for _, reverseExporter := range []*config.ReverseExporterConfig{
+		{Labels: map[string]string{"job_component": "x"}, ExporterLabel: "job_component"},
+		{Labels: map[string]string{reverseProxyNameLabel: "x"}},
+	} {
+		reverseExporter.Path = "/metrics"
+		reverseExporter.Exporters = &config.ExportersConfig{}
+		_, err := NewMetricReverseProxy(reverseExporter, nil)
+		c.Check(errors.Is(err, ErrNameFieldOverrideAttempted), Equals, true, Commentf("got error: %v", err))
+	}
+
+	edge.Labels = map[string]string{"job_component": "x"}
+	_, err = NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path:          "/metrics",
+		ExporterLabel: "job_component",
+		Exporters:     &config.ExportersConfig{StaticExporters: []*config.StaticExporterConfig{edge}},
+	}, nil)
+	c.Check(errors.Is(err, ErrNameFieldOverrideAttempted), Equals, true, Commentf("got error: %v", err))
+
+	_, err = NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path:      "/metrics",
+		Labels:    map[string]string{"__name__": "x"},
+		Exporters: &config.ExportersConfig{},
+	}, nil)
+	c.Check(errors.Is(err, ErrStaticLabelInvalid), Equals, true, Commentf("got error: %v", err))
+
+	for _, exporterLabel := range []string{"le", "__exporter", "job-component"} {
+		_, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+			Path:          "/metrics",
+			ExporterLabel: exporterLabel,
+			Exporters:     &config.ExportersConfig{},
+		}, nil)
+		c.Check(errors.Is(err, ErrExporterLabelInvalid), Equals, true, Commentf("exporter label: %s", exporterLabel))
+	}
+}
@@ -0,0 +1,87 @@
+package metricproxy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherFunc gathers the metrics of a set of backends.
+type gatherFunc func(ctx context.Context) []*dto.MetricFamily
+
+// scrapeCoalescer coalesces concurrent scrapes with the same key into a single gather.
+// The gather is cancelled once every scrape waiting for it has given up.
+type scrapeCoalescer struct {
+	mtx   *sync.Mutex
+	calls map[string]*coalescedScrape
+}
+
+// coalescedScrape is a gather in progress.
+type coalescedScrape struct {
+	// done is closed once mfs is set
+	done chan struct{}
+	mfs  []*dto.MetricFamily
+	// waiters is the number of scrapes waiting for the gather (guarded by scrapeCoalescer.mtx)
+	waiters  int
+	cancelFn context.CancelFunc
+}
+
+func newScrapeCoalescer() *scrapeCoalescer {
+	return &scrapeCoalescer{
+		mtx:   &sync.Mutex{},
+		calls: make(map[string]*coalescedScrape),
+	}
+}
+
+// scrape returns the result of gather, joining a gather with the same key if one is in
+// progress. Every caller receives its own copy of the metrics.
+func (sc *scrapeCoalescer) scrape(ctx context.Context, key string, gather gatherFunc) ([]*dto.MetricFamily, error) {
+	sc.mtx.Lock()
+	call, found := sc.calls[key]
+	if !found {
+		gatherCtx, cancelFn := context.WithCancel(context.Background())
+		call = &coalescedScrape{
+			done:     make(chan struct{}),
+			cancelFn: cancelFn,
+		}
+		sc.calls[key] = call
+
+		go func() {
+			defer cancelFn()
+			call.mfs = gather(gatherCtx)
+			sc.forget(key, call)
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	sc.mtx.Unlock()
+
+	select {
+	case <-call.done:
+		return cloneMetricFamilies(call.mfs), nil
+	case <-ctx.Done():
+		sc.mtx.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancelFn()
+			// Later scrapes must not join the cancelled gather.
+			if sc.calls[key] == call {
+				delete(sc.calls, key)
+			}
+		}
+		sc.mtx.Unlock()
+		return nil, errors.Wrap(ctx.Err(), "scrape ended before the backends returned")
+	}
+}
+
+// forget stops later scrapes joining a finished gather.
+func (sc *scrapeCoalescer) forget(key string, call *coalescedScrape) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	if sc.calls[key] == call {
+		delete(sc.calls, key)
+	}
+}
@@ -0,0 +1,295 @@
+package metricproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// ErrSeriesSelectorInvalid returned when a match[] param is not a valid series selector.
+var ErrSeriesSelectorInvalid = errors.New("invalid series selector")
+
+// matchParam is the url param series selectors are given in, like for the Prometheus
+// /federate endpoint.
+const matchParam = "match[]"
+
+// matchOp is the operator of a label matcher.
+type matchOp string
+
+const (
+	matchEqual     matchOp = "="
+	matchNotEqual  matchOp = "!="
+	matchRegexp    matchOp = "=~"
+	matchNotRegexp matchOp = "!~"
+)
+
+// labelMatcher matches the value of a label. Absent labels have an empty value.
+type labelMatcher struct {
+	name  string
+	op    matchOp
+	value string
+	re    *regexp.Regexp
+}
+
+// matches returns true if the label value is matched.
+func (lm *labelMatcher) matches(value string) bool {
+	switch lm.op {
+	case matchEqual:
+		return value == lm.value
+	case matchNotEqual:
+		return value != lm.value
+	case matchRegexp:
+		return lm.re.MatchString(value)
+	case matchNotRegexp:
+		return !lm.re.MatchString(value)
+	}
+	return false
+}
+
+// seriesSelector is a Prometheus instant vector selector without offset or range, e.g.
+// `up{job=~"node.*"}`. It matches the series all its matchers match.
+type seriesSelector []*labelMatcher
+
+// matches returns true if the series with the given labels, including __name__, is matched.
+func (ss seriesSelector) matches(labels map[string]string) bool {
+	for _, matcher := range ss {
+		if !matcher.matches(labels[matcher.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSeriesSelectors parses the series selectors of the match[] params in values.
+func parseSeriesSelectors(values []string) ([]seriesSelector, error) {
+	selectors := make([]seriesSelector, 0, len(values))
+	for _, value := range values {
+		selector, err := parseSeriesSelector(value)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+// selectorParser is the state of parsing a series selector.
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+// parseSeriesSelector parses a series selector in Prometheus syntax. Like Prometheus, a
+// selector must have a metric name or a matcher which does not match the empty string.
+func parseSeriesSelector(input string) (seriesSelector, error) {
+	parser := &selectorParser{input: input}
+	selector := make(seriesSelector, 0)
+
+	parser.skipSpace()
+	if name := parser.name(true); name != "" {
+		selector = append(selector, &labelMatcher{name: model.MetricNameLabel, op: matchEqual, value: name})
+		parser.skipSpace()
+	}
+
+	if parser.consume("{") {
+		for {
+			parser.skipSpace()
+			if parser.consume("}") {
+				break
+			}
+			matcher, err := parser.matcher()
+			if err != nil {
+				return nil, err
+			}
+			selector = append(selector, matcher)
+			parser.skipSpace()
+			if parser.consume(",") {
+				continue
+			}
+			if !parser.consume("}") {
+				return nil, parser.errorf("expected , or } in label matchers")
+			}
+			break
+		}
+		parser.skipSpace()
+	}
+
+	if parser.pos != len(parser.input) {
+		return nil, parser.errorf("unexpected %q", parser.input[parser.pos:])
+	}
+	for _, matcher := range selector {
+		if !matcher.matches("") {
+			return selector, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrSeriesSelectorInvalid,
+		"%q: a metric name or a matcher which does not match the empty string is required", input)
+}
+
+// matcher parses a single label matcher.
+func (sp *selectorParser) matcher() (*labelMatcher, error) {
+	name := sp.name(false)
+	if name == "" {
+		return nil, sp.errorf("expected label name")
+	}
+	sp.skipSpace()
+
+	matcher := &labelMatcher{name: name}
+	// Two character operators are checked first, as = is a prefix of =~.
+	for _, op := range []matchOp{matchRegexp, matchNotRegexp, matchNotEqual, matchEqual} {
+		if sp.consume(string(op)) {
+			matcher.op = op
+			break
+		}
+	}
+	if matcher.op == "" {
+		return nil, sp.errorf("expected label matching operator after %s", name)
+	}
+	sp.skipSpace()
+
+	value, err := sp.quoted()
+	if err != nil {
+		return nil, err
+	}
+	matcher.value = value
+	if matcher.op == matchRegexp || matcher.op == matchNotRegexp {
+		// Like Prometheus, regexes must match the whole value.
+		if matcher.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return nil, sp.errorf("invalid regex for %s: %v", name, err)
+		}
+	}
+	return matcher, nil
+}
+
+// name parses a metric or label name. Metric names may also contain colons. An empty
+// string is returned if there is no name at the current position.
+func (sp *selectorParser) name(metricName bool) string {
+	start := sp.pos
+	for sp.pos < len(sp.input) {
+		char := sp.input[sp.pos]
+		isNameChar := char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
+			(metricName && char == ':') || (sp.pos > start && char >= '0' && char <= '9')
+		if !isNameChar {
+			break
+		}
+		sp.pos++
+	}
+	return sp.input[start:sp.pos]
+}
+
+// quoted parses a double, single or backtick quoted string.
+func (sp *selectorParser) quoted() (string, error) {
+	if sp.pos >= len(sp.input) {
+		return "", sp.errorf("expected quoted label value")
+	}
+	quote := sp.input[sp.pos]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", sp.errorf("expected quoted label value")
+	}
+
+	end := sp.pos + 1
+	for ; end < len(sp.input) && sp.input[end] != quote; end++ {
+		if sp.input[end] == '\\' && quote != '`' {
+			end++
+		}
+	}
+	if end >= len(sp.input) {
+		return "", sp.errorf("unterminated quoted label value")
+	}
+	literal := sp.input[sp.pos : end+1]
+	sp.pos = end + 1
+
+	if quote == '\'' {
+		literal = requoteSingleQuoted(literal)
+	}
+	value, err := strconv.Unquote(literal)
+	if err != nil {
+		return "", sp.errorf("invalid quoted label value %s", literal)
+	}
+	return value, nil
+}
+
+// requoteSingleQuoted returns a single quoted string as a double quoted string, which
+// strconv.Unquote only accepts for single characters.
+func requoteSingleQuoted(literal string) string {
+	var requoted strings.Builder
+	requoted.WriteByte('"')
+	content := literal[1 : len(literal)-1]
+	for idx := 0; idx < len(content); idx++ {
+		switch {
+		case content[idx] == '\\' && idx+1 < len(content) && content[idx+1] == '\'':
+			requoted.WriteByte('\'')
+			idx++
+		case content[idx] == '\\' && idx+1 < len(content):
+			requoted.WriteString(content[idx : idx+2])
+			idx++
+		case content[idx] == '"':
+			requoted.WriteString(`\"`)
+		default:
+			requoted.WriteByte(content[idx])
+		}
+	}
+	requoted.WriteByte('"')
+	return requoted.String()
+}
+
+// skipSpace skips whitespace.
+func (sp *selectorParser) skipSpace() {
+	for sp.pos < len(sp.input) && strings.ContainsRune(" \t\r\n", rune(sp.input[sp.pos])) {
+		sp.pos++
+	}
+}
+
+// consume skips token and returns true if it is at the current position.
+func (sp *selectorParser) consume(token string) bool {
+	if strings.HasPrefix(sp.input[sp.pos:], token) {
+		sp.pos += len(token)
+		return true
+	}
+	return false
+}
+
+// errorf returns an ErrSeriesSelectorInvalid error for the current position.
+func (sp *selectorParser) errorf(format string, args ...interface{}) error {
+	return errors.Wrapf(ErrSeriesSelectorInvalid, "%q at position %d: %s", sp.input, sp.pos, fmt.Sprintf(format, args...))
+}
+
+// filterMetricFamilies returns the metric families with only the series any of the
+// selectors match. Selectors match the family name as __name__. Histograms and summaries
+// are kept whole if any of the series they are exposed as is matched, so e.g. a selector
+// for foo_bucket{le="+Inf"} keeps the foo histogram. Families left without series are
+// dropped.
+func filterMetricFamilies(mfs []*dto.MetricFamily, selectors []seriesSelector) []*dto.MetricFamily {
+	filtered := mfs[:0]
+	for _, mf := range mfs {
+		metrics := mf.Metric[:0]
+		for _, metric := range mf.GetMetric() {
+			if selectorsMatch(selectors, exposedSeries(mf, metric)) {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered
+}
+
+// selectorsMatch returns true if any of the selectors matches any of the series.
+func selectorsMatch(selectors []seriesSelector, series []map[string]string) bool {
+	for _, labels := range series {
+		for _, selector := range selectors {
+			if selector.matches(labels) {
+				return true
+			}
+		}
+	}
+	return false
+}
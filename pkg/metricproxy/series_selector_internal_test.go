@@ -0,0 +1,108 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type SeriesSelectorSuite struct{}
+
+var _ = Suite(&SeriesSelectorSuite{})
+
+func (s *SeriesSelectorSuite) TestParseSeriesSelector(c *C) {
+	labels := map[string]string{"__name__": "http_requests_total", "job": "node", "code": "200", "path": `/a"b'c`}
+
+	for selector, matches := range map[string]bool{
+		`http_requests_total`:                               true,
+		` http_requests_total { } `:                         true,
+		`http_requests_total{job="node"}`:                   true,
+		`http_requests_total{job="node",}`:                  true,
+		`http_requests_total{job!="node"}`:                  false,
+		`{job=~"no.*", code!~"5.."}`:                        true,
+		`{job=~"no"}`:                                       false,
+		`{__name__=~"http_.*"}`:                             true,
+		`{job='node'}`:                                      true,
+		"{path=`/a\"b'c`}":                                  true,
+		`{path="/a\"b'c"}`:                                  true,
+		`{path='/a"b\'c'}`:                                  true,
+		`other_metric`:                                      false,
+		`http_requests_total{instance=""}`:                  true,
+		`node:http_requests:rate5m{job="node"}`:             false,
+		`http_requests_total{job="node", missing!="x"}`:     true,
+		"http_requests_total{job=\"node\",\n code=\"200\"}": true,
+	} {
+		parsed, err := parseSeriesSelector(selector)
+		c.Assert(err, IsNil, Commentf("selector: %s", selector))
+		c.Check(parsed.matches(labels), Equals, matches, Commentf("selector: %s", selector))
+	}
+
+	for _, selector := range []string{
+		``,
+		`{}`,
+		`{job=""}`,
+		`{job=~".*"}`,
+		`http_requests_total{`,
+		`http_requests_total{job}`,
+		`http_requests_total{job=node}`,
+		`http_requests_total{job="node"`,
+		`http_requests_total{job="node" code="200"}`,
+		`http_requests_total{job=~"("}`,
+		`http_requests_total[5m]`,
+		`rate(http_requests_total[5m])`,
+		`1metric`,
+	} {
+		_, err := parseSeriesSelector(selector)
+		c.Check(errors.Is(err, ErrSeriesSelectorInvalid), Equals, true, Commentf("selector: %s, got error: %v", selector, err))
+	}
+}
+
+func (s *SeriesSelectorSuite) TestMatchFilter(c *C) {
+	var federateQuery url.Values
+	federate := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		federateQuery = req.URL.Query()
+		fmt.Fprintf(wr, "up{job=\"node\",instance=\"a\"} 1 1600000000000\nup{job=\"db\",instance=\"b\"} 0 1600000000000\n")
+	}))
+	defer federate.Close()
+
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path: "/federate",
+		Exporters: &config.ExportersConfig{
+			HTTPExporters: []*config.HTTPExporterConfig{
+				{Exporter: config.Exporter{Name: "prometheus"}, Address: federate.URL + "/federate", ForwardURLParams: true},
+			},
+			StaticExporters: []*config.StaticExporterConfig{newTestStaticExporter("info", "appliance_info", "appliance_slots")},
+		},
+		MatchFilter: true,
+	}, nil)
+	c.Assert(err, IsNil)
+
+	code, body := getMetrics(endpoint, "/federate?match[]="+url.QueryEscape(`up{job="node"}`)+
+		"&match[]="+url.QueryEscape(`{exporter_name="info",__name__=~".*_slots"}`), "")
+	c.Assert(code, Equals, http.StatusOK)
+	// The selectors are passed through to the federate endpoint...
+	c.Check(federateQuery[matchParam], DeepEquals, []string{`up{job="node"}`, `{exporter_name="info",__name__=~".*_slots"}`})
+	// ...and filter the rewritten metrics, keeping timestamps.
+	c.Check(body, Matches, `(?s).*up\{exporter_name="prometheus",instance="a",job="node"\} 1 1600000000000\n.*`)
+	c.Check(body, Matches, `(?s).*appliance_slots\{exporter_name="info"\} 1\n.*`)
+	c.Check(strings.Contains(body, `job="db"`), Equals, false)
+	c.Check(strings.Contains(body, "appliance_info"), Equals, false)
+	c.Check(strings.Contains(body, backendUpMetricName), Equals, false)
+
+	// Without selectors everything is served.
+	code, body = getMetrics(endpoint, "/federate", "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Check(strings.Contains(body, `job="db"`), Equals, true)
+	c.Check(strings.Contains(body, "appliance_info"), Equals, true)
+
+	code, _ = getMetrics(endpoint, "/federate?match[]="+url.QueryEscape(`{job=""}`), "")
+	c.Check(code, Equals, http.StatusBadRequest)
+}
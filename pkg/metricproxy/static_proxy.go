@@ -0,0 +1,145 @@
+package metricproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// ErrStaticMetricInvalid returned when a static metric is not correctly declared.
+	ErrStaticMetricInvalid = errors.New("static metric is invalid")
+	// ErrStaticValueUnavailable returned when the value of a static metric or label cannot be read.
+	ErrStaticValueUnavailable = errors.New("static metric value is unavailable")
+)
+
+// ensure staticProxy implements MetricProxy.
+var _ MetricProxy = &staticProxy{}
+
+// staticProxy implements a reverse metric proxy which returns metrics declared in the
+// configuration. Values read from the environment or files are re-read on every scrape.
+type staticProxy struct {
+	metrics []*config.StaticMetricConfig
+}
+
+func newStaticProxy(config *config.StaticExporterConfig) *staticProxy {
+	return &staticProxy{
+		metrics: config.Metrics,
+	}
+}
+
+// validateStaticMetrics checks the static metrics of an exporter are correctly declared.
+//
+//nolint:cyclop
+func validateStaticMetrics(metrics []*config.StaticMetricConfig) error {
+	declared := make(declaredMetrics)
+
+	for _, metric := range metrics {
+		labelNames := append(append(lo.Keys(metric.Labels), lo.Keys(metric.LabelsFromEnv)...), lo.Keys(metric.LabelsFromFile)...)
+		if err := declared.check(ErrStaticMetricInvalid, metric.Name, metric.Type, metric.Help, labelNames); err != nil {
+			return err
+		}
+
+		sources := 0
+		if metric.Value != nil {
+			sources++
+		}
+		if metric.ValueFromEnv != "" {
+			sources++
+		}
+		if metric.ValueFromFile != "" {
+			sources++
+		}
+		if sources != 1 {
+			return errors.Wrapf(ErrStaticMetricInvalid,
+				"%s: exactly one of value, value_from_env or value_from_file must be specified", metric.Name)
+		}
+	}
+
+	return nil
+}
+
+// Scrape returns the static metrics.
+func (sp *staticProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	families := make(map[string]*dto.MetricFamily)
+	mfs := make([]*dto.MetricFamily, 0, len(sp.metrics))
+
+	for _, metricConfig := range sp.metrics {
+		metric, err := newStaticMetric(metricConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "static metric %s", metricConfig.Name)
+		}
+
+		mfs = appendMetric(mfs, families, metricConfig.Name, protoMetricType(metricConfig.Type), metricConfig.Help, metric)
+	}
+
+	return mfs, nil
+}
+
+// newStaticMetric reads the labels and value of a static metric.
+func newStaticMetric(metricConfig *config.StaticMetricConfig) (*dto.Metric, error) {
+	labels := make([]*dto.LabelPair, 0, len(metricConfig.Labels)+len(metricConfig.LabelsFromEnv)+len(metricConfig.LabelsFromFile))
+	for name, value := range metricConfig.Labels {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	for name, envVar := range metricConfig.LabelsFromEnv {
+		value, err := readStaticValue(envVar, "")
+		if err != nil {
+			return nil, errors.Wrapf(err, "label %s", name)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	for name, filename := range metricConfig.LabelsFromFile {
+		value, err := readStaticValue("", filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "label %s", name)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+	var value float64
+	if metricConfig.Value != nil {
+		value = *metricConfig.Value
+	} else {
+		text, err := readStaticValue(metricConfig.ValueFromEnv, metricConfig.ValueFromFile)
+		if err != nil {
+			return nil, err
+		}
+		value, err = strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, errors.Wrapf(ErrStaticValueUnavailable, "value is not a number: %q", text)
+		}
+	}
+
+	return newValueMetric(protoMetricType(metricConfig.Type), labels, value), nil
+}
+
+// readStaticValue reads a value from the named environment variable, or else from the named
+// file. Surrounding whitespace is removed.
+func readStaticValue(envVar string, filename string) (string, error) {
+	if envVar != "" {
+		value, found := os.LookupEnv(envVar)
+		if !found {
+			return "", errors.Wrapf(ErrStaticValueUnavailable, "environment variable %s is not set", envVar)
+		}
+		return strings.TrimSpace(value), nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", errors.Wrapf(ErrStaticValueUnavailable, "reading %s failed: %v", filename, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,120 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+
+	. "gopkg.in/check.v1"
+)
+
+type StaticProxySuite struct{}
+
+var _ = Suite(&StaticProxySuite{})
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
+
+func (s *StaticProxySuite) TestStaticProxy(c *C) {
+	dir := c.MkDir()
+	serialFile := filepath.Join(dir, "serial")
+	c.Assert(ioutil.WriteFile(serialFile, []byte("ABC123\n"), os.FileMode(0644)), IsNil)
+	valueFile := filepath.Join(dir, "value")
+	c.Assert(ioutil.WriteFile(valueFile, []byte(" 42\n"), os.FileMode(0644)), IsNil)
+
+	os.Setenv("STATIC_PROXY_TEST_VALUE", "7")
+	defer os.Unsetenv("STATIC_PROXY_TEST_VALUE")
+	os.Setenv("STATIC_PROXY_TEST_VERSION", "1.2.3")
+	defer os.Unsetenv("STATIC_PROXY_TEST_VERSION")
+
+	metrics := []*config.StaticMetricConfig{
+		{
+			Name:           "appliance_info",
+			Help:           "Appliance information",
+			Labels:         map[string]string{"model": "x1"},
+			LabelsFromEnv:  map[string]string{"version": "STATIC_PROXY_TEST_VERSION"},
+			LabelsFromFile: map[string]string{"serial": serialFile},
+			Value:          float64Ptr(1),
+		},
+		{Name: "appliance_slots", Type: config.MetricTypeCounter, ValueFromEnv: "STATIC_PROXY_TEST_VALUE", Labels: map[string]string{"slot": "a"}},
+		{Name: "appliance_slots", Type: config.MetricTypeCounter, ValueFromFile: valueFile, Labels: map[string]string{"slot": "b"}},
+	}
+	c.Assert(validateStaticMetrics(metrics), IsNil)
+
+	proxy := newStaticProxy(&config.StaticExporterConfig{Metrics: metrics})
+	mfs, err := proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(mfs, HasLen, 2)
+
+	c.Check(mfs[0].GetName(), Equals, "appliance_info")
+	c.Check(mfs[0].GetHelp(), Equals, "Appliance information")
+	c.Check(mfs[0].GetType(), Equals, dto.MetricType_GAUGE)
+	c.Assert(mfs[0].GetMetric(), HasLen, 1)
+	c.Check(mfs[0].GetMetric()[0].GetGauge().GetValue(), Equals, 1.0)
+	labels := map[string]string{}
+	for _, lp := range mfs[0].GetMetric()[0].GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	c.Check(labels, DeepEquals, map[string]string{"model": "x1", "serial": "ABC123", "version": "1.2.3"})
+	// Labels are sorted by name.
+	c.Check(mfs[0].GetMetric()[0].GetLabel()[0].GetName(), Equals, "model")
+
+	c.Check(mfs[1].GetName(), Equals, "appliance_slots")
+	c.Check(mfs[1].GetType(), Equals, dto.MetricType_COUNTER)
+	c.Assert(mfs[1].GetMetric(), HasLen, 2)
+	c.Check(mfs[1].GetMetric()[0].GetCounter().GetValue(), Equals, 7.0)
+	c.Check(mfs[1].GetMetric()[1].GetCounter().GetValue(), Equals, 42.0)
+
+	// Values are re-read on every scrape.
+	c.Assert(ioutil.WriteFile(valueFile, []byte("43"), os.FileMode(0644)), IsNil)
+	mfs, err = proxy.Scrape(context.Background(), nil)
+	c.Assert(err, IsNil)
+	c.Check(mfs[1].GetMetric()[1].GetCounter().GetValue(), Equals, 43.0)
+
+	// An unavailable value fails the scrape.
+	os.Unsetenv("STATIC_PROXY_TEST_VALUE")
+	_, err = proxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrStaticValueUnavailable), Equals, true, Commentf("got error: %v", err))
+
+	c.Assert(ioutil.WriteFile(valueFile, []byte("not a number"), os.FileMode(0644)), IsNil)
+	proxy = newStaticProxy(&config.StaticExporterConfig{Metrics: metrics[2:]})
+	_, err = proxy.Scrape(context.Background(), nil)
+	c.Check(errors.Is(err, ErrStaticValueUnavailable), Equals, true, Commentf("got error: %v", err))
+}
+
+func (s *StaticProxySuite) TestValidateStaticMetrics(c *C) {
+	invalidMetrics := [][]*config.StaticMetricConfig{
+		{{Name: "invalid-name", Value: float64Ptr(1)}},
+		{{Name: "no_value"}},
+		{{Name: "two_values", Value: float64Ptr(1), ValueFromEnv: "VALUE"}},
+		{{Name: "bad_label", Labels: map[string]string{"bad-label": "a"}, Value: float64Ptr(1)}},
+		{{Name: "name_label", Labels: map[string]string{"__name__": "a"}, Value: float64Ptr(1)}},
+		{{
+			Name:          "duplicate_label",
+			Labels:        map[string]string{"a": "a"},
+			LabelsFromEnv: map[string]string{"a": "VALUE"},
+			Value:         float64Ptr(1),
+		}},
+		{
+			{Name: "conflicting_type", Value: float64Ptr(1)},
+			{Name: "conflicting_type", Type: config.MetricTypeCounter, Value: float64Ptr(1)},
+		},
+		{
+			{Name: "conflicting_help", Help: "a", Value: float64Ptr(1)},
+			{Name: "conflicting_help", Help: "b", Value: float64Ptr(1)},
+		},
+	}
+
+	for _, metrics := range invalidMetrics {
+		err := validateStaticMetrics(metrics)
+		c.Check(errors.Is(err, ErrStaticMetricInvalid), Equals, true, Commentf("%s: got error: %v", metrics[0].Name, err))
+	}
+}
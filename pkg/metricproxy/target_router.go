@@ -0,0 +1,241 @@
+package metricproxy
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	// ErrRoutingInvalid returned when the routing of a path is not correctly configured.
+	ErrRoutingInvalid = errors.New("routing is invalid")
+	// ErrRouteNotFound returned when no route allows the value of the routing param.
+	ErrRouteNotFound = errors.New("no route allows the requested target")
+	// ErrAddressTemplateHost returned when the value of the routing param changes which host
+	// an address template scrapes.
+	ErrAddressTemplateHost = errors.New("value changes the host of address_template")
+)
+
+// addressTemplateSentinel is the .Value an address template is rendered with to find the
+// scheme and host it scrapes.
+const addressTemplateSentinel = "reverseexportervalue"
+
+// addressTemplateFuncs are the functions address templates can use besides the builtins.
+//
+//nolint:gochecknoglobals
+var addressTemplateFuncs = template.FuncMap{
+	"pathEscape": url.PathEscape,
+}
+
+// targetRouter selects the backends of a path by the value of a url param.
+type targetRouter struct {
+	param  string
+	label  model.LabelName
+	routes []*targetRoute
+	// unrouted are the backends no route names, which are scraped for every value
+	unrouted []MetricProxy
+}
+
+// targetRoute is a set of allowed values, and the backends scraped for them.
+type targetRoute struct {
+	values map[string]struct{}
+	regex  *regexp.Regexp
+	// backends are the exporters of the path the route names, or its addressTemplateProxy
+	backends []MetricProxy
+}
+
+// ensure addressTemplateProxy implements MetricProxy.
+var _ MetricProxy = &addressTemplateProxy{}
+
+// addressTemplateProxy scrapes the address its template gives for the routing param value.
+type addressTemplateProxy struct {
+	param           string
+	addressTemplate *template.Template
+	// scheme and host are of the address rendered with addressTemplateSentinel
+	scheme   string
+	host     string
+	deadline time.Duration
+	maxBytes uint64
+}
+
+// newAddressTemplateProxy parses addressTemplate, and renders it with the sentinel value to
+// find the host it scrapes.
+func newAddressTemplateProxy(name string, param string, addressTemplate string) (*addressTemplateProxy, error) {
+	parsed, err := template.New(name).Option("missingkey=error").Funcs(addressTemplateFuncs).Parse(addressTemplate)
+	if err != nil {
+		return nil, err
+	}
+	atp := &addressTemplateProxy{param: param, addressTemplate: parsed}
+	address, err := atp.render(addressTemplateSentinel)
+	if err != nil {
+		return nil, err
+	}
+	atp.scheme, atp.host = address.Scheme, address.Host
+	if atp.host == "" {
+		return nil, errors.Errorf("address %q has no host", address)
+	}
+	return atp, nil
+}
+
+// render executes the address template with value, and parses the address.
+func (atp *addressTemplateProxy) render(value string) (*url.URL, error) {
+	var address strings.Builder
+	if err := atp.addressTemplate.Execute(&address, struct{ Value string }{value}); err != nil {
+		return nil, errors.Wrap(err, "executing address_template failed")
+	}
+	return url.Parse(address.String())
+}
+
+// Scrape scrapes the address for the routing param in values. The query of the address is
+// kept, and no other url params are forwarded. The value can only take the place of the
+// sentinel in the host, so a value which is not escaped cannot redirect the scrape with
+// user info, a path or a fragment.
+func (atp *addressTemplateProxy) Scrape(ctx context.Context, values url.Values) ([]*dto.MetricFamily, error) {
+	value := values.Get(atp.param)
+	address, err := atp.render(value)
+	if err != nil {
+		return nil, err
+	}
+	if address.Scheme != atp.scheme || address.User != nil ||
+		address.Host != strings.ReplaceAll(atp.host, addressTemplateSentinel, value) {
+		return nil, errors.Wrapf(ErrAddressTemplateHost, "value %q", value)
+	}
+	return scrape(ctx, atp.deadline, address.String(), nil, atp.maxBytes)
+}
+
+// newTargetRouter initializes a router from the routing config of a path. backends are the
+// rewriteProxy backends of the path. The backends of address templates are labelled with
+// the exporter label and labels of the path like those are.
+//
+//nolint:cyclop
+func newTargetRouter(routing *config.RoutingConfig, backends []MetricProxy, nameLabel model.LabelName,
+	pathLabels model.LabelSet) (*targetRouter, error) {
+	router := &targetRouter{
+		param:  routing.Param,
+		label:  model.LabelName(routing.Label),
+		routes: make([]*targetRoute, 0, len(routing.Routes)),
+	}
+	if router.param == "" {
+		return nil, errors.Wrap(ErrRoutingInvalid, "param is required")
+	}
+	if router.label == "" {
+		router.label = model.LabelName(router.param)
+	}
+	if !router.label.IsValid() || strings.HasPrefix(string(router.label), model.ReservedLabelPrefix) {
+		return nil, errors.Wrapf(ErrRoutingInvalid, "invalid label name %q", router.label)
+	}
+	if _, found := pathLabels[router.label]; found || router.label == nameLabel || isBucketLabel(string(router.label)) {
+		return nil, errors.Wrapf(ErrRoutingInvalid, "label cannot be %s", router.label)
+	}
+	if len(routing.Routes) == 0 {
+		return nil, errors.Wrap(ErrRoutingInvalid, "at least one route is required")
+	}
+
+	byName := make(map[string]MetricProxy, len(backends))
+	for _, backend := range backends {
+		if rewriter, ok := backend.(*rewriteProxy); ok {
+			byName[rewriter.name] = backend
+		}
+	}
+	routed := make(map[string]struct{})
+
+	for idx, routeConfig := range routing.Routes {
+		route := &targetRoute{
+			values: make(map[string]struct{}, len(routeConfig.Values)),
+		}
+		for _, value := range routeConfig.Values {
+			route.values[value] = struct{}{}
+		}
+		if routeConfig.Regex.Regexp != nil {
+			// The regex must match the whole value, like Prometheus relabelling regexes.
+			route.regex = regexp.MustCompile("^(?:" + routeConfig.Regex.String() + ")$")
+		}
+		if len(route.values) == 0 && route.regex == nil {
+			return nil, errors.Wrapf(ErrRoutingInvalid, "route %d allows no values", idx)
+		}
+
+		switch {
+		case len(routeConfig.Exporters) > 0 && routeConfig.AddressTemplate != "":
+			return nil, errors.Wrapf(ErrRoutingInvalid, "route %d has both exporters and address_template", idx)
+		case len(routeConfig.Exporters) > 0:
+			for _, name := range routeConfig.Exporters {
+				backend, found := byName[name]
+				if !found {
+					return nil, errors.Wrapf(ErrRoutingInvalid, "route %d names unknown exporter %q", idx, name)
+				}
+				route.backends = append(route.backends, backend)
+				routed[name] = struct{}{}
+			}
+		case routeConfig.AddressTemplate != "":
+			name := routeConfig.Name
+			if name == "" {
+				return nil, errors.Wrapf(ErrRoutingInvalid, "route %d needs a name for its address_template", idx)
+			}
+			if _, found := byName[name]; found {
+				return nil, errors.Wrapf(ErrRoutingInvalid, "route %d name %q is already used by an exporter", idx, name)
+			}
+			proxy, err := newAddressTemplateProxy(name, router.param, routeConfig.AddressTemplate)
+			if err != nil {
+				return nil, errors.Wrapf(ErrRoutingInvalid, "route %d has invalid address_template: %v", idx, err)
+			}
+			proxy.deadline = time.Duration(routeConfig.Timeout)
+			proxy.maxBytes = routeConfig.MaxBytes
+			route.backends = append(route.backends, &rewriteProxy{
+				name:      name,
+				nameLabel: nameLabel,
+				proxy:     proxy,
+				labels:    pathLabels.Merge(model.LabelSet{nameLabel: model.LabelValue(name)}),
+			})
+		default:
+			return nil, errors.Wrapf(ErrRoutingInvalid, "route %d needs exporters or an address_template", idx)
+		}
+		router.routes = append(router.routes, route)
+	}
+
+	for _, backend := range backends {
+		if rewriter, ok := backend.(*rewriteProxy); ok {
+			if _, found := routed[rewriter.name]; found {
+				continue
+			}
+		}
+		router.unrouted = append(router.unrouted, backend)
+	}
+	return router, nil
+}
+
+// route returns the backends to scrape for the routing param in values, and the label
+// the selected value is added as. ErrRouteNotFound is returned if no route allows it.
+func (tr *targetRouter) route(values url.Values) ([]MetricProxy, model.LabelSet, error) {
+	value := values.Get(tr.param)
+	if value == "" {
+		return nil, nil, errors.Wrapf(ErrRouteNotFound, "missing %s param", tr.param)
+	}
+
+	for _, route := range tr.routes {
+		if !route.allows(value) {
+			continue
+		}
+		backends := make([]MetricProxy, 0, len(tr.unrouted)+len(route.backends))
+		backends = append(backends, tr.unrouted...)
+		backends = append(backends, route.backends...)
+		return backends, model.LabelSet{tr.label: model.LabelValue(value)}, nil
+	}
+	return nil, nil, errors.Wrapf(ErrRouteNotFound, "%s param value is not allowed", tr.param)
+}
+
+// allows returns true if the route allows value.
+func (r *targetRoute) allows(value string) bool {
+	if _, found := r.values[value]; found {
+		return true
+	}
+	return r.regex != nil && r.regex.MatchString(value)
+}
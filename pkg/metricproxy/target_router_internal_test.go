@@ -0,0 +1,171 @@
+//nolint:errcheck,testpackage
+package metricproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type TargetRouterSuite struct{}
+
+var _ = Suite(&TargetRouterSuite{})
+
+// probedBody returns a newTestServer body which reports the target param it was probed with.
+func probedBody(metricName string) func(url.Values) string {
+	return func(params url.Values) string {
+		return fmt.Sprintf("%s{probed=%q} 1\n", metricName, params.Get("target"))
+	}
+}
+
+func (s *TargetRouterSuite) TestRouting(c *C) {
+	web := newTestServer("", "", probedBody("web_probe"))
+	defer web.Close()
+	dns := newTestServer("", "", probedBody("dns_probe"))
+	defer dns.Close()
+	db := newTestServer("", "", probedBody("db_probe"))
+	defer db.Close()
+
+	reverseExporter := &config.ReverseExporterConfig{
+		Path: "/probe",
+		Exporters: &config.ExportersConfig{
+			HTTPExporters: []*config.HTTPExporterConfig{
+				{Exporter: config.Exporter{Name: "web"}, Address: web.URL, ForwardURLParams: true},
+				{Exporter: config.Exporter{Name: "dns"}, Address: dns.URL, ForwardURLParams: true},
+			},
+			StaticExporters: []*config.StaticExporterConfig{newTestStaticExporter("info", "probe_info")},
+		},
+		Routing: &config.RoutingConfig{
+			Param: "target",
+			Routes: []*config.RouteConfig{
+				{Values: []string{"www.example.com", "api.example.com"}, Exporters: []string{"web"}},
+				{Regex: config.Regexp{Regexp: regexp.MustCompile(`ns[0-9]`)}, Exporters: []string{"dns"}},
+				{
+					Regex:           config.Regexp{Regexp: regexp.MustCompile(`db[0-9]`)},
+					Name:            "db",
+					AddressTemplate: db.URL + "/probe?target={{ .Value | urlquery }}",
+				},
+			},
+		},
+	}
+	endpoint, err := NewMetricReverseProxy(reverseExporter, nil)
+	c.Assert(err, IsNil)
+
+	code, body := getMetrics(endpoint, "/probe?target=www.example.com", "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Check(body, Matches, `(?s).*web_probe\{exporter_name="web",probed="www.example.com",target="www.example.com"\} 1.*`)
+	// Exporters no route names are scraped for every target.
+	c.Check(body, Matches, `(?s).*probe_info\{exporter_name="info",target="www.example.com"\} 1.*`)
+	c.Check(strings.Contains(body, "dns_probe"), Equals, false)
+
+	code, body = getMetrics(endpoint, "/probe?target=ns1", "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Check(body, Matches, `(?s).*dns_probe\{exporter_name="dns",probed="ns1",target="ns1"\} 1.*`)
+	c.Check(strings.Contains(body, "web_probe"), Equals, false)
+
+	code, body = getMetrics(endpoint, "/probe?target=db2", "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Check(body, Matches, `(?s).*db_probe\{exporter_name="db",probed="db2",target="db2"\} 1.*`)
+	c.Check(body, Matches, `(?s).*reverse_exporter_backend_up\{exporter_name="db",target="db2"\} 1.*`)
+
+	// Regexes must match the whole value, so nothing else can be probed.
+	for _, path := range []string{"/probe", "/probe?target=evil.example.com", "/probe?target=ns1.evil.example.com"} {
+		code, _ = getMetrics(endpoint, path, "")
+		c.Check(code, Equals, http.StatusBadRequest, Commentf("path: %s", path))
+	}
+}
+
+func (s *TargetRouterSuite) TestAddressTemplateHostileValues(c *C) {
+	db := newTestServer("", "", probedBody("db_probe"))
+	defer db.Close()
+	dbHost := strings.TrimPrefix(db.URL, "http://")
+
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path:      "/probe",
+		Exporters: &config.ExportersConfig{},
+		Routing: &config.RoutingConfig{
+			Param: "target",
+			Routes: []*config.RouteConfig{{
+				Regex:           config.Regexp{Regexp: regexp.MustCompile(`.*`)},
+				Name:            "db",
+				AddressTemplate: "http://{{ .Value }}/probe?target=db",
+			}},
+		},
+	}, nil)
+	c.Assert(err, IsNil)
+
+	code, body := getMetrics(endpoint, "/probe?target="+url.QueryEscape(dbHost), "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Check(body, Matches, `(?s).*db_probe\{exporter_name="db",probed="db",target="[^"]+"\} 1.*`)
+
+	// Values which move the host elsewhere, or into the user info or path, are not scraped.
+	for _, value := range []string{"evil.example.com@" + dbHost, dbHost + "/other?", dbHost + "#", dbHost + ".evil.example.com"} {
+		code, body = getMetrics(endpoint, "/probe?target="+url.QueryEscape(value), "")
+		c.Assert(code, Equals, http.StatusOK)
+		c.Check(strings.Contains(body, "db_probe"), Equals, false, Commentf("value: %s", value))
+		c.Check(body, Matches, `(?s).*reverse_exporter_backend_up\{exporter_name="db",target="[^"]+"\} 0.*`, Commentf("value: %s", value))
+	}
+
+	// pathEscape keeps a value in the path segment of the template.
+	proxy, err := newAddressTemplateProxy("db", "target", db.URL+"/probe/{{ .Value | pathEscape }}")
+	c.Assert(err, IsNil)
+	address, err := proxy.render("a/b?c#d")
+	c.Assert(err, IsNil)
+	c.Check(address.Host, Equals, dbHost)
+	c.Check(address.EscapedPath(), Equals, "/probe/a%2Fb%3Fc%23d")
+}
+
+func (s *TargetRouterSuite) TestInvalidRouting(c *C) {
+	valuesRoute := func(route *config.RouteConfig) *config.RouteConfig {
+		route.Values = []string{"a"}
+		return route
+	}
+	for _, routing := range []*config.RoutingConfig{
+		{Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Exporters: []string{"web"}})}},
+		{Param: "target"},
+		{Param: "target", Label: "exporter_name", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Exporters: []string{"web"}})}},
+		{Param: "target", Label: "__target", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Exporters: []string{"web"}})}},
+		{Param: "target", Label: "le", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Exporters: []string{"web"}})}},
+		{Param: "target", Routes: []*config.RouteConfig{{Exporters: []string{"web"}}}},
+		{Param: "target", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Exporters: []string{"missing"}})}},
+		{Param: "target", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{})}},
+		{Param: "target", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{AddressTemplate: "http://a/"})}},
+		{Param: "target", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Name: "web", AddressTemplate: "http://a/"})}},
+		{Param: "target", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Name: "b", AddressTemplate: "{{ .Value"})}},
+		{Param: "target", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Name: "b", AddressTemplate: "/probe"})}},
+		{Param: "target", Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{
+			Name: "b", AddressTemplate: "http://a/", Exporters: []string{"web"},
+		})}},
+	} {
+		_, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+			Path: "/probe",
+			Exporters: &config.ExportersConfig{
+				StaticExporters: []*config.StaticExporterConfig{newTestStaticExporter("web", "web_info")},
+			},
+			Routing: routing,
+		}, nil)
+		c.Check(errors.Is(err, ErrRoutingInvalid), Equals, true, Commentf("routing: %+v, got error: %v", routing, err))
+	}
+
+	// The routing label cannot be the configured exporter label or a path label.
+	for _, label := range []string{"job_component", "site"} {
+		_, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+			Path:          "/probe",
+			ExporterLabel: "job_component",
+			Labels:        map[string]string{"site": "core"},
+			Exporters: &config.ExportersConfig{
+				StaticExporters: []*config.StaticExporterConfig{newTestStaticExporter("web", "web_info")},
+			},
+			Routing: &config.RoutingConfig{Param: "target", Label: label,
+				Routes: []*config.RouteConfig{valuesRoute(&config.RouteConfig{Exporters: []string{"web"}})}},
+		}, nil)
+		c.Check(errors.Is(err, ErrRoutingInvalid), Equals, true, Commentf("label: %s, got error: %v", label, err))
+	}
+}
@@ -0,0 +1,41 @@
+package metricproxy
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ErrTimestampsInvalid returned when an exporter cannot handle timestamps as configured.
+var ErrTimestampsInvalid = errors.New("timestamps mode is not supported by the exporter")
+
+// applyTimestamps strips or sets the sample timestamps of the metrics of a scrape which
+// started at scrapeTime. Production times are set by the exec and file proxies themselves,
+// as only they know when their metrics were produced.
+func applyTimestamps(mode config.TimestampMode, mfs []*dto.MetricFamily, scrapeTime time.Time) {
+	switch mode {
+	case config.TimestampsStrip:
+		for _, mf := range mfs {
+			for _, metric := range mf.GetMetric() {
+				metric.TimestampMs = nil
+			}
+		}
+	case config.TimestampsScrapeTime:
+		setTimestamps(mfs, scrapeTime)
+	case "", config.TimestampsKeep, config.TimestampsProductionTime:
+	}
+}
+
+// setTimestamps sets the sample timestamps of the metrics to timestamp.
+func setTimestamps(mfs []*dto.MetricFamily, timestamp time.Time) {
+	timestampMs := timestamp.UnixNano() / int64(time.Millisecond)
+	for _, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			metric.TimestampMs = proto.Int64(timestampMs)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package metricproxy
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
@@ -20,13 +24,18 @@ import (
 	"github.com/prometheus/common/model"
 )
 
+// staleLabel is added with the value "true" to metrics which are older than their max age
+// when the stale action is config.StaleActionLabel.
+const staleLabel = "stale"
+
 // decodeMetrics decodes metrics from an io.Reader. Returns an empty slice on error.
 // Use expfmt.Constants to pass in format. Breaks on first metric decoding error.
 func decodeMetrics(reader io.Reader, format expfmt.Format) ([]*dto.MetricFamily, error) {
 	var merr error
 	mfs := make([]*dto.MetricFamily, 0)
 
-	mfDec := expfmt.NewDecoder(reader, format)
+	recorder := &errRecordingReader{rdr: reader}
+	mfDec := expfmt.NewDecoder(recorder, format)
 
 	for {
 		metricFamily := &dto.MetricFamily{}
@@ -38,10 +47,95 @@ func decodeMetrics(reader io.Reader, format expfmt.Format) ([]*dto.MetricFamily,
 		}
 		mfs = append(mfs, metricFamily)
 	}
+	if merr == nil {
+		merr = recorder.err
+	}
 
 	return mfs, merr
 }
 
+// mergeMetricFamilies merges metric families with the same name and type, so metrics
+// from several backends are exposed under a single family. Families are returned in the
+// order they were first seen. Families whose type conflicts with the first family of the
+// same name are dropped, as Prometheus rejects a scrape with two types for one name.
+func mergeMetricFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	merged := make([]*dto.MetricFamily, 0, len(mfs))
+	// indexes holds the index of each family name in merged
+	indexes := make(map[string]int, len(mfs))
+	// copied holds the merged families which have been copied
+	copied := make(map[int]struct{})
+
+	for _, mf := range mfs {
+		idx, found := indexes[mf.GetName()]
+		if !found {
+			indexes[mf.GetName()] = len(merged)
+			merged = append(merged, mf)
+			continue
+		}
+		existing := merged[idx]
+		if existing.GetType() != mf.GetType() {
+			zap.L().Warn("Metric family returned with conflicting types - dropping it",
+				zap.String("metric_family", mf.GetName()), zap.String("type", mf.GetType().String()),
+				zap.String("existing_type", existing.GetType().String()))
+			continue
+		}
+		// Families may be shared with concurrent scrapes, so copy before appending.
+		if _, found := copied[idx]; !found {
+			existing = &dto.MetricFamily{
+				Name:   existing.Name,
+				Help:   existing.Help,
+				Type:   existing.Type,
+				Metric: append(make([]*dto.Metric, 0, len(existing.Metric)+len(mf.Metric)), existing.Metric...),
+			}
+			merged[idx] = existing
+			copied[idx] = struct{}{}
+		}
+		existing.Metric = append(existing.Metric, mf.Metric...)
+	}
+
+	return merged
+}
+
+// mergeBackendMetricFamilies merges the metric families each backend returned, in the
+// order of the backends. A backend which returns a family whose type conflicts with an
+// earlier family of the same name has that family dropped, and is counted as failed in
+// its backend up metrics, so it does not fail the scrape of the other backends.
+func mergeBackendMetricFamilies(results [][]*dto.MetricFamily) []*dto.MetricFamily {
+	types := make(map[string]dto.MetricType)
+	mfs := make([]*dto.MetricFamily, 0)
+	for _, result := range results {
+		conflicting := false
+		for _, mf := range result {
+			if existingType, found := types[mf.GetName()]; found && existingType != mf.GetType() {
+				conflicting = true
+				continue
+			}
+			types[mf.GetName()] = mf.GetType()
+		}
+		if conflicting {
+			result = markBackendDown(result)
+		}
+		mfs = append(mfs, result...)
+	}
+	return mergeMetricFamilies(mfs)
+}
+
+// markBackendDown returns mfs with the value of its backend up metrics set to 0. The up
+// family is copied, as the families may be shared with concurrent scrapes.
+func markBackendDown(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	marked := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		if mf.GetName() == backendUpMetricName {
+			mf = cloneMetricFamilies([]*dto.MetricFamily{mf})[0]
+			for _, metric := range mf.GetMetric() {
+				metric.Gauge = &dto.Gauge{Value: proto.Float64(0)}
+			}
+		}
+		marked = append(marked, mf)
+	}
+	return marked
+}
+
 // rewriteMetrics adds the given labelset to all metrics in the given metricFamily's.
 func rewriteMetrics(labels model.LabelSet, mfs []*dto.MetricFamily) {
 	// Loop through all metric families
@@ -76,9 +170,26 @@ func rewriteMetrics(labels model.LabelSet, mfs []*dto.MetricFamily) {
 	}
 }
 
+// seriesKey identifies a series by its name and sorted labels.
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var key strings.Builder
+	key.WriteString(name)
+	for _, label := range labels {
+		key.WriteByte(0)
+		key.WriteString(label.GetName())
+		key.WriteByte(0)
+		key.WriteString(label.GetValue())
+	}
+	return key.String()
+}
+
 // handleSerializeMetrics writes the samples as metrics to the given http.ResponseWriter.
-func handleSerializeMetrics(w http.ResponseWriter, req *http.Request, mfs []*dto.MetricFamily) {
+// OpenMetrics is only served to scrapers which accept it if openMetrics is set.
+func handleSerializeMetrics(w http.ResponseWriter, req *http.Request, mfs []*dto.MetricFamily, openMetrics bool) {
 	contentType := expfmt.Negotiate(req.Header)
+	if openMetrics {
+		contentType = expfmt.NegotiateIncludingOpenMetrics(req.Header)
+	}
 	buf := getBuf()
 	defer giveBuf(buf)
 	writer, encoding := decorateWriter(req, buf)
@@ -91,6 +202,13 @@ func handleSerializeMetrics(w http.ResponseWriter, req *http.Request, mfs []*dto
 			return
 		}
 	}
+	// Closing the encoder writes the OpenMetrics # EOF marker.
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			http.Error(w, "An error has occurred during metrics encoding:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	if closer, ok := writer.(io.Closer); ok {
 		closer.Close()
 	}
@@ -140,3 +258,25 @@ func giveBuf(buf *bytes.Buffer) {
 	buf.Reset()
 	bufPool.Put(buf)
 }
+
+// writeFileAtomic replaces the file at path with content. A temporary file is written and
+// renamed over path, so the file is never partially written.
+func writeFileAtomic(path string, content []byte) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file failed")
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(content); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "writing temporary file failed")
+	}
+	if err := tempFile.Close(); err != nil {
+		return errors.Wrap(err, "writing temporary file failed")
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return errors.Wrapf(err, "replacing %s failed", path)
+	}
+	return nil
+}
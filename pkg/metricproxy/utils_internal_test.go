@@ -1,15 +1,99 @@
 package metricproxy
 
 import (
+	"bytes"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/moby/moby/pkg/reexec"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/reverse_exporter/pkg/config"
 	. "gopkg.in/check.v1"
 )
 
+// TestMain allows the test binary to act as the exec sandbox helper.
+func TestMain(m *testing.M) {
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
 // Hook up gocheck into the "go test" runner.
 func Test(t *testing.T) { TestingT(t) }
 
+// getMetrics requests path from handler with an Accept header, if accept is set, and
+// returns the response code and body.
+func getMetrics(handler http.Handler, path string, accept string) (int, string) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	handler.ServeHTTP(recorder, req)
+	return recorder.Code, recorder.Body.String()
+}
+
+// familyValues returns the values of the series of the named family by the value of their
+// labelName label, or by all of their labels if labelName is empty.
+func familyValues(mfs []*dto.MetricFamily, name string, labelName string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			labels := make(model.LabelSet, len(metric.GetLabel()))
+			for _, label := range metric.GetLabel() {
+				labels[model.LabelName(label.GetName())] = model.LabelValue(label.GetValue())
+			}
+			key := labels.String()
+			if labelName != "" {
+				key = string(labels[model.LabelName(labelName)])
+			}
+			values[key], _ = metricValue(mf.GetType(), metric)
+		}
+	}
+	return values
+}
+
+// newTestServer returns a server which answers requests for path, or for any path if it is
+// empty, with the body returned for their url params. The Content-Type is set if given.
+func newTestServer(path string, contentType string, body func(params url.Values) string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if path != "" && req.URL.Path != path {
+			http.NotFound(wr, req)
+			return
+		}
+		if contentType != "" {
+			wr.Header().Set(contentTypeHeader, contentType)
+		}
+		io.WriteString(wr, body(req.URL.Query())) //nolint:errcheck
+	}))
+}
+
+// constBody returns a newTestServer body which ignores the url params.
+func constBody(body string) func(url.Values) string {
+	return func(url.Values) string { return body }
+}
+
+// protobufBody returns the metric families encoded as delimited protobuf.
+func protobufBody(mfs ...*dto.MetricFamily) string {
+	var body bytes.Buffer
+	enc := expfmt.NewEncoder(&body, expfmt.FmtProtoDelim)
+	for _, mf := range mfs {
+		enc.Encode(mf) //nolint:errcheck
+	}
+	return body.String()
+}
+
 type UtilSuite struct{}
 
 var _ = Suite(&UtilSuite{})
@@ -25,3 +109,49 @@ func (s *UtilSuite) TestBufFunctions(c *C) {
 	c.Check(err, Equals, io.EOF)
 	c.Check(len(str), Equals, 0, Commentf("Buffer from pool was not empty - got: %s", s))
 }
+
+func (s *UtilSuite) TestMergeMetricFamilies(c *C) {
+	first := newGaugeFamily("test_metric", "help", 1)
+	second := newGaugeFamily("test_metric", "help", 2)
+	other := newGaugeFamily("other_metric", "help", 3)
+	conflicting := newGaugeFamily("test_metric", "help", 4)
+	conflicting.Type = dto.MetricType_COUNTER.Enum()
+
+	// Families with a conflicting type are dropped, keeping the first type seen.
+	merged := mergeMetricFamilies([]*dto.MetricFamily{first, other, second, conflicting})
+	c.Assert(merged, HasLen, 2)
+	c.Check(merged[0].GetName(), Equals, "test_metric")
+	c.Check(merged[0].GetType(), Equals, dto.MetricType_GAUGE)
+	c.Check(merged[0].GetMetric(), HasLen, 2)
+	c.Check(merged[1].GetName(), Equals, "other_metric")
+
+	// The input families are not modified.
+	c.Check(first.GetMetric(), HasLen, 1)
+}
+
+func (s *UtilSuite) TestMergeConflictingBackends(c *C) {
+	counter := newTestStaticExporter("counter", "test_metric")
+	counter.Metrics[0].Type = config.MetricTypeCounter
+	endpoint, err := NewMetricReverseProxy(&config.ReverseExporterConfig{
+		Path: "/metrics",
+		Exporters: &config.ExportersConfig{StaticExporters: []*config.StaticExporterConfig{
+			counter,
+			newTestStaticExporter("gauge", "test_metric", "other_metric"),
+		}},
+	}, nil)
+	c.Assert(err, IsNil)
+
+	// The output parses, so the backend with the conflicting type does not fail the scrape.
+	code, body := getMetrics(endpoint, "/metrics", "")
+	c.Assert(code, Equals, http.StatusOK)
+	mfs, err := new(expfmt.TextParser).TextToMetricFamilies(strings.NewReader(body))
+	c.Assert(err, IsNil, Commentf("body: %s", body))
+
+	c.Check(mfs["test_metric"].GetType(), Equals, dto.MetricType_COUNTER)
+	c.Check(mfs["test_metric"].GetMetric(), HasLen, 1)
+	c.Check(mfs["other_metric"].GetMetric(), HasLen, 1, Commentf("the other families of the backend are kept"))
+
+	// The backend which sent the conflicting family is counted as failed.
+	c.Check(familyValues([]*dto.MetricFamily{mfs[backendUpMetricName]}, backendUpMetricName, "exporter_name"),
+		DeepEquals, map[string]float64{"counter": 1, "gauge": 0})
+}